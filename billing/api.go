@@ -3,12 +3,17 @@ package billing
 
 import (
 	"context"
+	"errors"
+	"net/http"
 	"time"
 
 	"encore.app/billing/models"
 	"encore.app/billing/workflows"
 	"encore.dev/beta/errs"
 	"encore.dev/rlog"
+	"github.com/google/uuid"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
 	"go.temporal.io/sdk/client"
 )
 
@@ -19,10 +24,18 @@ type Response struct {
 
 type ListBillResponse struct {
 	Bills []models.Bill `json:"bills"`
+	// NextCursor fetches the next page when passed as cursor. It is empty on the last page.
+	NextCursor string `json:"next_cursor"`
 }
 //encore:api private method=GET path=/bills
 func (s *Service) ListBills(ctx context.Context,params *workflows.ListBillParams) (*ListBillResponse, error) {
-	bills,err := workflows.ListBills(ctx, params)
+	if params.CustomerId == "" {
+		return nil, &errs.Error{
+			Code: errs.InvalidArgument,
+			Message: "Customer is required",
+		}
+	}
+	page,err := workflows.ListBills(ctx, params)
 	if err != nil {
         return nil, &errs.Error{
 			Code: errs.InvalidArgument,
@@ -30,14 +43,29 @@ func (s *Service) ListBills(ctx context.Context,params *workflows.ListBillParams
 		}
     }
 
-	return &ListBillResponse{Bills: bills}, nil
+	return &ListBillResponse{Bills: page.Bills, NextCursor: page.NextCursor}, nil
 }
 
 
 
+type GetBillParams struct {
+	// CustomerId restricts the lookup to bills owned by that customer. It is required.
+	CustomerId string `query:"customerId"`
+}
+
 //encore:api private path=/bill/:billId
-func (s *Service) GetBill(ctx context.Context, billId string) (*models.Bill, error) {
-	result,err := s.Client.QueryWorkflow(context.Background(), billId, "",workflows.QueryBill,nil)
+func (s *Service) GetBill(ctx context.Context, billId string, params *GetBillParams) (*models.Bill, error) {
+	if params.CustomerId == "" {
+		return nil, &errs.Error{
+			Code: errs.InvalidArgument,
+			Message: "Customer is required",
+		}
+	}
+	workflowId, err := workflows.GetBillWorkflowId(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	result,err := s.Client.QueryWorkflow(context.Background(), workflowId, "",workflows.QueryBill,nil)
 	var bill *models.Bill
 	if err != nil {
         return nil, &errs.Error{
@@ -47,6 +75,19 @@ func (s *Service) GetBill(ctx context.Context, billId string) (*models.Bill, err
     }
 	
 	result.Get(&bill)
+	// Scheduled bills share a workflow that has since moved on to a later period.
+	if bill == nil || bill.BillId != billId {
+		bill, err = workflows.GetBill(ctx, billId)
+		if err != nil {
+			return nil, toAPIError(err)
+		}
+	}
+	if bill == nil || bill.CustomerId != params.CustomerId {
+		return nil, &errs.Error{
+			Code: errs.NotFound,
+			Message: "Bill not found",
+		}
+	}
 
 	return bill, nil
 }
@@ -54,7 +95,14 @@ func (s *Service) GetBill(ctx context.Context, billId string) (*models.Bill, err
 
 
 type CreateBillRequest struct {
+	IdempotencyKey string `header:"Idempotency-Key" json:"-"`
+	CustomerId string `json:"customerId"`
 	CloseDate time.Time `json:"CloseDate"`
+	// SettlementCurrency is the currency the bill's grand total is converted into. Defaults to USD.
+	SettlementCurrency string `json:"settlementCurrency"`
+	// GracePeriodSeconds keeps accepting items that occurred before the close
+	// date for this long after it. Defaults to no grace period.
+	GracePeriodSeconds int `json:"gracePeriodSeconds"`
 }
 type CreateBillResponse struct {
 	BillId string `json:"billId"`
@@ -63,26 +111,74 @@ type CreateBillResponse struct {
 
 //encore:api private method=POST path=/bill
 func (s *Service) CreateBill(ctx context.Context, createBillRequest CreateBillRequest) (*CreateBillResponse, error) {
-	bill, err := workflows.CreateBill(ctx,createBillRequest.CloseDate)
-	if err != nil {
-		return nil, err
-	}
-	options := client.StartWorkflowOptions{
-        ID:        bill.BillId,
-        TaskQueue: billingTaskQueue,
-    }
-	s.Client.ExecuteWorkflow(ctx, options, workflows.ComposeBill, bill)
-	return &CreateBillResponse{BillId: bill.BillId}, nil
+	scope := "create_bill:" + createBillRequest.CustomerId
+	return withIdempotency(ctx, scope, createBillRequest.IdempotencyKey, createBillRequest, func() (*CreateBillResponse, error) {
+		billId := uuid.NewString()
+		if createBillRequest.IdempotencyKey != "" {
+			// A retry opens the same bill and starts its workflow if an earlier attempt could not.
+			billId = workflows.IdempotentId(scope, createBillRequest.IdempotencyKey)
+		}
+		bill, err := workflows.CreateBillWithId(ctx,billId,createBillRequest.CustomerId,createBillRequest.CloseDate,createBillRequest.SettlementCurrency,createBillRequest.GracePeriodSeconds)
+		if err != nil {
+			return nil, toAPIError(err)
+		}
+		options := client.StartWorkflowOptions{
+			ID:        workflows.BillWorkflowId(bill.CustomerId, bill.BillId),
+			TaskQueue: billingTaskQueue,
+			// A bill has one workflow, which a retry must not start again once it has finished.
+			WorkflowIDReusePolicy: enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+		}
+		_, err = s.Client.ExecuteWorkflow(ctx, options, workflows.ComposeBill, bill)
+		var started *serviceerror.WorkflowExecutionAlreadyStarted
+		if errors.As(err, &started) {
+			err = nil
+		}
+		if err != nil {
+			if createBillRequest.IdempotencyKey == "" {
+				// Nothing can resume a bill opened without a key, so it is voided
+				// rather than left open without a workflow to close it.
+				voidErr := workflows.TransitionBill(ctx, bill.BillId, models.BillStatusVoid, "Bill workflow failed to start")
+				if voidErr != nil {
+					rlog.Error("Failed to void bill without a workflow", "billId", bill.BillId, "err", voidErr)
+				}
+			}
+			return nil, &errs.Error{
+				Code: errs.Internal,
+				Message: err.Error(),
+			}
+		}
+		return &CreateBillResponse{BillId: bill.BillId}, nil
+	})
 }
 
 
 
 type AddBillItemsRequest struct {
+	IdempotencyKey string `header:"Idempotency-Key" json:"-"`
+	// BillItems are stored in the order given. Adjustments can only correct
+	// charges already on the bill, not charges sent in the same request.
 	BillItems []models.BillItem `json:"billItems"`
+	// Atomic adds all items in one transaction, or none of them if any is
+	// rejected. Otherwise items are added one by one and may partially fail.
+	Atomic bool `json:"atomic"`
+}
+
+type AddBillItemsResponse struct {
+	// HTTPStatus is 200 if every item was added, 207 if only some were and 422 if none were.
+	HTTPStatus int `encore:"httpstatus"`
+	Message string
+	// Results holds the outcome of each item, in the order they were sent.
+	Results []models.BillItemResult `json:"results"`
 }
 
 //encore:api private method=POST path=/bill/:billId/items
-func (s *Service) AddBillItems(ctx context.Context, billId string, billItems AddBillItemsRequest) (*Response, error) {
+func (s *Service) AddBillItems(ctx context.Context, billId string, billItems AddBillItemsRequest) (*AddBillItemsResponse, error) {
+	return withIdempotency(ctx, "add_bill_items:"+billId, billItems.IdempotencyKey, billItems, func() (*AddBillItemsResponse, error) {
+		return s.addBillItems(ctx, billId, billItems)
+	})
+}
+
+func (s *Service) addBillItems(ctx context.Context, billId string, billItems AddBillItemsRequest) (*AddBillItemsResponse, error) {
 	rlog.Info("Bill ID" + billId)
 	isOpen, err := workflows.CheckOpenBill(ctx,billId)
 	if err != nil {
@@ -98,40 +194,104 @@ func (s *Service) AddBillItems(ctx context.Context, billId string, billItems Add
 		}
 	}
 
+	workflowId, err := workflows.GetBillWorkflowId(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+
 	updateHandle , err := s.Client.UpdateWorkflow(context.Background(),client.UpdateWorkflowOptions{
-		WorkflowID: billId,
+		// Temporal drops updates whose ID it has already seen, so a retried request is applied once.
+		UpdateID: billItems.IdempotencyKey,
+		WorkflowID: workflowId,
 		UpdateName: workflows.UpdateBillItems,
-		Args: []interface{}{billItems.BillItems},
+		Args: []interface{}{billId, billItems.BillItems, billItems.Atomic},
 		WaitForStage: client.WorkflowUpdateStageCompleted,
 	})
 
 	if err != nil {
 		rlog.Error("Failed to update bill", billId)
-		return nil, &errs.Error{
-			Code: errs.InvalidArgument,
-			Message: err.Error(),
-		}
+		return nil, toAPIError(err)
 	}
 
-	var updateResult string
-	err = updateHandle.Get(context.Background(),&updateResult)
+	var results []models.BillItemResult
+	err = updateHandle.Get(context.Background(),&results)
 
 	if err != nil {
 		rlog.Error("Failed to update bill", billId)
-		return nil, & errs.Error{
-			Code: errs.InvalidArgument,
-			Message: err.Error(),
-		}
+		return nil, toAPIError(err)
 	}
 
-	return &Response{Message: "Bill items added."}, nil
+	accepted := 0
+	for _, result := range results {
+		if result.Status == models.BillItemAccepted {
+			accepted++
+		}
+	}
+	switch accepted {
+	case len(results):
+		return &AddBillItemsResponse{HTTPStatus: http.StatusOK, Message: "Bill items added.", Results: results}, nil
+	case 0:
+		return &AddBillItemsResponse{HTTPStatus: http.StatusUnprocessableEntity, Message: "No bill items were added.", Results: results}, nil
+	}
+	return &AddBillItemsResponse{HTTPStatus: http.StatusMultiStatus, Message: "Some bill items were not added.", Results: results}, nil
 }
 
 
 
+// VoidBillItem voids an item of an open bill. The item is kept for audit but
+// no longer counts towards the bill's totals.
+//encore:api private method=DELETE path=/bill/:billId/items/:itemId
+func (s *Service) VoidBillItem(ctx context.Context, billId string, itemId string) (*Response, error) {
+	isOpen, err := workflows.CheckOpenBill(ctx,billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	if !isOpen {
+		return nil, &errs.Error{
+			Code: errs.FailedPrecondition,
+			Message: "Bill is already closed.",
+		}
+	}
+	workflowId, err := workflows.GetBillWorkflowId(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+
+	updateHandle, err := s.Client.UpdateWorkflow(ctx, client.UpdateWorkflowOptions{
+		WorkflowID: workflowId,
+		UpdateName: workflows.UpdateVoidBillItem,
+		Args: []interface{}{itemId},
+		WaitForStage: client.WorkflowUpdateStageCompleted,
+	})
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	err = updateHandle.Get(ctx, nil)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &Response{Message: "Bill item voided."}, nil
+}
+
 //encore:api private path=/bill/:billId/close
 func (s *Service) CloseBill(ctx context.Context, billId string) (*Response, error) {
-	err := s.Client.SignalWorkflow(ctx, billId, "", "CLOSE_BILL",nil)
+	// The workflow of a scheduled bill moves on to the next period once the
+	// bill is closed, so signalling it would close that period's bill instead.
+	isOpen, err := workflows.CheckOpenBill(ctx,billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	if !isOpen {
+		return nil, &errs.Error{
+			Code: errs.FailedPrecondition,
+			Message: "Bill is already closed.",
+		}
+	}
+	workflowId, err := workflows.GetBillWorkflowId(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	err = s.Client.SignalWorkflow(ctx, workflowId, "", "CLOSE_BILL", billId)
 	if err != nil {
         return nil, &errs.Error{
 			Code: errs.InvalidArgument,
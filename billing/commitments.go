@@ -0,0 +1,97 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+)
+
+type CommitmentRequest struct {
+	// MinimumAmount is made up with a true-up item when a bill closes below it. Zero means no minimum.
+	MinimumAmount int64 `json:"minimumAmount"`
+	// CapAmount is the most the items of a bill may add up to. Zero means no cap.
+	CapAmount int64 `json:"capAmount"`
+	// CapMode is "reject" (the default) or "flag".
+	CapMode string `json:"capMode"`
+	// AlertThresholds are percentages of the cap that raise an alert once reached.
+	AlertThresholds []int `json:"alertThresholds"`
+}
+
+type ListCommitmentsResponse struct {
+	Commitments []models.Commitment `json:"commitments"`
+}
+
+func (r CommitmentRequest) commitment(currency string) models.Commitment {
+	return models.Commitment{
+		Currency: currency,
+		MinimumAmount: r.MinimumAmount,
+		CapAmount: r.CapAmount,
+		CapMode: r.CapMode,
+		AlertThresholds: r.AlertThresholds,
+	}
+}
+
+// SaveCustomerCommitment sets the minimum charge and spending cap of a
+// customer's bills in one currency.
+//encore:api private method=PUT path=/customer/:customerId/commitment/:currency
+func (s *Service) SaveCustomerCommitment(ctx context.Context, customerId string, currency string, request CommitmentRequest) (*models.Commitment, error) {
+	commitment := request.commitment(currency)
+	commitment.CustomerId = customerId
+	saved, err := workflows.SaveCommitment(ctx, commitment)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return saved, nil
+}
+
+//encore:api private method=GET path=/customer/:customerId/commitments
+func (s *Service) ListCustomerCommitments(ctx context.Context, customerId string) (*ListCommitmentsResponse, error) {
+	commitments, err := workflows.ListCustomerCommitments(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListCommitmentsResponse{Commitments: commitments}, nil
+}
+
+//encore:api private method=DELETE path=/customer/:customerId/commitment/:currency
+func (s *Service) DeleteCustomerCommitment(ctx context.Context, customerId string, currency string) (*Response, error) {
+	err := workflows.DeleteCommitment(ctx, customerId, "", currency)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &Response{Message: "Commitment deleted."}, nil
+}
+
+// SaveBillCommitment sets the minimum charge and spending cap of an open
+// bill in one currency, overriding the customer's.
+//encore:api private method=PUT path=/bill/:billId/commitment/:currency
+func (s *Service) SaveBillCommitment(ctx context.Context, billId string, currency string, request CommitmentRequest) (*models.Commitment, error) {
+	commitment := request.commitment(currency)
+	commitment.BillId = billId
+	saved, err := workflows.SaveCommitment(ctx, commitment)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return saved, nil
+}
+
+// ListBillCommitments returns the commitments in effect for a bill, its own
+// or its customer's.
+//encore:api private method=GET path=/bill/:billId/commitments
+func (s *Service) ListBillCommitments(ctx context.Context, billId string) (*ListCommitmentsResponse, error) {
+	commitments, err := workflows.ListBillCommitments(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListCommitmentsResponse{Commitments: commitments}, nil
+}
+
+//encore:api private method=DELETE path=/bill/:billId/commitment/:currency
+func (s *Service) DeleteBillCommitment(ctx context.Context, billId string, currency string) (*Response, error) {
+	err := workflows.DeleteCommitment(ctx, "", billId, currency)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &Response{Message: "Commitment deleted."}, nil
+}
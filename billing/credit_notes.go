@@ -0,0 +1,40 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+)
+
+type CreateCreditNoteRequest struct {
+	Reason string `json:"reason"`
+	// BillItems are adjustments, each referencing the charge it credits.
+	BillItems []models.BillItem `json:"billItems"`
+}
+
+type ListCreditNotesResponse struct {
+	CreditNotes []models.CreditNote `json:"creditNotes"`
+}
+
+// CreateCreditNote credits a customer for charges on a bill that has already closed.
+// What was paid beyond the credited total becomes customer credit.
+//encore:api private method=POST path=/bill/:billId/credit-notes
+func (s *Service) CreateCreditNote(ctx context.Context, billId string, request CreateCreditNoteRequest) (*models.CreditNote, error) {
+	creditNote, err := workflows.CreateCreditNote(ctx, billId, request.Reason, request.BillItems)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	// A credit note may have settled the bill.
+	s.signalBill(ctx, billId, workflows.SignalBillStatusChanged, nil)
+	return creditNote, nil
+}
+
+//encore:api private method=GET path=/bill/:billId/credit-notes
+func (s *Service) ListCreditNotes(ctx context.Context, billId string) (*ListCreditNotesResponse, error) {
+	creditNotes, err := workflows.ListCreditNotes(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListCreditNotesResponse{CreditNotes: creditNotes}, nil
+}
@@ -0,0 +1,55 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+)
+
+type ListCurrenciesResponse struct {
+	Currencies []models.Currency `json:"currencies"`
+}
+
+type SaveCurrencyRequest struct {
+	Exponent int `json:"exponent"`
+	Symbol string `json:"symbol"`
+	Enabled bool `json:"enabled"`
+	// RoundingMode is "half_even" (the default) or "half_up".
+	RoundingMode string `json:"roundingMode"`
+}
+
+//encore:api private method=GET path=/currencies
+func (s *Service) ListCurrencies(ctx context.Context) (*ListCurrenciesResponse, error) {
+	currencies, err := workflows.ListCurrencies(ctx)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListCurrenciesResponse{Currencies: currencies}, nil
+}
+
+// SaveCurrency registers a new currency or enables, disables, relabels or
+// changes the rounding of an existing one, without requiring a schema migration.
+//encore:api private method=PUT path=/admin/currency/:code
+func (s *Service) SaveCurrency(ctx context.Context, code string, request SaveCurrencyRequest) (*models.Currency, error) {
+	currency, err := workflows.SaveCurrency(ctx, models.Currency{
+		Code: code,
+		Exponent: request.Exponent,
+		Symbol: request.Symbol,
+		Enabled: request.Enabled,
+		RoundingMode: request.RoundingMode,
+	})
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return currency, nil
+}
+
+//encore:api private method=POST path=/admin/fx-rate
+func (s *Service) SaveFxRate(ctx context.Context, request models.FxRate) (*models.FxRate, error) {
+	rate, err := workflows.SaveFxRate(ctx, request)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return rate, nil
+}
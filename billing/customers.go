@@ -0,0 +1,62 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+)
+
+type CustomerRequest struct {
+	Name string `json:"name"`
+	Email string `json:"email"`
+}
+
+type ListCustomersResponse struct {
+	Customers []models.Customer `json:"customers"`
+}
+
+//encore:api private method=POST path=/customer
+func (s *Service) CreateCustomer(ctx context.Context, request CustomerRequest) (*models.Customer, error) {
+	customer, err := workflows.CreateCustomer(ctx, request.Name, request.Email)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return customer, nil
+}
+
+//encore:api private method=GET path=/customer/:customerId
+func (s *Service) GetCustomer(ctx context.Context, customerId string) (*models.Customer, error) {
+	customer, err := workflows.GetCustomer(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return customer, nil
+}
+
+//encore:api private method=GET path=/customers
+func (s *Service) ListCustomers(ctx context.Context) (*ListCustomersResponse, error) {
+	customers, err := workflows.ListCustomers(ctx)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListCustomersResponse{Customers: customers}, nil
+}
+
+//encore:api private method=PUT path=/customer/:customerId
+func (s *Service) UpdateCustomer(ctx context.Context, customerId string, request CustomerRequest) (*models.Customer, error) {
+	customer, err := workflows.UpdateCustomer(ctx, customerId, request.Name, request.Email)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return customer, nil
+}
+
+//encore:api private method=DELETE path=/customer/:customerId
+func (s *Service) DeleteCustomer(ctx context.Context, customerId string) (*Response, error) {
+	err := workflows.DeleteCustomer(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &Response{Message: "Customer deleted."}, nil
+}
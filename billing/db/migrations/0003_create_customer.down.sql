@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS bill_customer_id_idx;
+ALTER TABLE bill DROP COLUMN IF EXISTS workflow_id;
+ALTER TABLE bill DROP COLUMN IF EXISTS customer_id;
+DROP TABLE IF EXISTS customer;
@@ -0,0 +1,14 @@
+CREATE TABLE customer (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  name TEXT NOT NULL,
+  email TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT now(),
+  updated_at TIMESTAMP DEFAULT now(),
+  deleted_at TIMESTAMP NULL
+);
+
+-- Bills created before customers existed keep a NULL owner.
+ALTER TABLE bill ADD COLUMN customer_id UUID NULL REFERENCES customer(id);
+ALTER TABLE bill ADD COLUMN workflow_id TEXT NULL;
+
+CREATE INDEX bill_customer_id_idx ON bill (customer_id);
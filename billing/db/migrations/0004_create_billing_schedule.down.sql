@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS bill_open_schedule_idx;
+ALTER TABLE bill DROP COLUMN IF EXISTS schedule_id;
+DROP TABLE IF EXISTS billing_schedule;
+DROP TYPE IF EXISTS schedule_period;
@@ -0,0 +1,19 @@
+CREATE TYPE schedule_period AS ENUM ('weekly', 'monthly', 'custom');
+
+CREATE TABLE billing_schedule (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  customer_id UUID NOT NULL,
+  period schedule_period NOT NULL,
+  interval_days INT NULL,
+  anchor_date TIMESTAMP NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMP DEFAULT now(),
+
+  FOREIGN KEY (customer_id) REFERENCES customer(id),
+  CHECK (period <> 'custom' OR interval_days > 0)
+);
+
+ALTER TABLE bill ADD COLUMN schedule_id UUID NULL REFERENCES billing_schedule(id);
+
+-- A schedule never has more than one open bill at a time.
+CREATE UNIQUE INDEX bill_open_schedule_idx ON bill (schedule_id) WHERE status = 'open';
@@ -0,0 +1,15 @@
+DROP VIEW IF EXISTS bill_summary;
+ALTER TABLE bill_item DROP CONSTRAINT IF EXISTS bill_item_currency_fkey;
+CREATE TYPE currency_type AS ENUM ('GEL', 'USD');
+ALTER TABLE bill_item ALTER COLUMN currency TYPE currency_type USING currency::currency_type;
+DROP TABLE IF EXISTS currency;
+
+CREATE VIEW bill_summary AS
+SELECT
+  bill_id,
+  currency,
+  SUM(amount) as total_amount
+FROM
+  bill_item
+GROUP BY
+  bill_id, currency;
@@ -0,0 +1,28 @@
+CREATE TABLE currency (
+  code TEXT PRIMARY KEY CHECK (code ~ '^[A-Z]{3}$'),
+  exponent SMALLINT NOT NULL CHECK (exponent BETWEEN 0 AND 4),
+  symbol TEXT NOT NULL,
+  enabled BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMP DEFAULT now(),
+  updated_at TIMESTAMP DEFAULT now()
+);
+
+INSERT INTO currency (code, exponent, symbol) VALUES
+  ('USD', 2, '$'),
+  ('GEL', 2, '₾');
+
+-- Currencies are now rows in the registry rather than enum values.
+DROP VIEW bill_summary;
+ALTER TABLE bill_item ALTER COLUMN currency TYPE TEXT;
+ALTER TABLE bill_item ADD FOREIGN KEY (currency) REFERENCES currency(code);
+DROP TYPE currency_type;
+
+CREATE VIEW bill_summary AS
+SELECT
+  bill_id,
+  currency,
+  SUM(amount) as total_amount
+FROM
+  bill_item
+GROUP BY
+  bill_id, currency;
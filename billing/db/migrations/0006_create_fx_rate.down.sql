@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS bill_fx_rate;
+DROP TABLE IF EXISTS fx_rate;
+ALTER TABLE billing_schedule DROP COLUMN IF EXISTS settlement_currency;
+ALTER TABLE bill DROP COLUMN IF EXISTS settlement_currency;
@@ -0,0 +1,27 @@
+ALTER TABLE bill ADD COLUMN settlement_currency TEXT NOT NULL DEFAULT 'USD' REFERENCES currency(code);
+ALTER TABLE billing_schedule ADD COLUMN settlement_currency TEXT NOT NULL DEFAULT 'USD' REFERENCES currency(code);
+
+-- One major unit of base_currency is worth rate major units of quote_currency.
+CREATE TABLE fx_rate (
+  base_currency TEXT NOT NULL REFERENCES currency(code),
+  quote_currency TEXT NOT NULL REFERENCES currency(code),
+  rate NUMERIC(24, 12) NOT NULL CHECK (rate > 0),
+  effective_at TIMESTAMP NOT NULL,
+  created_at TIMESTAMP DEFAULT now(),
+
+  PRIMARY KEY (base_currency, quote_currency, effective_at)
+);
+
+-- Rates captured when a bill closes, so that its converted total can be reproduced.
+CREATE TABLE bill_fx_rate (
+  bill_id UUID NOT NULL,
+  base_currency TEXT NOT NULL,
+  quote_currency TEXT NOT NULL,
+  rate NUMERIC(24, 12) NOT NULL,
+  effective_at TIMESTAMP NOT NULL,
+  source TEXT NOT NULL,
+  captured_at TIMESTAMP DEFAULT now(),
+
+  PRIMARY KEY (bill_id, base_currency, quote_currency),
+  FOREIGN KEY (bill_id) REFERENCES bill(id) ON DELETE CASCADE
+);
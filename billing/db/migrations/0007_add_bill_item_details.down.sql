@@ -0,0 +1,10 @@
+ALTER TABLE bill_item
+  DROP CONSTRAINT IF EXISTS bill_item_service_period_check,
+  DROP CONSTRAINT IF EXISTS bill_item_amount_check,
+  DROP COLUMN IF EXISTS metadata,
+  DROP COLUMN IF EXISTS service_period_end,
+  DROP COLUMN IF EXISTS service_period_start,
+  DROP COLUMN IF EXISTS sku,
+  DROP COLUMN IF EXISTS unit_price,
+  DROP COLUMN IF EXISTS quantity,
+  DROP COLUMN IF EXISTS description;
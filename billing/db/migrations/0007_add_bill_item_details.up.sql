@@ -0,0 +1,15 @@
+ALTER TABLE bill_item
+  ADD COLUMN description TEXT NOT NULL DEFAULT '',
+  ADD COLUMN quantity INT NOT NULL DEFAULT 1 CHECK (quantity > 0),
+  ADD COLUMN unit_price INT NULL,
+  ADD COLUMN sku TEXT NULL,
+  ADD COLUMN service_period_start TIMESTAMP NULL,
+  ADD COLUMN service_period_end TIMESTAMP NULL,
+  ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+
+-- Existing items were single charges for their full amount.
+UPDATE bill_item SET unit_price = amount;
+
+ALTER TABLE bill_item ALTER COLUMN unit_price SET NOT NULL;
+ALTER TABLE bill_item ADD CONSTRAINT bill_item_amount_check CHECK (amount = quantity * unit_price);
+ALTER TABLE bill_item ADD CONSTRAINT bill_item_service_period_check CHECK (service_period_end >= service_period_start);
@@ -0,0 +1,10 @@
+DROP TRIGGER IF EXISTS bill_item_immutable ON bill_item;
+DROP FUNCTION IF EXISTS bill_item_immutable();
+DROP INDEX IF EXISTS bill_item_adjusts_item_id_idx;
+ALTER TABLE bill_item
+  DROP CONSTRAINT IF EXISTS bill_item_kind_check,
+  DROP COLUMN IF EXISTS credit_note_id,
+  DROP COLUMN IF EXISTS adjusts_item_id,
+  DROP COLUMN IF EXISTS kind;
+DROP TABLE IF EXISTS credit_note;
+DROP TYPE IF EXISTS bill_item_kind;
@@ -0,0 +1,45 @@
+CREATE TYPE bill_item_kind AS ENUM ('charge', 'adjustment');
+
+-- A credit note credits a customer for items of a bill that has already closed.
+CREATE TABLE credit_note (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  bill_id UUID NOT NULL,
+  reason TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT now(),
+
+  FOREIGN KEY (bill_id) REFERENCES bill(id) ON DELETE CASCADE
+);
+
+ALTER TABLE bill_item
+  ADD COLUMN kind bill_item_kind NOT NULL DEFAULT 'charge',
+  ADD COLUMN adjusts_item_id UUID NULL REFERENCES bill_item(id),
+  ADD COLUMN credit_note_id UUID NULL REFERENCES credit_note(id),
+  ADD CONSTRAINT bill_item_kind_check CHECK (
+    (kind = 'charge' AND amount > 0 AND adjusts_item_id IS NULL AND credit_note_id IS NULL)
+    OR (kind = 'adjustment' AND amount < 0 AND adjusts_item_id IS NOT NULL)
+  );
+
+CREATE INDEX bill_item_adjusts_item_id_idx ON bill_item (adjusts_item_id);
+
+-- Charges are corrected by adding adjustments, never by rewriting or removing rows.
+CREATE FUNCTION bill_item_immutable() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    RAISE EXCEPTION 'bill item % cannot be deleted', OLD.id;
+  END IF;
+  IF (NEW.bill_id, NEW.amount, NEW.currency, NEW.kind, NEW.adjusts_item_id, NEW.credit_note_id,
+      NEW.description, NEW.quantity, NEW.unit_price, NEW.sku, NEW.service_period_start,
+      NEW.service_period_end, NEW.metadata, NEW.created_at)
+    IS DISTINCT FROM
+     (OLD.bill_id, OLD.amount, OLD.currency, OLD.kind, OLD.adjusts_item_id, OLD.credit_note_id,
+      OLD.description, OLD.quantity, OLD.unit_price, OLD.sku, OLD.service_period_start,
+      OLD.service_period_end, OLD.metadata, OLD.created_at) THEN
+    RAISE EXCEPTION 'bill item % cannot be modified', OLD.id;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER bill_item_immutable
+BEFORE UPDATE OR DELETE ON bill_item
+FOR EACH ROW EXECUTE FUNCTION bill_item_immutable();
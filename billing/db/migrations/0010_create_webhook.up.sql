@@ -0,0 +1,34 @@
+CREATE TABLE webhook_endpoint (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  customer_id UUID NOT NULL,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  -- An empty list subscribes the endpoint to every event type.
+  event_types TEXT[] NOT NULL DEFAULT '{}',
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMP DEFAULT now(),
+
+  FOREIGN KEY (customer_id) REFERENCES customer(id)
+);
+
+CREATE INDEX webhook_endpoint_customer_id_idx ON webhook_endpoint (customer_id);
+
+CREATE TYPE webhook_delivery_status AS ENUM ('pending', 'delivered', 'failed');
+
+CREATE TABLE webhook_delivery (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  endpoint_id UUID NOT NULL,
+  event_id UUID NOT NULL,
+  event_type TEXT NOT NULL,
+  payload JSONB NOT NULL,
+  status webhook_delivery_status NOT NULL DEFAULT 'pending',
+  attempts INT NOT NULL DEFAULT 0,
+  response_status INT NULL,
+  last_error TEXT NULL,
+  created_at TIMESTAMP DEFAULT now(),
+  last_attempt_at TIMESTAMP NULL,
+  delivered_at TIMESTAMP NULL,
+
+  FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoint(id),
+  UNIQUE (endpoint_id, event_id)
+);
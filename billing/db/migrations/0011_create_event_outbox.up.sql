@@ -0,0 +1,11 @@
+-- Events are written here in the same transaction as the change they describe,
+-- and published to Pub/Sub once that transaction has committed.
+CREATE TABLE event_outbox (
+  id UUID PRIMARY KEY,
+  event_type TEXT NOT NULL,
+  payload JSONB NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+  published_at TIMESTAMP NULL
+);
+
+CREATE INDEX event_outbox_unpublished_idx ON event_outbox (created_at) WHERE published_at IS NULL;
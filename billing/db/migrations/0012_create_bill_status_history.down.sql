@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS bill_status_history;
+
+-- Enum values cannot be dropped, so the type is rebuilt with every non-open status folded into 'closed'.
+DROP INDEX IF EXISTS bill_open_schedule_idx;
+ALTER TABLE bill ALTER COLUMN status DROP DEFAULT;
+ALTER TABLE bill ALTER COLUMN status TYPE TEXT;
+DROP TYPE bill_status;
+UPDATE bill SET status = 'closed' WHERE status NOT IN ('open', 'closing');
+UPDATE bill SET status = 'open' WHERE status = 'closing';
+CREATE TYPE bill_status AS ENUM ('open', 'closed');
+ALTER TABLE bill ALTER COLUMN status TYPE bill_status USING status::bill_status;
+ALTER TABLE bill ALTER COLUMN status SET DEFAULT 'open';
+CREATE UNIQUE INDEX bill_open_schedule_idx ON bill (schedule_id) WHERE status = 'open';
@@ -0,0 +1,28 @@
+-- Closed bills are now invoiced, and can go on to be paid, voided or written off.
+ALTER TYPE bill_status RENAME VALUE 'closed' TO 'invoiced';
+ALTER TYPE bill_status ADD VALUE 'closing' BEFORE 'invoiced';
+ALTER TYPE bill_status ADD VALUE 'partially_paid';
+ALTER TYPE bill_status ADD VALUE 'paid';
+ALTER TYPE bill_status ADD VALUE 'void';
+ALTER TYPE bill_status ADD VALUE 'written_off';
+
+CREATE TABLE bill_status_history (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  bill_id UUID NOT NULL,
+  -- NULL for the bill being opened.
+  from_status bill_status NULL,
+  to_status bill_status NOT NULL,
+  reason TEXT NOT NULL DEFAULT '',
+  -- clock_timestamp() keeps several transitions made in one transaction in order.
+  created_at TIMESTAMP NOT NULL DEFAULT clock_timestamp(),
+
+  FOREIGN KEY (bill_id) REFERENCES bill(id) ON DELETE CASCADE
+);
+
+CREATE INDEX bill_status_history_bill_id_idx ON bill_status_history (bill_id, created_at);
+
+INSERT INTO bill_status_history (bill_id, from_status, to_status, created_at)
+SELECT id, NULL, 'open', COALESCE(created_at, now()) FROM bill;
+
+INSERT INTO bill_status_history (bill_id, from_status, to_status, created_at)
+SELECT id, 'open', status, COALESCE(closed_at, now()) FROM bill WHERE status <> 'open';
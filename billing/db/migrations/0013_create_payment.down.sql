@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS customer_credit;
+DROP TABLE IF EXISTS payment;
@@ -0,0 +1,34 @@
+CREATE TABLE payment (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  bill_id UUID NOT NULL,
+  amount INT NOT NULL CHECK (amount > 0),
+  currency TEXT NOT NULL,
+  -- The part of the amount that settles the bill. The rest becomes customer credit.
+  applied_amount INT NOT NULL CHECK (applied_amount >= 0 AND applied_amount <= amount),
+  method TEXT NOT NULL,
+  external_reference TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  FOREIGN KEY (bill_id) REFERENCES bill(id),
+  FOREIGN KEY (currency) REFERENCES currency(code)
+);
+
+CREATE INDEX payment_bill_id_idx ON payment (bill_id);
+-- A payment reported twice by the provider is only recorded once.
+CREATE UNIQUE INDEX payment_external_reference_idx ON payment (bill_id, external_reference) WHERE external_reference <> '';
+
+-- Ledger of customer credit. Positive entries add credit, negative entries use it up.
+CREATE TABLE customer_credit (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  customer_id UUID NOT NULL,
+  currency TEXT NOT NULL,
+  amount INT NOT NULL,
+  payment_id UUID NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  FOREIGN KEY (customer_id) REFERENCES customer(id),
+  FOREIGN KEY (currency) REFERENCES currency(code),
+  FOREIGN KEY (payment_id) REFERENCES payment(id)
+);
+
+CREATE INDEX customer_credit_customer_id_idx ON customer_credit (customer_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS dunning_event;
+DROP TYPE IF EXISTS dunning_action;
+ALTER TABLE customer DROP COLUMN IF EXISTS suspended_at;
+ALTER TABLE bill DROP COLUMN IF EXISTS overdue_at;
@@ -0,0 +1,18 @@
+ALTER TABLE bill ADD COLUMN overdue_at TIMESTAMP NULL;
+
+-- Suspended customers cannot be billed anew until their overdue bills are settled.
+ALTER TABLE customer ADD COLUMN suspended_at TIMESTAMP NULL;
+
+CREATE TYPE dunning_action AS ENUM ('remind', 'overdue', 'suspend');
+
+CREATE TABLE dunning_event (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  bill_id UUID NOT NULL,
+  -- Position of the step in the dunning schedule, so each step is recorded once.
+  step INT NOT NULL,
+  action dunning_action NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  FOREIGN KEY (bill_id) REFERENCES bill(id),
+  UNIQUE (bill_id, step)
+);
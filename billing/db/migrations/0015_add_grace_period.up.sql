@@ -0,0 +1,27 @@
+-- After its close date a bill with a grace period is "closing" for that long,
+-- still accepting items that occurred before the close date.
+ALTER TABLE bill ADD COLUMN grace_period_seconds INT NOT NULL DEFAULT 0 CHECK (grace_period_seconds >= 0);
+ALTER TABLE billing_schedule ADD COLUMN grace_period_seconds INT NOT NULL DEFAULT 0 CHECK (grace_period_seconds >= 0);
+
+ALTER TABLE bill_item ADD COLUMN occurred_at TIMESTAMP NULL;
+
+CREATE OR REPLACE FUNCTION bill_item_immutable() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    RAISE EXCEPTION 'bill item % cannot be deleted', OLD.id;
+  END IF;
+  IF OLD.voided_at IS NOT NULL AND NEW.voided_at IS DISTINCT FROM OLD.voided_at THEN
+    RAISE EXCEPTION 'bill item % is already voided', OLD.id;
+  END IF;
+  IF (NEW.bill_id, NEW.amount, NEW.currency, NEW.kind, NEW.adjusts_item_id, NEW.credit_note_id,
+      NEW.description, NEW.quantity, NEW.unit_price, NEW.sku, NEW.service_period_start,
+      NEW.service_period_end, NEW.metadata, NEW.occurred_at, NEW.created_at)
+    IS DISTINCT FROM
+     (OLD.bill_id, OLD.amount, OLD.currency, OLD.kind, OLD.adjusts_item_id, OLD.credit_note_id,
+      OLD.description, OLD.quantity, OLD.unit_price, OLD.sku, OLD.service_period_start,
+      OLD.service_period_end, OLD.metadata, OLD.occurred_at, OLD.created_at) THEN
+    RAISE EXCEPTION 'bill item % cannot be modified', OLD.id;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,13 @@
+CREATE OR REPLACE VIEW bill_summary AS
+SELECT
+  bill_id,
+  currency,
+  SUM(amount) as total_amount
+FROM
+  bill_item
+WHERE
+  voided_at IS NULL
+GROUP BY
+  bill_id, currency;
+
+DROP TABLE IF EXISTS bill_total;
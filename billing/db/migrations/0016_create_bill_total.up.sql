@@ -0,0 +1,30 @@
+-- Running totals per bill and currency, kept up to date in the same
+-- transaction as every item insert and void.
+CREATE TABLE bill_total (
+  bill_id UUID NOT NULL,
+  currency TEXT NOT NULL,
+  total_amount BIGINT NOT NULL DEFAULT 0,
+  -- Number of items that are not voided. Currencies without any are left out of bill_summary.
+  item_count INT NOT NULL DEFAULT 0,
+  updated_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  PRIMARY KEY (bill_id, currency),
+  FOREIGN KEY (bill_id) REFERENCES bill(id),
+  FOREIGN KEY (currency) REFERENCES currency(code)
+);
+
+INSERT INTO bill_total (bill_id, currency, total_amount, item_count)
+SELECT bill_id, currency, SUM(amount), COUNT(*)
+FROM bill_item
+WHERE voided_at IS NULL
+GROUP BY bill_id, currency;
+
+CREATE OR REPLACE VIEW bill_summary AS
+SELECT
+  bill_id,
+  currency,
+  total_amount
+FROM
+  bill_total
+WHERE
+  item_count > 0;
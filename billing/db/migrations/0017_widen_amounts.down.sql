@@ -0,0 +1,35 @@
+CREATE OR REPLACE FUNCTION bill_item_immutable() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    RAISE EXCEPTION 'bill item % cannot be deleted', OLD.id;
+  END IF;
+  IF OLD.voided_at IS NOT NULL AND NEW.voided_at IS DISTINCT FROM OLD.voided_at THEN
+    RAISE EXCEPTION 'bill item % is already voided', OLD.id;
+  END IF;
+  IF (NEW.bill_id, NEW.amount, NEW.currency, NEW.kind, NEW.adjusts_item_id, NEW.credit_note_id,
+      NEW.description, NEW.quantity, NEW.unit_price, NEW.sku, NEW.service_period_start,
+      NEW.service_period_end, NEW.metadata, NEW.occurred_at, NEW.created_at)
+    IS DISTINCT FROM
+     (OLD.bill_id, OLD.amount, OLD.currency, OLD.kind, OLD.adjusts_item_id, OLD.credit_note_id,
+      OLD.description, OLD.quantity, OLD.unit_price, OLD.sku, OLD.service_period_start,
+      OLD.service_period_end, OLD.metadata, OLD.occurred_at, OLD.created_at) THEN
+    RAISE EXCEPTION 'bill item % cannot be modified', OLD.id;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE currency DROP COLUMN rounding_mode;
+
+ALTER TABLE customer_credit ALTER COLUMN amount TYPE INT;
+ALTER TABLE payment
+  ALTER COLUMN amount TYPE INT,
+  ALTER COLUMN applied_amount TYPE INT;
+
+ALTER TABLE bill_item DROP CONSTRAINT bill_item_amount_check;
+ALTER TABLE bill_item DROP COLUMN unit_price_decimal;
+ALTER TABLE bill_item
+  ALTER COLUMN amount TYPE INT,
+  ALTER COLUMN quantity TYPE INT,
+  ALTER COLUMN unit_price TYPE INT;
+ALTER TABLE bill_item ADD CONSTRAINT bill_item_amount_check CHECK (amount = quantity * unit_price);
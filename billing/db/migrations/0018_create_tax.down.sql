@@ -0,0 +1,27 @@
+CREATE OR REPLACE FUNCTION bill_item_immutable() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    RAISE EXCEPTION 'bill item % cannot be deleted', OLD.id;
+  END IF;
+  IF OLD.voided_at IS NOT NULL AND NEW.voided_at IS DISTINCT FROM OLD.voided_at THEN
+    RAISE EXCEPTION 'bill item % is already voided', OLD.id;
+  END IF;
+  IF (NEW.bill_id, NEW.amount, NEW.currency, NEW.kind, NEW.adjusts_item_id, NEW.credit_note_id,
+      NEW.description, NEW.quantity, NEW.unit_price, NEW.unit_price_decimal, NEW.sku, NEW.service_period_start,
+      NEW.service_period_end, NEW.metadata, NEW.occurred_at, NEW.created_at)
+    IS DISTINCT FROM
+     (OLD.bill_id, OLD.amount, OLD.currency, OLD.kind, OLD.adjusts_item_id, OLD.credit_note_id,
+      OLD.description, OLD.quantity, OLD.unit_price, OLD.unit_price_decimal, OLD.sku, OLD.service_period_start,
+      OLD.service_period_end, OLD.metadata, OLD.occurred_at, OLD.created_at) THEN
+    RAISE EXCEPTION 'bill item % cannot be modified', OLD.id;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TABLE IF EXISTS bill_tax_line;
+DROP FUNCTION IF EXISTS bill_tax_line_immutable();
+DROP TABLE IF EXISTS customer_tax_exemption;
+DROP TABLE IF EXISTS customer_tax_profile;
+DROP TABLE IF EXISTS tax_rate;
+ALTER TABLE bill_item DROP COLUMN IF EXISTS tax_category;
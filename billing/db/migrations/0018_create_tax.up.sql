@@ -0,0 +1,85 @@
+-- Items are taxed by category, at the rate their customer's jurisdiction
+-- charges for that category.
+ALTER TABLE bill_item ADD COLUMN tax_category TEXT NOT NULL DEFAULT 'standard';
+
+-- Tax rules. rate is a fraction, e.g. 0.18 for 18%. Inclusive rates are
+-- already part of item prices, exclusive rates are charged on top of them.
+CREATE TABLE tax_rate (
+  jurisdiction TEXT NOT NULL,
+  tax_category TEXT NOT NULL,
+  rate NUMERIC(9, 6) NOT NULL CHECK (rate >= 0 AND rate < 1),
+  inclusive BOOLEAN NOT NULL DEFAULT FALSE,
+  effective_at TIMESTAMP NOT NULL,
+  created_at TIMESTAMP DEFAULT now(),
+
+  PRIMARY KEY (jurisdiction, tax_category, effective_at)
+);
+
+CREATE TABLE customer_tax_profile (
+  customer_id UUID PRIMARY KEY,
+  jurisdiction TEXT NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  FOREIGN KEY (customer_id) REFERENCES customer(id)
+);
+
+-- An exemption with an empty tax_category covers every category.
+CREATE TABLE customer_tax_exemption (
+  customer_id UUID NOT NULL,
+  tax_category TEXT NOT NULL DEFAULT '',
+  reason TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  PRIMARY KEY (customer_id, tax_category),
+  FOREIGN KEY (customer_id) REFERENCES customer(id)
+);
+
+-- Tax computed when a bill closes, one line per currency and tax category.
+-- taxable_amount excludes the tax, also for inclusive rates.
+CREATE TABLE bill_tax_line (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  bill_id UUID NOT NULL,
+  currency TEXT NOT NULL,
+  jurisdiction TEXT NOT NULL,
+  tax_category TEXT NOT NULL,
+  rate NUMERIC(9, 6) NOT NULL,
+  inclusive BOOLEAN NOT NULL,
+  taxable_amount BIGINT NOT NULL,
+  tax_amount BIGINT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  UNIQUE (bill_id, currency, tax_category),
+  FOREIGN KEY (bill_id) REFERENCES bill(id),
+  FOREIGN KEY (currency) REFERENCES currency(code)
+);
+
+CREATE FUNCTION bill_tax_line_immutable() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'bill tax line % cannot be modified', OLD.id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER bill_tax_line_immutable
+BEFORE UPDATE OR DELETE ON bill_tax_line
+FOR EACH ROW EXECUTE FUNCTION bill_tax_line_immutable();
+
+CREATE OR REPLACE FUNCTION bill_item_immutable() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    RAISE EXCEPTION 'bill item % cannot be deleted', OLD.id;
+  END IF;
+  IF OLD.voided_at IS NOT NULL AND NEW.voided_at IS DISTINCT FROM OLD.voided_at THEN
+    RAISE EXCEPTION 'bill item % is already voided', OLD.id;
+  END IF;
+  IF (NEW.bill_id, NEW.amount, NEW.currency, NEW.kind, NEW.adjusts_item_id, NEW.credit_note_id,
+      NEW.description, NEW.quantity, NEW.unit_price, NEW.unit_price_decimal, NEW.sku, NEW.service_period_start,
+      NEW.service_period_end, NEW.metadata, NEW.occurred_at, NEW.tax_category, NEW.created_at)
+    IS DISTINCT FROM
+     (OLD.bill_id, OLD.amount, OLD.currency, OLD.kind, OLD.adjusts_item_id, OLD.credit_note_id,
+      OLD.description, OLD.quantity, OLD.unit_price, OLD.unit_price_decimal, OLD.sku, OLD.service_period_start,
+      OLD.service_period_end, OLD.metadata, OLD.occurred_at, OLD.tax_category, OLD.created_at) THEN
+    RAISE EXCEPTION 'bill item % cannot be modified', OLD.id;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS bill_discount_line;
+DROP FUNCTION IF EXISTS bill_discount_line_immutable();
+DROP TABLE IF EXISTS customer_promotion;
+DROP TABLE IF EXISTS coupon;
@@ -0,0 +1,69 @@
+CREATE TABLE coupon (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  code TEXT NOT NULL UNIQUE,
+  kind TEXT NOT NULL CHECK (kind IN ('percentage', 'fixed')),
+  percent_off NUMERIC(5, 2) NULL CHECK (percent_off > 0 AND percent_off <= 100),
+  amount_off BIGINT NULL CHECK (amount_off > 0),
+  currency TEXT NULL REFERENCES currency(code),
+  stackable BOOLEAN NOT NULL DEFAULT FALSE,
+  valid_from TIMESTAMP NULL,
+  valid_until TIMESTAMP NULL,
+  -- Zero means no limit.
+  max_redemptions INT NOT NULL DEFAULT 0 CHECK (max_redemptions >= 0),
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  CHECK (
+    (kind = 'percentage' AND percent_off IS NOT NULL AND amount_off IS NULL AND currency IS NULL)
+    OR (kind = 'fixed' AND percent_off IS NULL AND amount_off IS NOT NULL AND currency IS NOT NULL)
+  ),
+  CHECK (valid_until > valid_from)
+);
+
+-- A coupon granted to a customer.
+CREATE TABLE customer_promotion (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  customer_id UUID NOT NULL,
+  coupon_id UUID NOT NULL,
+  valid_from TIMESTAMP NULL,
+  valid_until TIMESTAMP NULL,
+  -- Zero means no limit.
+  max_redemptions INT NOT NULL DEFAULT 0 CHECK (max_redemptions >= 0),
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  FOREIGN KEY (customer_id) REFERENCES customer(id),
+  FOREIGN KEY (coupon_id) REFERENCES coupon(id),
+  CHECK (valid_until > valid_from)
+);
+
+CREATE INDEX customer_promotion_customer_id_idx ON customer_promotion (customer_id);
+
+-- Discounts applied when a bill closes, one line per promotion and currency.
+-- Each bill a promotion discounts counts as one redemption.
+CREATE TABLE bill_discount_line (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  bill_id UUID NOT NULL,
+  promotion_id UUID NOT NULL,
+  coupon_id UUID NOT NULL,
+  currency TEXT NOT NULL,
+  amount BIGINT NOT NULL CHECK (amount > 0),
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  UNIQUE (bill_id, promotion_id, currency),
+  FOREIGN KEY (bill_id) REFERENCES bill(id),
+  FOREIGN KEY (promotion_id) REFERENCES customer_promotion(id),
+  FOREIGN KEY (coupon_id) REFERENCES coupon(id),
+  FOREIGN KEY (currency) REFERENCES currency(code)
+);
+
+CREATE INDEX bill_discount_line_coupon_id_idx ON bill_discount_line (coupon_id);
+CREATE INDEX bill_discount_line_promotion_id_idx ON bill_discount_line (promotion_id);
+
+CREATE FUNCTION bill_discount_line_immutable() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'bill discount line % cannot be modified', OLD.id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER bill_discount_line_immutable
+BEFORE UPDATE OR DELETE ON bill_discount_line
+FOR EACH ROW EXECUTE FUNCTION bill_discount_line_immutable();
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS usage_event;
+DROP TABLE IF EXISTS usage_rating_item;
+DROP TABLE IF EXISTS usage_rating;
+DROP TABLE IF EXISTS meter_price;
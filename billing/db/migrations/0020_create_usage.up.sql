@@ -0,0 +1,65 @@
+-- The price book: how the usage of each meter is rated.
+CREATE TABLE meter_price (
+  meter TEXT PRIMARY KEY,
+  description TEXT NOT NULL DEFAULT '',
+  currency TEXT NOT NULL REFERENCES currency(code),
+  model TEXT NOT NULL CHECK (model IN ('flat', 'tiered', 'volume', 'package')),
+  unit_price NUMERIC(38, 12) NULL CHECK (unit_price >= 0),
+  package_size BIGINT NULL CHECK (package_size > 0),
+  -- Tiers of tiered and volume prices: [{"upTo": 1000, "unitPrice": "0.5"}, {"unitPrice": "0.2"}].
+  tiers JSONB NOT NULL DEFAULT '[]',
+  sku TEXT NULL,
+  tax_category TEXT NOT NULL DEFAULT 'standard',
+  updated_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  CHECK (
+    (model = 'flat' AND unit_price IS NOT NULL AND package_size IS NULL)
+    OR (model = 'package' AND unit_price IS NOT NULL AND package_size IS NOT NULL)
+    OR (model IN ('tiered', 'volume') AND unit_price IS NULL AND package_size IS NULL)
+  )
+);
+
+-- The events of a meter that were rated into a bill at once.
+CREATE TABLE usage_rating (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  bill_id UUID NOT NULL,
+  meter TEXT NOT NULL,
+  quantity BIGINT NOT NULL DEFAULT 0,
+  event_count INT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  FOREIGN KEY (bill_id) REFERENCES bill(id),
+  FOREIGN KEY (meter) REFERENCES meter_price(meter)
+);
+
+CREATE INDEX usage_rating_bill_id_idx ON usage_rating (bill_id);
+
+-- The items a rating was charged as, one per tier used.
+CREATE TABLE usage_rating_item (
+  rating_id UUID NOT NULL,
+  bill_item_id UUID NOT NULL,
+
+  PRIMARY KEY (rating_id, bill_item_id),
+  FOREIGN KEY (rating_id) REFERENCES usage_rating(id),
+  FOREIGN KEY (bill_item_id) REFERENCES bill_item(id)
+);
+
+-- Raw usage as reported. Events are unique per customer by the ID the reporter gives them.
+CREATE TABLE usage_event (
+  customer_id UUID NOT NULL,
+  event_id TEXT NOT NULL,
+  meter TEXT NOT NULL,
+  quantity BIGINT NOT NULL CHECK (quantity >= 0),
+  occurred_at TIMESTAMP NOT NULL,
+  properties JSONB NOT NULL DEFAULT '{}',
+  received_at TIMESTAMP NOT NULL DEFAULT now(),
+  rating_id UUID NULL,
+
+  PRIMARY KEY (customer_id, event_id),
+  FOREIGN KEY (customer_id) REFERENCES customer(id),
+  FOREIGN KEY (meter) REFERENCES meter_price(meter),
+  FOREIGN KEY (rating_id) REFERENCES usage_rating(id)
+);
+
+CREATE INDEX usage_event_unrated_idx ON usage_event (customer_id, meter, occurred_at) WHERE rating_id IS NULL;
+CREATE INDEX usage_event_rating_id_idx ON usage_event (rating_id);
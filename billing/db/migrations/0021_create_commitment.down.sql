@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS bill_cap_alert;
+DROP TABLE IF EXISTS commitment;
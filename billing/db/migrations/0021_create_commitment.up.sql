@@ -0,0 +1,37 @@
+-- Minimum charges and spending caps, for all bills of a customer or for a
+-- single bill, whose commitment replaces the customer's in that currency.
+CREATE TABLE commitment (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  customer_id UUID NULL,
+  bill_id UUID NULL,
+  currency TEXT NOT NULL,
+  -- Zero means no minimum.
+  minimum_amount BIGINT NOT NULL DEFAULT 0 CHECK (minimum_amount >= 0),
+  -- Zero means no cap.
+  cap_amount BIGINT NOT NULL DEFAULT 0 CHECK (cap_amount >= 0),
+  cap_mode TEXT NOT NULL DEFAULT 'reject' CHECK (cap_mode IN ('reject', 'flag')),
+  -- Percentages of the cap that raise an alert, e.g. [80, 100].
+  alert_thresholds JSONB NOT NULL DEFAULT '[]',
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+  updated_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  FOREIGN KEY (customer_id) REFERENCES customer(id),
+  FOREIGN KEY (bill_id) REFERENCES bill(id),
+  FOREIGN KEY (currency) REFERENCES currency(code),
+  CHECK ((customer_id IS NULL) <> (bill_id IS NULL)),
+  CHECK (cap_amount = 0 OR cap_amount >= minimum_amount)
+);
+
+CREATE UNIQUE INDEX commitment_customer_currency_idx ON commitment (customer_id, currency) WHERE customer_id IS NOT NULL;
+CREATE UNIQUE INDEX commitment_bill_currency_idx ON commitment (bill_id, currency) WHERE bill_id IS NOT NULL;
+
+-- The cap thresholds a bill has reached, so that each alerts once.
+CREATE TABLE bill_cap_alert (
+  bill_id UUID NOT NULL,
+  currency TEXT NOT NULL,
+  threshold INT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  PRIMARY KEY (bill_id, currency, threshold),
+  FOREIGN KEY (bill_id) REFERENCES bill(id)
+);
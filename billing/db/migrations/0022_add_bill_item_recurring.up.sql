@@ -0,0 +1,29 @@
+-- Recurring items are fixed fees charged for the period of their bill. They
+-- are prorated when the close date of the bill changes, at the rate their
+-- service period gives.
+ALTER TABLE bill_item ADD COLUMN recurring BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE bill_item ADD CONSTRAINT bill_item_recurring_check CHECK (
+  NOT recurring OR (kind = 'charge' AND service_period_start IS NOT NULL AND service_period_end > service_period_start)
+);
+
+CREATE OR REPLACE FUNCTION bill_item_immutable() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    RAISE EXCEPTION 'bill item % cannot be deleted', OLD.id;
+  END IF;
+  IF OLD.voided_at IS NOT NULL AND NEW.voided_at IS DISTINCT FROM OLD.voided_at THEN
+    RAISE EXCEPTION 'bill item % is already voided', OLD.id;
+  END IF;
+  IF (NEW.bill_id, NEW.amount, NEW.currency, NEW.kind, NEW.adjusts_item_id, NEW.credit_note_id,
+      NEW.description, NEW.quantity, NEW.unit_price, NEW.unit_price_decimal, NEW.sku, NEW.service_period_start,
+      NEW.service_period_end, NEW.metadata, NEW.occurred_at, NEW.tax_category, NEW.recurring, NEW.created_at)
+    IS DISTINCT FROM
+     (OLD.bill_id, OLD.amount, OLD.currency, OLD.kind, OLD.adjusts_item_id, OLD.credit_note_id,
+      OLD.description, OLD.quantity, OLD.unit_price, OLD.unit_price_decimal, OLD.sku, OLD.service_period_start,
+      OLD.service_period_end, OLD.metadata, OLD.occurred_at, OLD.tax_category, OLD.recurring, OLD.created_at) THEN
+    RAISE EXCEPTION 'bill item % cannot be modified', OLD.id;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS invoice;
+DROP FUNCTION IF EXISTS invoice_immutable();
+DROP SEQUENCE IF EXISTS invoice_number_seq;
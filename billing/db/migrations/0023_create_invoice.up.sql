@@ -0,0 +1,22 @@
+CREATE SEQUENCE invoice_number_seq;
+
+-- invoice holds the documents of a closed bill as they were first rendered.
+CREATE TABLE invoice (
+  bill_id UUID PRIMARY KEY,
+  number TEXT NOT NULL UNIQUE,
+  html TEXT NOT NULL,
+  pdf BYTEA NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT now(),
+
+  FOREIGN KEY (bill_id) REFERENCES bill(id)
+);
+
+CREATE FUNCTION invoice_immutable() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'invoice % cannot be modified', OLD.number;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER invoice_immutable
+BEFORE UPDATE OR DELETE ON invoice
+FOR EACH ROW EXECUTE FUNCTION invoice_immutable();
@@ -0,0 +1,3 @@
+-- locked_until bounds how long a request holds a key it has not saved a
+-- response for. Keys held past it were left behind by a failed request.
+ALTER TABLE idempotency_key ADD COLUMN locked_until TIMESTAMP NOT NULL DEFAULT now();
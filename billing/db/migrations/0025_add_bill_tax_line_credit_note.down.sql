@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS bill_tax_line_closing_idx;
+DROP INDEX IF EXISTS bill_tax_line_credit_note_idx;
+
+ALTER TABLE bill_tax_line DISABLE TRIGGER bill_tax_line_immutable;
+DELETE FROM bill_tax_line WHERE credit_note_id IS NOT NULL;
+ALTER TABLE bill_tax_line ENABLE TRIGGER bill_tax_line_immutable;
+
+ALTER TABLE bill_tax_line
+  DROP COLUMN IF EXISTS credit_note_id,
+  ADD CONSTRAINT bill_tax_line_bill_id_currency_tax_category_key UNIQUE (bill_id, currency, tax_category);
@@ -0,0 +1,9 @@
+-- Credit notes take back the tax on their items with tax lines of their own,
+-- so a bill keeps one line per currency and tax category as it closed and
+-- one per credit note.
+ALTER TABLE bill_tax_line
+  ADD COLUMN credit_note_id UUID NULL REFERENCES credit_note(id),
+  DROP CONSTRAINT bill_tax_line_bill_id_currency_tax_category_key;
+
+CREATE UNIQUE INDEX bill_tax_line_closing_idx ON bill_tax_line (bill_id, currency, tax_category) WHERE credit_note_id IS NULL;
+CREATE UNIQUE INDEX bill_tax_line_credit_note_idx ON bill_tax_line (credit_note_id, currency, tax_category) WHERE credit_note_id IS NOT NULL;
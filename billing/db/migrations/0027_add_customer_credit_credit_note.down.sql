@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS customer_credit_credit_note_id_idx;
+ALTER TABLE customer_credit DROP COLUMN IF EXISTS credit_note_id;
@@ -0,0 +1,5 @@
+-- Credit notes on bills that were already paid give the excess back as
+-- customer credit. That credit is no longer counted as paid on the bill.
+ALTER TABLE customer_credit ADD COLUMN credit_note_id UUID NULL REFERENCES credit_note(id);
+
+CREATE INDEX customer_credit_credit_note_id_idx ON customer_credit (credit_note_id) WHERE credit_note_id IS NOT NULL;
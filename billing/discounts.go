@@ -0,0 +1,64 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+)
+
+type ListCouponsResponse struct {
+	Coupons []models.Coupon `json:"coupons"`
+}
+
+type PromotionRequest struct {
+	CouponCode string `json:"couponCode"`
+	// ValidFrom and ValidUntil narrow the validity of the coupon for this customer.
+	ValidFrom *time.Time `json:"validFrom,omitempty"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
+	// MaxRedemptions caps how many bills of the customer the promotion discounts. Zero means no limit.
+	MaxRedemptions int `json:"maxRedemptions"`
+}
+
+type ListPromotionsResponse struct {
+	Promotions []models.Promotion `json:"promotions"`
+}
+
+//encore:api private method=POST path=/admin/coupon
+func (s *Service) CreateCoupon(ctx context.Context, request models.Coupon) (*models.Coupon, error) {
+	coupon, err := workflows.CreateCoupon(ctx, request)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return coupon, nil
+}
+
+//encore:api private method=GET path=/admin/coupons
+func (s *Service) ListCoupons(ctx context.Context) (*ListCouponsResponse, error) {
+	coupons, err := workflows.ListCoupons(ctx)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListCouponsResponse{Coupons: coupons}, nil
+}
+
+// CreatePromotion grants a coupon to a customer. It discounts the customer's
+// bills as they close.
+//encore:api private method=POST path=/customer/:customerId/promotion
+func (s *Service) CreatePromotion(ctx context.Context, customerId string, request PromotionRequest) (*models.Promotion, error) {
+	promotion, err := workflows.CreatePromotion(ctx, customerId, request.CouponCode, request.ValidFrom, request.ValidUntil, request.MaxRedemptions)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return promotion, nil
+}
+
+//encore:api private method=GET path=/customer/:customerId/promotions
+func (s *Service) ListPromotions(ctx context.Context, customerId string) (*ListPromotionsResponse, error) {
+	promotions, err := workflows.ListPromotions(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListPromotionsResponse{Promotions: promotions}, nil
+}
@@ -0,0 +1,26 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+)
+
+type ListDunningEventsResponse struct {
+	Events []models.DunningEvent `json:"events"`
+}
+
+// ListDunningEvents returns the reminders and other dunning steps taken for an unpaid bill.
+//encore:api private method=GET path=/bill/:billId/dunning
+func (s *Service) ListDunningEvents(ctx context.Context, billId string) (*ListDunningEventsResponse, error) {
+	_, err := workflows.GetBillStatus(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	events, err := workflows.ListDunningEvents(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListDunningEventsResponse{Events: events}, nil
+}
@@ -0,0 +1,28 @@
+package billing
+
+import (
+	"errors"
+
+	"encore.dev/beta/errs"
+	"go.temporal.io/sdk/temporal"
+)
+
+// toAPIError maps the application error types raised by the workflows package to API error codes.
+func toAPIError(err error) error {
+	code := errs.InvalidArgument
+	var appErr *temporal.ApplicationError
+	if errors.As(err, &appErr) {
+		switch appErr.Type() {
+		case "NOT_FOUND":
+			code = errs.NotFound
+		case "FAILED-PRECONDITION":
+			code = errs.FailedPrecondition
+		case "DB-ERROR":
+			code = errs.Internal
+		}
+	}
+	return &errs.Error{
+		Code: code,
+		Message: err.Error(),
+	}
+}
@@ -0,0 +1,131 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"encore.app/billing/workflows"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+)
+
+// withIdempotency runs fn at most once per idempotency key within scope. Retries
+// carrying the same key and request replay the stored response instead.
+func withIdempotency[T any](ctx context.Context, scope string, key string, request interface{}, fn func() (*T, error)) (*T, error) {
+	if key == "" {
+		return fn()
+	}
+
+	requestHash, err := workflows.HashRequest(request)
+	if err != nil {
+		return nil, &errs.Error{
+			Code: errs.InvalidArgument,
+			Message: err.Error(),
+		}
+	}
+	record, err := workflows.ReserveIdempotencyKey(ctx, scope, key, requestHash)
+	if err != nil {
+		return nil, &errs.Error{
+			Code: errs.Internal,
+			Message: err.Error(),
+		}
+	}
+	if record != nil {
+		if record.RequestHash != requestHash {
+			return nil, &errs.Error{
+				Code: errs.InvalidArgument,
+				Message: "Idempotency-Key was already used for a different request.",
+			}
+		}
+		if record.Response == nil {
+			return nil, &errs.Error{
+				Code: errs.Aborted,
+				Message: "A request with this Idempotency-Key is still in progress.",
+			}
+		}
+		var response T
+		err = json.Unmarshal(record.Response, &response)
+		if err != nil {
+			return nil, &errs.Error{
+				Code: errs.Internal,
+				Message: err.Error(),
+			}
+		}
+		return &response, nil
+	}
+
+	response, err := runHoldingKey(ctx, scope, key, fn)
+	if err != nil {
+		releaseErr := workflows.ReleaseIdempotencyKey(ctx, scope, key)
+		if releaseErr != nil {
+			rlog.Error("Failed to release idempotency key", "scope", scope, "key", key, "err", releaseErr)
+		}
+		return nil, err
+	}
+
+	// The request has gone through, so the key stays held whatever happens:
+	// releasing it would let a retry run the request a second time.
+	for attempt := 1; ; attempt++ {
+		err = workflows.SaveIdempotentResponse(ctx, scope, key, response)
+		if err == nil {
+			break
+		}
+		if attempt == idempotentSaveAttempts {
+			// Retries are told the request is in progress until the lease runs
+			// out, and then run it again. Requests run under a key are written
+			// to resume what an earlier attempt did, rather than repeat it.
+			rlog.Error("Failed to store idempotent response", "scope", scope, "key", key, "err", err)
+			break
+		}
+		time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+	}
+	return response, nil
+}
+
+// idempotentSaveAttempts is how often storing a response is tried before giving up.
+const idempotentSaveAttempts = 3
+
+// runHoldingKey runs fn, renewing the lease of the key it runs under until fn returns.
+func runHoldingKey[T any](ctx context.Context, scope string, key string, fn func() (*T, error)) (*T, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(workflows.IdempotencyLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := workflows.RenewIdempotencyKey(ctx, scope, key)
+				if err != nil {
+					rlog.Error("Failed to renew idempotency key", "scope", scope, "key", key, "err", err)
+				}
+			}
+		}
+	}()
+	return fn()
+}
+
+// Nothing else deletes expired keys, as reserving a key only replaces an expired one with the same key.
+var _ = cron.NewJob("prune-idempotency-keys", cron.JobConfig{
+	Title:    "Delete expired idempotency keys",
+	Every:    1 * cron.Hour,
+	Endpoint: PruneIdempotencyKeys,
+})
+
+type PruneIdempotencyKeysResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+// PruneIdempotencyKeys deletes idempotency keys whose responses are no longer replayed.
+//encore:api private method=POST path=/admin/idempotency-keys/prune
+func PruneIdempotencyKeys(ctx context.Context) (*PruneIdempotencyKeysResponse, error) {
+	deleted, err := workflows.PruneIdempotencyKeys(ctx)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &PruneIdempotencyKeysResponse{Deleted: deleted}, nil
+}
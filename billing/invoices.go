@@ -0,0 +1,36 @@
+package billing
+
+import (
+	"net/http"
+	"strconv"
+
+	"encore.app/billing/workflows"
+	"encore.dev"
+	"encore.dev/beta/errs"
+)
+
+// GetInvoiceHTML serves the invoice of a closed bill as an HTML page.
+//encore:api private raw method=GET path=/bill/:billId/invoice.html
+func (s *Service) GetInvoiceHTML(w http.ResponseWriter, req *http.Request) {
+	invoice, err := workflows.GetInvoice(req.Context(), encore.CurrentRequest().PathParams.Get("billId"))
+	if err != nil {
+		errs.HTTPError(w, toAPIError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(invoice.Html))
+}
+
+// GetInvoicePDF serves the invoice of a closed bill as a PDF document.
+//encore:api private raw method=GET path=/bill/:billId/invoice.pdf
+func (s *Service) GetInvoicePDF(w http.ResponseWriter, req *http.Request) {
+	invoice, err := workflows.GetInvoice(req.Context(), encore.CurrentRequest().PathParams.Get("billId"))
+	if err != nil {
+		errs.HTTPError(w, toAPIError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="`+invoice.Number+`.pdf"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(invoice.Pdf)))
+	w.Write(invoice.Pdf)
+}
@@ -1,18 +1,142 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type BillItem struct {
 	Id string `json:"id"`
-	Amount int `json:"amount"`
+	// Amount is Quantity × UnitPrice in minor units. Items that only give an
+	// amount are a single unit at that price. Items priced with UnitPriceDecimal
+	// have Quantity × UnitPriceDecimal as amount, rounded per their currency.
+	Amount int64 `json:"amount"`
 	Currency string `json:"currency"`
+	Description string `json:"description"`
+	Quantity int64 `json:"quantity"`
+	UnitPrice int64 `json:"unitPrice"`
+	// UnitPriceDecimal is a unit price in minor units with up to 12 decimal
+	// places, e.g. "0.015" for usage priced below a cent. UnitPrice then holds
+	// it rounded to whole minor units.
+	UnitPriceDecimal string `json:"unitPriceDecimal,omitempty"`
+	// Sku identifies the product or fee code that was charged.
+	Sku string `json:"sku,omitempty"`
+	ServicePeriodStart *time.Time `json:"servicePeriodStart,omitempty"`
+	ServicePeriodEnd *time.Time `json:"servicePeriodEnd,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Kind is "charge" (the default) or "adjustment". Adjustments are negative
+	// and correct the charge given by AdjustsItemId.
+	Kind string `json:"kind"`
+	AdjustsItemId string `json:"adjustsItemId,omitempty"`
+	// CreditNoteId is set on adjustments issued after the bill closed.
+	CreditNoteId string `json:"creditNoteId,omitempty"`
+	// VoidedAt is set once an item has been voided. Voided items are kept for audit but excluded from totals.
+	VoidedAt *time.Time `json:"voidedAt,omitempty"`
+	// OccurredAt is when the charged usage happened. Items without it are taken to occur when they arrive.
+	OccurredAt *time.Time `json:"occurredAt,omitempty"`
+	// TaxCategory selects the tax rate of the item, TaxCategoryStandard by default.
+	TaxCategory string `json:"taxCategory,omitempty"`
+	// Recurring marks a fixed fee charged for the period of the bill. It is
+	// prorated when the bill is rescheduled, at the rate of Amount per
+	// service period, which recurring fees must give.
+	Recurring bool `json:"recurring,omitempty"`
+}
+
+const (
+	BillItemAccepted = "accepted"
+	BillItemRejected = "rejected"
+)
+
+// BillItemResult is the outcome of adding one item of a batch, in the order the items were sent.
+type BillItemResult struct {
+	// ItemId is set for accepted items.
+	ItemId string `json:"itemId,omitempty"`
+	// BillId is the bill the item was added to, which is the next period's
+	// for late items routed there during a grace period.
+	BillId string `json:"billId,omitempty"`
+	Status string `json:"status"`
+	Error string `json:"error,omitempty"`
+}
+
+type CreditNote struct {
+	Id string `json:"id"`
+	BillId string `json:"billId"`
+	Reason string `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+	BillItems []BillItem `json:"billItems"`
+}
+
+type Customer struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	Email string `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// SuspendedAt is set once dunning suspends the customer for an unpaid bill.
+	SuspendedAt *time.Time `json:"suspendedAt,omitempty"`
 }
 
 type Bill struct {
 	BillId string `json:"id"`
+	CustomerId string `json:"customerId"`
+	ScheduleId string `json:"scheduleId,omitempty"`
+	SettlementCurrency string `json:"settlementCurrency"`
 	CloseDate time.Time `json:"closeDate"`
+	// GracePeriodSeconds keeps the bill closing for this long after its close
+	// date, accepting late items that occurred before the close date.
+	GracePeriodSeconds int `json:"gracePeriodSeconds"`
 	Status string `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+	ClosedAt *time.Time `json:"closedAt,omitempty"`
+	// OverdueAt is set once dunning marks the bill as overdue.
+	OverdueAt *time.Time `json:"overdueAt,omitempty"`
 	BillItems []BillItem
+	// Totals per currency, excluding voided items. Only filled in when listing bills.
+	Totals []BillItemSummary `json:"totals,omitempty"`
+}
+
+// Bill statuses. A bill starts open and moves along the transitions allowed by
+// the workflows package; void, paid and written_off are final.
+const (
+	BillStatusOpen = "open"
+	// BillStatusClosing is a bill past its close date, still accepting late items.
+	BillStatusClosing = "closing"
+	BillStatusInvoiced = "invoiced"
+	BillStatusPartiallyPaid = "partially_paid"
+	BillStatusPaid = "paid"
+	BillStatusVoid = "void"
+	BillStatusWrittenOff = "written_off"
+)
+
+// How recurring fees are prorated when a bill is rescheduled: by the share of
+// seconds or of whole UTC days of their service period.
+const (
+	ProrateBySeconds = "seconds"
+	ProrateByDays = "days"
+)
+
+// BillStatusChange is one entry of a bill's status history.
+type BillStatusChange struct {
+	// FromStatus is empty for the bill being opened.
+	FromStatus string `json:"fromStatus,omitempty"`
+	ToStatus string `json:"toStatus"`
+	Reason string `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type BillingSchedule struct {
+	Id string `json:"id"`
+	CustomerId string `json:"customerId"`
+	// Period is one of "weekly", "monthly" or "custom".
+	Period string `json:"period"`
+	// IntervalDays is the period length for custom schedules.
+	IntervalDays int `json:"intervalDays,omitempty"`
+	// AnchorDate is the first close date; later close dates fall on the same weekday or day of month.
+	AnchorDate time.Time `json:"anchorDate"`
+	SettlementCurrency string `json:"settlementCurrency"`
+	// GracePeriodSeconds is given to every bill of the schedule.
+	GracePeriodSeconds int `json:"gracePeriodSeconds"`
+	Active bool `json:"active"`
 }
 
 type BillSummary struct {
@@ -21,10 +145,389 @@ type BillSummary struct {
 	Status string `json:"status"`
 	BillItems []BillItem `json:"billItems"`
 	BillItemSummary []BillItemSummary `json:"billItemSummary"`
+	CreditNotes []CreditNote `json:"creditNotes"`
+	SettlementCurrency string `json:"settlementCurrency"`
+	// ConvertedTotal is the grand total in the settlement currency, using the
+	// rates captured at close. It is nil if a rate is missing.
+	ConvertedTotal *int64 `json:"convertedTotal,omitempty"`
+	FormattedConvertedTotal string `json:"formattedConvertedTotal,omitempty"`
+	FxRates []FxRate `json:"fxRates"`
+	Discounts []DiscountLine `json:"discounts"`
+	TaxLines []TaxLine `json:"taxLines"`
+	Payments []Payment `json:"payments"`
+	Balances []BillBalance `json:"balances"`
+}
+
+// BillTotalDrift is a running bill total that no longer matches the items of its bill.
+type BillTotalDrift struct {
+	BillId string `json:"billId"`
+	Currency string `json:"currency"`
+	RecordedTotal int64 `json:"recordedTotal"`
+	ActualTotal int64 `json:"actualTotal"`
+	RecordedItemCount int `json:"recordedItemCount"`
+	ActualItemCount int `json:"actualItemCount"`
 }
 
 type BillItemSummary struct {
 	BillId string `json:"billId"`
-	TotalAmount int `json:"totalAmount"`
+	// TotalAmount is what the items come to, including tax charged on top of them.
+	TotalAmount int64 `json:"totalAmount"`
+	Currency string `json:"currency"`
+	FormattedTotal string `json:"formattedTotal"`
+	// DiscountAmount is taken off the items before tax. Subtotal and TaxAmount
+	// split TotalAmount into the discounted items before tax and their tax.
+	// These are only filled in for bill summaries.
+	DiscountAmount int64 `json:"discountAmount"`
+	FormattedDiscountAmount string `json:"formattedDiscountAmount,omitempty"`
+	Subtotal int64 `json:"subtotal"`
+	FormattedSubtotal string `json:"formattedSubtotal,omitempty"`
+	TaxAmount int64 `json:"taxAmount"`
+	FormattedTaxAmount string `json:"formattedTaxAmount,omitempty"`
+}
+
+type FxRate struct {
+	Base string `json:"base"`
+	Quote string `json:"quote"`
+	// Rate is the decimal value of one major unit of Base in major units of Quote.
+	Rate string `json:"rate"`
+	EffectiveAt time.Time `json:"effectiveAt"`
+	Source string `json:"source"`
+}
+
+// Coupon kinds.
+const (
+	CouponPercentage = "percentage"
+	CouponFixed = "fixed"
+)
+
+// Coupon defines a discount. Customers get it through a Promotion.
+type Coupon struct {
+	Id string `json:"id"`
+	Code string `json:"code"`
+	// Kind is CouponPercentage or CouponFixed.
+	Kind string `json:"kind"`
+	// PercentOff is the decimal percentage taken off percentage coupons, e.g. "12.5".
+	PercentOff string `json:"percentOff,omitempty"`
+	// AmountOff is taken off the Currency items of fixed coupons, in minor units.
+	AmountOff int64 `json:"amountOff,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	// Stackable coupons combine with other stackable coupons. Others only apply on their own.
+	Stackable bool `json:"stackable"`
+	ValidFrom *time.Time `json:"validFrom,omitempty"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
+	// MaxRedemptions caps how many bills the coupon discounts across all customers. Zero means no limit.
+	MaxRedemptions int `json:"maxRedemptions,omitempty"`
+	Redemptions int `json:"redemptions"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Promotion grants a coupon to a customer. It discounts the bills of the
+// customer that close within both its and the coupon's validity window.
+type Promotion struct {
+	Id string `json:"id"`
+	CustomerId string `json:"customerId"`
+	Coupon Coupon `json:"coupon"`
+	ValidFrom *time.Time `json:"validFrom,omitempty"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
+	// MaxRedemptions caps how many bills of the customer the promotion discounts. Zero means no limit.
+	MaxRedemptions int `json:"maxRedemptions,omitempty"`
+	Redemptions int `json:"redemptions"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DiscountLine is what a promotion took off the items of a closed bill in one currency.
+type DiscountLine struct {
+	Id string `json:"id"`
+	PromotionId string `json:"promotionId"`
+	CouponCode string `json:"couponCode"`
+	Currency string `json:"currency"`
+	// Amount is positive and reduces the bill total.
+	Amount int64 `json:"amount"`
+	FormattedAmount string `json:"formattedAmount"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const TaxCategoryStandard = "standard"
+
+// TaxRate is a rule of the tax table: the rate charged on items of a tax
+// category in a jurisdiction from EffectiveAt on.
+type TaxRate struct {
+	Jurisdiction string `json:"jurisdiction"`
+	TaxCategory string `json:"taxCategory"`
+	// Rate is a decimal fraction, e.g. "0.18" for 18%.
+	Rate string `json:"rate"`
+	// Inclusive rates are already part of item prices. Exclusive rates are charged on top of them.
+	Inclusive bool `json:"inclusive"`
+	EffectiveAt time.Time `json:"effectiveAt"`
+}
+
+// CustomerTaxProfile says where a customer is taxed and what it is exempt from.
+type CustomerTaxProfile struct {
+	CustomerId string `json:"customerId"`
+	// Jurisdiction is empty for customers that are not taxed.
+	Jurisdiction string `json:"jurisdiction"`
+	Exemptions []TaxExemption `json:"exemptions"`
+}
+
+// TaxExemption exempts a customer from the tax of one category, or of all
+// categories if TaxCategory is empty.
+type TaxExemption struct {
+	TaxCategory string `json:"taxCategory"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// TaxLine is the tax on the items of a closed bill in one currency and tax category.
+type TaxLine struct {
+	Id string `json:"id"`
+	Currency string `json:"currency"`
+	Jurisdiction string `json:"jurisdiction"`
+	TaxCategory string `json:"taxCategory"`
+	Rate string `json:"rate"`
+	Inclusive bool `json:"inclusive"`
+	// TaxableAmount is the amount taxed, excluding the tax also for inclusive rates.
+	TaxableAmount int64 `json:"taxableAmount"`
+	TaxAmount int64 `json:"taxAmount"`
+	FormattedTaxAmount string `json:"formattedTaxAmount"`
+	// CreditNoteId is set on lines that take back the tax on the items of a
+	// credit note. Their amounts are negative.
+	CreditNoteId string `json:"creditNoteId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Pricing models of the price book.
+const (
+	// PricingFlat charges every unit at UnitPrice.
+	PricingFlat = "flat"
+	// PricingTiered charges the units within each tier at the price of that tier.
+	PricingTiered = "tiered"
+	// PricingVolume charges all units at the price of the tier the total falls in.
+	PricingVolume = "volume"
+	// PricingPackage charges UnitPrice for every started package of PackageSize units.
+	PricingPackage = "package"
+)
+
+// MeterPrice is the entry of the price book that rates the usage of a meter.
+type MeterPrice struct {
+	Meter string `json:"meter"`
+	// Description is given to the items rated from the meter.
+	Description string `json:"description"`
+	Currency string `json:"currency"`
+	// Model is PricingFlat, PricingTiered, PricingVolume or PricingPackage.
+	Model string `json:"model"`
+	// UnitPrice is the decimal price in minor units of a unit of flat prices
+	// or of a package of package prices.
+	UnitPrice string `json:"unitPrice,omitempty"`
+	PackageSize int64 `json:"packageSize,omitempty"`
+	// Tiers of tiered and volume prices, in ascending order.
+	Tiers []PriceTier `json:"tiers,omitempty"`
+	Sku string `json:"sku,omitempty"`
+	TaxCategory string `json:"taxCategory,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// PriceTier prices the units up to and including UpTo. The last tier has no UpTo.
+type PriceTier struct {
+	UpTo int64 `json:"upTo,omitempty"`
+	// UnitPrice is the decimal price of a unit in minor units.
+	UnitPrice string `json:"unitPrice"`
+}
+
+// UsageEvent is a metered quantity reported for a customer.
+type UsageEvent struct {
+	// Id is given by the reporter and deduplicates the events of a customer.
+	Id string `json:"id"`
+	CustomerId string `json:"customerId"`
+	Meter string `json:"meter"`
+	Quantity int64 `json:"quantity"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Properties map[string]string `json:"properties,omitempty"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	// RatingId is set once the event has been rated into a bill.
+	RatingId string `json:"ratingId,omitempty"`
+}
+
+// UsageRating records the events of a meter that were rated into a bill and
+// the items they were charged as. Items rated at no charge are not added.
+type UsageRating struct {
+	Id string `json:"id"`
+	BillId string `json:"billId"`
+	Meter string `json:"meter"`
+	Quantity int64 `json:"quantity"`
+	EventCount int `json:"eventCount"`
+	ItemIds []string `json:"itemIds"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// What happens to items that would take a bill over its spending cap.
+const (
+	CapReject = "reject"
+	// CapFlag accepts the items with metadata "capExceeded" set to "true".
+	CapFlag = "flag"
+)
+
+// Commitment is the minimum charge and spending cap of a contract in one
+// currency. It applies to all bills of a customer, or to a single bill, in
+// which case it replaces the customer's.
+type Commitment struct {
+	Id string `json:"id"`
+	// Either CustomerId or BillId is set.
+	CustomerId string `json:"customerId,omitempty"`
+	BillId string `json:"billId,omitempty"`
+	Currency string `json:"currency"`
+	// MinimumAmount is charged at least: a true-up item makes up the
+	// difference when a bill closes below it. Zero means no minimum.
+	MinimumAmount int64 `json:"minimumAmount"`
+	// CapAmount is the most the items of a bill may add up to. Zero means no cap.
+	CapAmount int64 `json:"capAmount"`
+	// CapMode is CapReject (the default) or CapFlag.
+	CapMode string `json:"capMode"`
+	// AlertThresholds are percentages of the cap that raise an alert once
+	// the bill reaches them, e.g. [80, 100].
+	AlertThresholds []int `json:"alertThresholds"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SpendAlert reports that the items of a bill reached a threshold of its
+// spending cap, or went over it.
+type SpendAlert struct {
+	Currency string `json:"currency"`
+	// Threshold is the percentage of the cap reached. It is zero for items going over a flagging cap.
+	Threshold int `json:"threshold,omitempty"`
+	CapAmount int64 `json:"capAmount"`
+	TotalAmount int64 `json:"totalAmount"`
+}
+
+type Currency struct {
+	// Code is the ISO 4217 currency code.
+	Code string `json:"code"`
+	// Exponent is the number of minor units per major unit as a power of ten, e.g. 2 for cents.
+	Exponent int `json:"exponent"`
+	Symbol string `json:"symbol"`
+	Enabled bool `json:"enabled"`
+	// RoundingMode is RoundHalfEven (the default) or RoundHalfUp. It applies
+	// whenever an amount in this currency is computed with fractions of a
+	// minor unit, e.g. decimal unit prices and converted totals.
+	RoundingMode string `json:"roundingMode"`
+}
+
+// Format renders an amount in minor units for display, e.g. 123456 USD as "$1234.56".
+func (c Currency) Format(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if c.Exponent == 0 {
+		return fmt.Sprintf("%s%s%d", sign, c.Symbol, amount)
+	}
+	digits := fmt.Sprintf("%0*d", c.Exponent+1, amount)
+	split := len(digits) - c.Exponent
+	return fmt.Sprintf("%s%s%s.%s", sign, c.Symbol, digits[:split], digits[split:])
+}
+
+const (
+	EventBillCreated = "bill.created"
+	EventBillItemAdded = "bill.item_added"
+	EventBillItemFailed = "bill.item_failed"
+	EventBillClosed = "bill.closed"
+	EventBillReminder = "bill.reminder"
+	EventBillOverdue = "bill.overdue"
+	EventBillSuspended = "bill.suspended"
+	EventBillCapApproaching = "bill.cap_approaching"
+	EventBillCapExceeded = "bill.cap_exceeded"
+)
+
+// BillEvent describes something that happened to a bill. It is the payload
+// delivered to webhook endpoints.
+type BillEvent struct {
+	Id string `json:"id"`
+	Type string `json:"type"`
+	BillId string `json:"billId"`
+	CustomerId string `json:"customerId"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Item is set for item events.
+	Item *BillItem `json:"item,omitempty"`
+	// Error explains why an item failed.
+	Error string `json:"error,omitempty"`
+	// Dunning is set for dunning events.
+	Dunning *DunningEvent `json:"dunning,omitempty"`
+	// SpendAlert is set for spending cap events.
+	SpendAlert *SpendAlert `json:"spendAlert,omitempty"`
+}
+
+// DunningEvent records a step of the dunning schedule taken for an unpaid bill.
+type DunningEvent struct {
+	Step int `json:"step"`
+	// Action is one of "remind", "overdue" or "suspend".
+	Action string `json:"action"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type WebhookEndpoint struct {
+	Id string `json:"id"`
+	CustomerId string `json:"customerId"`
+	Url string `json:"url"`
+	// Secret signs deliveries to this endpoint. It is only returned when the
+	// endpoint is created.
+	Secret string `json:"secret,omitempty"`
+	// EventTypes the endpoint receives. Empty means all of them.
+	EventTypes []string `json:"eventTypes"`
+	Active bool `json:"active"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type WebhookDelivery struct {
+	Id string `json:"id"`
+	EndpointId string `json:"endpointId"`
+	EventId string `json:"eventId"`
+	EventType string `json:"eventType"`
+	// Status is one of "pending", "delivered" or "failed".
+	Status string `json:"status"`
+	Attempts int `json:"attempts"`
+	ResponseStatus *int `json:"responseStatus,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+}
+
+type Payment struct {
+	Id string `json:"id"`
+	BillId string `json:"billId"`
+	Amount int64 `json:"amount"`
+	Currency string `json:"currency"`
+	// AppliedAmount is the part of Amount that settled the bill. Any excess became customer credit.
+	AppliedAmount int64 `json:"appliedAmount"`
+	// Method is how the customer paid, e.g. "card" or "bank_transfer".
+	Method string `json:"method"`
+	// ExternalReference identifies the payment with the provider. A reference is only recorded once per bill.
+	ExternalReference string `json:"externalReference,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Invoice is the customer-facing document of a closed bill. It is rendered
+// once, numbered, and served as stored from then on.
+type Invoice struct {
+	BillId string `json:"billId"`
+	Number string `json:"number"`
+	Html string `json:"-"`
+	Pdf []byte `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// BillBalance is what is left to pay on a bill in one currency.
+type BillBalance struct {
+	Currency string `json:"currency"`
+	Total int64 `json:"total"`
+	Paid int64 `json:"paid"`
+	Outstanding int64 `json:"outstanding"`
+	FormattedOutstanding string `json:"formattedOutstanding"`
+}
+
+// CustomerCredit is a customer's credit balance in one currency.
+type CustomerCredit struct {
 	Currency string `json:"currency"`
+	Amount int64 `json:"amount"`
+	FormattedAmount string `json:"formattedAmount"`
 }
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCurrency_Format(t *testing.T) {
+	usd := Currency{Code: "USD", Exponent: 2, Symbol: "$"}
+	require.Equal(t, "$1234.56", usd.Format(123456))
+	require.Equal(t, "$0.05", usd.Format(5))
+	require.Equal(t, "-$1.00", usd.Format(-100))
+
+	jpy := Currency{Code: "JPY", Exponent: 0, Symbol: "¥"}
+	require.Equal(t, "¥500", jpy.Format(500))
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// Rounding modes for amounts computed with fractions of a minor unit.
+const (
+	// RoundHalfEven rounds halves to the nearest even number, also known as banker's rounding.
+	RoundHalfEven = "half_even"
+	// RoundHalfUp rounds halves away from zero.
+	RoundHalfUp = "half_up"
+)
+
+var ErrAmountOverflow = errors.New("amount overflows")
+
+var ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+
+// decimalPattern matches the decimals accepted for unit prices, which are stored as NUMERIC(38, 12).
+var decimalPattern = regexp.MustCompile(`^-?[0-9]{1,26}(\.[0-9]{1,12})?$`)
+
+// Money is an amount in minor units of a currency, e.g. cents.
+type Money struct {
+	Amount int64 `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	amount, err := AddAmounts(m.Amount, other.Amount)
+	return Money{Amount: amount, Currency: m.Currency}, err
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if other.Amount == math.MinInt64 {
+		return Money{}, ErrAmountOverflow
+	}
+	return m.Add(Money{Amount: -other.Amount, Currency: other.Currency})
+}
+
+// Mul multiplies the amount by a whole quantity.
+func (m Money) Mul(quantity int64) (Money, error) {
+	amount, err := MulAmounts(m.Amount, quantity)
+	return Money{Amount: amount, Currency: m.Currency}, err
+}
+
+// AddAmounts adds two amounts in minor units, failing instead of wrapping around.
+func AddAmounts(a int64, b int64) (int64, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, ErrAmountOverflow
+	}
+	return a + b, nil
+}
+
+// MulAmounts multiplies two amounts in minor units, failing instead of wrapping around.
+func MulAmounts(a int64, b int64) (int64, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+	product := a * b
+	if product/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, ErrAmountOverflow
+	}
+	return product, nil
+}
+
+// ParseDecimal parses a plain decimal number such as "0.015".
+func ParseDecimal(value string) (*big.Rat, bool) {
+	if !decimalPattern.MatchString(value) {
+		return nil, false
+	}
+	return new(big.Rat).SetString(value)
+}
+
+// FormatDecimal renders a decimal parsed by ParseDecimal without trailing zeros.
+func FormatDecimal(value *big.Rat) string {
+	formatted := value.FloatString(12)
+	formatted = strings.TrimRight(formatted, "0")
+	return strings.TrimSuffix(formatted, ".")
+}
+
+// Round rounds a number of minor units to a whole number using the given
+// rounding mode. Unknown modes round half to even.
+func Round(value *big.Rat, mode string) (int64, error) {
+	remainder := new(big.Int)
+	quotient, remainder := new(big.Int).QuoRem(value.Num(), value.Denom(), remainder)
+	// Compare the remainder with half of the denominator.
+	twice := new(big.Int).Lsh(new(big.Int).Abs(remainder), 1)
+	switch cmp := twice.Cmp(value.Denom()); {
+	case cmp > 0, cmp == 0 && (mode == RoundHalfUp || quotient.Bit(0) == 1):
+		quotient.Add(quotient, big.NewInt(int64(value.Sign())))
+	}
+	if !quotient.IsInt64() {
+		return 0, ErrAmountOverflow
+	}
+	return quotient.Int64(), nil
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMoney_Arithmetic(t *testing.T) {
+	sum, err := Money{Amount: 150, Currency: "USD"}.Add(Money{Amount: 50, Currency: "USD"})
+	require.NoError(t, err)
+	require.Equal(t, Money{Amount: 200, Currency: "USD"}, sum)
+
+	_, err = Money{Amount: 150, Currency: "USD"}.Add(Money{Amount: 50, Currency: "GEL"})
+	require.ErrorIs(t, err, ErrCurrencyMismatch)
+
+	_, err = Money{Amount: math.MaxInt64, Currency: "USD"}.Add(Money{Amount: 1, Currency: "USD"})
+	require.ErrorIs(t, err, ErrAmountOverflow)
+	_, err = Money{Amount: math.MinInt64, Currency: "USD"}.Sub(Money{Amount: 1, Currency: "USD"})
+	require.ErrorIs(t, err, ErrAmountOverflow)
+
+	product, err := Money{Amount: -25, Currency: "USD"}.Mul(4)
+	require.NoError(t, err)
+	require.Equal(t, int64(-100), product.Amount)
+	_, err = Money{Amount: math.MaxInt64 / 2, Currency: "USD"}.Mul(3)
+	require.ErrorIs(t, err, ErrAmountOverflow)
+	_, err = MulAmounts(math.MinInt64, -1)
+	require.ErrorIs(t, err, ErrAmountOverflow)
+}
+
+func TestRound(t *testing.T) {
+	cases := []struct {
+		value string
+		halfEven int64
+		halfUp int64
+	}{
+		{"2.5", 2, 3},
+		{"3.5", 4, 4},
+		{"-2.5", -2, -3},
+		{"2.4999", 2, 2},
+		{"2.5001", 3, 3},
+		{"-0.5", 0, -1},
+		{"7", 7, 7},
+	}
+	for _, c := range cases {
+		value, ok := ParseDecimal(c.value)
+		require.True(t, ok, c.value)
+		rounded, err := Round(value, RoundHalfEven)
+		require.NoError(t, err)
+		require.Equal(t, c.halfEven, rounded, c.value)
+		rounded, err = Round(value, RoundHalfUp)
+		require.NoError(t, err)
+		require.Equal(t, c.halfUp, rounded, c.value)
+	}
+
+	_, err := Round(new(big.Rat).SetFloat64(1e20), RoundHalfEven)
+	require.ErrorIs(t, err, ErrAmountOverflow)
+}
+
+func TestParseDecimal(t *testing.T) {
+	value, ok := ParseDecimal("0.015000")
+	require.True(t, ok)
+	require.Equal(t, "0.015", FormatDecimal(value))
+
+	for _, invalid := range []string{"", "1e-3", ".5", "1.", "0.0000000000001", "1/3"} {
+		_, ok := ParseDecimal(invalid)
+		require.False(t, ok, invalid)
+	}
+}
@@ -0,0 +1,34 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/workflows"
+	"encore.dev/cron"
+)
+
+// Events are normally published as soon as their transaction commits. This
+// job catches up on any that were not, e.g. because Pub/Sub was unavailable.
+var _ = cron.NewJob("publish-outbox", cron.JobConfig{
+	Title:    "Publish pending bill events",
+	Every:    1 * cron.Minute,
+	Endpoint: PublishOutbox,
+})
+
+type PublishOutboxResponse struct {
+	Published int `json:"published"`
+}
+
+// PublishOutbox publishes bill events still waiting in the outbox.
+//encore:api private method=POST path=/admin/outbox/publish
+func PublishOutbox(ctx context.Context) (*PublishOutboxResponse, error) {
+	published, err := workflows.PublishOutboxEvents(ctx)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	err = workflows.PruneOutbox(ctx)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &PublishOutboxResponse{Published: published}, nil
+}
@@ -0,0 +1,99 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+	"encore.dev/rlog"
+)
+
+type RecordPaymentRequest struct {
+	IdempotencyKey string `header:"Idempotency-Key" json:"-"`
+	Amount int64 `json:"amount"`
+	Currency string `json:"currency"`
+	// Method is how the customer paid, e.g. "card" or "bank_transfer".
+	Method string `json:"method"`
+	// ExternalReference is the payment's ID with the provider. A reference is only recorded once per bill.
+	ExternalReference string `json:"externalReference"`
+}
+
+type RecordPaymentResponse struct {
+	Payment *models.Payment `json:"payment"`
+	Status string `json:"status"`
+	Balances []models.BillBalance `json:"balances"`
+}
+
+type ListPaymentsResponse struct {
+	Payments []models.Payment `json:"payments"`
+	Balances []models.BillBalance `json:"balances"`
+}
+
+type CustomerCreditResponse struct {
+	Credits []models.CustomerCredit `json:"credits"`
+}
+
+// RecordPayment records a payment against an invoiced bill. Paying more than
+// is outstanding in the payment's currency leaves the excess as customer credit.
+//encore:api private method=POST path=/bill/:billId/payments
+func (s *Service) RecordPayment(ctx context.Context, billId string, request RecordPaymentRequest) (*RecordPaymentResponse, error) {
+	return withIdempotency(ctx, "record_payment:"+billId, request.IdempotencyKey, request, func() (*RecordPaymentResponse, error) {
+		result, err := workflows.RecordPayment(ctx, billId, models.Payment{
+			Amount: request.Amount,
+			Currency: request.Currency,
+			Method: request.Method,
+			ExternalReference: request.ExternalReference,
+		})
+		if err != nil {
+			return nil, toAPIError(err)
+		}
+		s.signalBill(ctx, billId, workflows.SignalPaymentReceived, result.Payment)
+		return &RecordPaymentResponse{Payment: result.Payment, Status: result.Status, Balances: result.Balances}, nil
+	})
+}
+
+//encore:api private method=GET path=/bill/:billId/payments
+func (s *Service) ListPayments(ctx context.Context, billId string) (*ListPaymentsResponse, error) {
+	_, err := workflows.GetBillStatus(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	payments, err := workflows.ListPayments(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	balances, err := workflows.GetBillBalances(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListPaymentsResponse{Payments: payments, Balances: balances}, nil
+}
+
+// GetCustomerCredit returns the credit a customer has left from overpayments.
+// Credit pays the customer's bills as they close, as payments with the
+// "credit" method.
+//encore:api private method=GET path=/customer/:customerId/credit
+func (s *Service) GetCustomerCredit(ctx context.Context, customerId string) (*CustomerCreditResponse, error) {
+	_, err := workflows.GetCustomer(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	credits, err := workflows.GetCustomerCredit(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &CustomerCreditResponse{Credits: credits}, nil
+}
+
+// signalBill lets the workflow of a bill know that the bill changed. The
+// database stays the source of truth, so a workflow that has already finished
+// is not an error.
+func (s *Service) signalBill(ctx context.Context, billId string, signalName string, arg interface{}) {
+	workflowId, err := workflows.GetBillWorkflowId(ctx, billId)
+	if err == nil {
+		err = s.Client.SignalWorkflow(ctx, workflowId, "", signalName, arg)
+	}
+	if err != nil {
+		rlog.Warn("could not signal bill workflow", "billId", billId, "signal", signalName, "error", err)
+	}
+}
@@ -0,0 +1,76 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+	"encore.dev/beta/errs"
+	"go.temporal.io/sdk/client"
+)
+
+type CreateBillingScheduleRequest struct {
+	// Period is one of "weekly", "monthly" or "custom".
+	Period string `json:"period"`
+	IntervalDays int `json:"intervalDays"`
+	AnchorDate time.Time `json:"anchorDate"`
+	SettlementCurrency string `json:"settlementCurrency"`
+	// GracePeriodSeconds is given to every bill of the schedule, see CreateBillRequest.
+	GracePeriodSeconds int `json:"gracePeriodSeconds"`
+}
+
+type CreateBillingScheduleResponse struct {
+	Schedule *models.BillingSchedule `json:"schedule"`
+	BillId string `json:"billId"`
+}
+
+type ListBillingSchedulesResponse struct {
+	Schedules []models.BillingSchedule `json:"schedules"`
+}
+
+// CreateBillingSchedule creates a recurring schedule and opens its first bill.
+// Closing a bill of the schedule automatically opens the next one.
+//encore:api private method=POST path=/customer/:customerId/schedule
+func (s *Service) CreateBillingSchedule(ctx context.Context, customerId string, request CreateBillingScheduleRequest) (*CreateBillingScheduleResponse, error) {
+	schedule, err := workflows.CreateBillingSchedule(ctx, customerId, request.Period, request.IntervalDays, request.AnchorDate, request.SettlementCurrency, request.GracePeriodSeconds)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	bill, err := workflows.CreateScheduledBill(ctx, schedule.Id, time.Now())
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+
+	options := client.StartWorkflowOptions{
+		ID:        workflows.ScheduleWorkflowId(customerId, schedule.Id),
+		TaskQueue: billingTaskQueue,
+	}
+	_, err = s.Client.ExecuteWorkflow(ctx, options, workflows.ComposeBill, bill)
+	if err != nil {
+		return nil, &errs.Error{
+			Code: errs.Internal,
+			Message: err.Error(),
+		}
+	}
+	return &CreateBillingScheduleResponse{Schedule: schedule, BillId: bill.BillId}, nil
+}
+
+//encore:api private method=GET path=/customer/:customerId/schedules
+func (s *Service) ListBillingSchedules(ctx context.Context, customerId string) (*ListBillingSchedulesResponse, error) {
+	schedules, err := workflows.ListBillingSchedules(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListBillingSchedulesResponse{Schedules: schedules}, nil
+}
+
+// DeactivateBillingSchedule stops a schedule after its current bill closes.
+//encore:api private method=DELETE path=/customer/:customerId/schedule/:scheduleId
+func (s *Service) DeactivateBillingSchedule(ctx context.Context, customerId string, scheduleId string) (*Response, error) {
+	err := workflows.DeactivateBillingSchedule(ctx, customerId, scheduleId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &Response{Message: "Billing schedule deactivated."}, nil
+}
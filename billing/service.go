@@ -4,6 +4,7 @@ package billing
 import (
 	"context"
 	"fmt"
+	"os"
 
 	"encore.app/billing/workflows"
 	"encore.dev"
@@ -27,17 +28,57 @@ func initService() (*Service, error) {
 		return nil, fmt.Errorf("create temporal client: %v", err)
 	}
 
+	err = workflows.Currencies.Load(context.Background())
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("load currencies: %v", err)
+	}
+
+	// Local setups can point at a JSON file of rates instead of the fx_rate table.
+	if path := os.Getenv("FX_RATES_FILE"); path != "" {
+		workflows.Rates = workflows.FileRateSource{Path: path}
+	}
+
+	if value := os.Getenv("INVOICE_PAYMENT_INSTRUCTIONS"); value != "" {
+		workflows.InvoicePaymentInstructions = value
+	}
+
+	// e.g. "3d:remind,7d:remind,14d:remind,21d:overdue,30d:suspend"
+	if value := os.Getenv("DUNNING_SCHEDULE"); value != "" {
+		schedule, err := workflows.ParseDunningSchedule(value)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("parse dunning schedule: %v", err)
+		}
+		workflows.DunningSchedule = schedule
+	}
+
 	w := worker.New(c, billingTaskQueue, worker.Options{})
 	// Workflows
 	w.RegisterWorkflow(workflows.ComposeBill)
+	w.RegisterWorkflow(workflows.DeliverWebhook)
+	w.RegisterWorkflow(workflows.SettleBill)
 	
 	// Activities
 	w.RegisterActivity(workflows.CloseBill)
+	w.RegisterActivity(workflows.RateUsage)
 	w.RegisterActivity(workflows.CreateBill)
 	w.RegisterActivity(workflows.AddBillItem)
+	w.RegisterActivity(workflows.AddBillItemBatch)
+	w.RegisterActivity(workflows.VoidBillItem)
+	w.RegisterActivity(workflows.RescheduleBill)
 	w.RegisterActivity(workflows.GetBill)
 	w.RegisterActivity(workflows.GetBillSummary)
 	w.RegisterActivity(workflows.CheckOpenBill)
+	w.RegisterActivity(workflows.TransitionBill)
+	w.RegisterActivity(workflows.GetBillStatus)
+	w.RegisterActivity(workflows.SetBillWorkflowId)
+	w.RegisterActivity(workflows.RecordDunningStep)
+	w.RegisterActivity(workflows.CreateScheduledBill)
+	w.RegisterActivity(workflows.RecordWebhookEvent)
+	w.RegisterActivity(workflows.RecordWebhookEvents)
+	w.RegisterActivity(workflows.DeliverWebhookAttempt)
+	w.RegisterActivity(workflows.MarkWebhookDeliveryFailed)
 
 	err = w.Start()
 	if err != nil {
@@ -0,0 +1,130 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+	"encore.dev/beta/errs"
+	"go.temporal.io/sdk/client"
+)
+
+type BillStatusRequest struct {
+	Reason string `json:"reason"`
+}
+
+type RescheduleBillRequest struct {
+	CloseDate time.Time `json:"closeDate"`
+	// ProrationMethod measures the periods recurring fees are prorated over,
+	// "days" (the default) or "seconds".
+	ProrationMethod string `json:"prorationMethod"`
+}
+
+type RescheduleBillResponse struct {
+	// Prorations are the items added to move recurring fees to the new period.
+	Prorations []models.BillItem `json:"prorations"`
+}
+
+type BillStatusHistoryResponse struct {
+	History []models.BillStatusChange `json:"history"`
+}
+
+// VoidBill cancels a bill. Open bills stop accepting items and are never invoiced.
+//encore:api private method=POST path=/bill/:billId/void
+func (s *Service) VoidBill(ctx context.Context, billId string, request BillStatusRequest) (*Response, error) {
+	status, err := workflows.GetBillStatus(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	if status != models.BillStatusOpen && status != models.BillStatusClosing {
+		// The bill is no longer being composed, so it is updated directly.
+		err = workflows.TransitionBill(ctx, billId, models.BillStatusVoid, request.Reason)
+		if err != nil {
+			return nil, toAPIError(err)
+		}
+		s.signalBill(ctx, billId, workflows.SignalBillStatusChanged, nil)
+		return &Response{Message: "Bill voided."}, nil
+	}
+
+	workflowId, err := workflows.GetBillWorkflowId(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	updateHandle, err := s.Client.UpdateWorkflow(ctx, client.UpdateWorkflowOptions{
+		WorkflowID: workflowId,
+		UpdateName: workflows.UpdateVoidBill,
+		Args: []interface{}{billId, request.Reason},
+		WaitForStage: client.WorkflowUpdateStageCompleted,
+	})
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	err = updateHandle.Get(ctx, nil)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &Response{Message: "Bill voided."}, nil
+}
+
+// RescheduleBill moves the close date of an open bill and prorates its recurring fees.
+//encore:api private method=POST path=/bill/:billId/reschedule
+func (s *Service) RescheduleBill(ctx context.Context, billId string, request RescheduleBillRequest) (*RescheduleBillResponse, error) {
+	if request.ProrationMethod == "" {
+		request.ProrationMethod = models.ProrateByDays
+	}
+	status, err := workflows.GetBillStatus(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	if status != models.BillStatusOpen {
+		// Closed bills of a schedule share their workflow with the open bill of the next period.
+		return nil, &errs.Error{
+			Code: errs.FailedPrecondition,
+			Message: "Only open bills can be rescheduled, this one is " + status,
+		}
+	}
+	workflowId, err := workflows.GetBillWorkflowId(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	updateHandle, err := s.Client.UpdateWorkflow(ctx, client.UpdateWorkflowOptions{
+		WorkflowID: workflowId,
+		UpdateName: workflows.UpdateRescheduleBill,
+		Args: []interface{}{billId, request.CloseDate, request.ProrationMethod},
+		WaitForStage: client.WorkflowUpdateStageCompleted,
+	})
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	var prorations []models.BillItem
+	err = updateHandle.Get(ctx, &prorations)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &RescheduleBillResponse{Prorations: prorations}, nil
+}
+
+// WriteOffBill gives up on collecting an invoiced bill.
+//encore:api private method=POST path=/bill/:billId/write-off
+func (s *Service) WriteOffBill(ctx context.Context, billId string, request BillStatusRequest) (*Response, error) {
+	err := workflows.TransitionBill(ctx, billId, models.BillStatusWrittenOff, request.Reason)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	s.signalBill(ctx, billId, workflows.SignalBillStatusChanged, nil)
+	return &Response{Message: "Bill written off."}, nil
+}
+
+//encore:api private method=GET path=/bill/:billId/history
+func (s *Service) GetBillStatusHistory(ctx context.Context, billId string) (*BillStatusHistoryResponse, error) {
+	_, err := workflows.GetBillStatus(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	history, err := workflows.ListBillStatusHistory(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &BillStatusHistoryResponse{History: history}, nil
+}
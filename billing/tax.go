@@ -0,0 +1,53 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+)
+
+type CustomerTaxProfileRequest struct {
+	// Jurisdiction is where the customer is taxed, e.g. "GE" or "US-CA". Leave it empty for customers that are not taxed.
+	Jurisdiction string `json:"jurisdiction"`
+	Exemptions []models.TaxExemption `json:"exemptions"`
+}
+
+// SaveTaxRate adds a rule to the tax table. A rule with the same jurisdiction,
+// tax category and effective time is replaced.
+//encore:api private method=POST path=/admin/tax-rate
+func (s *Service) SaveTaxRate(ctx context.Context, request models.TaxRate) (*models.TaxRate, error) {
+	rate, err := workflows.SaveTaxRate(ctx, request)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return rate, nil
+}
+
+//encore:api private method=GET path=/customer/:customerId/tax-profile
+func (s *Service) GetCustomerTaxProfile(ctx context.Context, customerId string) (*models.CustomerTaxProfile, error) {
+	_, err := workflows.GetCustomer(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	profile, err := workflows.GetCustomerTaxProfile(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return profile, nil
+}
+
+// SaveCustomerTaxProfile sets where a customer is taxed and what it is exempt
+// from. It applies to bills closing from now on.
+//encore:api private method=PUT path=/customer/:customerId/tax-profile
+func (s *Service) SaveCustomerTaxProfile(ctx context.Context, customerId string, request CustomerTaxProfileRequest) (*models.CustomerTaxProfile, error) {
+	profile, err := workflows.SaveCustomerTaxProfile(ctx, models.CustomerTaxProfile{
+		CustomerId: customerId,
+		Jurisdiction: request.Jurisdiction,
+		Exemptions: request.Exemptions,
+	})
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return profile, nil
+}
@@ -0,0 +1,31 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+	"encore.dev/cron"
+)
+
+// Bill totals are kept up to date as items are added and voided. This job
+// checks them against the items themselves and reports any drift.
+var _ = cron.NewJob("reconcile-bill-totals", cron.JobConfig{
+	Title:    "Reconcile bill totals with their items",
+	Every:    24 * cron.Hour,
+	Endpoint: ReconcileBillTotals,
+})
+
+type ReconcileBillTotalsResponse struct {
+	Drifts []models.BillTotalDrift `json:"drifts"`
+}
+
+// ReconcileBillTotals lists the bill totals that no longer match their items.
+//encore:api private method=POST path=/admin/bill-totals/reconcile
+func ReconcileBillTotals(ctx context.Context) (*ReconcileBillTotalsResponse, error) {
+	drifts, err := workflows.ReconcileBillTotals(ctx)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ReconcileBillTotalsResponse{Drifts: drifts}, nil
+}
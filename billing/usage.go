@@ -0,0 +1,87 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+)
+
+type RecordUsageRequest struct {
+	Events []models.UsageEvent `json:"events"`
+}
+
+type RecordUsageResponse struct {
+	// Recorded counts the new events. Events sent before are not recorded again.
+	Recorded int `json:"recorded"`
+	Duplicates int `json:"duplicates"`
+}
+
+type ListMeterPricesResponse struct {
+	Prices []models.MeterPrice `json:"prices"`
+}
+
+type ListUsageRatingsResponse struct {
+	Ratings []models.UsageRating `json:"ratings"`
+}
+
+type ListUsageEventsParams struct {
+	// After is the last event ID of the previous page.
+	After string `query:"after"`
+	// Limit is the page size, 100 by default and at most 1000.
+	Limit int `query:"limit"`
+}
+
+type ListUsageEventsResponse struct {
+	Events []models.UsageEvent `json:"events"`
+}
+
+// RecordUsage records metered usage of customers. It is rated against the
+// price book into items of each customer's bill when the bill closes.
+//encore:api private method=POST path=/usage
+func (s *Service) RecordUsage(ctx context.Context, request RecordUsageRequest) (*RecordUsageResponse, error) {
+	recorded, err := workflows.RecordUsageEvents(ctx, request.Events)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &RecordUsageResponse{Recorded: recorded, Duplicates: len(request.Events) - recorded}, nil
+}
+
+//encore:api private method=PUT path=/admin/price-book/:meter
+func (s *Service) SaveMeterPrice(ctx context.Context, meter string, request models.MeterPrice) (*models.MeterPrice, error) {
+	request.Meter = meter
+	price, err := workflows.SaveMeterPrice(ctx, request)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return price, nil
+}
+
+//encore:api private method=GET path=/admin/price-book
+func (s *Service) ListMeterPrices(ctx context.Context) (*ListMeterPricesResponse, error) {
+	prices, err := workflows.ListMeterPrices(ctx)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListMeterPricesResponse{Prices: prices}, nil
+}
+
+// ListUsageRatings returns the usage rated into a bill and the items it was charged as.
+//encore:api private method=GET path=/bill/:billId/usage
+func (s *Service) ListUsageRatings(ctx context.Context, billId string) (*ListUsageRatingsResponse, error) {
+	ratings, err := workflows.ListUsageRatings(ctx, billId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListUsageRatingsResponse{Ratings: ratings}, nil
+}
+
+// ListUsageEvents returns the raw events behind a usage rating.
+//encore:api private method=GET path=/usage-rating/:ratingId/events
+func (s *Service) ListUsageEvents(ctx context.Context, ratingId string, params *ListUsageEventsParams) (*ListUsageEventsResponse, error) {
+	events, err := workflows.ListUsageEvents(ctx, ratingId, params.After, params.Limit)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListUsageEventsResponse{Events: events}, nil
+}
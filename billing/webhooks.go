@@ -0,0 +1,89 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/models"
+	"encore.app/billing/workflows"
+	"encore.dev/beta/errs"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/client"
+)
+
+type CreateWebhookEndpointRequest struct {
+	Url string `json:"url"`
+	// EventTypes to deliver, e.g. "bill.closed". Leave empty to receive every event.
+	EventTypes []string `json:"eventTypes"`
+}
+
+type ListWebhookEndpointsResponse struct {
+	Endpoints []models.WebhookEndpoint `json:"endpoints"`
+}
+
+type ListWebhookDeliveriesResponse struct {
+	Deliveries []models.WebhookDelivery `json:"deliveries"`
+}
+
+// CreateWebhookEndpoint subscribes a URL to the bill events of a customer.
+// Deliveries are signed with the returned secret in the Pave-Signature header.
+//encore:api private method=POST path=/customer/:customerId/webhook
+func (s *Service) CreateWebhookEndpoint(ctx context.Context, customerId string, request CreateWebhookEndpointRequest) (*models.WebhookEndpoint, error) {
+	endpoint, err := workflows.CreateWebhookEndpoint(ctx, customerId, request.Url, request.EventTypes)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return endpoint, nil
+}
+
+//encore:api private method=GET path=/customer/:customerId/webhooks
+func (s *Service) ListWebhookEndpoints(ctx context.Context, customerId string) (*ListWebhookEndpointsResponse, error) {
+	endpoints, err := workflows.ListWebhookEndpoints(ctx, customerId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListWebhookEndpointsResponse{Endpoints: endpoints}, nil
+}
+
+// DeactivateWebhookEndpoint stops new events from being sent to an endpoint.
+//encore:api private method=DELETE path=/customer/:customerId/webhook/:endpointId
+func (s *Service) DeactivateWebhookEndpoint(ctx context.Context, customerId string, endpointId string) (*Response, error) {
+	err := workflows.DeactivateWebhookEndpoint(ctx, customerId, endpointId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &Response{Message: "Webhook endpoint deactivated."}, nil
+}
+
+//encore:api private method=GET path=/customer/:customerId/webhook/:endpointId/deliveries
+func (s *Service) ListWebhookDeliveries(ctx context.Context, customerId string, endpointId string) (*ListWebhookDeliveriesResponse, error) {
+	deliveries, err := workflows.ListWebhookDeliveries(ctx, customerId, endpointId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+	return &ListWebhookDeliveriesResponse{Deliveries: deliveries}, nil
+}
+
+// RedeliverWebhook sends a delivery again, e.g. after it failed or the receiver lost it.
+//encore:api private method=POST path=/customer/:customerId/webhook/:endpointId/delivery/:deliveryId/redeliver
+func (s *Service) RedeliverWebhook(ctx context.Context, customerId string, endpointId string, deliveryId string) (*Response, error) {
+	err := workflows.ResetWebhookDelivery(ctx, customerId, endpointId, deliveryId)
+	if err != nil {
+		return nil, toAPIError(err)
+	}
+
+	options := client.StartWorkflowOptions{
+		ID:        workflows.WebhookDeliveryWorkflowId(deliveryId),
+		TaskQueue: billingTaskQueue,
+		WorkflowIDReusePolicy: enums.WORKFLOW_ID_REUSE_POLICY_ALLOW_DUPLICATE,
+		// A delivery that is still retrying is restarted from its first attempt.
+		WorkflowIDConflictPolicy: enums.WORKFLOW_ID_CONFLICT_POLICY_TERMINATE_EXISTING,
+	}
+	_, err = s.Client.ExecuteWorkflow(ctx, options, workflows.DeliverWebhook, deliveryId)
+	if err != nil {
+		return nil, &errs.Error{
+			Code: errs.Internal,
+			Message: err.Error(),
+		}
+	}
+	return &Response{Message: "Webhook redelivery started."}, nil
+}
@@ -2,80 +2,503 @@ package workflows
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
 	"time"
 
 	"encore.app/billing/db"
 	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+	"go.temporal.io/sdk/activity"
 	"go.temporal.io/sdk/temporal"
 )
 
-func CreateBill(ctx context.Context, billCloseDate time.Time) (*models.Bill,error) {
+func CreateBill(ctx context.Context, customerId string, billCloseDate time.Time, settlementCurrency string, gracePeriodSeconds int) (*models.Bill,error) {
+	return CreateBillWithId(ctx, uuid.NewString(), customerId, billCloseDate, settlementCurrency, gracePeriodSeconds)
+}
+
+// CreateBillWithId opens a bill under the given ID. If a bill of the customer
+// was already opened under it, that bill is returned instead, so that a
+// retried request carries on with it rather than opening a second bill.
+func CreateBillWithId(ctx context.Context, billId string, customerId string, billCloseDate time.Time, settlementCurrency string, gracePeriodSeconds int) (*models.Bill,error) {
+	existing, err := GetBill(ctx, billId)
+	if err == nil {
+		if existing.CustomerId != customerId {
+			return nil, temporal.NewNonRetryableApplicationError("Bill "+billId+" belongs to another customer", "CONFLICT", nil)
+		}
+		return existing, nil
+	}
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, err
+	}
+
 	if billCloseDate.Before(time.Now()) {
 		return nil,temporal.NewNonRetryableApplicationError("Invalid Bill Close Date", "INVALID-DATA",nil)
 	}
+	if gracePeriodSeconds < 0 {
+		return nil, temporal.NewNonRetryableApplicationError("Grace period cannot be negative", "INVALID-DATA", nil)
+	}
+	if settlementCurrency == "" {
+		settlementCurrency = DefaultSettlementCurrency
+	}
+	err = validateCurrency(ctx, settlementCurrency)
+	if err != nil {
+		return nil, err
+	}
+	customer, err := GetCustomer(ctx, customerId)
+	if err != nil {
+		return nil, err
+	}
+	if customer.SuspendedAt != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Customer is suspended until its overdue bills are paid", "FAILED-PRECONDITION", nil)
+	}
+
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Deleting a customer locks it, so this waits for a delete in progress and then sees it.
+	var id string
+	err = tx.QueryRow(ctx, `
+	SELECT id
+	FROM customer
+	WHERE id = $1 AND deleted_at IS NULL
+	FOR SHARE
+	`, customerId).Scan(&id)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Customer not found", "NOT_FOUND", nil)
+	}
 
 	var bill models.Bill
-	err := db.BillDb.QueryRow(ctx, `
+	err = tx.QueryRow(ctx, `
 	INSERT INTO bill
-	(close_date)
-	VALUES ($1)
-	RETURNING id, status, close_date
-	`,billCloseDate).Scan(&bill.BillId, &bill.Status, &bill.CloseDate)
+	(id, customer_id, close_date, workflow_id, settlement_currency, grace_period_seconds)
+	VALUES ($1,$2,$3,$4,$5,$6)
+	ON CONFLICT (id) DO NOTHING
+	RETURNING id, customer_id, status, close_date, grace_period_seconds, settlement_currency, created_at
+	`,billId, customerId, billCloseDate, BillWorkflowId(customerId, billId), settlementCurrency, gracePeriodSeconds).Scan(&bill.BillId, &bill.CustomerId, &bill.Status, &bill.CloseDate, &bill.GracePeriodSeconds, &bill.SettlementCurrency, &bill.CreatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		// A concurrent attempt opened the bill first.
+		tx.Rollback()
+		return CreateBillWithId(ctx, billId, customerId, billCloseDate, settlementCurrency, gracePeriodSeconds)
+	}
 	if err != nil {
 		return nil,temporal.NewNonRetryableApplicationError(err.Error(),"DB-ERROR",nil)
 	}
+	err = recordBillStatus(ctx, tx, bill.BillId, "", models.BillStatusOpen, "Bill created")
+	if err != nil {
+		return nil, err
+	}
+	eventId, err := enqueueEvent(ctx, tx, models.EventBillCreated, bill, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	flushEvent(ctx, eventId)
 	fmt.Printf("Bill created successfully: %s\n", billCloseDate)
 
 	return &bill, nil
 }
-func validateBillItem(amount int, currency string) error {
-	if amount <= 0 {
-		return temporal.NewNonRetryableApplicationError("Invalid amount "+ fmt.Sprint(amount), "INVALID-DATA",nil)
+
+// GetBillWorkflowId returns the ID of the workflow that owns a bill. Bills
+// created before customers existed use their bill ID as workflow ID.
+func GetBillWorkflowId(ctx context.Context, billId string) (string, error) {
+	var workflowId string
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT COALESCE(workflow_id, id::text)
+	FROM bill
+	WHERE bill.id = $1
+	`,billId).Scan(&workflowId)
+	if err != nil {
+		return "", temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND",nil)
+	}
+	return workflowId, nil
+}
+func validateBillItem(ctx context.Context, item models.BillItem) error {
+	err := checkBillItem(item)
+	if err != nil {
+		return err
+	}
+	return validateCurrency(ctx, item.Currency)
+}
+
+// checkBillItem validates a normalized item without looking anything up, so
+// that it can also be used from workflow code.
+func checkBillItem(item models.BillItem) error {
+	switch item.Kind {
+	case "charge":
+		if item.Amount <= 0 {
+			return temporal.NewNonRetryableApplicationError("Invalid amount "+ fmt.Sprint(item.Amount), "INVALID-DATA",nil)
+		}
+		if item.AdjustsItemId != "" {
+			return temporal.NewNonRetryableApplicationError("Only adjustments can reference another item", "INVALID-DATA",nil)
+		}
+	case "adjustment":
+		if item.Amount >= 0 {
+			return temporal.NewNonRetryableApplicationError("Adjustments must have a negative amount", "INVALID-DATA",nil)
+		}
+		if _, err := uuid.Parse(item.AdjustsItemId); err != nil {
+			return temporal.NewNonRetryableApplicationError("Adjustments must reference the item they correct", "INVALID-DATA",nil)
+		}
+	default:
+		return temporal.NewNonRetryableApplicationError("Invalid item kind: "+item.Kind, "INVALID-DATA",nil)
+	}
+	if item.Currency == "" {
+		return temporal.NewNonRetryableApplicationError("Currency is required", "INVALID-DATA",nil)
+	}
+	if !taxCategoryPattern.MatchString(item.TaxCategory) {
+		return temporal.NewNonRetryableApplicationError("Invalid tax category: "+item.TaxCategory, "INVALID-DATA", nil)
+	}
+	if item.Recurring {
+		if item.Kind != "charge" {
+			return temporal.NewNonRetryableApplicationError("Only charges can recur", "INVALID-DATA", nil)
+		}
+		if item.ServicePeriodStart == nil || item.ServicePeriodEnd == nil || !item.ServicePeriodEnd.After(*item.ServicePeriodStart) {
+			return temporal.NewNonRetryableApplicationError("Recurring items must give the service period they are charged for", "INVALID-DATA", nil)
 		}
-	if currency != "USD" && currency != "GEL" {
-		return temporal.NewNonRetryableApplicationError("Invalid currency: " + currency, "INVALID-DATA",nil)
 	}
 	return nil
 }
 
-func AddBillItem(ctx context.Context,billId string, amount int, currency string) error {
-	err := validateBillItem(amount, currency)
+// validateAdjustment checks an adjustment against the charge it corrects.
+// The charge row is locked so that concurrent adjustments cannot together
+// credit more than was charged.
+func validateAdjustment(ctx context.Context, q querier, billId string, item models.BillItem) error {
+	var currency, kind string
+	var amount, adjusted int64
+	err := q.QueryRow(ctx, `
+	SELECT currency, kind, amount, COALESCE((
+		SELECT SUM(adjustment.amount)
+		FROM bill_item adjustment
+		WHERE adjustment.adjusts_item_id = original.id AND adjustment.voided_at IS NULL
+	), 0)::bigint
+	FROM bill_item original
+	WHERE original.id = $1 AND original.bill_id = $2 AND original.voided_at IS NULL
+	FOR UPDATE
+	`, item.AdjustsItemId, billId).Scan(&currency, &kind, &amount, &adjusted)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return temporal.NewNonRetryableApplicationError("Adjusted item not found on bill", "NOT_FOUND", nil)
+	}
 	if err != nil {
 		return err
 	}
-	_, err = db.BillDb.Exec(ctx, `
+	if kind != "charge" {
+		return temporal.NewNonRetryableApplicationError("Only charges can be adjusted", "INVALID-DATA", nil)
+	}
+	if currency != item.Currency {
+		return temporal.NewNonRetryableApplicationError("Adjustment currency must match the adjusted item", "INVALID-DATA", nil)
+	}
+	if amount+adjusted+item.Amount < 0 {
+		return temporal.NewNonRetryableApplicationError(fmt.Sprintf("Adjustment exceeds the remaining %d of the adjusted item", amount+adjusted), "INVALID-DATA", nil)
+	}
+	return nil
+}
+
+// insertBillItem stores a normalized, validated item and returns its ID.
+func insertBillItem(ctx context.Context, q querier, billId string, item models.BillItem) (string, error) {
+	return insertBillItemAt(ctx, q, billId, item, 0)
+}
+
+// insertBillItemAt inserts an item at a position reserved with
+// reserveBillItemSeqs, or after every item so far if seq is 0.
+func insertBillItemAt(ctx context.Context, q querier, billId string, item models.BillItem, seq int64) (string, error) {
+	if item.Kind == "adjustment" {
+		err := validateAdjustment(ctx, q, billId, item)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var itemId string
+	err := q.QueryRow(ctx, `
 	INSERT INTO bill_item
-	(bill_id,amount,currency)
-	VALUES ($1,$2,$3)
-	`, billId, amount, currency)
+	(bill_id, amount, currency, description, quantity, unit_price, unit_price_decimal, sku, service_period_start, service_period_end, metadata, kind, adjusts_item_id, credit_note_id, occurred_at, tax_category, recurring, seq)
+	VALUES ($1,$2,$3,$4,$5,$6,NULLIF($7, '')::numeric,NULLIF($8, ''),$9,$10,$11,$12,NULLIF($13, '')::uuid,NULLIF($14, '')::uuid,$15,$16,$17,COALESCE(NULLIF($18::bigint, 0), nextval(pg_get_serial_sequence('bill_item', 'seq'))))
+	RETURNING id
+	`, billId, item.Amount, item.Currency, item.Description, item.Quantity, item.UnitPrice, item.UnitPriceDecimal, item.Sku, item.ServicePeriodStart, item.ServicePeriodEnd, item.Metadata, item.Kind, item.AdjustsItemId, item.CreditNoteId, item.OccurredAt, item.TaxCategory, item.Recurring, seq).Scan(&itemId)
+	if err != nil {
+		return "", err
+	}
+	err = addToBillTotal(ctx, q, billId, item.Currency, item.Amount, 1)
+	if err != nil {
+		return "", err
+	}
+	return itemId, nil
+}
+
+// normalizeBillItem fills in the quantity and unit price of an item that
+// only gives an amount, and checks that the amount is quantity × unit price.
+// Items with a decimal unit price get their amount computed instead, rounded
+// with the given mode.
+func normalizeBillItem(item models.BillItem, rounding string) (models.BillItem, error) {
+	if item.Quantity == 0 {
+		item.Quantity = 1
+	}
+	if item.Quantity < 0 {
+		return item, temporal.NewNonRetryableApplicationError("Invalid quantity "+fmt.Sprint(item.Quantity), "INVALID-DATA", nil)
+	}
+	if item.UnitPriceDecimal != "" {
+		if item.Amount != 0 || item.UnitPrice != 0 {
+			return item, temporal.NewNonRetryableApplicationError("Items with a decimal unit price cannot give an amount or unit price", "INVALID-DATA", nil)
+		}
+		unitPrice, ok := models.ParseDecimal(item.UnitPriceDecimal)
+		if !ok {
+			return item, temporal.NewNonRetryableApplicationError("Invalid decimal unit price "+item.UnitPriceDecimal, "INVALID-DATA", nil)
+		}
+		amount, err := models.Round(new(big.Rat).Mul(unitPrice, big.NewRat(item.Quantity, 1)), rounding)
+		if err == nil {
+			item.UnitPrice, err = models.Round(unitPrice, rounding)
+		}
+		if err != nil {
+			return item, temporal.NewNonRetryableApplicationError("Amount overflows", "INVALID-DATA", nil)
+		}
+		item.Amount = amount
+		item.UnitPriceDecimal = models.FormatDecimal(unitPrice)
+	} else {
+		if item.UnitPrice == 0 {
+			if item.Amount%item.Quantity != 0 {
+				return item, temporal.NewNonRetryableApplicationError("Amount is not a whole multiple of quantity", "INVALID-DATA", nil)
+			}
+			item.UnitPrice = item.Amount / item.Quantity
+		}
+		amount, err := models.MulAmounts(item.Quantity, item.UnitPrice)
+		if err != nil {
+			return item, temporal.NewNonRetryableApplicationError("Amount overflows", "INVALID-DATA", nil)
+		}
+		if item.Amount != 0 && item.Amount != amount {
+			return item, temporal.NewNonRetryableApplicationError(fmt.Sprintf("Amount %d does not equal quantity %d × unit price %d", item.Amount, item.Quantity, item.UnitPrice), "INVALID-DATA", nil)
+		}
+		item.Amount = amount
+	}
 
+	if item.ServicePeriodStart != nil && item.ServicePeriodEnd != nil && item.ServicePeriodEnd.Before(*item.ServicePeriodStart) {
+		return item, temporal.NewNonRetryableApplicationError("Service period ends before it starts", "INVALID-DATA", nil)
+	}
+	if item.Metadata == nil {
+		item.Metadata = map[string]string{}
+	}
+	if item.Kind == "" {
+		item.Kind = "charge"
+	}
+	if item.TaxCategory == "" {
+		item.TaxCategory = models.TaxCategoryStandard
+	}
+	return item, nil
+}
+
+// occurredBefore reports whether an item is stamped as having occurred before
+// the given time. Items without a stamp are taken to occur on arrival, which
+// for a closing bill is always after its close date.
+func occurredBefore(item models.BillItem, t time.Time) bool {
+	return item.OccurredAt != nil && item.OccurredAt.Before(t)
+}
+
+// lockBillForItems reads the bill items are about to be added to. Locking the
+// bill keeps it from closing while they are added.
+func lockBillForItems(ctx context.Context, q querier, billId string) (models.Bill, error) {
+	bill := models.Bill{BillId: billId}
+	err := q.QueryRow(ctx, `
+	SELECT COALESCE(customer_id::text, ''), status, close_date
+	FROM bill
+	WHERE id = $1
+	FOR SHARE
+	`, billId).Scan(&bill.CustomerId, &bill.Status, &bill.CloseDate)
 	if err != nil {
-		return err
+		return bill, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+	return bill, nil
+}
+
+// checkBillAcceptsItem checks that a bill is open, or closing and the item occurred before its close date.
+func checkBillAcceptsItem(bill models.Bill, item models.BillItem) error {
+	switch {
+	case bill.Status == models.BillStatusClosing && !occurredBefore(item, bill.CloseDate):
+		return temporal.NewNonRetryableApplicationError("Bill is closing and only accepts items that occurred before its close date "+bill.CloseDate.Format(time.RFC3339), "FAILED-PRECONDITION", nil)
+	case bill.Status != models.BillStatusOpen && bill.Status != models.BillStatusClosing:
+		return temporal.NewNonRetryableApplicationError("Items can only be added while the bill is open", "FAILED-PRECONDITION", nil)
 	}
 	return nil
 }
 
-func GetBill(ctx context.Context, billId string) (*models.Bill, error) {
-	var bill models.Bill
-	err := db.BillDb.QueryRow(ctx, `
-	SELECT id,status
+// AddBillItem inserts a bill item and returns its ID. Retries of the same
+// activity are deduplicated so that an item is only ever inserted once.
+func AddBillItem(ctx context.Context, billId string, item models.BillItem) (string, error) {
+	dedupeKey := ""
+	if activity.IsActivity(ctx) {
+		info := activity.GetInfo(ctx)
+		dedupeKey = info.WorkflowExecution.RunID + "/" + info.ActivityID
+	}
+	return addBillItem(ctx, billId, item, dedupeKey)
+}
+
+func addBillItem(ctx context.Context, billId string, item models.BillItem, dedupeKey string) (string, error) {
+	rounding, err := Currencies.RoundingMode(ctx, item.Currency)
+	if err != nil {
+		return "", err
+	}
+	item, err = normalizeBillItem(item, rounding)
+	if err != nil {
+		return "", err
+	}
+	err = validateBillItem(ctx, item)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	scope := "add_bill_item:" + billId
+	if dedupeKey != "" {
+		requestHash, err := HashRequest([]interface{}{billId, item})
+		if err != nil {
+			return "", err
+		}
+		record, err := reserveIdempotencyKey(ctx, tx, scope, dedupeKey, requestHash)
+		if err != nil {
+			return "", err
+		}
+		if record != nil {
+			var itemId string
+			if record.RequestHash != requestHash || json.Unmarshal(record.Response, &itemId) != nil {
+				return "", temporal.NewNonRetryableApplicationError("Conflicting bill item for key "+dedupeKey, "CONFLICT", nil)
+			}
+			return itemId, nil
+		}
+	}
+
+	bill, err := lockBillForItems(ctx, tx, billId)
+	if err != nil {
+		return "", err
+	}
+	err = checkBillAcceptsItem(bill, item)
+	if err != nil {
+		return "", err
+	}
+	alerts, err := newSpendCaps(bill).check(ctx, tx, &item)
+	if err != nil {
+		return "", err
+	}
+
+	itemId, err := insertBillItem(ctx, tx, billId, item)
+	if err != nil {
+		return "", err
+	}
+	item.Id = itemId
+	eventId, err := enqueueEvent(ctx, tx, models.EventBillItemAdded, bill, &item)
+	if err != nil {
+		return "", err
+	}
+	alertIds, err := enqueueCapAlerts(ctx, tx, bill, &item, alerts)
+	if err != nil {
+		return "", err
+	}
+
+	if dedupeKey != "" {
+		err = saveIdempotentResponse(ctx, tx, scope, dedupeKey, itemId)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+	for _, eventId := range append([]string{eventId}, alertIds...) {
+		flushEvent(ctx, eventId)
+	}
+	return itemId, nil
+}
+
+// VoidBillItem voids an item of an open bill and returns when it was voided.
+// The row is kept for audit. Voiding an already voided item returns the
+// original time, so the activity is safe to retry.
+func VoidBillItem(ctx context.Context, billId string, itemId string) (time.Time, error) {
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(ctx, `
+	SELECT status
 	FROM bill
-	WHERE bill.id = $1
-	`,billId).Scan(&bill.BillId, &bill.Status)
+	WHERE id = $1
+	FOR UPDATE
+	`, billId).Scan(&status)
+	if err != nil {
+		return time.Time{}, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
 
+	var voidedAt *time.Time
+	var activeAdjustments int
+	err = tx.QueryRow(ctx, `
+	SELECT voided_at, (
+		SELECT COUNT(*)
+		FROM bill_item adjustment
+		WHERE adjustment.adjusts_item_id = item.id AND adjustment.voided_at IS NULL
+	)
+	FROM bill_item item
+	WHERE item.id = $1 AND item.bill_id = $2
+	`, itemId, billId).Scan(&voidedAt, &activeAdjustments)
 	if err != nil {
-		return nil, err
+		return time.Time{}, temporal.NewNonRetryableApplicationError("Bill item not found", "NOT_FOUND", nil)
+	}
+	if voidedAt != nil {
+		return *voidedAt, nil
+	}
+	if status != models.BillStatusOpen {
+		return time.Time{}, temporal.NewNonRetryableApplicationError("Items can only be voided while the bill is open", "FAILED-PRECONDITION", nil)
+	}
+	if activeAdjustments > 0 {
+		return time.Time{}, temporal.NewNonRetryableApplicationError("Void the adjustments of this item first", "FAILED-PRECONDITION", nil)
 	}
 
-	if bill.BillId == "" {
-		return nil, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND",nil)
+	var voided time.Time
+	var amount int64
+	var currency string
+	err = tx.QueryRow(ctx, `
+	UPDATE bill_item
+	SET voided_at = NOW()
+	WHERE id = $1
+	RETURNING voided_at, amount, currency
+	`, itemId).Scan(&voided, &amount, &currency)
+	if err != nil {
+		return time.Time{}, err
+	}
+	err = addToBillTotal(ctx, tx, billId, currency, -amount, -1)
+	if err != nil {
+		return time.Time{}, err
 	}
 
-	rows, err := db.BillDb.Query(ctx,`
-	SELECT id, currency, amount
+	err = tx.Commit()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return voided, nil
+}
+
+// getBillItems returns the items of a bill in the order they were added.
+func getBillItems(ctx context.Context, q querier, billId string) ([]models.BillItem, error) {
+	rows, err := q.Query(ctx,`
+	SELECT id, currency, amount, description, quantity, unit_price, COALESCE(unit_price_decimal::text, ''), COALESCE(sku, ''), service_period_start, service_period_end, metadata,
+	kind, COALESCE(adjusts_item_id::text, ''), COALESCE(credit_note_id::text, ''), voided_at, occurred_at, tax_category, recurring
 	FROM bill_item
 	where bill_item.bill_id = $1
+	ORDER BY created_at, seq
 	`,billId)
 
 	if err != nil {
@@ -88,36 +511,126 @@ func GetBill(ctx context.Context, billId string) (*models.Bill, error) {
 
 	for rows.Next() {
 		var item models.BillItem
-		err := rows.Scan(&item.Id, &item.Currency, &item.Amount)
+		err := rows.Scan(&item.Id, &item.Currency, &item.Amount, &item.Description, &item.Quantity, &item.UnitPrice, &item.UnitPriceDecimal, &item.Sku, &item.ServicePeriodStart, &item.ServicePeriodEnd, &item.Metadata,
+			&item.Kind, &item.AdjustsItemId, &item.CreditNoteId, &item.VoidedAt, &item.OccurredAt, &item.TaxCategory, &item.Recurring)
 		if err != nil {
 			return nil, err
 		}
+		if unitPrice, ok := models.ParseDecimal(item.UnitPriceDecimal); ok {
+			// NUMERIC pads the decimal to its full scale.
+			item.UnitPriceDecimal = models.FormatDecimal(unitPrice)
+		}
 		billItems = append(billItems, item)
 	}
+	return billItems, nil
+}
+
+func GetBill(ctx context.Context, billId string) (*models.Bill, error) {
+	var bill models.Bill
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT id, COALESCE(customer_id::text, ''), COALESCE(schedule_id::text, ''), status, close_date, grace_period_seconds, settlement_currency, created_at, closed_at, overdue_at
+	FROM bill
+	WHERE bill.id = $1
+	`,billId).Scan(&bill.BillId, &bill.CustomerId, &bill.ScheduleId, &bill.Status, &bill.CloseDate, &bill.GracePeriodSeconds, &bill.SettlementCurrency, &bill.CreatedAt, &bill.ClosedAt, &bill.OverdueAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bill.BillId == "" {
+		return nil, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND",nil)
+	}
+
+	billItems, err := getBillItems(ctx, db.BillDb, billId)
+	if err != nil {
+		return nil, err
+	}
 	bill.BillItems = billItems
 
 	return &bill, nil
 }
 
+// CloseBill invoices an open bill and pays what it can out of the customer's
+// credit. Closing a bill that is already invoiced is a no-op.
 func CloseBill(ctx context.Context, billId string) error {
-	var bill models.Bill
-	err := db.BillDb.QueryRow(ctx,`
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A closed bill may already be paid, e.g. with credit as it closed, so
+	// retries look at closed_at rather than the status.
+	var closed *time.Time
+	err = tx.QueryRow(ctx, `
+	SELECT closed_at
+	FROM bill
+	WHERE id = $1
+	FOR UPDATE
+	`, billId).Scan(&closed)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+	if closed != nil {
+		return nil
+	}
+	from, err := transitionBill(ctx, tx, billId, models.BillStatusInvoiced, "Bill closed")
+	if err != nil {
+		return err
+	}
+	if from == models.BillStatusInvoiced {
+		return nil
+	}
+
+	bill := models.Bill{BillId: billId, Status: models.BillStatusInvoiced}
+	var closedAt time.Time
+	err = tx.QueryRow(ctx,`
 	UPDATE bill
-	SET 
-    status = 'closed',
-    closed_at = NOW()
-	WHERE id = $1 AND status = 'open'
-	RETURNING id, status
-	`,billId).Scan(&bill.BillId, &bill.Status)
+	SET closed_at = NOW()
+	WHERE id = $1
+	RETURNING COALESCE(customer_id::text, ''), closed_at
+	`,billId).Scan(&bill.CustomerId, &closedAt)
 	if err != nil {
 		return err
 	}
-	if bill.BillId == "" {
-		return temporal.NewNonRetryableApplicationError("Bill not found","NOT_FOUND",nil)
+	// The minimum commitment is made up for before discounts and tax, which
+	// are computed once, as the bill closes, and never recomputed.
+	eventIds, err := applyMinimumCommitments(ctx, tx, bill)
+	if err != nil {
+		return err
+	}
+	discounts, err := applyBillDiscounts(ctx, tx, billId, bill.CustomerId, closedAt)
+	if err != nil {
+		return err
+	}
+	err = calculateBillTax(ctx, tx, billId, bill.CustomerId, closedAt, discounts)
+	if err != nil {
+		return err
+	}
+	err = snapshotFxRates(ctx, tx, billId, closedAt)
+	if err != nil {
+		return err
+	}
+	err = applyCustomerCredit(ctx, tx, bill)
+	if err != nil {
+		return err
+	}
+	eventId, err := enqueueEvent(ctx, tx, models.EventBillClosed, bill, nil)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, eventId := range append(eventIds, eventId) {
+		flushEvent(ctx, eventId)
 	}
 	return nil
 }
 
+// CheckOpenBill reports whether a bill still accepts items, i.e. is open or
+// in the grace period after its close date.
 func CheckOpenBill(ctx context.Context, billId string) (bool,error) {
 	var bill models.Bill
 
@@ -134,47 +647,28 @@ func CheckOpenBill(ctx context.Context, billId string) (bool,error) {
 	if err != nil {
 		return false, err
 	}
-	return bill.Status == "open", nil
+	return bill.Status == models.BillStatusOpen || bill.Status == models.BillStatusClosing, nil
 }
 
 func GetBillSummary(ctx context.Context, billId string) (*models.BillSummary, error) {
 	var billSummary models.BillSummary
 	err := db.BillDb.QueryRow(ctx, `
-	SELECT id,status, closed_at
+	SELECT id,status, closed_at, settlement_currency
 	FROM bill
 	WHERE bill.id = $1
-	`,billId).Scan(&billSummary.BillId, &billSummary.Status, &billSummary.ClosedAt)
+	`,billId).Scan(&billSummary.BillId, &billSummary.Status, &billSummary.ClosedAt, &billSummary.SettlementCurrency)
 
 	if err != nil {
 		return nil, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND",nil)
 	}
 
-	rows, err := db.BillDb.Query(ctx,`
-	SELECT id, currency, amount
-	FROM bill_item
-	where bill_item.bill_id = $1
-	`,billId)
-
+	billItems, err := getBillItems(ctx, db.BillDb, billId)
 	if err != nil {
 		return nil, err
 	}
-
-
-	var billItems []models.BillItem
-
-	for rows.Next() {
-		var item models.BillItem
-		err := rows.Scan(&item.Id, &item.Currency, &item.Amount)
-		if err != nil {
-			return nil, err
-		}
-		billItems = append(billItems, item)
-	}
 	billSummary.BillItems = billItems
 
-	rows.Close()
-
-	rows, err = db.BillDb.Query(ctx,`
+	rows, err := db.BillDb.Query(ctx,`
 	SELECT bill_id, currency, total_amount
 	FROM bill_summary
 	where bill_summary.bill_id = $1
@@ -192,49 +686,46 @@ func GetBillSummary(ctx context.Context, billId string) (*models.BillSummary, er
 		if err != nil {
 			return nil, err
 		}
+		item.FormattedTotal = Currencies.Format(ctx, item.TotalAmount, item.Currency)
 		billItemSummary = append(billItemSummary, item)
 	}
 	billSummary.BillItemSummary = billItemSummary
 
 	rows.Close()
 
-	return &billSummary, nil
-}
-type ListBillParams struct {
-	Status string
-}
-func ListBills(ctx context.Context, params *ListBillParams) ([]models.Bill, error) {
-	query := `
-	SELECT id, status 
-	FROM bill
-	WHERE 1=1
-	`
-	var args []interface{}
-	if params.Status != "" {
-		query += `
-		AND status = $1
-		`
-		args = append(args, params.Status)
+	billSummary.CreditNotes, err = ListCreditNotes(ctx, billId)
+	if err != nil {
+		return nil, err
 	}
-
-	rows, err := db.BillDb.Query(ctx,query, args...)
-
+	billSummary.Discounts, err = getBillDiscountLines(ctx, billId)
 	if err != nil {
 		return nil, err
 	}
-
-	defer rows.Close()
-
-	var bills []models.Bill
-
-	for rows.Next() {
-		var item models.Bill
-		err := rows.Scan(&item.BillId, &item.Status)
-		if err != nil {
-			return nil, err
-		}
-		bills = append(bills, item)
+	applyDiscountLines(ctx, &billSummary)
+	billSummary.TaxLines, err = getBillTaxLines(ctx, db.BillDb, billId)
+	if err != nil {
+		return nil, err
+	}
+	err = applyTaxLines(ctx, &billSummary)
+	if err != nil {
+		return nil, err
+	}
+	billSummary.FxRates, err = getBillFxRates(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	billSummary.Payments, err = ListPayments(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	billSummary.Balances, err = GetBillBalances(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	err = convertSummary(ctx, &billSummary)
+	if err != nil {
+		return nil, err
 	}
-	return bills, nil
 
-}
\ No newline at end of file
+	return &billSummary, nil
+}
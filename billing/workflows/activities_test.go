@@ -2,6 +2,7 @@ package workflows
 
 import (
 	"context"
+	"math"
 	"testing"
 	"time"
 
@@ -12,42 +13,203 @@ import (
 	"go.temporal.io/sdk/testsuite"
 )
 
+func createTestCustomer(t *testing.T) string {
+	customer, err := CreateCustomer(context.Background(), "Test Customer", "billing@example.com")
+	require.NoError(t, err)
+	return customer.Id
+}
+
 func TestActivity_CreateBill(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(CreateBill)
 
 	var bill models.Bill
-	val, err := env.ExecuteActivity(CreateBill, time.Now().Add(24 * time.Hour))
+	val, err := env.ExecuteActivity(CreateBill, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
 	require.NoError(t, val.Get(&bill))
 	require.NoError(t, err)
 }
 
+func TestActivity_CreateBill_UnknownCustomer(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestActivityEnvironment()
+	env.RegisterActivity(CreateBill)
+
+	_, err := env.ExecuteActivity(CreateBill, uuid.New().String(), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.Error(t, err)
+}
+
 func TestActivity_CreateBill_InvalidDate(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(CreateBill)
 
-	val, err := env.ExecuteActivity(CreateBill, time.Now().Add(-24 * time.Hour))
+	val, err := env.ExecuteActivity(CreateBill, createTestCustomer(t), time.Now().Add(-24 * time.Hour), "USD", 0)
 	require.Error(t, err)
 	require.Empty(t, val)
 }
 
+func TestCreateBillWithId_ResumesExistingBill(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	billId := IdempotentId("create_bill:"+customerId, uuid.NewString())
+
+	bill, err := CreateBillWithId(ctx, billId, customerId, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+	require.Equal(t, billId, bill.BillId)
+
+	// A retry gets the bill back, even once its request would no longer be valid.
+	again, err := CreateBillWithId(ctx, billId, customerId, time.Now().Add(-24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+	require.Equal(t, billId, again.BillId)
+	require.True(t, bill.CloseDate.Equal(again.CloseDate))
+
+	_, err = CreateBillWithId(ctx, billId, createTestCustomer(t), time.Now().Add(24*time.Hour), "USD", 0)
+	require.Error(t, err)
+	require.Equal(t, "CONFLICT", applicationErrorType(err))
+}
+
 func TestActivity_AddBillItem(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(AddBillItem)
-	bill, _ := CreateBill(context.Background(), time.Now().Add(24 * time.Hour))
-	_, err := env.ExecuteActivity(AddBillItem,bill.BillId, 100, "USD")
+	bill, _ := CreateBill(context.Background(), createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	_, err := env.ExecuteActivity(AddBillItem, bill.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.NoError(t, err)
+}
+
+func TestActivity_AddBillItem_DedupesRetries(t *testing.T) {
+	bill, _ := CreateBill(context.Background(), createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	key := uuid.New().String()
+	firstId, err := addBillItem(context.Background(), bill.BillId, models.BillItem{Amount: 100, Currency: "USD"}, key)
+	require.NoError(t, err)
+	retryId, err := addBillItem(context.Background(), bill.BillId, models.BillItem{Amount: 100, Currency: "USD"}, key)
 	require.NoError(t, err)
+	require.Equal(t, firstId, retryId)
+
+	bill, _ = GetBill(context.Background(), bill.BillId)
+	require.Len(t, bill.BillItems, 1)
+}
+
+func TestActivity_AddBillItem_Details(t *testing.T) {
+	ctx := context.Background()
+	bill, _ := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	_, err := AddBillItem(ctx, bill.BillId, models.BillItem{
+		Currency: "USD",
+		Description: "API calls",
+		Quantity: 3,
+		UnitPrice: 250,
+		Sku: "API-CALL",
+		ServicePeriodStart: &start,
+		ServicePeriodEnd: &end,
+		Metadata: map[string]string{"region": "eu"},
+	})
+	require.NoError(t, err)
+
+	bill, err = GetBill(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, bill.BillItems, 1)
+	item := bill.BillItems[0]
+	require.Equal(t, int64(750), item.Amount)
+	require.Equal(t, "API-CALL", item.Sku)
+	require.Equal(t, "eu", item.Metadata["region"])
+	require.True(t, item.ServicePeriodEnd.Equal(end))
+}
+
+func TestActivity_AddBillItem_WhileClosing(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 3600)
+	require.NoError(t, err)
+	require.Equal(t, 3600, bill.GracePeriodSeconds)
+	err = TransitionBill(ctx, bill.BillId, models.BillStatusClosing, "Grace period started")
+	require.NoError(t, err)
+
+	before := bill.CloseDate.Add(-time.Minute)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD", OccurredAt: &before})
+	require.NoError(t, err)
+
+	after := bill.CloseDate.Add(time.Minute)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD", OccurredAt: &after})
+	require.ErrorContains(t, err, "only accepts items that occurred before its close date")
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.Error(t, err)
+
+	bill, err = GetBill(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, bill.BillItems, 1)
+	require.True(t, bill.BillItems[0].OccurredAt.Equal(before))
+}
+
+func TestActivity_AddBillItem_AmountMismatch(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestActivityEnvironment()
+	env.RegisterActivity(AddBillItem)
+	bill, _ := CreateBill(context.Background(), createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	_, err := env.ExecuteActivity(AddBillItem, bill.BillId, models.BillItem{Amount: 100, Currency: "USD", Quantity: 3, UnitPrice: 50})
+	require.Error(t, err)
+}
+
+func TestNormalizeBillItem(t *testing.T) {
+	item, err := normalizeBillItem(models.BillItem{Amount: 300, Quantity: 3}, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), item.UnitPrice)
+
+	item, err = normalizeBillItem(models.BillItem{Amount: 100}, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), item.Quantity)
+	require.Equal(t, int64(100), item.UnitPrice)
+
+	_, err = normalizeBillItem(models.BillItem{Amount: 100, Quantity: 3}, models.RoundHalfEven)
+	require.Error(t, err)
+
+	_, err = normalizeBillItem(models.BillItem{Quantity: math.MaxInt64, UnitPrice: 2}, models.RoundHalfEven)
+	require.Error(t, err)
+}
+
+func TestNormalizeBillItem_DecimalUnitPrice(t *testing.T) {
+	// 150 × 0.015 is 2.25 minor units.
+	item, err := normalizeBillItem(models.BillItem{Quantity: 150, UnitPriceDecimal: "0.0150"}, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), item.Amount)
+	require.Equal(t, int64(0), item.UnitPrice)
+	require.Equal(t, "0.015", item.UnitPriceDecimal)
+
+	// 100 × 0.025 is 2.5 minor units, which rounds to even or up.
+	item, err = normalizeBillItem(models.BillItem{Quantity: 100, UnitPriceDecimal: "0.025"}, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), item.Amount)
+	item, err = normalizeBillItem(models.BillItem{Quantity: 100, UnitPriceDecimal: "0.025"}, models.RoundHalfUp)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), item.Amount)
+
+	_, err = normalizeBillItem(models.BillItem{Amount: 2, Quantity: 100, UnitPriceDecimal: "0.025"}, models.RoundHalfEven)
+	require.Error(t, err)
+	_, err = normalizeBillItem(models.BillItem{UnitPriceDecimal: "1e-3"}, models.RoundHalfEven)
+	require.Error(t, err)
+}
+
+func TestActivity_AddBillItem_DecimalUnitPrice(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Quantity: 1000, UnitPriceDecimal: "0.0125", Currency: "USD"})
+	require.NoError(t, err)
+
+	bill, err = GetBill(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, bill.BillItems, 1)
+	require.Equal(t, int64(12), bill.BillItems[0].Amount)
+	require.Equal(t, "0.0125", bill.BillItems[0].UnitPriceDecimal)
 }
 
 func TestActivity_AddBillItem_InvalidAmount(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(AddBillItem)
-	bill, _ := CreateBill(context.Background(), time.Now().Add(24 * time.Hour))
-	_, err := env.ExecuteActivity(AddBillItem, bill.BillId, -100, "USD")
+	bill, _ := CreateBill(context.Background(), createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	_, err := env.ExecuteActivity(AddBillItem, bill.BillId, models.BillItem{Amount: -100, Currency: "USD"})
 	require.Error(t, err)
 }
 
@@ -55,8 +217,8 @@ func TestActivity_AddBillItem_InvalidCurrency(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(AddBillItem)
-	bill, _ := CreateBill(context.Background(), time.Now().Add(24 * time.Hour))
-	_, err := env.ExecuteActivity(AddBillItem, bill.BillId, 100, "ABC")
+	bill, _ := CreateBill(context.Background(), createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	_, err := env.ExecuteActivity(AddBillItem, bill.BillId, models.BillItem{Amount: 100, Currency: "ABC"})
 	require.Error(t, err)
 }
 
@@ -64,7 +226,7 @@ func TestActivity_GetBill(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(GetBill)
-	bill, _ := CreateBill(context.Background(), time.Now().Add(24 * time.Hour))
+	bill, _ := CreateBill(context.Background(), createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
 	_, err := env.ExecuteActivity(GetBill, bill.BillId)
 	require.NoError(t, err)
 }
@@ -80,12 +242,12 @@ func TestActivity_CloseBill(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(CloseBill)
-	bill, _ := CreateBill(context.Background(), time.Now().Add(24 * time.Hour))
+	bill, _ := CreateBill(context.Background(), createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
 	require.Equal(t, bill.Status, "open")
 	_, err := env.ExecuteActivity(CloseBill, bill.BillId)
 	require.NoError(t, err)
 	bill, _ = GetBill(context.Background(),bill.BillId)
-	require.Equal(t, bill.Status, "closed")
+	require.Equal(t, bill.Status, "invoiced")
 }
 
 func TestActivity_CloseBill_Invalid(t *testing.T) {
@@ -99,7 +261,7 @@ func TestActivity_GetBillSummary(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(GetBillSummary)
-	bill, _ := CreateBill(context.Background(), time.Now().Add(24 * time.Hour))
+	bill, _ := CreateBill(context.Background(), createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
 	 _  = CloseBill(context.Background(), bill.BillId)
 	_, err := env.ExecuteActivity(GetBillSummary, bill.BillId)
 	require.NoError(t, err)
@@ -109,7 +271,46 @@ func TestActivity_GetBillSummary_InvalidOpenBill(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(GetBillSummary)
-	bill, _ := CreateBill(context.Background(), time.Now().Add(24 * time.Hour))
+	bill, _ := CreateBill(context.Background(), createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
 	_, err := env.ExecuteActivity(GetBillSummary, bill.BillId)
 	require.Error(t, err)
-}
\ No newline at end of file
+}
+func TestActivity_VoidBillItem(t *testing.T) {
+	ctx := context.Background()
+	bill, _ := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	keptId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.NoError(t, err)
+	voidedId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 250, Currency: "USD"})
+	require.NoError(t, err)
+
+	voidedAt, err := VoidBillItem(ctx, bill.BillId, voidedId)
+	require.NoError(t, err)
+	retriedAt, err := VoidBillItem(ctx, bill.BillId, voidedId)
+	require.NoError(t, err)
+	require.True(t, voidedAt.Equal(retriedAt))
+
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	_, err = VoidBillItem(ctx, bill.BillId, keptId)
+	require.Error(t, err)
+
+	summary, err := GetBillSummary(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, summary.BillItems, 2)
+	require.Equal(t, int64(100), summary.BillItemSummary[0].TotalAmount)
+}
+
+func TestActivity_VoidBillItem_WithAdjustments(t *testing.T) {
+	ctx := context.Background()
+	bill, _ := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	chargeId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.NoError(t, err)
+	adjustmentId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Kind: "adjustment", Amount: -50, Currency: "USD", AdjustsItemId: chargeId})
+	require.NoError(t, err)
+
+	_, err = VoidBillItem(ctx, bill.BillId, chargeId)
+	require.Error(t, err)
+	_, err = VoidBillItem(ctx, bill.BillId, adjustmentId)
+	require.NoError(t, err)
+	_, err = VoidBillItem(ctx, bill.BillId, chargeId)
+	require.NoError(t, err)
+}
@@ -0,0 +1,232 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// MaxBillItemsPerBatch caps the size of an atomic batch, which is written in a single transaction.
+const MaxBillItemsPerBatch = 1000
+
+// billItemInsertChunk keeps multi-row inserts well below the 65535 parameters Postgres allows per statement.
+const billItemInsertChunk = 500
+
+// batchItemError points an error at the item of a batch that caused it, keeping its type.
+func batchItemError(i int, err error) error {
+	return temporal.NewNonRetryableApplicationError(fmt.Sprintf("Bill item %d: %s", i, errorReason(err)), applicationErrorType(err), nil)
+}
+
+// AddBillItemBatch adds all items of a batch to a bill in a single transaction
+// and returns their IDs in order. If any item is rejected, none are added.
+// Adjustments can only correct charges already on the bill, not charges of
+// the same batch, whose IDs are only assigned here.
+// Retries of the same activity are deduplicated like those of AddBillItem.
+func AddBillItemBatch(ctx context.Context, billId string, items []models.BillItem) ([]string, error) {
+	dedupeKey := ""
+	if activity.IsActivity(ctx) {
+		info := activity.GetInfo(ctx)
+		dedupeKey = info.WorkflowExecution.RunID + "/" + info.ActivityID
+	}
+	return addBillItemBatch(ctx, billId, items, dedupeKey)
+}
+
+func addBillItemBatch(ctx context.Context, billId string, items []models.BillItem, dedupeKey string) ([]string, error) {
+	if len(items) == 0 {
+		return nil, temporal.NewNonRetryableApplicationError("No bill items given", "INVALID-DATA", nil)
+	}
+	if len(items) > MaxBillItemsPerBatch {
+		return nil, temporal.NewNonRetryableApplicationError(fmt.Sprintf("At most %d bill items can be added in one batch", MaxBillItemsPerBatch), "INVALID-DATA", nil)
+	}
+	normalized := make([]models.BillItem, len(items))
+	for i, item := range items {
+		rounding, err := Currencies.RoundingMode(ctx, item.Currency)
+		if err != nil {
+			return nil, err
+		}
+		item, err = normalizeBillItem(item, rounding)
+		if err == nil {
+			err = validateBillItem(ctx, item)
+		}
+		if err != nil {
+			return nil, batchItemError(i, err)
+		}
+		normalized[i] = item
+	}
+	items = normalized
+
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	scope := "add_bill_item:" + billId
+	if dedupeKey != "" {
+		requestHash, err := HashRequest([]interface{}{billId, items})
+		if err != nil {
+			return nil, err
+		}
+		record, err := reserveIdempotencyKey(ctx, tx, scope, dedupeKey, requestHash)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			var itemIds []string
+			if record.RequestHash != requestHash || json.Unmarshal(record.Response, &itemIds) != nil {
+				return nil, temporal.NewNonRetryableApplicationError("Conflicting bill items for key "+dedupeKey, "CONFLICT", nil)
+			}
+			return itemIds, nil
+		}
+	}
+
+	bill, err := lockBillForItems(ctx, tx, billId)
+	if err != nil {
+		return nil, err
+	}
+	seqs, err := reserveBillItemSeqs(ctx, tx, len(items))
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	itemIds := make([]string, len(items))
+	alerts := make([][]capAlert, len(items))
+	caps := newSpendCaps(bill)
+	var charges []int
+	for i, item := range items {
+		err = checkBillAcceptsItem(bill, item)
+		if err == nil {
+			alerts[i], err = caps.check(ctx, tx, &items[i])
+		}
+		if err != nil {
+			return nil, batchItemError(i, err)
+		}
+		if item.Kind != "adjustment" {
+			itemIds[i] = uuid.NewString()
+			charges = append(charges, i)
+		}
+	}
+	err = insertBillItems(ctx, tx, billId, items, itemIds, seqs, charges)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	// Adjustments are checked one by one against what has already been
+	// adjusted. Their reserved seq keeps them in batch order among the charges.
+	for i, item := range items {
+		if item.Kind != "adjustment" {
+			continue
+		}
+		itemIds[i], err = insertBillItemAt(ctx, tx, billId, item, seqs[i])
+		if err != nil {
+			return nil, batchItemError(i, err)
+		}
+	}
+
+	for i := range items {
+		items[i].Id = itemIds[i]
+		_, err = enqueueEvent(ctx, tx, models.EventBillItemAdded, bill, &items[i])
+		if err != nil {
+			return nil, err
+		}
+		_, err = enqueueCapAlerts(ctx, tx, bill, &items[i], alerts[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dedupeKey != "" {
+		err = saveIdempotentResponse(ctx, tx, scope, dedupeKey, itemIds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	_, err = PublishOutboxEvents(ctx)
+	if err != nil {
+		rlog.Warn("failed to publish events, leaving them in the outbox", "billId", billId, "error", err)
+	}
+	return itemIds, nil
+}
+
+// reserveBillItemSeqs reserves n increasing positions for the items of a batch,
+// which are inserted out of order.
+func reserveBillItemSeqs(ctx context.Context, q querier, n int) ([]int64, error) {
+	rows, err := q.Query(ctx, `
+	SELECT nextval(pg_get_serial_sequence('bill_item', 'seq'))
+	FROM generate_series(1, $1)
+	`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seqs := make([]int64, 0, n)
+	for rows.Next() {
+		var seq int64
+		err := rows.Scan(&seq)
+		if err != nil {
+			return nil, err
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// insertBillItems stores the given charges of a batch with multi-row inserts,
+// under the IDs and positions already assigned to them.
+func insertBillItems(ctx context.Context, q querier, billId string, items []models.BillItem, itemIds []string, seqs []int64, charges []int) error {
+	const columns = 16
+	totals := map[string]int64{}
+	counts := map[string]int{}
+	for start := 0; start < len(charges); start += billItemInsertChunk {
+		chunk := charges[start:min(start+billItemInsertChunk, len(charges))]
+		values := make([]string, 0, len(chunk))
+		args := make([]interface{}, 0, len(chunk)*columns)
+		for _, i := range chunk {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d,$%d,NULLIF($%d, '')::numeric,NULLIF($%d, ''),$%d,$%d,$%d,$%d,$%d,$%d,$%d,'charge')",
+				n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+11, n+12, n+13, n+14, n+15, n+16))
+			item := items[i]
+			total, err := models.AddAmounts(totals[item.Currency], item.Amount)
+			if err != nil {
+				return err
+			}
+			totals[item.Currency] = total
+			counts[item.Currency]++
+			args = append(args, itemIds[i], billId, item.Amount, item.Currency, item.Description, item.Quantity, item.UnitPrice, item.UnitPriceDecimal, item.Sku, item.ServicePeriodStart, item.ServicePeriodEnd, item.Metadata, item.OccurredAt, item.TaxCategory, item.Recurring, seqs[i])
+		}
+		_, err := q.Exec(ctx, `
+		INSERT INTO bill_item
+		(id, bill_id, amount, currency, description, quantity, unit_price, unit_price_decimal, sku, service_period_start, service_period_end, metadata, occurred_at, tax_category, recurring, seq, kind)
+		VALUES `+strings.Join(values, ",\n\t\t"), args...)
+		if err != nil {
+			return err
+		}
+	}
+	// Totals are updated in a fixed order so that concurrent batches cannot deadlock.
+	currencies := make([]string, 0, len(totals))
+	for currency := range totals {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		err := addToBillTotal(ctx, q, billId, currency, totals[currency], counts[currency])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
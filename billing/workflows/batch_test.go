@@ -0,0 +1,132 @@
+package workflows
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivity_AddBillItemBatch(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+	chargeId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.NoError(t, err)
+
+	itemIds, err := AddBillItemBatch(ctx, bill.BillId, []models.BillItem{
+		{Amount: 200, Currency: "USD", Sku: "API-CALL"},
+		{Kind: "adjustment", Amount: -50, Currency: "USD", AdjustsItemId: chargeId},
+		{Quantity: 3, UnitPrice: 25, Currency: "GEL"},
+	})
+	require.NoError(t, err)
+	require.Len(t, itemIds, 3)
+
+	bill, err = GetBill(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, bill.BillItems, 4)
+	amounts := map[string]int64{}
+	for _, item := range bill.BillItems {
+		amounts[item.Id] = item.Amount
+	}
+	require.Equal(t, int64(200), amounts[itemIds[0]])
+	require.Equal(t, int64(-50), amounts[itemIds[1]])
+	require.Equal(t, int64(75), amounts[itemIds[2]])
+
+	// Items come back in the order they were added, adjustments included.
+	var ids []string
+	for _, item := range bill.BillItems {
+		ids = append(ids, item.Id)
+	}
+	require.Equal(t, append([]string{chargeId}, itemIds...), ids)
+}
+
+func TestActivity_AddBillItemBatch_AllOrNothing(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	_, err = AddBillItemBatch(ctx, bill.BillId, []models.BillItem{
+		{Amount: 100, Currency: "USD"},
+		{Amount: 100, Currency: "XXX"},
+	})
+	require.ErrorContains(t, err, "Bill item 1")
+	_, err = AddBillItemBatch(ctx, bill.BillId, []models.BillItem{
+		{Amount: 100, Currency: "USD"},
+		{Kind: "adjustment", Amount: -50, Currency: "USD", AdjustsItemId: uuid.New().String()},
+	})
+	require.ErrorContains(t, err, "Bill item 1")
+
+	bill, err = GetBill(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Empty(t, bill.BillItems)
+}
+
+func TestActivity_AddBillItemBatch_DedupesRetries(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+	items := []models.BillItem{{Amount: 100, Currency: "USD"}, {Amount: 200, Currency: "USD"}}
+	key := uuid.New().String()
+
+	firstIds, err := addBillItemBatch(ctx, bill.BillId, items, key)
+	require.NoError(t, err)
+	retryIds, err := addBillItemBatch(ctx, bill.BillId, items, key)
+	require.NoError(t, err)
+	require.Equal(t, firstIds, retryIds)
+
+	bill, err = GetBill(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, bill.BillItems, 2)
+}
+
+func benchmarkItems(n int) []models.BillItem {
+	items := make([]models.BillItem, n)
+	for i := range items {
+		items[i] = models.BillItem{Amount: int64(100 + i), Currency: "USD", Description: fmt.Sprintf("Usage %d", i)}
+	}
+	return items
+}
+
+// BenchmarkAddBillItem_OneByOne adds 100 items the best-effort way, one
+// transaction per item. Compare with BenchmarkAddBillItemBatch.
+func BenchmarkAddBillItem_OneByOne(b *testing.B) {
+	ctx := context.Background()
+	customer, err := CreateCustomer(ctx, "Benchmark Customer", "billing@example.com")
+	require.NoError(b, err)
+	items := benchmarkItems(100)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		bill, err := CreateBill(ctx, customer.Id, time.Now().Add(24 * time.Hour), "USD", 0)
+		require.NoError(b, err)
+		b.StartTimer()
+		for i, item := range items {
+			_, err := addBillItem(ctx, bill.BillId, item, fmt.Sprintf("bench-%d-%d", n, i))
+			require.NoError(b, err)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(items))/b.Elapsed().Seconds(), "items/s")
+}
+
+// BenchmarkAddBillItemBatch adds the same 100 items in one atomic batch.
+func BenchmarkAddBillItemBatch(b *testing.B) {
+	ctx := context.Background()
+	customer, err := CreateCustomer(ctx, "Benchmark Customer", "billing@example.com")
+	require.NoError(b, err)
+	items := benchmarkItems(100)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		bill, err := CreateBill(ctx, customer.Id, time.Now().Add(24 * time.Hour), "USD", 0)
+		require.NoError(b, err)
+		b.StartTimer()
+		_, err = addBillItemBatch(ctx, bill.BillId, items, fmt.Sprintf("bench-%d", n))
+		require.NoError(b, err)
+	}
+	b.ReportMetric(float64(b.N*len(items))/b.Elapsed().Seconds(), "items/s")
+}
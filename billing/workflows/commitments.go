@@ -0,0 +1,352 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/sdk/temporal"
+)
+
+const commitmentColumns = `id, COALESCE(customer_id::text, ''), COALESCE(bill_id::text, ''), currency, minimum_amount, cap_amount, cap_mode,
+	alert_thresholds, created_at, updated_at`
+
+func scanCommitment(row interface{ Scan(...interface{}) error }, commitment *models.Commitment) error {
+	return row.Scan(&commitment.Id, &commitment.CustomerId, &commitment.BillId, &commitment.Currency, &commitment.MinimumAmount, &commitment.CapAmount, &commitment.CapMode,
+		&commitment.AlertThresholds, &commitment.CreatedAt, &commitment.UpdatedAt)
+}
+
+func validateCommitment(ctx context.Context, commitment models.Commitment) error {
+	err := validateCurrency(ctx, commitment.Currency)
+	if err != nil {
+		return err
+	}
+	switch {
+	case commitment.MinimumAmount < 0 || commitment.CapAmount < 0:
+		return temporal.NewNonRetryableApplicationError("Minimum and cap cannot be negative", "INVALID-DATA", nil)
+	case commitment.CapAmount > 0 && commitment.CapAmount < commitment.MinimumAmount:
+		return temporal.NewNonRetryableApplicationError("Cap is below the minimum", "INVALID-DATA", nil)
+	case commitment.CapMode != models.CapReject && commitment.CapMode != models.CapFlag:
+		return temporal.NewNonRetryableApplicationError("Invalid cap mode: "+commitment.CapMode, "INVALID-DATA", nil)
+	case commitment.CapAmount == 0 && len(commitment.AlertThresholds) > 0:
+		return temporal.NewNonRetryableApplicationError("Alert thresholds need a cap", "INVALID-DATA", nil)
+	}
+	below := 0
+	for _, threshold := range commitment.AlertThresholds {
+		if threshold <= below || threshold > 100 {
+			return temporal.NewNonRetryableApplicationError("Alert thresholds must be increasing percentages up to 100", "INVALID-DATA", nil)
+		}
+		below = threshold
+	}
+	return nil
+}
+
+// SaveCommitment sets the commitment of a customer or of a bill in one
+// currency, replacing the one it had. Bills only take commitments while
+// they are open.
+func SaveCommitment(ctx context.Context, commitment models.Commitment) (*models.Commitment, error) {
+	if commitment.CapMode == "" {
+		commitment.CapMode = models.CapReject
+	}
+	if commitment.AlertThresholds == nil {
+		commitment.AlertThresholds = []int{}
+	}
+	err := validateCommitment(ctx, commitment)
+	if err != nil {
+		return nil, err
+	}
+	conflict := "customer_id"
+	switch {
+	case (commitment.CustomerId == "") == (commitment.BillId == ""):
+		return nil, temporal.NewNonRetryableApplicationError("Commitments belong to either a customer or a bill", "INVALID-DATA", nil)
+	case commitment.CustomerId != "":
+		_, err = GetCustomer(ctx, commitment.CustomerId)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		conflict = "bill_id"
+		status, err := GetBillStatus(ctx, commitment.BillId)
+		if err != nil {
+			return nil, err
+		}
+		if status != models.BillStatusOpen && status != models.BillStatusClosing {
+			return nil, temporal.NewNonRetryableApplicationError("Commitments can only be set while the bill is open", "FAILED-PRECONDITION", nil)
+		}
+	}
+
+	var saved models.Commitment
+	err = scanCommitment(db.BillDb.QueryRow(ctx, `
+	INSERT INTO commitment
+	(customer_id, bill_id, currency, minimum_amount, cap_amount, cap_mode, alert_thresholds)
+	VALUES (NULLIF($1, '')::uuid,NULLIF($2, '')::uuid,$3,$4,$5,$6,$7)
+	ON CONFLICT (`+conflict+`, currency) WHERE `+conflict+` IS NOT NULL DO UPDATE
+	SET
+    minimum_amount = EXCLUDED.minimum_amount,
+    cap_amount = EXCLUDED.cap_amount,
+    cap_mode = EXCLUDED.cap_mode,
+    alert_thresholds = EXCLUDED.alert_thresholds,
+    updated_at = now()
+	RETURNING `+commitmentColumns+`
+	`, commitment.CustomerId, commitment.BillId, commitment.Currency, commitment.MinimumAmount, commitment.CapAmount, commitment.CapMode, commitment.AlertThresholds), &saved)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	return &saved, nil
+}
+
+// DeleteCommitment removes the commitment of a customer or of a bill in one currency.
+func DeleteCommitment(ctx context.Context, customerId string, billId string, currency string) error {
+	result, err := db.BillDb.Exec(ctx, `
+	DELETE FROM commitment
+	WHERE customer_id IS NOT DISTINCT FROM NULLIF($1, '')::uuid AND bill_id IS NOT DISTINCT FROM NULLIF($2, '')::uuid AND currency = $3
+	`, customerId, billId, currency)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	if result.RowsAffected() == 0 {
+		return temporal.NewNonRetryableApplicationError("Commitment not found", "NOT_FOUND", nil)
+	}
+	return nil
+}
+
+// ListCustomerCommitments returns the commitments of a customer ordered by currency.
+func ListCustomerCommitments(ctx context.Context, customerId string) ([]models.Commitment, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT `+commitmentColumns+`
+	FROM commitment
+	WHERE customer_id = $1
+	ORDER BY currency
+	`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanCommitments(rows)
+}
+
+// ListBillCommitments returns the commitments in effect for a bill: its own,
+// and those of its customer in the other currencies.
+func ListBillCommitments(ctx context.Context, billId string) ([]models.Commitment, error) {
+	var customerId string
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT COALESCE(customer_id::text, '')
+	FROM bill
+	WHERE id = $1
+	`, billId).Scan(&customerId)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return billCommitments(ctx, db.BillDb, billId, customerId)
+}
+
+func billCommitments(ctx context.Context, q querier, billId string, customerId string) ([]models.Commitment, error) {
+	rows, err := q.Query(ctx, `
+	SELECT DISTINCT ON (currency) `+commitmentColumns+`
+	FROM commitment
+	WHERE bill_id = $1 OR customer_id = NULLIF($2, '')::uuid
+	ORDER BY currency, bill_id IS NULL
+	`, billId, customerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanCommitments(rows)
+}
+
+func scanCommitments(rows *sqldb.Rows) ([]models.Commitment, error) {
+	commitments := []models.Commitment{}
+	for rows.Next() {
+		var commitment models.Commitment
+		err := scanCommitment(rows, &commitment)
+		if err != nil {
+			return nil, err
+		}
+		commitments = append(commitments, commitment)
+	}
+	return commitments, nil
+}
+
+// lockBillTotal returns the running total of a bill in one currency, locking
+// it until the transaction ends so that concurrent items are counted in turn.
+func lockBillTotal(ctx context.Context, q querier, billId string, currency string) (int64, error) {
+	var total int64
+	err := q.QueryRow(ctx, `
+	INSERT INTO bill_total
+	(bill_id, currency, total_amount, item_count)
+	VALUES ($1,$2,0,0)
+	ON CONFLICT (bill_id, currency) DO UPDATE
+	SET total_amount = bill_total.total_amount
+	RETURNING total_amount
+	`, billId, currency).Scan(&total)
+	return total, err
+}
+
+// reachedShare reports whether total is at least percent of the cap.
+func reachedShare(total int64, capAmount int64, percent int) bool {
+	share := new(big.Int).Mul(big.NewInt(capAmount), big.NewInt(int64(percent)))
+	return new(big.Int).Mul(big.NewInt(total), big.NewInt(100)).Cmp(share) >= 0
+}
+
+// capAlert is an alert raised by an item, published once the item is added.
+type capAlert struct {
+	eventType string
+	alert models.SpendAlert
+}
+
+// spendCaps checks the items added to a bill in one transaction against the
+// caps of the bill, keeping track of the totals they add up to.
+type spendCaps struct {
+	bill models.Bill
+	caps map[string]*models.Commitment
+	totals map[string]int64
+}
+
+func newSpendCaps(bill models.Bill) *spendCaps {
+	return &spendCaps{bill: bill, caps: make(map[string]*models.Commitment), totals: make(map[string]int64)}
+}
+
+// check counts a charge against the cap of its currency. Charges that would
+// go over a rejecting cap are refused, those going over a flagging cap are
+// flagged in their metadata. It returns the alerts the charge raises.
+func (c *spendCaps) check(ctx context.Context, q querier, item *models.BillItem) ([]capAlert, error) {
+	if item.Kind == "adjustment" || item.Amount <= 0 {
+		return nil, nil
+	}
+	commitment, loaded := c.caps[item.Currency]
+	if !loaded {
+		commitments, err := billCommitments(ctx, q, c.bill.BillId, c.bill.CustomerId)
+		if err != nil {
+			return nil, err
+		}
+		for i := range commitments {
+			if commitments[i].Currency == item.Currency && commitments[i].CapAmount > 0 {
+				commitment = &commitments[i]
+			}
+		}
+		c.caps[item.Currency] = commitment
+		if commitment != nil {
+			c.totals[item.Currency], err = lockBillTotal(ctx, q, c.bill.BillId, item.Currency)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if commitment == nil {
+		return nil, nil
+	}
+
+	before := c.totals[item.Currency]
+	after, err := models.AddAmounts(before, item.Amount)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Bill total overflows", "INVALID-DATA", nil)
+	}
+	var alerts []capAlert
+	for _, threshold := range commitment.AlertThresholds {
+		if reachedShare(before, commitment.CapAmount, threshold) || !reachedShare(after, commitment.CapAmount, threshold) {
+			continue
+		}
+		result, err := q.Exec(ctx, `
+		INSERT INTO bill_cap_alert
+		(bill_id, currency, threshold)
+		VALUES ($1,$2,$3)
+		ON CONFLICT DO NOTHING
+		`, c.bill.BillId, item.Currency, threshold)
+		if err != nil {
+			return nil, err
+		}
+		// Thresholds alert once, even if voided items take the bill below them again.
+		if result.RowsAffected() > 0 {
+			alerts = append(alerts, capAlert{eventType: models.EventBillCapApproaching, alert: models.SpendAlert{
+				Currency: item.Currency, Threshold: threshold, CapAmount: commitment.CapAmount, TotalAmount: after,
+			}})
+		}
+	}
+	if after > commitment.CapAmount {
+		if commitment.CapMode != models.CapFlag {
+			return nil, temporal.NewNonRetryableApplicationError(fmt.Sprintf("Item would take the bill over its spending cap of %s",
+				Currencies.Format(ctx, commitment.CapAmount, item.Currency)), "FAILED-PRECONDITION", nil)
+		}
+		metadata := make(map[string]string, len(item.Metadata)+1)
+		for key, value := range item.Metadata {
+			metadata[key] = value
+		}
+		metadata["capExceeded"] = "true"
+		item.Metadata = metadata
+		alerts = append(alerts, capAlert{eventType: models.EventBillCapExceeded, alert: models.SpendAlert{
+			Currency: item.Currency, CapAmount: commitment.CapAmount, TotalAmount: after,
+		}})
+	}
+	c.totals[item.Currency] = after
+	return alerts, nil
+}
+
+// enqueueCapAlerts writes the alerts an added item raised to the outbox and returns their event IDs.
+func enqueueCapAlerts(ctx context.Context, q querier, bill models.Bill, item *models.BillItem, alerts []capAlert) ([]string, error) {
+	eventIds := make([]string, 0, len(alerts))
+	for _, alert := range alerts {
+		var alertItem *models.BillItem
+		if alert.eventType == models.EventBillCapExceeded {
+			alertItem = item
+		}
+		eventId, err := enqueueSpendAlert(ctx, q, alert.eventType, bill, alertItem, alert.alert)
+		if err != nil {
+			return nil, err
+		}
+		eventIds = append(eventIds, eventId)
+	}
+	return eventIds, nil
+}
+
+// applyMinimumCommitments adds a true-up item in each currency in which the
+// items of a closing bill fall short of its minimum commitment. It returns
+// the IDs of the events of the items.
+func applyMinimumCommitments(ctx context.Context, q querier, bill models.Bill) ([]string, error) {
+	commitments, err := billCommitments(ctx, q, bill.BillId, bill.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+	var eventIds []string
+	for _, commitment := range commitments {
+		if commitment.MinimumAmount == 0 {
+			continue
+		}
+		total, err := lockBillTotal(ctx, q, bill.BillId, commitment.Currency)
+		if err != nil {
+			return nil, err
+		}
+		if total >= commitment.MinimumAmount {
+			continue
+		}
+		rounding, err := Currencies.RoundingMode(ctx, commitment.Currency)
+		if err != nil {
+			return nil, err
+		}
+		item, err := normalizeBillItem(models.BillItem{
+			Amount: commitment.MinimumAmount - total,
+			Currency: commitment.Currency,
+			Description: "Minimum commitment true-up",
+			Metadata: map[string]string{"commitmentId": commitment.Id},
+		}, rounding)
+		if err != nil {
+			return nil, err
+		}
+		item.Id, err = insertBillItem(ctx, q, bill.BillId, item)
+		if err != nil {
+			return nil, err
+		}
+		eventId, err := enqueueEvent(ctx, q, models.EventBillItemAdded, bill, &item)
+		if err != nil {
+			return nil, err
+		}
+		eventIds = append(eventIds, eventId)
+	}
+	return eventIds, nil
+}
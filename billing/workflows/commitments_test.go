@@ -0,0 +1,154 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReachedShare(t *testing.T) {
+	require.True(t, reachedShare(800, 1000, 80))
+	require.False(t, reachedShare(799, 1000, 80))
+	require.True(t, reachedShare(1000, 1000, 100))
+}
+
+func TestSaveCommitment_Invalid(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	_, err := SaveCommitment(ctx, models.Commitment{CustomerId: customerId, Currency: "USD", MinimumAmount: 1000, CapAmount: 500})
+	require.Error(t, err)
+	_, err = SaveCommitment(ctx, models.Commitment{CustomerId: customerId, Currency: "USD", AlertThresholds: []int{80}})
+	require.Error(t, err)
+	_, err = SaveCommitment(ctx, models.Commitment{CustomerId: customerId, Currency: "USD", CapAmount: 1000, AlertThresholds: []int{90, 80}})
+	require.Error(t, err)
+	_, err = SaveCommitment(ctx, models.Commitment{CustomerId: customerId, Currency: "USD", CapAmount: 1000, CapMode: "warn"})
+	require.Error(t, err)
+
+	bill := createInvoicedBill(t, customerId)
+	_, err = SaveCommitment(ctx, models.Commitment{BillId: bill, Currency: "USD", MinimumAmount: 1000})
+	require.Error(t, err)
+}
+
+func TestCloseBill_MinimumCommitmentTrueUp(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	_, err := SaveCommitment(ctx, models.Commitment{CustomerId: customerId, Currency: "USD", MinimumAmount: 5000})
+	require.NoError(t, err)
+
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1200, Currency: "USD"})
+	summary, err := GetBillSummary(ctx, billId)
+	require.NoError(t, err)
+	require.Equal(t, int64(5000), summary.BillItemSummary[0].TotalAmount)
+	items, err := getBillItems(ctx, db.BillDb, billId)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, int64(3800), items[1].Amount)
+	require.Equal(t, "Minimum commitment true-up", items[1].Description)
+
+	// Bills above the minimum are left as they are.
+	billId = createInvoicedBill(t, customerId, models.BillItem{Amount: 6000, Currency: "USD"})
+	items, err = getBillItems(ctx, db.BillDb, billId)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+
+	// A commitment of the bill replaces the customer's.
+	bill, err := CreateBill(ctx, customerId, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = SaveCommitment(ctx, models.Commitment{BillId: bill.BillId, Currency: "USD", MinimumAmount: 100})
+	require.NoError(t, err)
+	commitments, err := ListBillCommitments(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, commitments, 1)
+	require.Equal(t, int64(100), commitments[0].MinimumAmount)
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	items, err = getBillItems(ctx, db.BillDb, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, int64(100), items[0].Amount)
+}
+
+func TestCloseBill_MinimumCommitmentIsTaxed(t *testing.T) {
+	ctx := context.Background()
+	_, err := SaveTaxRate(ctx, models.TaxRate{Jurisdiction: "GE-TU", TaxCategory: models.TaxCategoryStandard, Rate: "0.1", EffectiveAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)})
+	require.NoError(t, err)
+	customerId := createTestCustomer(t)
+	_, err = SaveCustomerTaxProfile(ctx, models.CustomerTaxProfile{CustomerId: customerId, Jurisdiction: "GE-TU"})
+	require.NoError(t, err)
+	_, err = SaveCommitment(ctx, models.Commitment{CustomerId: customerId, Currency: "USD", MinimumAmount: 5000})
+	require.NoError(t, err)
+
+	// The true-up is taxed like the items it makes up for.
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1200, Currency: "USD"})
+	summary, err := GetBillSummary(ctx, billId)
+	require.NoError(t, err)
+	require.Len(t, summary.TaxLines, 1)
+	require.Equal(t, int64(5000), summary.TaxLines[0].TaxableAmount)
+	require.Equal(t, int64(500), summary.TaxLines[0].TaxAmount)
+	require.Equal(t, int64(5500), summary.BillItemSummary[0].TotalAmount)
+}
+
+func TestAddBillItem_SpendingCap(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	_, err := SaveCommitment(ctx, models.Commitment{CustomerId: customerId, Currency: "USD", CapAmount: 1000, AlertThresholds: []int{50, 80}})
+	require.NoError(t, err)
+	bill, err := CreateBill(ctx, customerId, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 600, Currency: "USD"})
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 300, Currency: "USD"})
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 200, Currency: "USD"})
+	require.Error(t, err)
+	require.Equal(t, "FAILED-PRECONDITION", applicationErrorType(err))
+	// Other currencies are not capped.
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 2000, Currency: "GEL"})
+	require.NoError(t, err)
+
+	var thresholds []int
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT payload
+	FROM event_outbox
+	WHERE event_type = $1 AND payload->>'billId' = $2
+	ORDER BY created_at
+	`, models.EventBillCapApproaching, bill.BillId)
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var payload []byte
+		require.NoError(t, rows.Scan(&payload))
+		var event models.BillEvent
+		require.NoError(t, json.Unmarshal(payload, &event))
+		thresholds = append(thresholds, event.SpendAlert.Threshold)
+	}
+	require.Equal(t, []int{50, 80}, thresholds)
+}
+
+func TestAddBillItem_FlaggingCap(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	bill, err := CreateBill(ctx, customerId, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = SaveCommitment(ctx, models.Commitment{BillId: bill.BillId, Currency: "USD", CapAmount: 1000, CapMode: models.CapFlag})
+	require.NoError(t, err)
+
+	ids, err := AddBillItemBatch(ctx, bill.BillId, []models.BillItem{{Amount: 800, Currency: "USD"}, {Amount: 400, Currency: "USD"}})
+	require.NoError(t, err)
+	require.Len(t, ids, 2)
+	items, err := getBillItems(ctx, db.BillDb, bill.BillId)
+	require.NoError(t, err)
+	for _, item := range items {
+		// Items of a batch are checked in order, so only the second goes over the cap.
+		if item.Amount == 800 {
+			require.Empty(t, item.Metadata["capExceeded"])
+		} else {
+			require.Equal(t, "true", item.Metadata["capExceeded"])
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package workflows
+
+import (
+	"context"
+	"strings"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"go.temporal.io/sdk/temporal"
+)
+
+// CreateCreditNote credits a customer for items of a closed bill. Every item
+// must be an adjustment of a charge on that bill, and together with earlier
+// adjustments cannot credit more than was charged; either all of them are
+// recorded or none are. What was already paid beyond the credited total
+// becomes credit of the customer.
+func CreateCreditNote(ctx context.Context, billId string, reason string, items []models.BillItem) (*models.CreditNote, error) {
+	if strings.TrimSpace(reason) == "" {
+		return nil, temporal.NewNonRetryableApplicationError("A credit note needs a reason", "INVALID-DATA", nil)
+	}
+	if len(items) == 0 {
+		return nil, temporal.NewNonRetryableApplicationError("A credit note needs at least one item", "INVALID-DATA", nil)
+	}
+
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status, customerId string
+	err = tx.QueryRow(ctx, `
+	SELECT status, COALESCE(customer_id::text, '')
+	FROM bill
+	WHERE id = $1
+	FOR UPDATE
+	`, billId).Scan(&status, &customerId)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+	switch status {
+	case models.BillStatusOpen, models.BillStatusClosing:
+		return nil, temporal.NewNonRetryableApplicationError("Open bills are adjusted directly, not with credit notes", "FAILED-PRECONDITION", nil)
+	case models.BillStatusVoid:
+		return nil, temporal.NewNonRetryableApplicationError("Void bills cannot be credited", "FAILED-PRECONDITION", nil)
+	}
+
+	creditNote := models.CreditNote{BillId: billId, Reason: reason}
+	err = tx.QueryRow(ctx, `
+	INSERT INTO credit_note
+	(bill_id, reason)
+	VALUES ($1,$2)
+	RETURNING id, created_at
+	`, billId, reason).Scan(&creditNote.Id, &creditNote.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		item.Kind = "adjustment"
+		item.CreditNoteId = creditNote.Id
+		rounding, err := Currencies.RoundingMode(ctx, item.Currency)
+		if err != nil {
+			return nil, err
+		}
+		item, err = normalizeBillItem(item, rounding)
+		if err != nil {
+			return nil, err
+		}
+		err = validateBillItem(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		// Adjustments are checked against the charge and its earlier adjustments as they are inserted.
+		item.Id, err = insertBillItem(ctx, tx, billId, item)
+		if err != nil {
+			return nil, err
+		}
+		creditNote.BillItems = append(creditNote.BillItems, item)
+	}
+	err = creditBillTax(ctx, tx, billId, creditNote.Id, creditNote.BillItems)
+	if err != nil {
+		return nil, err
+	}
+	err = refundCreditedBill(ctx, tx, billId, customerId, status, creditNote.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &creditNote, nil
+}
+
+// refundCreditedBill gives back what was paid on a bill beyond its total
+// after a credit note as customer credit, and marks a bill that no longer
+// owes anything as paid.
+func refundCreditedBill(ctx context.Context, q querier, billId string, customerId string, status string, creditNoteId string) error {
+	balances, err := getBillBalances(ctx, q, billId)
+	if err != nil {
+		return err
+	}
+	settled := true
+	for _, balance := range balances {
+		if balance.Outstanding > 0 {
+			settled = false
+			continue
+		}
+		// Discounts can leave a credited bill below zero, which was never paid.
+		refund := min(-balance.Outstanding, balance.Paid)
+		if refund <= 0 {
+			continue
+		}
+		if customerId == "" {
+			return temporal.NewNonRetryableApplicationError("Overpaid bills need a customer to hold the credit", "INVALID-DATA", nil)
+		}
+		_, err = q.Exec(ctx, `
+		INSERT INTO customer_credit
+		(customer_id, currency, amount, credit_note_id)
+		VALUES ($1,$2,$3,$4)
+		`, customerId, balance.Currency, refund, creditNoteId)
+		if err != nil {
+			return err
+		}
+	}
+	if settled && isUnsettled(status) {
+		_, err = transitionBill(ctx, q, billId, models.BillStatusPaid, "Credit note "+creditNoteId)
+		return err
+	}
+	return nil
+}
+
+func ListCreditNotes(ctx context.Context, billId string) ([]models.CreditNote, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT id, bill_id, reason, created_at
+	FROM credit_note
+	WHERE bill_id = $1
+	ORDER BY created_at
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creditNotes []models.CreditNote
+	for rows.Next() {
+		var creditNote models.CreditNote
+		err := rows.Scan(&creditNote.Id, &creditNote.BillId, &creditNote.Reason, &creditNote.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		creditNotes = append(creditNotes, creditNote)
+	}
+	if len(creditNotes) == 0 {
+		return creditNotes, nil
+	}
+
+	items, err := getBillItems(ctx, db.BillDb, billId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range creditNotes {
+		for _, item := range items {
+			if item.CreditNoteId == creditNotes[i].Id {
+				creditNotes[i].BillItems = append(creditNotes[i].BillItems, item)
+			}
+		}
+	}
+	return creditNotes, nil
+}
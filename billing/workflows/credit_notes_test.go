@@ -0,0 +1,136 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdjustment_OpenBill(t *testing.T) {
+	ctx := context.Background()
+	bill, _ := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24*time.Hour), "USD", 0)
+	chargeId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 1000, Currency: "USD"})
+	require.NoError(t, err)
+
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Kind: "adjustment", Amount: -1500, Currency: "USD", AdjustsItemId: chargeId})
+	require.Error(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Kind: "adjustment", Amount: -300, Currency: "GEL", AdjustsItemId: chargeId})
+	require.Error(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: -300, Currency: "USD", AdjustsItemId: chargeId})
+	require.Error(t, err)
+
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Kind: "adjustment", Description: "Goodwill credit", Amount: -300, Currency: "USD", AdjustsItemId: chargeId})
+	require.NoError(t, err)
+
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	summary, err := GetBillSummary(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Equal(t, int64(700), summary.BillItemSummary[0].TotalAmount)
+}
+
+func TestCreditNote_ClosedBill(t *testing.T) {
+	ctx := context.Background()
+	bill, _ := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24*time.Hour), "USD", 0)
+	chargeId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 1000, Currency: "USD"})
+	require.NoError(t, err)
+
+	credit := []models.BillItem{{Amount: -400, Currency: "USD", AdjustsItemId: chargeId}}
+	_, err = CreateCreditNote(ctx, bill.BillId, "Service outage", credit)
+	require.Error(t, err)
+
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	creditNote, err := CreateCreditNote(ctx, bill.BillId, "Service outage", credit)
+	require.NoError(t, err)
+	require.Len(t, creditNote.BillItems, 1)
+
+	// A credit note is all or nothing.
+	_, err = CreateCreditNote(ctx, bill.BillId, "Too much", []models.BillItem{
+		{Amount: -100, Currency: "USD", AdjustsItemId: chargeId},
+		{Amount: -600, Currency: "USD", AdjustsItemId: chargeId},
+	})
+	require.Error(t, err)
+
+	summary, err := GetBillSummary(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Equal(t, int64(600), summary.BillItemSummary[0].TotalAmount)
+	require.Len(t, summary.CreditNotes, 1)
+}
+
+func TestCreditNote_PaidBillBecomesCustomerCredit(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	bill, err := CreateBill(ctx, customerId, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+	chargeId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 1000, Currency: "USD"})
+	require.NoError(t, err)
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	_, err = RecordPayment(ctx, bill.BillId, models.Payment{Amount: 1000, Currency: "USD", Method: "card"})
+	require.NoError(t, err)
+
+	_, err = CreateCreditNote(ctx, bill.BillId, "Service outage", []models.BillItem{{Amount: -300, Currency: "USD", AdjustsItemId: chargeId}})
+	require.NoError(t, err)
+	credits, err := GetCustomerCredit(ctx, customerId)
+	require.NoError(t, err)
+	require.Len(t, credits, 1)
+	require.Equal(t, int64(300), credits[0].Amount)
+
+	// The credit is taken off what the bill counts as paid, so it is only given once.
+	balances, err := GetBillBalances(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Equal(t, int64(700), balances[0].Paid)
+	require.Equal(t, int64(0), balances[0].Outstanding)
+
+	_, err = CreateCreditNote(ctx, bill.BillId, "Second outage", []models.BillItem{{Amount: -200, Currency: "USD", AdjustsItemId: chargeId}})
+	require.NoError(t, err)
+	credits, err = GetCustomerCredit(ctx, customerId)
+	require.NoError(t, err)
+	require.Equal(t, int64(500), credits[0].Amount)
+}
+
+func TestBillItem_Immutable(t *testing.T) {
+	ctx := context.Background()
+	bill, _ := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24*time.Hour), "USD", 0)
+	chargeId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 1000, Currency: "USD"})
+	require.NoError(t, err)
+
+	_, err = db.BillDb.Exec(ctx, `UPDATE bill_item SET amount = 1, unit_price = 1 WHERE id = $1`, chargeId)
+	require.Error(t, err)
+	_, err = db.BillDb.Exec(ctx, `DELETE FROM bill_item WHERE id = $1`, chargeId)
+	require.Error(t, err)
+}
+
+func TestCreditNote_TakesBackTax(t *testing.T) {
+	ctx := context.Background()
+	_, err := SaveTaxRate(ctx, models.TaxRate{Jurisdiction: "GE-TU", TaxCategory: models.TaxCategoryStandard, Rate: "0.1", EffectiveAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)})
+	require.NoError(t, err)
+	customerId := createTestCustomer(t)
+	_, err = SaveCustomerTaxProfile(ctx, models.CustomerTaxProfile{CustomerId: customerId, Jurisdiction: "GE-TU"})
+	require.NoError(t, err)
+	bill, err := CreateBill(ctx, customerId, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+	chargeId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 1000, Currency: "USD"})
+	require.NoError(t, err)
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+
+	creditNote, err := CreateCreditNote(ctx, bill.BillId, "Service outage", []models.BillItem{{Amount: -400, Currency: "USD", AdjustsItemId: chargeId}})
+	require.NoError(t, err)
+	summary, err := GetBillSummary(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, summary.TaxLines, 2)
+	require.Equal(t, creditNote.Id, summary.TaxLines[1].CreditNoteId)
+	require.Equal(t, int64(-400), summary.TaxLines[1].TaxableAmount)
+	require.Equal(t, int64(-40), summary.TaxLines[1].TaxAmount)
+	require.Equal(t, int64(60), summary.BillItemSummary[0].TaxAmount)
+	require.Equal(t, int64(660), summary.Balances[0].Total)
+
+	// Crediting the rest takes back all of the tax.
+	_, err = CreateCreditNote(ctx, bill.BillId, "Cancelled", []models.BillItem{{Amount: -600, Currency: "USD", AdjustsItemId: chargeId}})
+	require.NoError(t, err)
+	balances, err := GetBillBalances(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Zero(t, balances[0].Total)
+}
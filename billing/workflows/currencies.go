@@ -0,0 +1,237 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/sdk/temporal"
+)
+
+// currencyCacheTTL bounds how long a change made through another instance takes to become visible.
+const currencyCacheTTL = time.Minute
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// CurrencyRegistry is an in-memory cache of the currency table.
+type CurrencyRegistry struct {
+	mu sync.RWMutex
+	currencies map[string]models.Currency
+	loadedAt time.Time
+}
+
+// Currencies is the registry shared by the service and its activities.
+var Currencies = &CurrencyRegistry{}
+
+// Load replaces the cached currencies with the contents of the currency table.
+func (r *CurrencyRegistry) Load(ctx context.Context) error {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT code, exponent, symbol, enabled, rounding_mode
+	FROM currency
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	currencies := make(map[string]models.Currency)
+	for rows.Next() {
+		var currency models.Currency
+		err := rows.Scan(&currency.Code, &currency.Exponent, &currency.Symbol, &currency.Enabled, &currency.RoundingMode)
+		if err != nil {
+			return err
+		}
+		currencies[currency.Code] = currency
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.currencies = currencies
+	r.loadedAt = time.Now()
+	return nil
+}
+
+func (r *CurrencyRegistry) refresh(ctx context.Context) error {
+	r.mu.RLock()
+	stale := time.Since(r.loadedAt) > currencyCacheTTL
+	r.mu.RUnlock()
+	if stale {
+		return r.Load(ctx)
+	}
+	return nil
+}
+
+// Lookup returns a currency by code, including disabled currencies.
+func (r *CurrencyRegistry) Lookup(ctx context.Context, code string) (models.Currency, bool, error) {
+	err := r.refresh(ctx)
+	if err != nil {
+		return models.Currency{}, false, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	currency, ok := r.currencies[code]
+	return currency, ok, nil
+}
+
+// Format renders an amount in minor units of the given currency, falling back
+// to the bare number and code for unknown currencies.
+func (r *CurrencyRegistry) Format(ctx context.Context, amount int64, code string) string {
+	currency, ok, err := r.Lookup(ctx, code)
+	if err != nil || !ok {
+		return models.Currency{Code: code, Symbol: code + " "}.Format(amount)
+	}
+	return currency.Format(amount)
+}
+
+// RoundingMode returns how amounts in a currency are rounded. Unknown
+// currencies round half to even; items in them are rejected anyway.
+func (r *CurrencyRegistry) RoundingMode(ctx context.Context, code string) (string, error) {
+	currency, ok, err := r.Lookup(ctx, code)
+	if err != nil || !ok {
+		return models.RoundHalfEven, err
+	}
+	return currency.RoundingMode, nil
+}
+
+// CurrencyRoundingMode is Currencies.RoundingMode as a local activity, for
+// workflows computing the amounts of items with a decimal unit price.
+func CurrencyRoundingMode(ctx context.Context, code string) (string, error) {
+	return Currencies.RoundingMode(ctx, code)
+}
+
+// validateCurrency checks that a currency is registered and enabled.
+func validateCurrency(ctx context.Context, code string) error {
+	currency, ok, err := Currencies.Lookup(ctx, code)
+	if err != nil {
+		return err
+	}
+	if !ok || !currency.Enabled {
+		return temporal.NewNonRetryableApplicationError("Invalid currency: "+code, "INVALID-DATA", nil)
+	}
+	return nil
+}
+
+func ListCurrencies(ctx context.Context) ([]models.Currency, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT code, exponent, symbol, enabled, rounding_mode
+	FROM currency
+	ORDER BY code
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var currencies []models.Currency
+	for rows.Next() {
+		var currency models.Currency
+		err := rows.Scan(&currency.Code, &currency.Exponent, &currency.Symbol, &currency.Enabled, &currency.RoundingMode)
+		if err != nil {
+			return nil, err
+		}
+		currencies = append(currencies, currency)
+	}
+	return currencies, nil
+}
+
+// minorUnitTables store amounts in minor units of the currency in their
+// currency column, which the exponent of that currency gives the value of.
+var minorUnitTables = []string{
+	"bill_item",
+	"bill_total",
+	"bill_discount_line",
+	"bill_tax_line",
+	"payment",
+	"customer_credit",
+	"commitment",
+	"meter_price",
+	"coupon",
+}
+
+// SaveCurrency adds a currency to the registry or updates an existing one.
+// The exponent of a currency already used by any of minorUnitTables cannot
+// change, as that would reinterpret stored amounts.
+func SaveCurrency(ctx context.Context, currency models.Currency) (*models.Currency, error) {
+	if !currencyCodePattern.MatchString(currency.Code) {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid currency code: "+currency.Code, "INVALID-DATA", nil)
+	}
+	if currency.Exponent < 0 || currency.Exponent > 4 {
+		return nil, temporal.NewNonRetryableApplicationError("Currency exponent must be between 0 and 4", "INVALID-DATA", nil)
+	}
+	if currency.Symbol == "" {
+		currency.Symbol = currency.Code + " "
+	}
+	if currency.RoundingMode == "" {
+		currency.RoundingMode = models.RoundHalfEven
+	}
+	if currency.RoundingMode != models.RoundHalfEven && currency.RoundingMode != models.RoundHalfUp {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid rounding mode: "+currency.RoundingMode, "INVALID-DATA", nil)
+	}
+
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Rows referencing the currency lock it against updates, so locking it
+	// here keeps new amounts from being stored until the exponent is saved.
+	var exponent int
+	err = tx.QueryRow(ctx, `
+	SELECT exponent
+	FROM currency
+	WHERE code = $1
+	FOR UPDATE
+	`, currency.Code).Scan(&exponent)
+	if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, err
+	}
+	if err == nil && exponent != currency.Exponent {
+		var uses []string
+		for _, table := range minorUnitTables {
+			uses = append(uses, "EXISTS (SELECT 1 FROM "+table+" WHERE currency = $1)")
+		}
+		var inUse bool
+		err = tx.QueryRow(ctx, `SELECT `+strings.Join(uses, " OR "), currency.Code).Scan(&inUse)
+		if err != nil {
+			return nil, err
+		}
+		if inUse {
+			return nil, temporal.NewNonRetryableApplicationError("Cannot change the exponent of a currency in use", "FAILED-PRECONDITION", nil)
+		}
+	}
+
+	var saved models.Currency
+	err = tx.QueryRow(ctx, `
+	INSERT INTO currency
+	(code, exponent, symbol, enabled, rounding_mode)
+	VALUES ($1,$2,$3,$4,$5)
+	ON CONFLICT (code) DO UPDATE
+	SET
+    exponent = EXCLUDED.exponent,
+    symbol = EXCLUDED.symbol,
+    enabled = EXCLUDED.enabled,
+    rounding_mode = EXCLUDED.rounding_mode,
+    updated_at = NOW()
+	RETURNING code, exponent, symbol, enabled, rounding_mode
+	`, currency.Code, currency.Exponent, currency.Symbol, currency.Enabled, currency.RoundingMode).Scan(&saved.Code, &saved.Exponent, &saved.Symbol, &saved.Enabled, &saved.RoundingMode)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	err = Currencies.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
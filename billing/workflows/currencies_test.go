@@ -0,0 +1,49 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCurrency_EnableNewCurrency(t *testing.T) {
+	ctx := context.Background()
+	bill, _ := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24*time.Hour), "USD", 0)
+
+	_, err := SaveCurrency(ctx, models.Currency{Code: "JPY", Exponent: 0, Symbol: "¥", Enabled: false})
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 500, Currency: "JPY"})
+	require.Error(t, err)
+
+	_, err = SaveCurrency(ctx, models.Currency{Code: "JPY", Exponent: 0, Symbol: "¥", Enabled: true})
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 500, Currency: "JPY"})
+	require.NoError(t, err)
+	require.Equal(t, "¥500", Currencies.Format(ctx, 500, "JPY"))
+
+	_, err = SaveCurrency(ctx, models.Currency{Code: "JPY", Exponent: 2, Symbol: "¥", Enabled: true})
+	require.Error(t, err)
+}
+
+func TestCurrency_ExponentUsedByCommitment(t *testing.T) {
+	ctx := context.Background()
+	_, err := SaveCurrency(ctx, models.Currency{Code: "BHD", Exponent: 3, Symbol: "BD ", Enabled: true})
+	require.NoError(t, err)
+	_, err = SaveCommitment(ctx, models.Commitment{CustomerId: createTestCustomer(t), Currency: "BHD", MinimumAmount: 5000})
+	require.NoError(t, err)
+
+	// Amounts stored outside of bill items hold on to the exponent too.
+	_, err = SaveCurrency(ctx, models.Currency{Code: "BHD", Exponent: 2, Symbol: "BD ", Enabled: true})
+	require.Error(t, err)
+	require.Equal(t, "FAILED-PRECONDITION", applicationErrorType(err))
+	_, err = SaveCurrency(ctx, models.Currency{Code: "BHD", Exponent: 3, Symbol: "BHD ", Enabled: true})
+	require.NoError(t, err)
+}
+
+func TestCurrency_InvalidCode(t *testing.T) {
+	_, err := SaveCurrency(context.Background(), models.Currency{Code: "usd", Exponent: 2, Enabled: true})
+	require.Error(t, err)
+}
@@ -0,0 +1,166 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/sdk/temporal"
+)
+
+// BillWorkflowId returns the ComposeBill workflow ID for a bill. The customer
+// prefix lets visibility queries filter per account, e.g.
+// WorkflowId STARTS_WITH "customer/<customerId>/".
+func BillWorkflowId(customerId string, billId string) string {
+	return fmt.Sprintf("customer/%s/bill/%s", customerId, billId)
+}
+
+func validateCustomer(name string, email string) error {
+	if strings.TrimSpace(name) == "" {
+		return temporal.NewNonRetryableApplicationError("Customer name is required", "INVALID-DATA", nil)
+	}
+	if _, err := mail.ParseAddress(email); err != nil {
+		return temporal.NewNonRetryableApplicationError("Invalid customer email: "+email, "INVALID-DATA", nil)
+	}
+	return nil
+}
+
+func CreateCustomer(ctx context.Context, name string, email string) (*models.Customer, error) {
+	err := validateCustomer(name, email)
+	if err != nil {
+		return nil, err
+	}
+
+	var customer models.Customer
+	err = db.BillDb.QueryRow(ctx, `
+	INSERT INTO customer
+	(name, email)
+	VALUES ($1,$2)
+	RETURNING id, name, email, created_at, updated_at, suspended_at
+	`, name, email).Scan(&customer.Id, &customer.Name, &customer.Email, &customer.CreatedAt, &customer.UpdatedAt, &customer.SuspendedAt)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	return &customer, nil
+}
+
+func GetCustomer(ctx context.Context, customerId string) (*models.Customer, error) {
+	var customer models.Customer
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT id, name, email, created_at, updated_at, suspended_at
+	FROM customer
+	WHERE id = $1 AND deleted_at IS NULL
+	`, customerId).Scan(&customer.Id, &customer.Name, &customer.Email, &customer.CreatedAt, &customer.UpdatedAt, &customer.SuspendedAt)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Customer not found", "NOT_FOUND", nil)
+	}
+	return &customer, nil
+}
+
+func ListCustomers(ctx context.Context) ([]models.Customer, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT id, name, email, created_at, updated_at, suspended_at
+	FROM customer
+	WHERE deleted_at IS NULL
+	ORDER BY created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var customers []models.Customer
+	for rows.Next() {
+		var customer models.Customer
+		err := rows.Scan(&customer.Id, &customer.Name, &customer.Email, &customer.CreatedAt, &customer.UpdatedAt, &customer.SuspendedAt)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, customer)
+	}
+	return customers, nil
+}
+
+func UpdateCustomer(ctx context.Context, customerId string, name string, email string) (*models.Customer, error) {
+	err := validateCustomer(name, email)
+	if err != nil {
+		return nil, err
+	}
+
+	var customer models.Customer
+	err = db.BillDb.QueryRow(ctx, `
+	UPDATE customer
+	SET
+    name = $2,
+    email = $3,
+    updated_at = NOW()
+	WHERE id = $1 AND deleted_at IS NULL
+	RETURNING id, name, email, created_at, updated_at, suspended_at
+	`, customerId, name, email).Scan(&customer.Id, &customer.Name, &customer.Email, &customer.CreatedAt, &customer.UpdatedAt, &customer.SuspendedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, temporal.NewNonRetryableApplicationError("Customer not found", "NOT_FOUND", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &customer, nil
+}
+
+// DeleteCustomer soft-deletes a customer so that its settled bills stay intact.
+// Customers with open bills, or bills still awaiting payment, cannot be deleted.
+// Its billing schedules are deactivated along with it.
+func DeleteCustomer(ctx context.Context, customerId string) error {
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the customer keeps bills from being created for it until it is deleted.
+	var id string
+	err = tx.QueryRow(ctx, `
+	SELECT id
+	FROM customer
+	WHERE id = $1 AND deleted_at IS NULL
+	FOR UPDATE
+	`, customerId).Scan(&id)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError("Customer not found", "NOT_FOUND", nil)
+	}
+
+	var openBills int
+	err = tx.QueryRow(ctx, `
+	SELECT COUNT(*)
+	FROM bill
+	WHERE customer_id = $1 AND status IN ($2, $3, $4, $5)
+	`, customerId, models.BillStatusOpen, models.BillStatusClosing, models.BillStatusInvoiced, models.BillStatusPartiallyPaid).Scan(&openBills)
+	if err != nil {
+		return err
+	}
+	if openBills > 0 {
+		return temporal.NewNonRetryableApplicationError("Customer has open or unpaid bills", "FAILED-PRECONDITION", nil)
+	}
+
+	_, err = tx.Exec(ctx, `
+	UPDATE customer
+	SET deleted_at = NOW()
+	WHERE id = $1
+	`, customerId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+	UPDATE billing_schedule
+	SET active = FALSE
+	WHERE customer_id = $1
+	`, customerId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
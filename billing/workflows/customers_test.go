@@ -0,0 +1,97 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomer_CRUD(t *testing.T) {
+	ctx := context.Background()
+	customer, err := CreateCustomer(ctx, "Acme", "billing@acme.test")
+	require.NoError(t, err)
+
+	customer, err = UpdateCustomer(ctx, customer.Id, "Acme Corp", "finance@acme.test")
+	require.NoError(t, err)
+	require.Equal(t, "Acme Corp", customer.Name)
+
+	fetched, err := GetCustomer(ctx, customer.Id)
+	require.NoError(t, err)
+	require.Equal(t, "finance@acme.test", fetched.Email)
+
+	require.NoError(t, DeleteCustomer(ctx, customer.Id))
+	_, err = GetCustomer(ctx, customer.Id)
+	require.Error(t, err)
+}
+
+func TestCustomer_InvalidEmail(t *testing.T) {
+	_, err := CreateCustomer(context.Background(), "Acme", "not-an-email")
+	require.Error(t, err)
+}
+
+func TestCustomer_DeleteWithOpenBill(t *testing.T) {
+	ctx := context.Background()
+	customer, err := CreateCustomer(ctx, "Acme", "billing@acme.test")
+	require.NoError(t, err)
+	_, err = CreateBill(ctx, customer.Id, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	require.Error(t, DeleteCustomer(ctx, customer.Id))
+}
+
+func TestCustomer_DeleteWithUnpaidBill(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1000, Currency: "USD"})
+
+	err := DeleteCustomer(ctx, customerId)
+	require.Error(t, err)
+	require.Equal(t, "FAILED-PRECONDITION", applicationErrorType(err))
+
+	_, err = RecordPayment(ctx, billId, models.Payment{Amount: 1000, Currency: "USD", Method: "card"})
+	require.NoError(t, err)
+	require.NoError(t, DeleteCustomer(ctx, customerId))
+}
+
+func TestCustomer_DeleteDeactivatesSchedules(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	schedule, err := CreateBillingSchedule(ctx, customerId, "monthly", 0, time.Now().Add(time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	require.NoError(t, DeleteCustomer(ctx, customerId))
+	schedule, err = GetBillingSchedule(ctx, schedule.Id)
+	require.NoError(t, err)
+	require.False(t, schedule.Active)
+
+	bill, err := CreateScheduledBill(ctx, schedule.Id, time.Now())
+	require.NoError(t, err)
+	require.Nil(t, bill)
+}
+
+func TestCustomer_DeleteUnknown(t *testing.T) {
+	require.Error(t, DeleteCustomer(context.Background(), uuid.New().String()))
+}
+
+func TestListBills_ScopedByCustomer(t *testing.T) {
+	ctx := context.Background()
+	customer, err := CreateCustomer(ctx, "Acme", "billing@acme.test")
+	require.NoError(t, err)
+	bill, err := CreateBill(ctx, customer.Id, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = CreateBill(ctx, createTestCustomer(t), time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	page, err := ListBills(ctx, &ListBillParams{CustomerId: customer.Id})
+	require.NoError(t, err)
+	require.Len(t, page.Bills, 1)
+	require.Equal(t, bill.BillId, page.Bills[0].BillId)
+
+	workflowId, err := GetBillWorkflowId(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Equal(t, BillWorkflowId(customer.Id, bill.BillId), workflowId)
+}
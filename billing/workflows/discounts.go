@@ -0,0 +1,460 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/sdk/temporal"
+)
+
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_-]{2,31}$`)
+
+// percentOffPattern matches the percentages coupon.percent_off stores.
+var percentOffPattern = regexp.MustCompile(`^[0-9]{1,3}(\.[0-9]{1,2})?$`)
+
+const couponColumns = `coupon.id, coupon.code, coupon.kind, COALESCE(coupon.percent_off::text, ''), COALESCE(coupon.amount_off, 0),
+	COALESCE(coupon.currency, ''), coupon.stackable, coupon.valid_from, coupon.valid_until, coupon.max_redemptions,
+	(SELECT COUNT(DISTINCT bill_id) FROM bill_discount_line WHERE bill_discount_line.coupon_id = coupon.id), coupon.created_at`
+
+const promotionColumns = `customer_promotion.id, customer_promotion.customer_id, customer_promotion.valid_from, customer_promotion.valid_until,
+	customer_promotion.max_redemptions, (SELECT COUNT(DISTINCT bill_id) FROM bill_discount_line WHERE bill_discount_line.promotion_id = customer_promotion.id),
+	customer_promotion.created_at, ` + couponColumns
+
+func couponFields(coupon *models.Coupon) []interface{} {
+	return []interface{}{&coupon.Id, &coupon.Code, &coupon.Kind, &coupon.PercentOff, &coupon.AmountOff,
+		&coupon.Currency, &coupon.Stackable, &coupon.ValidFrom, &coupon.ValidUntil, &coupon.MaxRedemptions,
+		&coupon.Redemptions, &coupon.CreatedAt}
+}
+
+// normalizeCoupon drops the padding NUMERIC adds to percentages.
+func normalizeCoupon(coupon *models.Coupon) {
+	if percentOff, ok := models.ParseDecimal(coupon.PercentOff); ok {
+		coupon.PercentOff = models.FormatDecimal(percentOff)
+	}
+}
+
+func scanCoupon(row interface{ Scan(...interface{}) error }, coupon *models.Coupon) error {
+	err := row.Scan(couponFields(coupon)...)
+	normalizeCoupon(coupon)
+	return err
+}
+
+func scanPromotion(row interface{ Scan(...interface{}) error }, promotion *models.Promotion) error {
+	fields := []interface{}{&promotion.Id, &promotion.CustomerId, &promotion.ValidFrom, &promotion.ValidUntil,
+		&promotion.MaxRedemptions, &promotion.Redemptions, &promotion.CreatedAt}
+	err := row.Scan(append(fields, couponFields(&promotion.Coupon)...)...)
+	normalizeCoupon(&promotion.Coupon)
+	return err
+}
+
+func validateValidity(validFrom *time.Time, validUntil *time.Time) error {
+	if validFrom != nil && validUntil != nil && !validUntil.After(*validFrom) {
+		return temporal.NewNonRetryableApplicationError("Validity ends before it starts", "INVALID-DATA", nil)
+	}
+	return nil
+}
+
+// CreateCoupon defines a new coupon. Codes are case insensitive and unique.
+func CreateCoupon(ctx context.Context, coupon models.Coupon) (*models.Coupon, error) {
+	coupon.Code = strings.ToUpper(strings.TrimSpace(coupon.Code))
+	if !couponCodePattern.MatchString(coupon.Code) {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid coupon code: "+coupon.Code, "INVALID-DATA", nil)
+	}
+	switch coupon.Kind {
+	case models.CouponPercentage:
+		percentOff, ok := models.ParseDecimal(coupon.PercentOff)
+		if !percentOffPattern.MatchString(coupon.PercentOff) || !ok || percentOff.Sign() <= 0 || percentOff.Cmp(big.NewRat(100, 1)) > 0 {
+			return nil, temporal.NewNonRetryableApplicationError("Percentage coupons take off more than 0 and at most 100 percent", "INVALID-DATA", nil)
+		}
+		if coupon.AmountOff != 0 || coupon.Currency != "" {
+			return nil, temporal.NewNonRetryableApplicationError("Percentage coupons cannot take off an amount", "INVALID-DATA", nil)
+		}
+	case models.CouponFixed:
+		if coupon.AmountOff <= 0 {
+			return nil, temporal.NewNonRetryableApplicationError("Fixed coupons must take off a positive amount", "INVALID-DATA", nil)
+		}
+		if coupon.PercentOff != "" {
+			return nil, temporal.NewNonRetryableApplicationError("Fixed coupons cannot take off a percentage", "INVALID-DATA", nil)
+		}
+		err := validateCurrency(ctx, coupon.Currency)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, temporal.NewNonRetryableApplicationError("Invalid coupon kind: "+coupon.Kind, "INVALID-DATA", nil)
+	}
+	err := validateValidity(coupon.ValidFrom, coupon.ValidUntil)
+	if err != nil {
+		return nil, err
+	}
+	if coupon.MaxRedemptions < 0 {
+		return nil, temporal.NewNonRetryableApplicationError("Maximum redemptions cannot be negative", "INVALID-DATA", nil)
+	}
+
+	var exists bool
+	err = db.BillDb.QueryRow(ctx, `
+	SELECT EXISTS (SELECT 1 FROM coupon WHERE code = $1)
+	`, coupon.Code).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, temporal.NewNonRetryableApplicationError("Coupon code already exists: "+coupon.Code, "CONFLICT", nil)
+	}
+
+	var saved models.Coupon
+	err = scanCoupon(db.BillDb.QueryRow(ctx, `
+	INSERT INTO coupon
+	(code, kind, percent_off, amount_off, currency, stackable, valid_from, valid_until, max_redemptions)
+	VALUES ($1,$2,NULLIF($3, '')::numeric,NULLIF($4, 0),NULLIF($5, ''),$6,$7,$8,$9)
+	RETURNING `+couponColumns+`
+	`, coupon.Code, coupon.Kind, coupon.PercentOff, coupon.AmountOff, coupon.Currency, coupon.Stackable, coupon.ValidFrom, coupon.ValidUntil, coupon.MaxRedemptions), &saved)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	return &saved, nil
+}
+
+func ListCoupons(ctx context.Context) ([]models.Coupon, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT `+couponColumns+`
+	FROM coupon
+	ORDER BY code
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coupons := []models.Coupon{}
+	for rows.Next() {
+		var coupon models.Coupon
+		err := scanCoupon(rows, &coupon)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	return coupons, nil
+}
+
+// CreatePromotion grants a coupon to a customer.
+func CreatePromotion(ctx context.Context, customerId string, couponCode string, validFrom *time.Time, validUntil *time.Time, maxRedemptions int) (*models.Promotion, error) {
+	err := validateValidity(validFrom, validUntil)
+	if err != nil {
+		return nil, err
+	}
+	if maxRedemptions < 0 {
+		return nil, temporal.NewNonRetryableApplicationError("Maximum redemptions cannot be negative", "INVALID-DATA", nil)
+	}
+	_, err = GetCustomer(ctx, customerId)
+	if err != nil {
+		return nil, err
+	}
+	var couponId string
+	err = db.BillDb.QueryRow(ctx, `
+	SELECT id
+	FROM coupon
+	WHERE code = $1
+	`, strings.ToUpper(strings.TrimSpace(couponCode))).Scan(&couponId)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, temporal.NewNonRetryableApplicationError("Coupon not found", "NOT_FOUND", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var promotionId string
+	err = db.BillDb.QueryRow(ctx, `
+	INSERT INTO customer_promotion
+	(customer_id, coupon_id, valid_from, valid_until, max_redemptions)
+	VALUES ($1,$2,$3,$4,$5)
+	RETURNING id
+	`, customerId, couponId, validFrom, validUntil, maxRedemptions).Scan(&promotionId)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+
+	var promotion models.Promotion
+	err = scanPromotion(db.BillDb.QueryRow(ctx, `
+	SELECT `+promotionColumns+`
+	FROM customer_promotion
+	JOIN coupon ON coupon.id = customer_promotion.coupon_id
+	WHERE customer_promotion.id = $1
+	`, promotionId), &promotion)
+	if err != nil {
+		return nil, err
+	}
+	return &promotion, nil
+}
+
+// ListPromotions returns the promotions of a customer in the order they were granted.
+func ListPromotions(ctx context.Context, customerId string) ([]models.Promotion, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT `+promotionColumns+`
+	FROM customer_promotion
+	JOIN coupon ON coupon.id = customer_promotion.coupon_id
+	WHERE customer_promotion.customer_id = $1
+	ORDER BY customer_promotion.created_at, customer_promotion.id
+	`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions := []models.Promotion{}
+	for rows.Next() {
+		var promotion models.Promotion
+		err := scanPromotion(rows, &promotion)
+		if err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, promotion)
+	}
+	return promotions, nil
+}
+
+// computeDiscountLines works out what the given promotions take off the item
+// totals of a bill per currency. Promotions apply in order, each to what the
+// ones before left. A promotion whose coupon is not stackable only applies if
+// no other has, and then keeps the later ones from applying.
+func computeDiscountLines(promotions []models.Promotion, totals map[string]int64, rounding map[string]string) ([]models.DiscountLine, error) {
+	remaining := make(map[string]int64, len(totals))
+	currencies := make([]string, 0, len(totals))
+	for currency, total := range totals {
+		remaining[currency] = total
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	var lines []models.DiscountLine
+	applied, exclusive := false, false
+	for _, promotion := range promotions {
+		if exclusive {
+			break
+		}
+		if applied && !promotion.Coupon.Stackable {
+			continue
+		}
+		var promotionLines []models.DiscountLine
+		discount := func(currency string, amount int64) {
+			amount = min(amount, remaining[currency])
+			if amount > 0 {
+				promotionLines = append(promotionLines, models.DiscountLine{PromotionId: promotion.Id, CouponCode: promotion.Coupon.Code, Currency: currency, Amount: amount})
+			}
+		}
+		switch promotion.Coupon.Kind {
+		case models.CouponPercentage:
+			percentOff, ok := models.ParseDecimal(promotion.Coupon.PercentOff)
+			if !ok {
+				return nil, temporal.NewNonRetryableApplicationError("Invalid coupon percentage: "+promotion.Coupon.PercentOff, "INVALID-DATA", nil)
+			}
+			for _, currency := range currencies {
+				off := new(big.Rat).Mul(big.NewRat(remaining[currency], 100), percentOff)
+				amount, err := models.Round(off, rounding[currency])
+				if err != nil {
+					return nil, temporal.NewNonRetryableApplicationError("Discount overflows", "INVALID-DATA", nil)
+				}
+				discount(currency, amount)
+			}
+		case models.CouponFixed:
+			discount(promotion.Coupon.Currency, promotion.Coupon.AmountOff)
+		}
+		if len(promotionLines) == 0 {
+			continue
+		}
+		for _, line := range promotionLines {
+			remaining[line.Currency] -= line.Amount
+		}
+		lines = append(lines, promotionLines...)
+		applied, exclusive = true, !promotion.Coupon.Stackable
+	}
+	return lines, nil
+}
+
+// applyBillDiscounts stores the discounts of a bill that is being closed by
+// the promotions of its customer valid at closedAt that have redemptions left.
+func applyBillDiscounts(ctx context.Context, q querier, billId string, customerId string, closedAt time.Time) ([]models.DiscountLine, error) {
+	if customerId == "" {
+		return nil, nil
+	}
+	// Lock the promotions and their coupons so that concurrently closing bills
+	// cannot redeem them beyond their limits.
+	_, err := q.Exec(ctx, `
+	SELECT 1
+	FROM customer_promotion
+	JOIN coupon ON coupon.id = customer_promotion.coupon_id
+	WHERE customer_promotion.customer_id = $1
+	FOR UPDATE OF customer_promotion, coupon
+	`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(ctx, `
+	SELECT `+promotionColumns+`
+	FROM customer_promotion
+	JOIN coupon ON coupon.id = customer_promotion.coupon_id
+	WHERE customer_promotion.customer_id = $1
+		AND (customer_promotion.valid_from IS NULL OR customer_promotion.valid_from <= $2)
+		AND (customer_promotion.valid_until IS NULL OR customer_promotion.valid_until > $2)
+		AND (coupon.valid_from IS NULL OR coupon.valid_from <= $2)
+		AND (coupon.valid_until IS NULL OR coupon.valid_until > $2)
+	ORDER BY customer_promotion.created_at, customer_promotion.id
+	`, customerId, closedAt)
+	if err != nil {
+		return nil, err
+	}
+	var promotions []models.Promotion
+	for rows.Next() {
+		var promotion models.Promotion
+		err := scanPromotion(rows, &promotion)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if promotion.MaxRedemptions > 0 && promotion.Redemptions >= promotion.MaxRedemptions {
+			continue
+		}
+		if promotion.Coupon.MaxRedemptions > 0 && promotion.Coupon.Redemptions >= promotion.Coupon.MaxRedemptions {
+			continue
+		}
+		promotions = append(promotions, promotion)
+	}
+	rows.Close()
+	if len(promotions) == 0 {
+		return nil, nil
+	}
+
+	rows, err = q.Query(ctx, `
+	SELECT currency, total_amount
+	FROM bill_summary
+	WHERE bill_id = $1
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int64)
+	for rows.Next() {
+		var currency string
+		var total int64
+		err := rows.Scan(&currency, &total)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		totals[currency] = total
+	}
+	rows.Close()
+	rounding := make(map[string]string, len(totals))
+	for currency := range totals {
+		rounding[currency], err = Currencies.RoundingMode(ctx, currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lines, err := computeDiscountLines(promotions, totals, rounding)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range lines {
+		err = q.QueryRow(ctx, `
+		INSERT INTO bill_discount_line
+		(bill_id, promotion_id, coupon_id, currency, amount)
+		SELECT $1, id, coupon_id, $3, $4
+		FROM customer_promotion
+		WHERE id = $2
+		RETURNING id, created_at
+		`, billId, line.PromotionId, line.Currency, line.Amount).Scan(&lines[i].Id, &lines[i].CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+// discountItems spreads each discount over the tax categories of its currency
+// in proportion to their amounts, as negative items that the tax engine nets
+// against the items of the bill.
+func discountItems(items []models.BillItem, discounts []models.DiscountLine) []models.BillItem {
+	var discounted []models.BillItem
+	for _, discount := range discounts {
+		gross := make(map[string]int64)
+		var categories []string
+		var total int64
+		for _, item := range items {
+			if item.VoidedAt != nil || item.Currency != discount.Currency {
+				continue
+			}
+			if _, ok := gross[item.TaxCategory]; !ok {
+				categories = append(categories, item.TaxCategory)
+			}
+			gross[item.TaxCategory] += item.Amount
+			total += item.Amount
+		}
+		if total <= 0 {
+			continue
+		}
+		sort.Strings(categories)
+		var allocated int64
+		for i, category := range categories {
+			share := new(big.Int).Mul(big.NewInt(discount.Amount), big.NewInt(gross[category]))
+			amount := share.Quo(share, big.NewInt(total)).Int64()
+			if i == len(categories)-1 {
+				amount = discount.Amount - allocated
+			}
+			allocated += amount
+			discounted = append(discounted, models.BillItem{Kind: "adjustment", Currency: discount.Currency, TaxCategory: category, Amount: -amount})
+		}
+	}
+	return discounted
+}
+
+func getBillDiscountLines(ctx context.Context, billId string) ([]models.DiscountLine, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT bill_discount_line.id, bill_discount_line.promotion_id, coupon.code, bill_discount_line.currency, bill_discount_line.amount, bill_discount_line.created_at
+	FROM bill_discount_line
+	JOIN coupon ON coupon.id = bill_discount_line.coupon_id
+	JOIN customer_promotion ON customer_promotion.id = bill_discount_line.promotion_id
+	WHERE bill_discount_line.bill_id = $1
+	ORDER BY customer_promotion.created_at, customer_promotion.id, bill_discount_line.currency
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []models.DiscountLine{}
+	for rows.Next() {
+		var line models.DiscountLine
+		err := rows.Scan(&line.Id, &line.PromotionId, &line.CouponCode, &line.Currency, &line.Amount, &line.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		line.FormattedAmount = Currencies.Format(ctx, line.Amount, line.Currency)
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// applyDiscountLines takes the discounts of a bill summary off its per-currency totals.
+func applyDiscountLines(ctx context.Context, summary *models.BillSummary) {
+	for i := range summary.BillItemSummary {
+		item := &summary.BillItemSummary[i]
+		for _, line := range summary.Discounts {
+			if line.Currency == item.Currency {
+				item.DiscountAmount += line.Amount
+			}
+		}
+		item.TotalAmount -= item.DiscountAmount
+		item.FormattedDiscountAmount = Currencies.Format(ctx, item.DiscountAmount, item.Currency)
+	}
+}
@@ -0,0 +1,130 @@
+package workflows
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func testCouponCode() string {
+	return "TEST-" + strings.ToUpper(uuid.NewString()[:8])
+}
+
+func TestComputeDiscountLines(t *testing.T) {
+	rounding := map[string]string{"USD": models.RoundHalfEven, "GEL": models.RoundHalfEven}
+	tenPercent := models.Promotion{Id: "p1", Coupon: models.Coupon{Code: "TEN", Kind: models.CouponPercentage, PercentOff: "10", Stackable: true}}
+	fiveDollars := models.Promotion{Id: "p2", Coupon: models.Coupon{Code: "FIVE", Kind: models.CouponFixed, AmountOff: 500, Currency: "USD", Stackable: true}}
+	exclusive := models.Promotion{Id: "p3", Coupon: models.Coupon{Code: "HALF", Kind: models.CouponPercentage, PercentOff: "50"}}
+
+	// Stackable promotions apply one after the other.
+	lines, err := computeDiscountLines([]models.Promotion{tenPercent, fiveDollars}, map[string]int64{"USD": 10000, "GEL": 2000}, rounding)
+	require.NoError(t, err)
+	require.Equal(t, []models.DiscountLine{
+		{PromotionId: "p1", CouponCode: "TEN", Currency: "GEL", Amount: 200},
+		{PromotionId: "p1", CouponCode: "TEN", Currency: "USD", Amount: 1000},
+		{PromotionId: "p2", CouponCode: "FIVE", Currency: "USD", Amount: 500},
+	}, lines)
+
+	// Fixed discounts never exceed what is left.
+	lines, err = computeDiscountLines([]models.Promotion{fiveDollars}, map[string]int64{"USD": 300}, rounding)
+	require.NoError(t, err)
+	require.Equal(t, int64(300), lines[0].Amount)
+
+	// A promotion that is not stackable applies alone.
+	lines, err = computeDiscountLines([]models.Promotion{exclusive, tenPercent}, map[string]int64{"USD": 10000}, rounding)
+	require.NoError(t, err)
+	require.Len(t, lines, 1)
+	require.Equal(t, "p3", lines[0].PromotionId)
+	lines, err = computeDiscountLines([]models.Promotion{tenPercent, exclusive}, map[string]int64{"USD": 10000}, rounding)
+	require.NoError(t, err)
+	require.Len(t, lines, 1)
+	require.Equal(t, "p1", lines[0].PromotionId)
+
+	// A fixed discount in a currency the bill does not use is not redeemed.
+	lines, err = computeDiscountLines([]models.Promotion{fiveDollars, exclusive}, map[string]int64{"GEL": 1000}, rounding)
+	require.NoError(t, err)
+	require.Len(t, lines, 1)
+	require.Equal(t, "p3", lines[0].PromotionId)
+}
+
+func TestCreateCoupon_Invalid(t *testing.T) {
+	ctx := context.Background()
+	_, err := CreateCoupon(ctx, models.Coupon{Code: testCouponCode(), Kind: models.CouponPercentage, PercentOff: "120"})
+	require.Error(t, err)
+	_, err = CreateCoupon(ctx, models.Coupon{Code: testCouponCode(), Kind: models.CouponFixed, AmountOff: 500})
+	require.Error(t, err)
+
+	code := testCouponCode()
+	coupon, err := CreateCoupon(ctx, models.Coupon{Code: strings.ToLower(code), Kind: models.CouponPercentage, PercentOff: "12.5"})
+	require.NoError(t, err)
+	require.Equal(t, code, coupon.Code)
+	require.Equal(t, "12.5", coupon.PercentOff)
+	_, err = CreateCoupon(ctx, models.Coupon{Code: code, Kind: models.CouponPercentage, PercentOff: "10"})
+	require.Error(t, err)
+}
+
+func TestCloseBill_AppliesDiscounts(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	percent, err := CreateCoupon(ctx, models.Coupon{Code: testCouponCode(), Kind: models.CouponPercentage, PercentOff: "10", Stackable: true})
+	require.NoError(t, err)
+	fixed, err := CreateCoupon(ctx, models.Coupon{Code: testCouponCode(), Kind: models.CouponFixed, AmountOff: 100, Currency: "USD", Stackable: true})
+	require.NoError(t, err)
+	expired := time.Now().Add(-time.Hour)
+	_, err = CreatePromotion(ctx, customerId, percent.Code, nil, nil, 1)
+	require.NoError(t, err)
+	_, err = CreatePromotion(ctx, customerId, fixed.Code, nil, nil, 0)
+	require.NoError(t, err)
+	_, err = CreatePromotion(ctx, customerId, percent.Code, nil, &expired, 0)
+	require.NoError(t, err)
+
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 2000, Currency: "USD"})
+	summary, err := GetBillSummary(ctx, billId)
+	require.NoError(t, err)
+	require.Len(t, summary.Discounts, 2)
+	require.Equal(t, int64(200), summary.Discounts[0].Amount)
+	require.Equal(t, int64(100), summary.Discounts[1].Amount)
+	require.Equal(t, int64(300), summary.BillItemSummary[0].DiscountAmount)
+	require.Equal(t, int64(1700), summary.BillItemSummary[0].TotalAmount)
+	require.Equal(t, int64(1700), summary.Balances[0].Outstanding)
+
+	// The percentage promotion was redeemed once, its limit.
+	billId = createInvoicedBill(t, customerId, models.BillItem{Amount: 2000, Currency: "USD"})
+	summary, err = GetBillSummary(ctx, billId)
+	require.NoError(t, err)
+	require.Len(t, summary.Discounts, 1)
+	require.Equal(t, fixed.Code, summary.Discounts[0].CouponCode)
+
+	promotions, err := ListPromotions(ctx, customerId)
+	require.NoError(t, err)
+	require.Equal(t, 1, promotions[0].Redemptions)
+	require.Equal(t, 2, promotions[1].Redemptions)
+	require.Equal(t, 0, promotions[2].Redemptions)
+}
+
+func TestCloseBill_TaxesDiscountedItems(t *testing.T) {
+	ctx := context.Background()
+	_, err := SaveTaxRate(ctx, models.TaxRate{Jurisdiction: "GE", TaxCategory: "test_discounted", Rate: "0.2", EffectiveAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)})
+	require.NoError(t, err)
+	customerId := createTestCustomer(t)
+	_, err = SaveCustomerTaxProfile(ctx, models.CustomerTaxProfile{CustomerId: customerId, Jurisdiction: "GE"})
+	require.NoError(t, err)
+	coupon, err := CreateCoupon(ctx, models.Coupon{Code: testCouponCode(), Kind: models.CouponPercentage, PercentOff: "25"})
+	require.NoError(t, err)
+	_, err = CreatePromotion(ctx, customerId, coupon.Code, nil, nil, 0)
+	require.NoError(t, err)
+
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1000, Currency: "USD", TaxCategory: "test_discounted"})
+	summary, err := GetBillSummary(ctx, billId)
+	require.NoError(t, err)
+	require.Len(t, summary.TaxLines, 1)
+	require.Equal(t, int64(750), summary.TaxLines[0].TaxableAmount)
+	require.Equal(t, int64(150), summary.TaxLines[0].TaxAmount)
+	require.Equal(t, int64(750), summary.BillItemSummary[0].Subtotal)
+	require.Equal(t, int64(900), summary.BillItemSummary[0].TotalAmount)
+}
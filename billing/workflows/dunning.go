@@ -0,0 +1,271 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+const (
+	DunningRemind = "remind"
+	// DunningOverdue marks the bill as overdue.
+	DunningOverdue = "overdue"
+	// DunningSuspend suspends the bill's customer until its overdue bills are settled.
+	DunningSuspend = "suspend"
+)
+
+// DunningStep is an action taken a fixed time after an unpaid bill was invoiced.
+type DunningStep struct {
+	After time.Duration
+	Action string
+}
+
+// DunningSchedule is followed for every invoiced bill until it is settled.
+// Bills whose schedule has run out stop being tracked by their workflow.
+var DunningSchedule = []DunningStep{
+	{After: 3 * 24 * time.Hour, Action: DunningRemind},
+	{After: 7 * 24 * time.Hour, Action: DunningRemind},
+	{After: 14 * 24 * time.Hour, Action: DunningRemind},
+	{After: 21 * 24 * time.Hour, Action: DunningOverdue},
+	{After: 30 * 24 * time.Hour, Action: DunningSuspend},
+}
+
+var dunningEventTypes = map[string]string{
+	DunningRemind: models.EventBillReminder,
+	DunningOverdue: models.EventBillOverdue,
+	DunningSuspend: models.EventBillSuspended,
+}
+
+// ParseDunningSchedule parses a schedule such as "3d:remind,7d:remind,21d:overdue,30d:suspend".
+// Delays are days ("d") or any unit understood by time.ParseDuration, and must increase.
+func ParseDunningSchedule(value string) ([]DunningStep, error) {
+	var steps []DunningStep
+	for _, part := range strings.Split(value, ",") {
+		delay, action, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, errors.New("invalid dunning step: " + part)
+		}
+		var after time.Duration
+		if days, found := strings.CutSuffix(delay, "d"); found {
+			n, err := strconv.Atoi(days)
+			if err != nil {
+				return nil, errors.New("invalid dunning delay: " + delay)
+			}
+			after = time.Duration(n) * 24 * time.Hour
+		} else {
+			var err error
+			after, err = time.ParseDuration(delay)
+			if err != nil {
+				return nil, errors.New("invalid dunning delay: " + delay)
+			}
+		}
+		if _, known := dunningEventTypes[action]; !known {
+			return nil, errors.New("invalid dunning action: " + action)
+		}
+		if after <= 0 || (len(steps) > 0 && after <= steps[len(steps)-1].After) {
+			return nil, errors.New("dunning delays must be positive and increasing")
+		}
+		steps = append(steps, DunningStep{After: after, Action: action})
+	}
+	return steps, nil
+}
+
+// RecordDunningStep records a step of the dunning schedule for a bill and
+// applies its action. It returns nil if the bill no longer needs dunning,
+// e.g. because a payment settled it in the meantime. Recording a step twice
+// returns the first record.
+func RecordDunningStep(ctx context.Context, billId string, step int, action string) (*models.DunningEvent, error) {
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status, customerId string
+	err = tx.QueryRow(ctx, `
+	SELECT status, COALESCE(customer_id::text, '')
+	FROM bill
+	WHERE id = $1
+	FOR UPDATE
+	`, billId).Scan(&status, &customerId)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+	if !isUnsettled(status) {
+		return nil, nil
+	}
+
+	event := models.DunningEvent{Step: step}
+	err = tx.QueryRow(ctx, `
+	INSERT INTO dunning_event
+	(bill_id, step, action)
+	VALUES ($1,$2,$3)
+	ON CONFLICT (bill_id, step) DO NOTHING
+	RETURNING action, created_at
+	`, billId, step, action).Scan(&event.Action, &event.CreatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		err = tx.QueryRow(ctx, `
+		SELECT action, created_at
+		FROM dunning_event
+		WHERE bill_id = $1 AND step = $2
+		`, billId, step).Scan(&event.Action, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		return &event, nil
+	}
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+
+	switch action {
+	case DunningOverdue:
+		_, err = tx.Exec(ctx, `
+		UPDATE bill
+		SET overdue_at = COALESCE(overdue_at, NOW())
+		WHERE id = $1
+		`, billId)
+	case DunningSuspend:
+		if customerId == "" {
+			break
+		}
+		_, err = tx.Exec(ctx, `
+		UPDATE customer
+		SET suspended_at = COALESCE(suspended_at, NOW())
+		WHERE id = $1
+		`, customerId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bill := models.Bill{BillId: billId, CustomerId: customerId, Status: status}
+	eventId, err := enqueueDunningEvent(ctx, tx, bill, event)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	flushEvent(ctx, eventId)
+	return &event, nil
+}
+
+// liftSuspension unsuspends a customer once none of its overdue bills are left unpaid.
+func liftSuspension(ctx context.Context, q querier, customerId string) error {
+	_, err := q.Exec(ctx, `
+	UPDATE customer
+	SET suspended_at = NULL
+	WHERE id = $1 AND suspended_at IS NOT NULL AND NOT EXISTS (
+		SELECT 1
+		FROM bill
+		WHERE bill.customer_id = customer.id AND bill.overdue_at IS NOT NULL AND bill.status IN ('invoiced', 'partially_paid')
+	)
+	`, customerId)
+	return err
+}
+
+func ListDunningEvents(ctx context.Context, billId string) ([]models.DunningEvent, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT step, action, created_at
+	FROM dunning_event
+	WHERE bill_id = $1
+	ORDER BY step
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.DunningEvent
+	for rows.Next() {
+		var event models.DunningEvent
+		err := rows.Scan(&event.Step, &event.Action, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// awaitSettlement waits until an invoiced bill is paid, voided or written off,
+// following the dunning schedule meanwhile. The bill's status is read back
+// from the database whenever a signal says it may have changed. Partial
+// payments do not stop dunning; the workflow gives up on the bill once the
+// schedule has run out.
+func awaitSettlement(ctx workflow.Context, bill *models.Bill) error {
+	logger := workflow.GetLogger(ctx)
+	payments := workflow.GetSignalChannel(ctx, SignalPaymentReceived)
+	statusChanges := workflow.GetSignalChannel(ctx, SignalBillStatusChanged)
+
+	// The schedule is recorded in the history so that changing it does not affect bills already being dunned.
+	var schedule []DunningStep
+	err := workflow.SideEffect(ctx, func(workflow.Context) interface{} {
+		return DunningSchedule
+	}).Get(&schedule)
+	if err != nil {
+		return err
+	}
+	invoicedAt := workflow.Now(ctx)
+
+	// Payments may have been recorded before this started waiting.
+	err = workflow.ExecuteActivity(ctx, GetBillStatus, bill.BillId).Get(ctx, &bill.Status)
+	if err != nil {
+		return err
+	}
+
+	for step := 0; isUnsettled(bill.Status); {
+		if step == len(schedule) {
+			logger.Info("Dunning schedule ran out before the bill was settled.", "status", bill.Status)
+			return nil
+		}
+
+		timerCtx, cancelTimer := workflow.WithCancel(ctx)
+		timer := workflow.NewTimer(timerCtx, invoicedAt.Add(schedule[step].After).Sub(workflow.Now(ctx)))
+		due := false
+		selector := workflow.NewSelector(ctx)
+		selector.AddReceive(payments, func(c workflow.ReceiveChannel, _ bool) {
+			var payment models.Payment
+			c.Receive(ctx, &payment)
+			logger.Info("Received payment.", "paymentId", payment.Id)
+		})
+		selector.AddReceive(statusChanges, func(c workflow.ReceiveChannel, _ bool) {
+			c.Receive(ctx, nil)
+		})
+		selector.AddFuture(timer, func(f workflow.Future) {
+			due = true
+		})
+		selector.Select(ctx)
+		cancelTimer()
+
+		if due {
+			var event *models.DunningEvent
+			err := workflow.ExecuteActivity(ctx, RecordDunningStep, bill.BillId, step, schedule[step].Action).Get(ctx, &event)
+			if err != nil {
+				return err
+			}
+			if event != nil {
+				logger.Info("Took dunning step.", "step", step, "action", event.Action)
+				emitDunningEvent(ctx, bill, event)
+				step++
+				continue
+			}
+		}
+		err := workflow.ExecuteActivity(ctx, GetBillStatus, bill.BillId).Get(ctx, &bill.Status)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Info("Bill settled.", "status", bill.Status)
+	return nil
+}
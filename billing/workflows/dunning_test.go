@@ -0,0 +1,87 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDunningSchedule(t *testing.T) {
+	steps, err := ParseDunningSchedule("3d:remind, 7d:remind,180h:overdue,30d:suspend")
+	require.NoError(t, err)
+	require.Equal(t, []DunningStep{
+		{After: 3 * 24 * time.Hour, Action: DunningRemind},
+		{After: 7 * 24 * time.Hour, Action: DunningRemind},
+		{After: 180 * time.Hour, Action: DunningOverdue},
+		{After: 30 * 24 * time.Hour, Action: DunningSuspend},
+	}, steps)
+
+	_, err = ParseDunningSchedule("3d:remind,2d:remind")
+	require.Error(t, err)
+	_, err = ParseDunningSchedule("3d:shout")
+	require.Error(t, err)
+	_, err = ParseDunningSchedule("soon:remind")
+	require.Error(t, err)
+}
+
+func TestRecordDunningStep_OverdueAndSuspend(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1000, Currency: "USD"})
+
+	event, err := RecordDunningStep(ctx, billId, 0, DunningRemind)
+	require.NoError(t, err)
+	require.Equal(t, DunningRemind, event.Action)
+	// Retrying a step returns the first record.
+	retried, err := RecordDunningStep(ctx, billId, 0, DunningRemind)
+	require.NoError(t, err)
+	require.Equal(t, event.CreatedAt, retried.CreatedAt)
+
+	_, err = RecordDunningStep(ctx, billId, 1, DunningOverdue)
+	require.NoError(t, err)
+	bill, err := GetBill(ctx, billId)
+	require.NoError(t, err)
+	require.NotNil(t, bill.OverdueAt)
+
+	_, err = RecordDunningStep(ctx, billId, 2, DunningSuspend)
+	require.NoError(t, err)
+	customer, err := GetCustomer(ctx, customerId)
+	require.NoError(t, err)
+	require.NotNil(t, customer.SuspendedAt)
+	_, err = CreateBill(ctx, customerId, time.Now().Add(24 * time.Hour), "USD", 0)
+	require.Error(t, err)
+
+	events, err := ListDunningEvents(ctx, billId)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	// Paying the overdue bill lifts the suspension and ends dunning.
+	_, err = RecordPayment(ctx, billId, models.Payment{Amount: 1000, Currency: "USD", Method: "card"})
+	require.NoError(t, err)
+	customer, err = GetCustomer(ctx, customerId)
+	require.NoError(t, err)
+	require.Nil(t, customer.SuspendedAt)
+
+	event, err = RecordDunningStep(ctx, billId, 3, DunningRemind)
+	require.NoError(t, err)
+	require.Nil(t, event)
+}
+
+func TestWriteOff_LiftsSuspension(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1000, Currency: "USD"})
+	_, err := RecordDunningStep(ctx, billId, 0, DunningOverdue)
+	require.NoError(t, err)
+	_, err = RecordDunningStep(ctx, billId, 1, DunningSuspend)
+	require.NoError(t, err)
+
+	// Giving up on the overdue bill leaves nothing to keep the customer suspended for.
+	require.NoError(t, TransitionBill(ctx, billId, models.BillStatusWrittenOff, "Uncollectible"))
+	customer, err := GetCustomer(ctx, customerId)
+	require.NoError(t, err)
+	require.Nil(t, customer.SuspendedAt)
+}
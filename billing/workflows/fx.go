@@ -0,0 +1,266 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/sdk/temporal"
+)
+
+// DefaultSettlementCurrency is used for bills created without a settlement currency.
+const DefaultSettlementCurrency = "USD"
+
+// RateSource looks up exchange rates.
+type RateSource interface {
+	// Rate returns the latest rate converting base into quote that took effect at or before the given time.
+	Rate(ctx context.Context, base string, quote string, at time.Time) (*models.FxRate, error)
+}
+
+// Rates is the rate source used when bills close.
+var Rates RateSource = DbRateSource{}
+
+var errRateNotFound = temporal.NewNonRetryableApplicationError("Exchange rate not found", "NOT_FOUND", nil)
+
+// DbRateSource reads rates from the fx_rate table.
+type DbRateSource struct{}
+
+func (DbRateSource) Rate(ctx context.Context, base string, quote string, at time.Time) (*models.FxRate, error) {
+	rate := models.FxRate{Base: base, Quote: quote, Source: "db"}
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT rate::text, effective_at
+	FROM fx_rate
+	WHERE base_currency = $1 AND quote_currency = $2 AND effective_at <= $3
+	ORDER BY effective_at DESC
+	LIMIT 1
+	`, base, quote, at).Scan(&rate.Rate, &rate.EffectiveAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errRateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
+// FileRateSource reads rates from a JSON file holding a list of models.FxRate,
+// which is convenient for local development.
+type FileRateSource struct {
+	Path string
+}
+
+func (s FileRateSource) Rate(ctx context.Context, base string, quote string, at time.Time) (*models.FxRate, error) {
+	body, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var rates []models.FxRate
+	err = json.Unmarshal(body, &rates)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *models.FxRate
+	for i := range rates {
+		rate := &rates[i]
+		if rate.Base != base || rate.Quote != quote || rate.EffectiveAt.After(at) {
+			continue
+		}
+		if latest == nil || rate.EffectiveAt.After(latest.EffectiveAt) {
+			latest = rate
+		}
+	}
+	if latest == nil {
+		return nil, errRateNotFound
+	}
+	latest.Source = "file:" + s.Path
+	return latest, nil
+}
+
+// SaveFxRate records a rate in the fx_rate table.
+func SaveFxRate(ctx context.Context, rate models.FxRate) (*models.FxRate, error) {
+	value, ok := new(big.Rat).SetString(rate.Rate)
+	if !ok || value.Sign() <= 0 {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid exchange rate: "+rate.Rate, "INVALID-DATA", nil)
+	}
+	for _, code := range []string{rate.Base, rate.Quote} {
+		err := validateCurrency(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	saved := models.FxRate{Source: "db"}
+	err := db.BillDb.QueryRow(ctx, `
+	INSERT INTO fx_rate
+	(base_currency, quote_currency, rate, effective_at)
+	VALUES ($1,$2,$3::numeric,$4)
+	ON CONFLICT (base_currency, quote_currency, effective_at) DO UPDATE
+	SET rate = EXCLUDED.rate
+	RETURNING base_currency, quote_currency, rate::text, effective_at
+	`, rate.Base, rate.Quote, rate.Rate, rate.EffectiveAt).Scan(&saved.Base, &saved.Quote, &saved.Rate, &saved.EffectiveAt)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	return &saved, nil
+}
+
+// snapshotFxRates captures the rates needed to convert every currency of a
+// bill that is being closed into its settlement currency, so the converted
+// total never changes once the bill has closed. Currencies without a rate at
+// closedAt are left out, which leaves the converted total unset.
+func snapshotFxRates(ctx context.Context, q querier, billId string, closedAt time.Time) error {
+	var settlementCurrency string
+	err := q.QueryRow(ctx, `
+	SELECT settlement_currency
+	FROM bill
+	WHERE id = $1
+	`, billId).Scan(&settlementCurrency)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+
+	rows, err := q.Query(ctx, `
+	SELECT DISTINCT currency
+	FROM bill_item
+	WHERE bill_id = $1 AND currency <> $2
+	`, billId, settlementCurrency)
+	if err != nil {
+		return err
+	}
+	var currencies []string
+	for rows.Next() {
+		var currency string
+		err := rows.Scan(&currency)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		currencies = append(currencies, currency)
+	}
+	rows.Close()
+
+	for _, currency := range currencies {
+		rate, err := Rates.Rate(ctx, currency, settlementCurrency, closedAt)
+		if errors.Is(err, errRateNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(ctx, `
+		INSERT INTO bill_fx_rate
+		(bill_id, base_currency, quote_currency, rate, effective_at, source)
+		VALUES ($1,$2,$3,$4::numeric,$5,$6)
+		ON CONFLICT (bill_id, base_currency, quote_currency) DO NOTHING
+		`, billId, rate.Base, rate.Quote, rate.Rate, rate.EffectiveAt, rate.Source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getBillFxRates(ctx context.Context, billId string) ([]models.FxRate, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT base_currency, quote_currency, rate::text, effective_at, source
+	FROM bill_fx_rate
+	WHERE bill_id = $1
+	ORDER BY base_currency
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []models.FxRate
+	for rows.Next() {
+		var rate models.FxRate
+		err := rows.Scan(&rate.Base, &rate.Quote, &rate.Rate, &rate.EffectiveAt, &rate.Source)
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+// ConvertAmount converts an amount in minor units of one currency into minor
+// units of another, rounding with the given mode.
+func ConvertAmount(amount int64, rate string, fromExponent int, toExponent int, rounding string) (int64, error) {
+	value, ok := new(big.Rat).SetString(rate)
+	if !ok {
+		return 0, temporal.NewNonRetryableApplicationError("Invalid exchange rate: "+rate, "INVALID-DATA", nil)
+	}
+	converted := new(big.Rat).Mul(big.NewRat(amount, 1), value)
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(toExponent-fromExponent))), nil))
+	if toExponent >= fromExponent {
+		converted.Mul(converted, scale)
+	} else {
+		converted.Quo(converted, scale)
+	}
+	rounded, err := models.Round(converted, rounding)
+	if err != nil {
+		return 0, temporal.NewNonRetryableApplicationError("Converted amount is too large", "INVALID-DATA", nil)
+	}
+	return rounded, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// convertSummary fills in the settlement currency total of a bill summary from its captured rates.
+func convertSummary(ctx context.Context, summary *models.BillSummary) error {
+	settlement, ok, err := Currencies.Lookup(ctx, summary.SettlementCurrency)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	rates := make(map[string]models.FxRate)
+	for _, rate := range summary.FxRates {
+		rates[rate.Base] = rate
+	}
+
+	var total int64
+	for _, item := range summary.BillItemSummary {
+		if item.Currency == settlement.Code {
+			total, err = models.AddAmounts(total, item.TotalAmount)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		rate, ok := rates[item.Currency]
+		if !ok {
+			return nil
+		}
+		from, _, err := Currencies.Lookup(ctx, item.Currency)
+		if err != nil {
+			return err
+		}
+		converted, err := ConvertAmount(item.TotalAmount, rate.Rate, from.Exponent, settlement.Exponent, settlement.RoundingMode)
+		if err != nil {
+			return err
+		}
+		total, err = models.AddAmounts(total, converted)
+		if err != nil {
+			return err
+		}
+	}
+	summary.ConvertedTotal = &total
+	summary.FormattedConvertedTotal = settlement.Format(total)
+	return nil
+}
@@ -0,0 +1,75 @@
+package workflows
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertAmount(t *testing.T) {
+	converted, err := ConvertAmount(1000, "0.37", 2, 2, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(370), converted)
+
+	// 1.25 USD at 150.5 JPY/USD is 188.125 JPY.
+	converted, err = ConvertAmount(125, "150.5", 2, 0, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(188), converted)
+
+	converted, err = ConvertAmount(-5, "0.5", 2, 2, models.RoundHalfUp)
+	require.NoError(t, err)
+	require.Equal(t, int64(-3), converted)
+	converted, err = ConvertAmount(-5, "0.5", 2, 2, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(-2), converted)
+
+	_, err = ConvertAmount(math.MaxInt64, "2", 2, 2, models.RoundHalfEven)
+	require.Error(t, err)
+}
+
+func TestFileRateSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"base": "GEL", "quote": "USD", "rate": "0.30", "effectiveAt": "2025-01-01T00:00:00Z"},
+		{"base": "GEL", "quote": "USD", "rate": "0.37", "effectiveAt": "2025-06-01T00:00:00Z"}
+	]`), 0o600))
+	source := FileRateSource{Path: path}
+
+	rate, err := source.Rate(context.Background(), "GEL", "USD", time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, "0.30", rate.Rate)
+
+	_, err = source.Rate(context.Background(), "USD", "GEL", time.Now())
+	require.Error(t, err)
+}
+
+func TestCloseBill_SnapshotsFxRates(t *testing.T) {
+	ctx := context.Background()
+	effectiveAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	_, err := SaveFxRate(ctx, models.FxRate{Base: "GEL", Quote: "USD", Rate: "0.37", EffectiveAt: effectiveAt})
+	require.NoError(t, err)
+
+	bill, _ := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24*time.Hour), "USD", 0)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 1000, Currency: "GEL"})
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 250, Currency: "USD"})
+	require.NoError(t, err)
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+
+	// Correcting the rate the bill closed at does not affect the bill.
+	_, err = SaveFxRate(ctx, models.FxRate{Base: "GEL", Quote: "USD", Rate: "0.50", EffectiveAt: effectiveAt})
+	require.NoError(t, err)
+
+	summary, err := GetBillSummary(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, summary.FxRates, 1)
+	require.NotNil(t, summary.ConvertedTotal)
+	require.Equal(t, int64(620), *summary.ConvertedTotal)
+	require.Equal(t, "$6.20", summary.FormattedConvertedTotal)
+}
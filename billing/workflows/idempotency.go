@@ -0,0 +1,148 @@
+package workflows
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+)
+
+// IdempotencyRetention is how long a stored response is replayed for a repeated key.
+const IdempotencyRetention = 24 * time.Hour
+
+// IdempotencyLease is how long a reservation lasts unless it is renewed. A
+// running request renews it every third of the lease, so keys that go
+// unrenewed for longer were left behind by a request that crashed, and are
+// free to be reserved again.
+const IdempotencyLease = time.Minute
+
+// idempotencyNamespace is the UUID namespace of IDs derived from idempotency keys.
+var idempotencyNamespace = uuid.MustParse("e8c19ec8-a0d3-406c-9c23-e9af0f2d8251")
+
+// IdempotentId returns the ID of a resource created under key within scope.
+// Creating it under that ID lets a retried request find what an earlier
+// attempt already created.
+func IdempotentId(scope string, key string) string {
+	return uuid.NewSHA1(idempotencyNamespace, []byte(scope+"/"+key)).String()
+}
+
+// querier is satisfied by both the database and an open transaction.
+type querier interface {
+	Exec(ctx context.Context, query string, args ...interface{}) (sqldb.ExecResult, error)
+	QueryRow(ctx context.Context, query string, args ...interface{}) *sqldb.Row
+	Query(ctx context.Context, query string, args ...interface{}) (*sqldb.Rows, error)
+}
+
+type IdempotencyRecord struct {
+	RequestHash string
+	// Response is nil while the request that reserved the key is still running.
+	Response []byte
+}
+
+// HashRequest returns a stable fingerprint of a request body, used to detect a key being reused for a different request.
+func HashRequest(request interface{}) (string, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ReserveIdempotencyKey claims key within scope. It returns nil if the key was
+// free (or expired, or its lease ran out) and is now held by the caller,
+// otherwise the existing record.
+func ReserveIdempotencyKey(ctx context.Context, scope string, key string, requestHash string) (*IdempotencyRecord, error) {
+	return reserveIdempotencyKey(ctx, db.BillDb, scope, key, requestHash)
+}
+
+func reserveIdempotencyKey(ctx context.Context, q querier, scope string, key string, requestHash string) (*IdempotencyRecord, error) {
+	_, err := q.Exec(ctx, `
+	DELETE FROM idempotency_key
+	WHERE scope = $1 AND key = $2 AND (expires_at < now() OR (response IS NULL AND locked_until < now()))
+	`, scope, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var reserved string
+	err = q.QueryRow(ctx, `
+	INSERT INTO idempotency_key
+	(scope, key, request_hash, expires_at, locked_until)
+	VALUES ($1,$2,$3,$4,$5)
+	ON CONFLICT (scope, key) DO NOTHING
+	RETURNING key
+	`, scope, key, requestHash, time.Now().Add(IdempotencyRetention), time.Now().Add(IdempotencyLease)).Scan(&reserved)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, err
+	}
+
+	var record IdempotencyRecord
+	err = q.QueryRow(ctx, `
+	SELECT request_hash, response
+	FROM idempotency_key
+	WHERE scope = $1 AND key = $2
+	`, scope, key).Scan(&record.RequestHash, &record.Response)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// SaveIdempotentResponse stores the response to replay for a key reserved with ReserveIdempotencyKey.
+func SaveIdempotentResponse(ctx context.Context, scope string, key string, response interface{}) error {
+	return saveIdempotentResponse(ctx, db.BillDb, scope, key, response)
+}
+
+func saveIdempotentResponse(ctx context.Context, q querier, scope string, key string, response interface{}) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(ctx, `
+	UPDATE idempotency_key
+	SET response = $3
+	WHERE scope = $1 AND key = $2
+	`, scope, key, body)
+	return err
+}
+
+// RenewIdempotencyKey extends the lease of a key that is still waiting for its response.
+func RenewIdempotencyKey(ctx context.Context, scope string, key string) error {
+	_, err := db.BillDb.Exec(ctx, `
+	UPDATE idempotency_key
+	SET locked_until = $3
+	WHERE scope = $1 AND key = $2 AND response IS NULL
+	`, scope, key, time.Now().Add(IdempotencyLease))
+	return err
+}
+
+// ReleaseIdempotencyKey frees a reserved key after a failed request so that the client can retry it.
+func ReleaseIdempotencyKey(ctx context.Context, scope string, key string) error {
+	_, err := db.BillDb.Exec(ctx, `
+	DELETE FROM idempotency_key
+	WHERE scope = $1 AND key = $2 AND response IS NULL
+	`, scope, key)
+	return err
+}
+
+// PruneIdempotencyKeys deletes keys past IdempotencyRetention and returns how many it deleted.
+func PruneIdempotencyKeys(ctx context.Context) (int64, error) {
+	result, err := db.BillDb.Exec(ctx, `
+	DELETE FROM idempotency_key
+	WHERE expires_at < now()
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
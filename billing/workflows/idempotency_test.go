@@ -0,0 +1,108 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/billing/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotency_ReserveAndReplay(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.New().String()
+	requestHash, err := HashRequest(map[string]int{"amount": 100})
+	require.NoError(t, err)
+
+	record, err := ReserveIdempotencyKey(ctx, "test", key, requestHash)
+	require.NoError(t, err)
+	require.Nil(t, record)
+
+	record, err = ReserveIdempotencyKey(ctx, "test", key, requestHash)
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	require.Nil(t, record.Response)
+
+	require.NoError(t, SaveIdempotentResponse(ctx, "test", key, "done"))
+	record, err = ReserveIdempotencyKey(ctx, "test", key, requestHash)
+	require.NoError(t, err)
+	require.JSONEq(t, `"done"`, string(record.Response))
+}
+
+func TestIdempotency_Release(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.New().String()
+
+	record, err := ReserveIdempotencyKey(ctx, "test", key, "hash")
+	require.NoError(t, err)
+	require.Nil(t, record)
+	require.NoError(t, ReleaseIdempotencyKey(ctx, "test", key))
+
+	record, err = ReserveIdempotencyKey(ctx, "test", key, "other-hash")
+	require.NoError(t, err)
+	require.Nil(t, record)
+}
+
+func TestIdempotency_LeaseExpires(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.New().String()
+
+	record, err := ReserveIdempotencyKey(ctx, "test", key, "hash")
+	require.NoError(t, err)
+	require.Nil(t, record)
+
+	// A request that never saved its response stops holding the key once its lease runs out.
+	_, err = db.BillDb.Exec(ctx, `
+	UPDATE idempotency_key
+	SET locked_until = now() - interval '1 second'
+	WHERE scope = 'test' AND key = $1
+	`, key)
+	require.NoError(t, err)
+	record, err = ReserveIdempotencyKey(ctx, "test", key, "hash")
+	require.NoError(t, err)
+	require.Nil(t, record)
+}
+
+func TestIdempotency_Renew(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.New().String()
+
+	_, err := ReserveIdempotencyKey(ctx, "test", key, "hash")
+	require.NoError(t, err)
+	_, err = db.BillDb.Exec(ctx, `
+	UPDATE idempotency_key
+	SET locked_until = now() - interval '1 second'
+	WHERE scope = 'test' AND key = $1
+	`, key)
+	require.NoError(t, err)
+
+	// A renewed key stays held by the request running under it.
+	require.NoError(t, RenewIdempotencyKey(ctx, "test", key))
+	record, err := ReserveIdempotencyKey(ctx, "test", key, "hash")
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	require.Nil(t, record.Response)
+}
+
+func TestIdempotency_Prune(t *testing.T) {
+	ctx := context.Background()
+	key := uuid.New().String()
+
+	_, err := ReserveIdempotencyKey(ctx, "test", key, "hash")
+	require.NoError(t, err)
+	require.NoError(t, SaveIdempotentResponse(ctx, "test", key, "done"))
+	_, err = db.BillDb.Exec(ctx, `
+	UPDATE idempotency_key
+	SET expires_at = now() - interval '1 second'
+	WHERE scope = 'test' AND key = $1
+	`, key)
+	require.NoError(t, err)
+
+	deleted, err := PruneIdempotencyKeys(ctx)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, deleted, int64(1))
+	var count int
+	require.NoError(t, db.BillDb.QueryRow(ctx, `SELECT COUNT(*) FROM idempotency_key WHERE scope = 'test' AND key = $1`, key).Scan(&count))
+	require.Zero(t, count)
+}
@@ -0,0 +1,385 @@
+package workflows
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/big"
+	"strings"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/sdk/temporal"
+)
+
+// InvoicePaymentInstructions are printed at the bottom of every invoice.
+var InvoicePaymentInstructions = "Please pay the total due within 30 days of the invoice date, quoting the invoice number as the payment reference."
+
+const invoiceDateFormat = "2006-01-02"
+
+// invoiceDocument is what an invoice shows, for both of its formats.
+type invoiceDocument struct {
+	Number string
+	IssuedAt time.Time
+	BillId string
+	// Customer is nil for bills without a customer.
+	Customer *models.Customer
+	Items []models.BillItem
+	Totals []models.BillItemSummary
+	TaxLines []models.TaxLine
+	PaymentInstructions string
+}
+
+func servicePeriod(item models.BillItem) string {
+	if item.ServicePeriodStart == nil || item.ServicePeriodEnd == nil {
+		return ""
+	}
+	return item.ServicePeriodStart.UTC().Format(invoiceDateFormat) + " to " + item.ServicePeriodEnd.UTC().Format(invoiceDateFormat)
+}
+
+func itemDescription(item models.BillItem) string {
+	if item.Description != "" {
+		return item.Description
+	}
+	if item.Sku != "" {
+		return item.Sku
+	}
+	return "Item"
+}
+
+// taxRatePercent renders a decimal fraction such as "0.18" as "18%".
+func taxRatePercent(rate string) string {
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok {
+		return rate
+	}
+	percent := r.Mul(r, big.NewRat(100, 1)).FloatString(4)
+	return strings.TrimSuffix(strings.TrimRight(percent, "0"), ".") + "%"
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.UTC().Format(invoiceDateFormat) },
+	"description": itemDescription,
+	"period": servicePeriod,
+	"percent": taxRatePercent,
+	// money is replaced per render, to format with the request's context.
+	"money": func(amount int64, currency string) string { return "" },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Invoice {{.Number}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 14px; color: #222; max-width: 800px; margin: 40px auto; }
+table { width: 100%; border-collapse: collapse; margin: 16px 0; }
+th, td { padding: 6px 8px; text-align: left; vertical-align: top; }
+.items th { border-bottom: 2px solid #222; }
+.items td { border-bottom: 1px solid #ddd; }
+.number { text-align: right; white-space: nowrap; }
+.period { color: #666; font-size: 12px; }
+.total td { font-weight: bold; border-top: 2px solid #222; }
+</style>
+</head>
+<body>
+<h1>Invoice {{.Number}}</h1>
+<table class="details">
+<tr><th>Invoice number</th><td>{{.Number}}</td></tr>
+<tr><th>Invoice date</th><td>{{date .IssuedAt}}</td></tr>
+<tr><th>Bill</th><td>{{.BillId}}</td></tr>
+</table>
+{{with .Customer}}<h2>Bill to</h2>
+<p>{{.Name}}<br>{{.Email}}<br>Customer {{.Id}}</p>
+{{end}}<h2>Items</h2>
+<table class="items">
+<thead><tr><th>Description</th><th class="number">Quantity</th><th class="number">Unit price</th><th class="number">Amount</th></tr></thead>
+<tbody>
+{{range .Items}}<tr><td>{{description .}}{{with period .}}<div class="period">{{.}}</div>{{end}}</td><td class="number">{{.Quantity}}</td><td class="number">{{money .UnitPrice .Currency}}</td><td class="number">{{money .Amount .Currency}}</td></tr>
+{{end}}</tbody>
+</table>
+{{range .Totals}}<h2>Total {{.Currency}}</h2>
+<table class="totals">
+{{if .DiscountAmount}}<tr><td>Discounts</td><td class="number">-{{money .DiscountAmount .Currency}}</td></tr>
+{{end}}<tr><td>Subtotal</td><td class="number">{{money .Subtotal .Currency}}</td></tr>
+<tr><td>Tax</td><td class="number">{{money .TaxAmount .Currency}}</td></tr>
+<tr class="total"><td>Total due</td><td class="number">{{money .TotalAmount .Currency}}</td></tr>
+</table>
+{{end}}{{if .TaxLines}}<h2>Tax</h2>
+<table class="tax">
+<thead><tr><th>Jurisdiction</th><th>Category</th><th class="number">Rate</th><th class="number">Taxable amount</th><th class="number">Tax</th></tr></thead>
+<tbody>
+{{range .TaxLines}}<tr><td>{{.Jurisdiction}}</td><td>{{.TaxCategory}}{{if .Inclusive}} (included){{end}}</td><td class="number">{{percent .Rate}}</td><td class="number">{{money .TaxableAmount .Currency}}</td><td class="number">{{money .TaxAmount .Currency}}</td></tr>
+{{end}}</tbody>
+</table>
+{{end}}<h2>Payment instructions</h2>
+<p>{{.PaymentInstructions}}</p>
+</body>
+</html>
+`))
+
+func renderInvoiceHTML(ctx context.Context, doc invoiceDocument) (string, error) {
+	tmpl, err := invoiceTemplate.Clone()
+	if err != nil {
+		return "", err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"money": func(amount int64, currency string) string { return Currencies.Format(ctx, amount, currency) },
+	})
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, doc)
+	if err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// pdfMoney formats an amount like Currencies.Format, falling back to the
+// currency code for symbols the PDF fonts cannot show.
+func pdfMoney(ctx context.Context, amount int64, code string) string {
+	currency, ok, err := Currencies.Lookup(ctx, code)
+	if err != nil || !ok || !pdfEncodable(currency.Symbol) {
+		currency.Code = code
+		currency.Symbol = code + " "
+	}
+	return currency.Format(amount)
+}
+
+func renderInvoicePDF(ctx context.Context, doc invoiceDocument) []byte {
+	const (
+		size = 10.0
+		mono = 9.0
+		height = 14.0
+		// Columns of the items table, as right edges apart from the description.
+		quantityRight = 370.0
+		unitPriceRight = 460.0
+		amountRight = pdfPageWidth - pdfMargin
+		// Characters of the monospaced font that fit left of the quantity column.
+		descriptionWidth = 50
+	)
+	money := func(amount int64, currency string) string { return pdfMoney(ctx, amount, currency) }
+	var pdf pdfWriter
+
+	pdf.newLine(20)
+	pdf.text(pdfBold, 20, pdfMargin, "Invoice "+doc.Number)
+	pdf.newLine(height)
+	pdf.newLine(height)
+	pdf.text(pdfRegular, size, pdfMargin, "Invoice number: "+doc.Number)
+	pdf.newLine(height)
+	pdf.text(pdfRegular, size, pdfMargin, "Invoice date: "+doc.IssuedAt.UTC().Format(invoiceDateFormat))
+	pdf.newLine(height)
+	pdf.text(pdfRegular, size, pdfMargin, "Bill: "+doc.BillId)
+
+	if doc.Customer != nil {
+		pdf.newLine(height)
+		pdf.newLine(height)
+		pdf.text(pdfBold, 12, pdfMargin, "Bill to")
+		for _, line := range []string{doc.Customer.Name, doc.Customer.Email, "Customer " + doc.Customer.Id} {
+			pdf.newLine(height)
+			pdf.text(pdfRegular, size, pdfMargin, line)
+		}
+	}
+
+	pdf.newLine(height)
+	pdf.newLine(height)
+	pdf.text(pdfBold, 12, pdfMargin, "Items")
+	pdf.newLine(height)
+	pdf.text(pdfMono, mono, pdfMargin, "Description")
+	pdf.monoRight(mono, quantityRight, "Quantity")
+	pdf.monoRight(mono, unitPriceRight, "Unit price")
+	pdf.monoRight(mono, amountRight, "Amount")
+	for _, item := range doc.Items {
+		lines := wrapText(itemDescription(item), descriptionWidth)
+		if period := servicePeriod(item); period != "" {
+			lines = append(lines, "  "+period)
+		}
+		for i, line := range lines {
+			pdf.newLine(height)
+			pdf.text(pdfMono, mono, pdfMargin, line)
+			if i == 0 {
+				pdf.monoRight(mono, quantityRight, fmt.Sprint(item.Quantity))
+				pdf.monoRight(mono, unitPriceRight, money(item.UnitPrice, item.Currency))
+				pdf.monoRight(mono, amountRight, money(item.Amount, item.Currency))
+			}
+		}
+	}
+
+	for _, total := range doc.Totals {
+		pdf.newLine(height)
+		pdf.newLine(height)
+		pdf.text(pdfBold, 12, pdfMargin, "Total "+total.Currency)
+		if total.DiscountAmount != 0 {
+			pdf.newLine(height)
+			pdf.text(pdfMono, mono, pdfMargin, "Discounts")
+			pdf.monoRight(mono, amountRight, "-"+money(total.DiscountAmount, total.Currency))
+		}
+		pdf.newLine(height)
+		pdf.text(pdfMono, mono, pdfMargin, "Subtotal")
+		pdf.monoRight(mono, amountRight, money(total.Subtotal, total.Currency))
+		pdf.newLine(height)
+		pdf.text(pdfMono, mono, pdfMargin, "Tax")
+		pdf.monoRight(mono, amountRight, money(total.TaxAmount, total.Currency))
+		pdf.newLine(height)
+		pdf.text(pdfBold, size, pdfMargin, "Total due")
+		pdf.monoRight(mono, amountRight, money(total.TotalAmount, total.Currency))
+	}
+
+	if len(doc.TaxLines) > 0 {
+		pdf.newLine(height)
+		pdf.newLine(height)
+		pdf.text(pdfBold, 12, pdfMargin, "Tax")
+		for _, line := range doc.TaxLines {
+			label := fmt.Sprintf("%s %s %s", line.Jurisdiction, line.TaxCategory, taxRatePercent(line.Rate))
+			if line.Inclusive {
+				label += " (included)"
+			}
+			pdf.newLine(height)
+			pdf.text(pdfMono, mono, pdfMargin, label)
+			pdf.monoRight(mono, unitPriceRight, money(line.TaxableAmount, line.Currency))
+			pdf.monoRight(mono, amountRight, money(line.TaxAmount, line.Currency))
+		}
+	}
+
+	pdf.newLine(height)
+	pdf.newLine(height)
+	pdf.text(pdfBold, 12, pdfMargin, "Payment instructions")
+	for _, line := range wrapText(doc.PaymentInstructions, 90) {
+		pdf.newLine(height)
+		pdf.text(pdfRegular, size, pdfMargin, line)
+	}
+
+	return pdf.Bytes("Invoice " + doc.Number)
+}
+
+// invoicedSummary returns the part of a bill summary that was billed as the
+// bill closed. Credit notes issued since are left out, as they are documents
+// of their own.
+func invoicedSummary(ctx context.Context, summary *models.BillSummary) (*models.BillSummary, error) {
+	invoiced := models.BillSummary{BillId: summary.BillId, Discounts: summary.Discounts}
+	amounts := make(map[string]int64)
+	for _, item := range summary.BillItems {
+		if item.VoidedAt != nil || item.CreditNoteId != "" {
+			continue
+		}
+		invoiced.BillItems = append(invoiced.BillItems, item)
+		amount, err := models.AddAmounts(amounts[item.Currency], item.Amount)
+		if err != nil {
+			return nil, temporal.NewNonRetryableApplicationError("Bill total overflows", "INVALID-DATA", nil)
+		}
+		amounts[item.Currency] = amount
+	}
+	for _, line := range summary.TaxLines {
+		if line.CreditNoteId == "" {
+			invoiced.TaxLines = append(invoiced.TaxLines, line)
+		}
+	}
+	for _, total := range summary.BillItemSummary {
+		amount, ok := amounts[total.Currency]
+		if !ok {
+			continue
+		}
+		invoiced.BillItemSummary = append(invoiced.BillItemSummary, models.BillItemSummary{BillId: total.BillId, Currency: total.Currency, TotalAmount: amount})
+	}
+	applyDiscountLines(ctx, &invoiced)
+	err := applyTaxLines(ctx, &invoiced)
+	if err != nil {
+		return nil, err
+	}
+	return &invoiced, nil
+}
+
+// GetInvoice returns the invoice of a closed bill. The first call numbers the
+// invoice and renders its documents, which are stored and returned unchanged
+// from then on, even if the bill is credited or paid later.
+func GetInvoice(ctx context.Context, billId string) (*models.Invoice, error) {
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the bill makes concurrent first calls wait for one invoice to be stored.
+	var customerId, status string
+	var closedAt *time.Time
+	err = tx.QueryRow(ctx, `
+	SELECT COALESCE(customer_id::text, ''), status, closed_at
+	FROM bill
+	WHERE id = $1
+	FOR UPDATE
+	`, billId).Scan(&customerId, &status, &closedAt)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+
+	invoice := models.Invoice{BillId: billId}
+	err = tx.QueryRow(ctx, `
+	SELECT number, html, pdf, created_at
+	FROM invoice
+	WHERE bill_id = $1
+	`, billId).Scan(&invoice.Number, &invoice.Html, &invoice.Pdf, &invoice.CreatedAt)
+	if err == nil {
+		return &invoice, nil
+	}
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, err
+	}
+	if closedAt == nil || status == models.BillStatusVoid {
+		return nil, temporal.NewNonRetryableApplicationError("Invoices are only issued for closed bills, this one is "+status, "FAILED-PRECONDITION", nil)
+	}
+
+	doc := invoiceDocument{BillId: billId, IssuedAt: *closedAt, PaymentInstructions: InvoicePaymentInstructions}
+	if customerId != "" {
+		// Customers deleted since are still named on their invoices.
+		doc.Customer = &models.Customer{Id: customerId}
+		err = tx.QueryRow(ctx, `
+		SELECT name, email
+		FROM customer
+		WHERE id = $1
+		`, customerId).Scan(&doc.Customer.Name, &doc.Customer.Email)
+		if err != nil {
+			return nil, err
+		}
+	}
+	summary, err := GetBillSummary(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	invoiced, err := invoicedSummary(ctx, summary)
+	if err != nil {
+		return nil, err
+	}
+	doc.Items = invoiced.BillItems
+	doc.Totals = invoiced.BillItemSummary
+	doc.TaxLines = invoiced.TaxLines
+
+	var sequence int64
+	err = tx.QueryRow(ctx, `SELECT nextval('invoice_number_seq')`).Scan(&sequence)
+	if err != nil {
+		return nil, err
+	}
+	doc.Number = fmt.Sprintf("INV-%06d", sequence)
+
+	invoice.Number = doc.Number
+	invoice.Html, err = renderInvoiceHTML(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	invoice.Pdf = renderInvoicePDF(ctx, doc)
+	err = tx.QueryRow(ctx, `
+	INSERT INTO invoice
+	(bill_id, number, html, pdf)
+	VALUES ($1,$2,$3,$4)
+	RETURNING created_at
+	`, billId, invoice.Number, invoice.Html, invoice.Pdf).Scan(&invoice.CreatedAt)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
@@ -0,0 +1,110 @@
+package workflows
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapText(t *testing.T) {
+	require.Equal(t, []string{"Pro plan for", "the whole", "team"}, wrapText("Pro plan for the whole team", 12))
+	require.Equal(t, []string{"abcde", "fgh"}, wrapText("abcdefgh", 5))
+	require.Equal(t, []string{"one", "two"}, wrapText("one\ntwo", 20))
+}
+
+func TestTaxRatePercent(t *testing.T) {
+	require.Equal(t, "18%", taxRatePercent("0.18"))
+	require.Equal(t, "7.25%", taxRatePercent("0.0725"))
+	require.Equal(t, "0%", taxRatePercent("0"))
+}
+
+func TestPdfWriter(t *testing.T) {
+	var pdf pdfWriter
+	for i := 0; i < 100; i++ {
+		pdf.newLine(14)
+		pdf.text(pdfRegular, 10, pdfMargin, fmt.Sprintf("Line (%d) \\ €5 ₾", i))
+	}
+	out := pdf.Bytes("Test")
+	require.True(t, bytes.HasPrefix(out, []byte("%PDF-1.4\n")))
+	require.True(t, bytes.HasSuffix(out, []byte("%%EOF\n")))
+	require.Contains(t, string(out), "/Count 2")
+	// Delimiters are escaped and characters missing from the fonts replaced.
+	require.Contains(t, string(out), "(Line \\(0\\) \\\\ \x805 ?) Tj")
+
+	// Every entry of the cross-reference table points at its object.
+	start, err := strconv.Atoi(regexp.MustCompile(`startxref\n(\d+)`).FindStringSubmatch(string(out))[1])
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(out[start:], []byte("xref\n")))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(string(out[start:]), -1)
+	require.Len(t, entries, 3+len(pdfFonts)+2*len(pdf.pages))
+	for i, entry := range entries {
+		offset, err := strconv.Atoi(entry[1])
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(out[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))))
+	}
+}
+
+func TestGetInvoice(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	bill, err := CreateBill(ctx, customerId, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 1250, Currency: "USD", Description: "Pro plan <monthly>"})
+	require.NoError(t, err)
+
+	// Open bills have no invoice yet.
+	_, err = GetInvoice(ctx, bill.BillId)
+	require.Error(t, err)
+	require.Equal(t, "FAILED-PRECONDITION", applicationErrorType(err))
+
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	invoice, err := GetInvoice(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Regexp(t, `^INV-\d{6,}$`, invoice.Number)
+	require.Contains(t, invoice.Html, "Invoice "+invoice.Number)
+	require.Contains(t, invoice.Html, "Test Customer")
+	require.Contains(t, invoice.Html, "Pro plan &lt;monthly&gt;")
+	require.Contains(t, invoice.Html, "$12.50")
+	require.Contains(t, invoice.Html, InvoicePaymentInstructions)
+	require.True(t, bytes.HasPrefix(invoice.Pdf, []byte("%PDF-")))
+	require.Contains(t, string(invoice.Pdf), "(Invoice "+invoice.Number+")")
+
+	// Later changes to the bill leave the stored invoice as it is.
+	_, err = RecordPayment(ctx, bill.BillId, models.Payment{Amount: 1250, Currency: "USD", Method: "card"})
+	require.NoError(t, err)
+	again, err := GetInvoice(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Equal(t, invoice.Number, again.Number)
+	require.Equal(t, invoice.Html, again.Html)
+	require.True(t, bytes.Equal(invoice.Pdf, again.Pdf))
+
+	_, err = GetInvoice(ctx, "00000000-0000-0000-0000-000000000000")
+	require.Error(t, err)
+}
+
+func TestGetInvoice_CreditNoteAfterClose(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+	chargeId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 1250, Currency: "USD", Description: "Pro plan"})
+	require.NoError(t, err)
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+
+	// A credit note issued before the invoice is first rendered is not part of it.
+	_, err = CreateCreditNote(ctx, bill.BillId, "Service outage", []models.BillItem{
+		{Amount: -400, Currency: "USD", Description: "Outage credit", AdjustsItemId: chargeId},
+	})
+	require.NoError(t, err)
+	invoice, err := GetInvoice(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.NotContains(t, invoice.Html, "Outage credit")
+	require.NotContains(t, invoice.Html, "$8.50")
+	require.Regexp(t, `Total due</td><td class="number">\$12\.50<`, invoice.Html)
+}
@@ -0,0 +1,291 @@
+package workflows
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"go.temporal.io/sdk/temporal"
+)
+
+const (
+	defaultListBillsLimit = 50
+	maxListBillsLimit = 200
+)
+
+// billSortColumns maps the accepted sort keys to their column.
+var billSortColumns = map[string]string{
+	"created_at": "created_at",
+	"close_date": "close_date",
+	"closed_at": "closed_at",
+}
+
+type ListBillParams struct {
+	Status string
+	CustomerId string
+	// Currency keeps bills with items in this currency. Combined with the total
+	// filters, the total in this currency must be in range.
+	Currency string
+
+	CreatedAfter time.Time
+	CreatedBefore time.Time
+	CloseDateAfter time.Time
+	CloseDateBefore time.Time
+	ClosedAfter time.Time
+	ClosedBefore time.Time
+
+	// MinTotal and MaxTotal bound the total of at least one currency of the
+	// bill, in minor units. Empty means unbounded.
+	MinTotal string
+	MaxTotal string
+
+	// Sort is one of "created_at" (the default), "close_date" or "closed_at".
+	// Sorting by closed_at only returns closed bills.
+	Sort string
+	// Order is "desc" (the default) or "asc".
+	Order string
+	// Limit is the page size, 50 by default and at most 200.
+	Limit int
+	// Cursor continues from the NextCursor of a previous page with the same sort.
+	Cursor string
+}
+
+type ListBillsPage struct {
+	Bills []models.Bill
+	// NextCursor is empty on the last page.
+	NextCursor string
+}
+
+type billCursor struct {
+	Sort string `json:"s"`
+	Order string `json:"o"`
+	Value time.Time `json:"v"`
+	Id string `json:"id"`
+}
+
+func encodeBillCursor(cursor billCursor) string {
+	body, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(body)
+}
+
+func decodeBillCursor(encoded string) (*billCursor, error) {
+	body, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid cursor", "INVALID-DATA", nil)
+	}
+	var cursor billCursor
+	err = json.Unmarshal(body, &cursor)
+	if err != nil || cursor.Id == "" {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid cursor", "INVALID-DATA", nil)
+	}
+	return &cursor, nil
+}
+
+func parseTotalBound(name string, value string) (*int64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	bound, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid "+name+": "+value, "INVALID-DATA", nil)
+	}
+	return &bound, nil
+}
+
+// ListBills returns a page of bills matching params, using keyset pagination
+// on the sort column and the bill ID.
+func ListBills(ctx context.Context, params *ListBillParams) (*ListBillsPage, error) {
+	sort := params.Sort
+	if sort == "" {
+		sort = "created_at"
+	}
+	column, ok := billSortColumns[sort]
+	if !ok {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid sort: "+sort, "INVALID-DATA", nil)
+	}
+	order := params.Order
+	if order == "" {
+		order = "desc"
+	}
+	if order != "asc" && order != "desc" {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid order: "+order, "INVALID-DATA", nil)
+	}
+	limit := params.Limit
+	if limit <= 0 {
+		limit = defaultListBillsLimit
+	}
+	if limit > maxListBillsLimit {
+		limit = maxListBillsLimit
+	}
+	minTotal, err := parseTotalBound("minimum total", params.MinTotal)
+	if err != nil {
+		return nil, err
+	}
+	maxTotal, err := parseTotalBound("maximum total", params.MaxTotal)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+	SELECT id, COALESCE(customer_id::text, ''), COALESCE(schedule_id::text, ''), status, close_date, settlement_currency, created_at, closed_at, overdue_at
+	FROM bill
+	WHERE 1=1
+	`
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		query += fmt.Sprintf(`
+		AND `+condition+`
+		`, len(args))
+	}
+
+	if params.Status != "" {
+		where("status = $%d", params.Status)
+	}
+	if params.CustomerId != "" {
+		where("customer_id = $%d", params.CustomerId)
+	}
+	for _, bound := range []struct {
+		condition string
+		value time.Time
+	}{
+		{"created_at >= $%d", params.CreatedAfter},
+		{"created_at < $%d", params.CreatedBefore},
+		{"close_date >= $%d", params.CloseDateAfter},
+		{"close_date < $%d", params.CloseDateBefore},
+		{"closed_at >= $%d", params.ClosedAfter},
+		{"closed_at < $%d", params.ClosedBefore},
+	} {
+		if !bound.value.IsZero() {
+			where(bound.condition, bound.value)
+		}
+	}
+	if sort == "closed_at" {
+		query += `
+		AND closed_at IS NOT NULL
+		`
+	}
+
+	if params.Currency != "" || minTotal != nil || maxTotal != nil {
+		query += `
+		AND EXISTS (
+			SELECT 1 FROM bill_summary
+			WHERE bill_summary.bill_id = bill.id
+		`
+		if params.Currency != "" {
+			where("bill_summary.currency = $%d", params.Currency)
+		}
+		if minTotal != nil {
+			where("bill_summary.total_amount >= $%d", *minTotal)
+		}
+		if maxTotal != nil {
+			where("bill_summary.total_amount <= $%d", *maxTotal)
+		}
+		query += `)
+		`
+	}
+
+	comparison := "<"
+	if order == "asc" {
+		comparison = ">"
+	}
+	if params.Cursor != "" {
+		cursor, err := decodeBillCursor(params.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.Sort != sort || cursor.Order != order {
+			return nil, temporal.NewNonRetryableApplicationError("Cursor was issued for a different sort", "INVALID-DATA", nil)
+		}
+		args = append(args, cursor.Value, cursor.Id)
+		query += fmt.Sprintf(`
+		AND (%s, id) %s ($%d, $%d)
+		`, column, comparison, len(args)-1, len(args))
+	}
+
+	// One extra row tells whether there is a next page.
+	args = append(args, limit+1)
+	query += fmt.Sprintf(`
+	ORDER BY %s %s, id %s
+	LIMIT $%d
+	`, column, order, order, len(args))
+
+	rows, err := db.BillDb.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &ListBillsPage{Bills: []models.Bill{}}
+	for rows.Next() {
+		var bill models.Bill
+		err := rows.Scan(&bill.BillId, &bill.CustomerId, &bill.ScheduleId, &bill.Status, &bill.CloseDate, &bill.SettlementCurrency, &bill.CreatedAt, &bill.ClosedAt, &bill.OverdueAt)
+		if err != nil {
+			return nil, err
+		}
+		page.Bills = append(page.Bills, bill)
+	}
+	rows.Close()
+
+	if len(page.Bills) > limit {
+		page.Bills = page.Bills[:limit]
+		last := page.Bills[limit-1]
+		cursor := billCursor{Sort: sort, Order: order, Id: last.BillId}
+		switch sort {
+		case "created_at":
+			cursor.Value = last.CreatedAt
+		case "close_date":
+			cursor.Value = last.CloseDate
+		case "closed_at":
+			cursor.Value = *last.ClosedAt
+		}
+		page.NextCursor = encodeBillCursor(cursor)
+	}
+
+	err = fillBillTotals(ctx, page.Bills)
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// fillBillTotals sets the per-currency totals of a page of bills with a single query.
+func fillBillTotals(ctx context.Context, bills []models.Bill) error {
+	if len(bills) == 0 {
+		return nil
+	}
+	billIds := make([]string, len(bills))
+	index := make(map[string]int, len(bills))
+	for i, bill := range bills {
+		billIds[i] = bill.BillId
+		index[bill.BillId] = i
+	}
+
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT bill_id, currency, total_amount
+	FROM bill_summary
+	WHERE bill_id = ANY($1::uuid[])
+	ORDER BY currency
+	`, billIds)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var total models.BillItemSummary
+		err := rows.Scan(&total.BillId, &total.Currency, &total.TotalAmount)
+		if err != nil {
+			return err
+		}
+		total.FormattedTotal = Currencies.Format(ctx, total.TotalAmount, total.Currency)
+		bill := &bills[index[total.BillId]]
+		bill.Totals = append(bill.Totals, total)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListBills_Pagination(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+
+	var billIds []string
+	for i := 1; i <= 5; i++ {
+		bill, err := CreateBill(ctx, customerId, time.Now().Add(time.Duration(i) * 24 * time.Hour), "USD", 0)
+		require.NoError(t, err)
+		billIds = append(billIds, bill.BillId)
+	}
+
+	var listed []string
+	params := &ListBillParams{CustomerId: customerId, Sort: "close_date", Order: "asc", Limit: 2}
+	for {
+		page, err := ListBills(ctx, params)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(page.Bills), 2)
+		for _, bill := range page.Bills {
+			listed = append(listed, bill.BillId)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		params.Cursor = page.NextCursor
+	}
+	require.Equal(t, billIds, listed)
+}
+
+func TestListBills_CursorForDifferentSort(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	for i := 0; i < 2; i++ {
+		_, err := CreateBill(ctx, customerId, time.Now().Add(24 * time.Hour), "USD", 0)
+		require.NoError(t, err)
+	}
+
+	page, err := ListBills(ctx, &ListBillParams{CustomerId: customerId, Limit: 1})
+	require.NoError(t, err)
+	require.NotEmpty(t, page.NextCursor)
+
+	_, err = ListBills(ctx, &ListBillParams{CustomerId: customerId, Sort: "close_date", Cursor: page.NextCursor})
+	require.Error(t, err)
+	_, err = ListBills(ctx, &ListBillParams{CustomerId: customerId, Cursor: "not a cursor"})
+	require.Error(t, err)
+	_, err = ListBills(ctx, &ListBillParams{Sort: "amount"})
+	require.Error(t, err)
+}
+
+func TestListBills_Filters(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+
+	small, err := CreateBill(ctx, customerId, time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, small.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.NoError(t, err)
+
+	large, err := CreateBill(ctx, customerId, time.Now().Add(48 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, large.BillId, models.BillItem{Amount: 5000, Currency: "GEL"})
+	require.NoError(t, err)
+	require.NoError(t, CloseBill(ctx, large.BillId))
+
+	page, err := ListBills(ctx, &ListBillParams{CustomerId: customerId, MinTotal: "1000"})
+	require.NoError(t, err)
+	require.Len(t, page.Bills, 1)
+	require.Equal(t, large.BillId, page.Bills[0].BillId)
+	require.Equal(t, []models.BillItemSummary{{BillId: large.BillId, Currency: "GEL", TotalAmount: 5000, FormattedTotal: Currencies.Format(ctx, 5000, "GEL")}}, page.Bills[0].Totals)
+
+	page, err = ListBills(ctx, &ListBillParams{CustomerId: customerId, Currency: "USD", MaxTotal: "100"})
+	require.NoError(t, err)
+	require.Len(t, page.Bills, 1)
+	require.Equal(t, small.BillId, page.Bills[0].BillId)
+
+	page, err = ListBills(ctx, &ListBillParams{CustomerId: customerId, Sort: "closed_at"})
+	require.NoError(t, err)
+	require.Len(t, page.Bills, 1)
+	require.NotNil(t, page.Bills[0].ClosedAt)
+
+	page, err = ListBills(ctx, &ListBillParams{CustomerId: customerId, CloseDateBefore: time.Now().Add(36 * time.Hour)})
+	require.NoError(t, err)
+	require.Len(t, page.Bills, 1)
+	require.Equal(t, small.BillId, page.Bills[0].BillId)
+
+	_, err = ListBills(ctx, &ListBillParams{MinTotal: "lots"})
+	require.Error(t, err)
+}
@@ -0,0 +1,207 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+)
+
+// Bill lifecycle events. Delivery is at least once, so subscribers should
+// deduplicate on the event ID.
+var BillCreated = pubsub.NewTopic[*models.BillEvent]("bill-created", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var BillItemAdded = pubsub.NewTopic[*models.BillEvent]("bill-item-added", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var BillClosed = pubsub.NewTopic[*models.BillEvent]("bill-closed", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// BillDunning carries the reminders, overdue notices and suspensions of unpaid bills.
+var BillDunning = pubsub.NewTopic[*models.BillEvent]("bill-dunning", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// BillSpendCap carries the alerts of bills approaching or going over their spending cap.
+var BillSpendCap = pubsub.NewTopic[*models.BillEvent]("bill-spend-cap", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// OutboxRetention is how long published events are kept in the outbox.
+const OutboxRetention = 7 * 24 * time.Hour
+
+const outboxBatchSize = 100
+
+// enqueueEvent writes an event to the outbox. Called within a transaction, the
+// event is only published if the transaction commits.
+func enqueueEvent(ctx context.Context, q querier, eventType string, bill models.Bill, item *models.BillItem) (string, error) {
+	event := models.BillEvent{
+		Id: uuid.NewString(),
+		Type: eventType,
+		BillId: bill.BillId,
+		CustomerId: bill.CustomerId,
+		CreatedAt: time.Now().UTC(),
+		Item: item,
+	}
+	return insertOutboxEvent(ctx, q, event)
+}
+
+// enqueueDunningEvent writes the event of a dunning step to the outbox.
+func enqueueDunningEvent(ctx context.Context, q querier, bill models.Bill, dunning models.DunningEvent) (string, error) {
+	event := models.BillEvent{
+		Id: uuid.NewString(),
+		Type: dunningEventTypes[dunning.Action],
+		BillId: bill.BillId,
+		CustomerId: bill.CustomerId,
+		CreatedAt: time.Now().UTC(),
+		Dunning: &dunning,
+	}
+	return insertOutboxEvent(ctx, q, event)
+}
+
+// enqueueSpendAlert writes a spending cap alert to the outbox. Alerts of
+// items going over a flagging cap carry the item.
+func enqueueSpendAlert(ctx context.Context, q querier, eventType string, bill models.Bill, item *models.BillItem, alert models.SpendAlert) (string, error) {
+	event := models.BillEvent{
+		Id: uuid.NewString(),
+		Type: eventType,
+		BillId: bill.BillId,
+		CustomerId: bill.CustomerId,
+		CreatedAt: time.Now().UTC(),
+		Item: item,
+		SpendAlert: &alert,
+	}
+	return insertOutboxEvent(ctx, q, event)
+}
+
+func insertOutboxEvent(ctx context.Context, q querier, event models.BillEvent) (string, error) {
+	_, err := q.Exec(ctx, `
+	INSERT INTO event_outbox
+	(id, event_type, payload, created_at)
+	VALUES ($1,$2,$3,$4)
+	`, event.Id, event.Type, event, event.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	return event.Id, nil
+}
+
+func publishBillEvent(ctx context.Context, event *models.BillEvent) error {
+	var err error
+	switch event.Type {
+	case models.EventBillCreated:
+		_, err = BillCreated.Publish(ctx, event)
+	case models.EventBillItemAdded:
+		_, err = BillItemAdded.Publish(ctx, event)
+	case models.EventBillClosed:
+		_, err = BillClosed.Publish(ctx, event)
+	case models.EventBillReminder, models.EventBillOverdue, models.EventBillSuspended:
+		_, err = BillDunning.Publish(ctx, event)
+	case models.EventBillCapApproaching, models.EventBillCapExceeded:
+		_, err = BillSpendCap.Publish(ctx, event)
+	}
+	return err
+}
+
+// flushEvent publishes an event right after the transaction that wrote it
+// committed. Failures are left for PublishOutboxEvents to retry.
+func flushEvent(ctx context.Context, eventId string) {
+	_, err := publishOutbox(ctx, eventId)
+	if err != nil {
+		rlog.Warn("failed to publish event, leaving it in the outbox", "eventId", eventId, "error", err)
+	}
+}
+
+// PublishOutboxEvents publishes every event still waiting in the outbox and
+// returns how many were published. Concurrent callers skip each other's rows.
+func PublishOutboxEvents(ctx context.Context) (int, error) {
+	published := 0
+	for {
+		n, err := publishOutbox(ctx, "")
+		published += n
+		if err != nil || n < outboxBatchSize {
+			return published, err
+		}
+	}
+}
+
+// PruneOutbox deletes published events past OutboxRetention.
+func PruneOutbox(ctx context.Context) error {
+	_, err := db.BillDb.Exec(ctx, `
+	DELETE FROM event_outbox
+	WHERE published_at < $1
+	`, time.Now().Add(-OutboxRetention))
+	return err
+}
+
+// publishOutbox publishes one batch of unpublished events, or only the given event if eventId is set.
+func publishOutbox(ctx context.Context, eventId string) (int, error) {
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(ctx, `
+	SELECT id, payload
+	FROM event_outbox
+	WHERE published_at IS NULL AND ($1 = '' OR id::text = $1)
+	ORDER BY created_at
+	LIMIT $2
+	FOR UPDATE SKIP LOCKED
+	`, eventId, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var events []*models.BillEvent
+	for rows.Next() {
+		var id string
+		var payload []byte
+		err := rows.Scan(&id, &payload)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var event models.BillEvent
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, &event)
+	}
+	rows.Close()
+
+	published := 0
+	for _, event := range events {
+		err = publishBillEvent(ctx, event)
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(ctx, `
+		UPDATE event_outbox
+		SET published_at = NOW()
+		WHERE id = $1
+		`, event.Id)
+		if err != nil {
+			break
+		}
+		published++
+	}
+
+	// Keep the progress made before a failure so those events are not published again.
+	commitErr := tx.Commit()
+	if err != nil {
+		return published, err
+	}
+	return published, commitErr
+}
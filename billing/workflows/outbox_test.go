@@ -0,0 +1,75 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/et"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox_PublishesCommittedEvents(t *testing.T) {
+	ctx := context.Background()
+
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.NoError(t, err)
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+
+	created := et.Topic(BillCreated).PublishedMessages()
+	require.Len(t, created, 1)
+	require.Equal(t, bill.BillId, created[0].BillId)
+	require.Equal(t, bill.CustomerId, created[0].CustomerId)
+
+	added := et.Topic(BillItemAdded).PublishedMessages()
+	require.Len(t, added, 1)
+	require.Equal(t, int64(100), added[0].Item.Amount)
+
+	closed := et.Topic(BillClosed).PublishedMessages()
+	require.Len(t, closed, 1)
+	require.Equal(t, bill.BillId, closed[0].BillId)
+
+	var pending int
+	require.NoError(t, db.BillDb.QueryRow(ctx, `
+	SELECT COUNT(*) FROM event_outbox WHERE published_at IS NULL AND payload->>'billId' = $1
+	`, bill.BillId).Scan(&pending))
+	require.Zero(t, pending)
+}
+
+func TestOutbox_SkipsRolledBackWrites(t *testing.T) {
+	ctx := context.Background()
+
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	tx, err := db.BillDb.Begin(ctx)
+	require.NoError(t, err)
+	_, err = enqueueEvent(ctx, tx, models.EventBillClosed, *bill, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+
+	_, err = PublishOutboxEvents(ctx)
+	require.NoError(t, err)
+	require.Empty(t, et.Topic(BillClosed).PublishedMessages())
+}
+
+func TestOutbox_RelaysUnpublishedEvents(t *testing.T) {
+	ctx := context.Background()
+
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	// An event whose immediate publish was lost stays in the outbox until the relay runs.
+	_, err = enqueueEvent(ctx, db.BillDb, models.EventBillItemAdded, *bill, &models.BillItem{Amount: 100, Currency: "USD"})
+	require.NoError(t, err)
+	require.Empty(t, et.Topic(BillItemAdded).PublishedMessages())
+
+	published, err := PublishOutboxEvents(ctx)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, published, 1)
+	require.Len(t, et.Topic(BillItemAdded).PublishedMessages(), 1)
+}
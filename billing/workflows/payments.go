@@ -0,0 +1,400 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// SignalPaymentReceived tells a bill workflow that a payment was recorded.
+const SignalPaymentReceived = "PAYMENT_RECEIVED"
+
+// SignalBillStatusChanged tells a bill workflow that its bill changed status
+// outside of it, e.g. was written off.
+const SignalBillStatusChanged = "BILL_STATUS_CHANGED"
+
+type PaymentResult struct {
+	Payment *models.Payment
+	Status string
+	Balances []models.BillBalance
+}
+
+// isUnsettled reports whether a bill in this status still expects payments.
+func isUnsettled(status string) bool {
+	return status == models.BillStatusInvoiced || status == models.BillStatusPartiallyPaid
+}
+
+func getBillBalances(ctx context.Context, q querier, billId string) ([]models.BillBalance, error) {
+	rows, err := q.Query(ctx, `
+	SELECT bill_summary.currency, bill_summary.total_amount - COALESCE(discount.amount, 0) + COALESCE(tax.amount, 0), COALESCE(paid.amount, 0) - COALESCE(refunded.amount, 0)
+	FROM bill_summary
+	LEFT JOIN (
+		SELECT currency, SUM(amount)::bigint AS amount
+		FROM bill_discount_line
+		WHERE bill_id = $1
+		GROUP BY currency
+	) discount ON discount.currency = bill_summary.currency
+	-- Inclusive tax is already part of the item total.
+	LEFT JOIN (
+		SELECT currency, SUM(tax_amount)::bigint AS amount
+		FROM bill_tax_line
+		WHERE bill_id = $1 AND NOT inclusive
+		GROUP BY currency
+	) tax ON tax.currency = bill_summary.currency
+	LEFT JOIN (
+		SELECT currency, SUM(applied_amount)::bigint AS amount
+		FROM payment
+		WHERE bill_id = $1
+		GROUP BY currency
+	) paid ON paid.currency = bill_summary.currency
+	-- Credit notes give back what was paid beyond the credited total as customer credit.
+	LEFT JOIN (
+		SELECT customer_credit.currency, SUM(customer_credit.amount)::bigint AS amount
+		FROM customer_credit
+		JOIN credit_note ON credit_note.id = customer_credit.credit_note_id
+		WHERE credit_note.bill_id = $1
+		GROUP BY customer_credit.currency
+	) refunded ON refunded.currency = bill_summary.currency
+	WHERE bill_summary.bill_id = $1
+	ORDER BY bill_summary.currency
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balances []models.BillBalance
+	for rows.Next() {
+		var balance models.BillBalance
+		err := rows.Scan(&balance.Currency, &balance.Total, &balance.Paid)
+		if err != nil {
+			return nil, err
+		}
+		balance.Outstanding = balance.Total - balance.Paid
+		balance.FormattedOutstanding = Currencies.Format(ctx, balance.Outstanding, balance.Currency)
+		balances = append(balances, balance)
+	}
+	return balances, nil
+}
+
+func GetBillBalances(ctx context.Context, billId string) ([]models.BillBalance, error) {
+	return getBillBalances(ctx, db.BillDb, billId)
+}
+
+const paymentColumns = `id, bill_id, amount, currency, applied_amount, method, external_reference, created_at`
+
+func scanPayment(row interface{ Scan(...interface{}) error }, payment *models.Payment) error {
+	return row.Scan(&payment.Id, &payment.BillId, &payment.Amount, &payment.Currency, &payment.AppliedAmount, &payment.Method, &payment.ExternalReference, &payment.CreatedAt)
+}
+
+// RecordPayment records a payment against an invoiced bill. The part of the
+// payment exceeding the outstanding balance in its currency becomes credit of
+// the bill's customer. Once nothing is outstanding the bill is paid.
+// Recording a payment with an external reference already seen on the bill
+// returns the earlier payment.
+func RecordPayment(ctx context.Context, billId string, payment models.Payment) (*PaymentResult, error) {
+	if payment.Amount <= 0 {
+		return nil, temporal.NewNonRetryableApplicationError("Payment amount must be positive", "INVALID-DATA", nil)
+	}
+	if payment.Method == "" {
+		return nil, temporal.NewNonRetryableApplicationError("Payment method is required", "INVALID-DATA", nil)
+	}
+	err := validateCurrency(ctx, payment.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status, customerId string
+	err = tx.QueryRow(ctx, `
+	SELECT status, COALESCE(customer_id::text, '')
+	FROM bill
+	WHERE id = $1
+	FOR UPDATE
+	`, billId).Scan(&status, &customerId)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+
+	if payment.ExternalReference != "" {
+		var existing models.Payment
+		err = scanPayment(tx.QueryRow(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payment
+		WHERE bill_id = $1 AND external_reference = $2
+		`, billId, payment.ExternalReference), &existing)
+		if err == nil {
+			if existing.Amount != payment.Amount || existing.Currency != payment.Currency {
+				return nil, temporal.NewNonRetryableApplicationError("Conflicting payment for reference "+payment.ExternalReference, "CONFLICT", nil)
+			}
+			balances, err := getBillBalances(ctx, tx, billId)
+			if err != nil {
+				return nil, err
+			}
+			return &PaymentResult{Payment: &existing, Status: status, Balances: balances}, nil
+		}
+		if !errors.Is(err, sqldb.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	if !isUnsettled(status) {
+		return nil, temporal.NewNonRetryableApplicationError("Payments can only be recorded for invoiced bills, this one is "+status, "FAILED-PRECONDITION", nil)
+	}
+
+	balances, err := getBillBalances(ctx, tx, billId)
+	if err != nil {
+		return nil, err
+	}
+	outstanding, found := int64(0), false
+	for _, balance := range balances {
+		if balance.Currency == payment.Currency {
+			outstanding, found = balance.Outstanding, true
+		}
+	}
+	if !found {
+		return nil, temporal.NewNonRetryableApplicationError("Bill has nothing to pay in "+payment.Currency, "INVALID-DATA", nil)
+	}
+	payment.AppliedAmount = payment.Amount
+	if payment.AppliedAmount > outstanding {
+		payment.AppliedAmount = max(outstanding, 0)
+	}
+	excess := payment.Amount - payment.AppliedAmount
+	if excess > 0 && customerId == "" {
+		return nil, temporal.NewNonRetryableApplicationError("Overpayments need a customer to hold the credit", "INVALID-DATA", nil)
+	}
+
+	err = scanPayment(tx.QueryRow(ctx, `
+	INSERT INTO payment
+	(bill_id, amount, currency, applied_amount, method, external_reference)
+	VALUES ($1,$2,$3,$4,$5,$6)
+	RETURNING `+paymentColumns+`
+	`, billId, payment.Amount, payment.Currency, payment.AppliedAmount, payment.Method, payment.ExternalReference), &payment)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	if excess > 0 {
+		_, err = tx.Exec(ctx, `
+		INSERT INTO customer_credit
+		(customer_id, currency, amount, payment_id)
+		VALUES ($1,$2,$3,$4)
+		`, customerId, payment.Currency, excess, payment.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	balances, err = getBillBalances(ctx, tx, billId)
+	if err != nil {
+		return nil, err
+	}
+	settled := true
+	for _, balance := range balances {
+		settled = settled && balance.Outstanding <= 0
+	}
+	status = models.BillStatusPartiallyPaid
+	if settled {
+		status = models.BillStatusPaid
+	}
+	_, err = transitionBill(ctx, tx, billId, status, "Payment "+payment.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentResult{Payment: &payment, Status: status, Balances: balances}, nil
+}
+
+func ListPayments(ctx context.Context, billId string) ([]models.Payment, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT `+paymentColumns+`
+	FROM payment
+	WHERE bill_id = $1
+	ORDER BY created_at, id
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []models.Payment
+	for rows.Next() {
+		var payment models.Payment
+		err := scanPayment(rows, &payment)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+// GetCustomerCredit returns the credit balance of a customer per currency.
+// Credit is used up by the customer's bills as they close.
+func GetCustomerCredit(ctx context.Context, customerId string) ([]models.CustomerCredit, error) {
+	return getCustomerCredit(ctx, db.BillDb, customerId)
+}
+
+func getCustomerCredit(ctx context.Context, q querier, customerId string) ([]models.CustomerCredit, error) {
+	rows, err := q.Query(ctx, `
+	SELECT currency, SUM(amount)::bigint
+	FROM customer_credit
+	WHERE customer_id = $1
+	GROUP BY currency
+	HAVING SUM(amount) <> 0
+	ORDER BY currency
+	`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credits []models.CustomerCredit
+	for rows.Next() {
+		var credit models.CustomerCredit
+		err := rows.Scan(&credit.Currency, &credit.Amount)
+		if err != nil {
+			return nil, err
+		}
+		credit.FormattedAmount = Currencies.Format(ctx, credit.Amount, credit.Currency)
+		credits = append(credits, credit)
+	}
+	return credits, nil
+}
+
+// CreditPaymentMethod is the method of payments made with customer credit.
+const CreditPaymentMethod = "credit"
+
+// applyCustomerCredit pays what a closing bill owes out of its customer's
+// credit in the same currency. Each use of credit is recorded as a payment
+// with a matching negative entry in the credit ledger. A bill that is
+// settled this way is paid as it closes.
+func applyCustomerCredit(ctx context.Context, q querier, bill models.Bill) error {
+	if bill.CustomerId == "" {
+		return nil
+	}
+	// Locking the customer keeps bills closing at the same time from spending the same credit.
+	var id string
+	err := q.QueryRow(ctx, `
+	SELECT id
+	FROM customer
+	WHERE id = $1
+	FOR NO KEY UPDATE
+	`, bill.CustomerId).Scan(&id)
+	if err != nil {
+		return err
+	}
+	credits, err := getCustomerCredit(ctx, q, bill.CustomerId)
+	if err != nil {
+		return err
+	}
+	balances, err := getBillBalances(ctx, q, bill.BillId)
+	if err != nil {
+		return err
+	}
+
+	var paymentIds []string
+	for _, balance := range balances {
+		for _, credit := range credits {
+			if credit.Currency != balance.Currency || credit.Amount <= 0 || balance.Outstanding <= 0 {
+				continue
+			}
+			amount := min(credit.Amount, balance.Outstanding)
+			var paymentId string
+			err = q.QueryRow(ctx, `
+			INSERT INTO payment
+			(bill_id, amount, currency, applied_amount, method)
+			VALUES ($1,$2,$3,$2,$4)
+			RETURNING id
+			`, bill.BillId, amount, balance.Currency, CreditPaymentMethod).Scan(&paymentId)
+			if err != nil {
+				return err
+			}
+			_, err = q.Exec(ctx, `
+			INSERT INTO customer_credit
+			(customer_id, currency, amount, payment_id)
+			VALUES ($1,$2,$3,$4)
+			`, bill.CustomerId, balance.Currency, -amount, paymentId)
+			if err != nil {
+				return err
+			}
+			paymentIds = append(paymentIds, paymentId)
+		}
+	}
+	if len(paymentIds) == 0 {
+		return nil
+	}
+
+	balances, err = getBillBalances(ctx, q, bill.BillId)
+	if err != nil {
+		return err
+	}
+	status := models.BillStatusPaid
+	for _, balance := range balances {
+		if balance.Outstanding > 0 {
+			status = models.BillStatusPartiallyPaid
+		}
+	}
+	_, err = transitionBill(ctx, q, bill.BillId, status, "Customer credit applied")
+	return err
+}
+
+// SetBillWorkflowId points a bill at the workflow now responsible for it.
+func SetBillWorkflowId(ctx context.Context, billId string, workflowId string) error {
+	_, err := db.BillDb.Exec(ctx, `
+	UPDATE bill
+	SET workflow_id = $2
+	WHERE id = $1
+	`, billId, workflowId)
+	return err
+}
+
+// SettleBill waits for the payment of an invoiced bill of a schedule, whose
+// own workflow has moved on to the next period.
+func SettleBill(ctx workflow.Context, bill *models.Bill) error {
+	options := workflow.ActivityOptions{
+		StartToCloseTimeout: time.Second * 5,
+		RetryPolicy: &temporal.RetryPolicy{
+			MaximumAttempts: 3,
+		},
+	}
+	ctx = workflow.WithActivityOptions(ctx, options)
+
+	err := workflow.SetQueryHandler(ctx, QueryBill, func() (*models.Bill, error) {
+		return bill, nil
+	})
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError(err.Error(), "WORKFLOW_ERROR", nil)
+	}
+	return awaitSettlement(ctx, bill)
+}
+
+// startSettlement hands an invoiced bill of a schedule over to its own SettleBill workflow.
+func startSettlement(ctx workflow.Context, bill *models.Bill) error {
+	workflowId := BillWorkflowId(bill.CustomerId, bill.BillId)
+	err := workflow.ExecuteActivity(ctx, SetBillWorkflowId, bill.BillId, workflowId).Get(ctx, nil)
+	if err != nil {
+		return err
+	}
+	childCtx := workflow.WithChildOptions(ctx, workflow.ChildWorkflowOptions{
+		WorkflowID: workflowId,
+		// The settlement outlives this run, which continues as new with the next bill.
+		ParentClosePolicy: enums.PARENT_CLOSE_POLICY_ABANDON,
+	})
+	return workflow.ExecuteChildWorkflow(childCtx, SettleBill, bill).GetChildWorkflowExecution().Get(ctx, nil)
+}
@@ -0,0 +1,129 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func createInvoicedBill(t *testing.T, customerId string, items ...models.BillItem) string {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, customerId, time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+	for _, item := range items {
+		_, err = AddBillItem(ctx, bill.BillId, item)
+		require.NoError(t, err)
+	}
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	return bill.BillId
+}
+
+func TestRecordPayment_PartialThenFull(t *testing.T) {
+	ctx := context.Background()
+	billId := createInvoicedBill(t, createTestCustomer(t), models.BillItem{Amount: 1000, Currency: "USD"})
+
+	result, err := RecordPayment(ctx, billId, models.Payment{Amount: 400, Currency: "USD", Method: "card"})
+	require.NoError(t, err)
+	require.Equal(t, models.BillStatusPartiallyPaid, result.Status)
+	require.Equal(t, int64(600), result.Balances[0].Outstanding)
+
+	result, err = RecordPayment(ctx, billId, models.Payment{Amount: 600, Currency: "USD", Method: "bank_transfer"})
+	require.NoError(t, err)
+	require.Equal(t, models.BillStatusPaid, result.Status)
+	require.Equal(t, int64(0), result.Balances[0].Outstanding)
+
+	payments, err := ListPayments(ctx, billId)
+	require.NoError(t, err)
+	require.Len(t, payments, 2)
+
+	// A settled bill takes no more payments.
+	_, err = RecordPayment(ctx, billId, models.Payment{Amount: 1, Currency: "USD", Method: "card"})
+	require.Error(t, err)
+}
+
+func TestRecordPayment_OverpaymentBecomesCredit(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1000, Currency: "USD"})
+
+	result, err := RecordPayment(ctx, billId, models.Payment{Amount: 1250, Currency: "USD", Method: "card"})
+	require.NoError(t, err)
+	require.Equal(t, models.BillStatusPaid, result.Status)
+	require.Equal(t, int64(1000), result.Payment.AppliedAmount)
+
+	credits, err := GetCustomerCredit(ctx, customerId)
+	require.NoError(t, err)
+	require.Len(t, credits, 1)
+	require.Equal(t, "USD", credits[0].Currency)
+	require.Equal(t, int64(250), credits[0].Amount)
+}
+
+func TestCloseBill_AppliesCustomerCredit(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1000, Currency: "USD"})
+	_, err := RecordPayment(ctx, billId, models.Payment{Amount: 1250, Currency: "USD", Method: "card"})
+	require.NoError(t, err)
+
+	billId = createInvoicedBill(t, customerId, models.BillItem{Amount: 100, Currency: "USD"})
+	status, err := GetBillStatus(ctx, billId)
+	require.NoError(t, err)
+	require.Equal(t, models.BillStatusPaid, status)
+	// Closing again does not spend credit twice.
+	require.NoError(t, CloseBill(ctx, billId))
+
+	billId = createInvoicedBill(t, customerId, models.BillItem{Amount: 400, Currency: "USD"})
+	status, err = GetBillStatus(ctx, billId)
+	require.NoError(t, err)
+	require.Equal(t, models.BillStatusPartiallyPaid, status)
+	payments, err := ListPayments(ctx, billId)
+	require.NoError(t, err)
+	require.Len(t, payments, 1)
+	require.Equal(t, CreditPaymentMethod, payments[0].Method)
+	require.Equal(t, int64(150), payments[0].AppliedAmount)
+
+	credits, err := GetCustomerCredit(ctx, customerId)
+	require.NoError(t, err)
+	require.Empty(t, credits)
+}
+
+func TestRecordPayment_ExternalReferenceRecordedOnce(t *testing.T) {
+	ctx := context.Background()
+	billId := createInvoicedBill(t, createTestCustomer(t), models.BillItem{Amount: 1000, Currency: "USD"})
+
+	payment := models.Payment{Amount: 500, Currency: "USD", Method: "card", ExternalReference: "ch_123"}
+	first, err := RecordPayment(ctx, billId, payment)
+	require.NoError(t, err)
+	second, err := RecordPayment(ctx, billId, payment)
+	require.NoError(t, err)
+	require.Equal(t, first.Payment.Id, second.Payment.Id)
+
+	payment.Amount = 600
+	_, err = RecordPayment(ctx, billId, payment)
+	require.Error(t, err)
+
+	payments, err := ListPayments(ctx, billId)
+	require.NoError(t, err)
+	require.Len(t, payments, 1)
+}
+
+func TestRecordPayment_Invalid(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+
+	open, err := CreateBill(ctx, customerId, time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = RecordPayment(ctx, open.BillId, models.Payment{Amount: 100, Currency: "USD", Method: "card"})
+	require.Error(t, err)
+
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1000, Currency: "USD"})
+	_, err = RecordPayment(ctx, billId, models.Payment{Amount: 0, Currency: "USD", Method: "card"})
+	require.Error(t, err)
+	_, err = RecordPayment(ctx, billId, models.Payment{Amount: 100, Currency: "GEL", Method: "card"})
+	require.Error(t, err)
+	_, err = RecordPayment(ctx, billId, models.Payment{Amount: 100, Currency: "USD"})
+	require.Error(t, err)
+}
@@ -0,0 +1,182 @@
+package workflows
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A4 in points, the unit of PDF coordinates. The origin is the bottom left.
+const (
+	pdfPageWidth = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin = 50.0
+)
+
+// Fonts of a pdfWriter. They are standard fonts, which PDF viewers provide
+// themselves, so nothing has to be embedded.
+const (
+	pdfRegular = "F1"
+	pdfBold = "F2"
+	pdfMono = "F3"
+)
+
+var pdfFonts = []string{"Helvetica", "Helvetica-Bold", "Courier"}
+
+// pdfWinAnsi maps the characters of WinAnsiEncoding outside Latin-1 to their codes.
+var pdfWinAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E,
+	'‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+	'˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// pdfEncode converts text to WinAnsiEncoding, replacing characters it lacks with "?".
+func pdfEncode(s string) []byte {
+	encoded := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r >= 0x20 && r < 0x7F, r >= 0xA0 && r <= 0xFF:
+			encoded = append(encoded, byte(r))
+		case pdfWinAnsi[r] != 0:
+			encoded = append(encoded, pdfWinAnsi[r])
+		default:
+			encoded = append(encoded, '?')
+		}
+	}
+	return encoded
+}
+
+// pdfEncodable reports whether text can be written without replacing characters.
+func pdfEncodable(s string) bool {
+	for _, r := range s {
+		if (r < 0x20 || r >= 0x7F) && (r < 0xA0 || r > 0xFF) && pdfWinAnsi[r] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pdfString quotes text as a PDF string literal.
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, c := range pdfEncode(s) {
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// wrapText breaks text into lines of at most width characters, at spaces
+// where possible.
+func wrapText(s string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for utf8.RuneCountInString(word) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				runes := []rune(word)
+				lines = append(lines, string(runes[:width]))
+				word = string(runes[width:])
+			}
+			switch {
+			case line == "":
+				line = word
+			case utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) <= width:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// pdfWriter lays out lines of text on A4 pages, top to bottom, starting a new
+// page when one is full.
+type pdfWriter struct {
+	pages []*bytes.Buffer
+	y float64
+}
+
+// newLine moves down by height, the line height in points, and returns the
+// baseline to write the new line at.
+func (p *pdfWriter) newLine(height float64) float64 {
+	if len(p.pages) == 0 || p.y-height < pdfMargin {
+		p.pages = append(p.pages, &bytes.Buffer{})
+		p.y = pdfPageHeight - pdfMargin
+	}
+	p.y -= height
+	return p.y
+}
+
+// text writes text starting at x on the current line.
+func (p *pdfWriter) text(font string, size float64, x float64, s string) {
+	if len(p.pages) == 0 {
+		p.newLine(size)
+	}
+	fmt.Fprintf(p.pages[len(p.pages)-1], "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, size, x, p.y, pdfString(s))
+}
+
+// monoRight writes text in the monospaced font, ending at right on the current line.
+func (p *pdfWriter) monoRight(size float64, right float64, s string) {
+	// Every Courier glyph is 600/1000 of the font size wide.
+	p.text(pdfMono, size, right-float64(len(pdfEncode(s)))*size*0.6, s)
+}
+
+// Bytes assembles the pages into a PDF document.
+func (p *pdfWriter) Bytes(title string) []byte {
+	if len(p.pages) == 0 {
+		p.newLine(0)
+	}
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Object numbers: the catalog, the page tree, the info dictionary, the
+	// fonts, then a page and its content stream for every page.
+	firstPage := 4 + len(pdfFonts)
+	var kids []string
+	for i := range p.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPage+2*i))
+	}
+	var fonts []string
+	for i := range pdfFonts {
+		fonts = append(fonts, fmt.Sprintf("/F%d %d 0 R", i+1, 4+i))
+	}
+
+	out.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+	object(fmt.Sprintf("<< /Title %s /Producer (billing) >>", pdfString(title)))
+	for _, font := range pdfFonts {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", font))
+	}
+	for i, page := range p.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, strings.Join(fonts, " "), firstPage+2*i+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,191 @@
+package workflows
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/rlog"
+	"go.temporal.io/sdk/temporal"
+)
+
+const prorationDateFormat = "2006-01-02"
+
+// periodLength measures a period in the unit of a proration method.
+func periodLength(start time.Time, end time.Time, method string) int64 {
+	if method == models.ProrateByDays {
+		day := 24 * time.Hour
+		return int64(end.UTC().Truncate(day).Sub(start.UTC().Truncate(day)) / day)
+	}
+	return int64(end.Sub(start) / time.Second)
+}
+
+func validateProrationMethod(method string) error {
+	if method != models.ProrateBySeconds && method != models.ProrateByDays {
+		return temporal.NewNonRetryableApplicationError("Invalid proration method: "+method, "INVALID-DATA", nil)
+	}
+	return nil
+}
+
+// prorateFees returns the items that move the recurring fees of a bill from
+// covering the period up to oldEnd to covering the period up to newEnd: a
+// charge for the time added to the period, or an adjustment of the fee for
+// the time taken off it. A fee costs its amount per service period, measured
+// with the given method. Fees and shares that come to nothing are skipped.
+func prorateFees(fees []models.BillItem, oldEnd time.Time, newEnd time.Time, method string, rounding map[string]string) ([]models.BillItem, error) {
+	var items []models.BillItem
+	for _, fee := range fees {
+		if !fee.Recurring || fee.VoidedAt != nil || fee.ServicePeriodStart == nil || fee.ServicePeriodEnd == nil {
+			continue
+		}
+		whole := periodLength(*fee.ServicePeriodStart, *fee.ServicePeriodEnd, method)
+		start, end := oldEnd, newEnd
+		if newEnd.Before(oldEnd) {
+			start, end = newEnd, oldEnd
+		}
+		part := periodLength(start, end, method)
+		if whole <= 0 || part <= 0 {
+			continue
+		}
+		amount, err := models.Round(new(big.Rat).Mul(big.NewRat(fee.Amount, 1), big.NewRat(part, whole)), rounding[fee.Currency])
+		if err != nil {
+			return nil, temporal.NewNonRetryableApplicationError("Amount overflows", "INVALID-DATA", nil)
+		}
+		if amount == 0 {
+			continue
+		}
+
+		share := fmt.Sprintf("%s to %s, %d of %d %s", start.UTC().Format(prorationDateFormat), end.UTC().Format(prorationDateFormat), part, whole, method)
+		item := models.BillItem{
+			Amount: amount,
+			Currency: fee.Currency,
+			Description: fmt.Sprintf("Proration of %s (%s)", fee.Description, share),
+			Sku: fee.Sku,
+			ServicePeriodStart: &start,
+			ServicePeriodEnd: &end,
+			Metadata: map[string]string{"proratesItemId": fee.Id},
+			Kind: "charge",
+			TaxCategory: fee.TaxCategory,
+		}
+		if newEnd.Before(oldEnd) {
+			item.Amount = -amount
+			item.Kind = "adjustment"
+			item.AdjustsItemId = fee.Id
+			item.Description = fmt.Sprintf("Proration credit for %s (%s)", fee.Description, share)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// RescheduleBill moves the close date of an open bill and prorates its
+// recurring fees to the new period. It returns the proration items it added.
+// Rescheduling to the current close date changes nothing, so the activity is
+// safe to retry.
+func RescheduleBill(ctx context.Context, billId string, closeDate time.Time, method string) ([]models.BillItem, error) {
+	err := validateProrationMethod(method)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bill := models.Bill{BillId: billId}
+	err = tx.QueryRow(ctx, `
+	SELECT COALESCE(customer_id::text, ''), status, close_date
+	FROM bill
+	WHERE id = $1
+	FOR UPDATE
+	`, billId).Scan(&bill.CustomerId, &bill.Status, &bill.CloseDate)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+	if bill.CloseDate.Equal(closeDate) {
+		return nil, nil
+	}
+	if bill.Status != models.BillStatusOpen {
+		return nil, temporal.NewNonRetryableApplicationError("Only open bills can be rescheduled", "FAILED-PRECONDITION", nil)
+	}
+	if !closeDate.After(time.Now()) {
+		return nil, temporal.NewNonRetryableApplicationError("Bills can only be rescheduled to close in the future", "INVALID-DATA", nil)
+	}
+
+	_, err = tx.Exec(ctx, `
+	UPDATE bill
+	SET close_date = $2
+	WHERE id = $1
+	`, billId, closeDate)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, `
+	SELECT id, currency, amount, description, COALESCE(sku, ''), service_period_start, service_period_end, tax_category, recurring
+	FROM bill_item
+	WHERE bill_id = $1 AND recurring AND voided_at IS NULL
+	ORDER BY created_at, seq
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	var fees []models.BillItem
+	rounding := make(map[string]string)
+	for rows.Next() {
+		var fee models.BillItem
+		err := rows.Scan(&fee.Id, &fee.Currency, &fee.Amount, &fee.Description, &fee.Sku, &fee.ServicePeriodStart, &fee.ServicePeriodEnd, &fee.TaxCategory, &fee.Recurring)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fees = append(fees, fee)
+	}
+	rows.Close()
+	for _, fee := range fees {
+		if _, ok := rounding[fee.Currency]; ok {
+			continue
+		}
+		rounding[fee.Currency], err = Currencies.RoundingMode(ctx, fee.Currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	items, err := prorateFees(fees, bill.CloseDate, closeDate, method, rounding)
+	if err != nil {
+		return nil, err
+	}
+	bill.CloseDate = closeDate
+	for i := range items {
+		items[i], err = normalizeBillItem(items[i], rounding[items[i].Currency])
+		if err != nil {
+			return nil, err
+		}
+		items[i].Id, err = insertBillItem(ctx, tx, billId, items[i])
+		if err != nil {
+			return nil, err
+		}
+		_, err = enqueueEvent(ctx, tx, models.EventBillItemAdded, bill, &items[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > 0 {
+		_, err = PublishOutboxEvents(ctx)
+		if err != nil {
+			rlog.Warn("failed to publish events, leaving them in the outbox", "billId", billId, "error", err)
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,78 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProrateFees(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+	fees := []models.BillItem{
+		{Id: "fee", Amount: 3000, Currency: "USD", Description: "Pro plan", ServicePeriodStart: &start, ServicePeriodEnd: &end, Recurring: true},
+		// One-off charges are not prorated.
+		{Id: "setup", Amount: 5000, Currency: "USD", Description: "Setup"},
+	}
+
+	// Extending the period by 10 of 30 days charges a third of the fee.
+	items, err := prorateFees(fees, end, end.AddDate(0, 0, 10), models.ProrateByDays, nil)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, int64(1000), items[0].Amount)
+	require.Equal(t, "charge", items[0].Kind)
+	require.Equal(t, "fee", items[0].Metadata["proratesItemId"])
+	require.Equal(t, "Proration of Pro plan (2026-03-31 to 2026-04-10, 10 of 30 days)", items[0].Description)
+
+	// Shortening it credits the fee for the time taken off.
+	items, err = prorateFees(fees, end, end.Add(-36*time.Hour), models.ProrateBySeconds, nil)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, int64(-150), items[0].Amount)
+	require.Equal(t, "adjustment", items[0].Kind)
+	require.Equal(t, "fee", items[0].AdjustsItemId)
+	require.Equal(t, "Proration credit for Pro plan (2026-03-29 to 2026-03-31, 129600 of 2592000 seconds)", items[0].Description)
+
+	// Moving the close date within a day prorates nothing by days.
+	items, err = prorateFees(fees, end, end.Add(time.Hour), models.ProrateByDays, nil)
+	require.NoError(t, err)
+	require.Empty(t, items)
+}
+
+func TestRescheduleBill(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	closeDate := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	bill, err := CreateBill(ctx, customerId, closeDate, "USD", 0)
+	require.NoError(t, err)
+	start := closeDate.AddDate(0, 0, -30)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 3000, Currency: "USD", Description: "Pro plan",
+		ServicePeriodStart: &start, ServicePeriodEnd: &closeDate, Recurring: true})
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 500, Currency: "USD", Recurring: true})
+	require.Error(t, err)
+
+	_, err = RescheduleBill(ctx, bill.BillId, closeDate, "weeks")
+	require.Error(t, err)
+	_, err = RescheduleBill(ctx, bill.BillId, time.Now().Add(-time.Hour), models.ProrateByDays)
+	require.Error(t, err)
+
+	newCloseDate := closeDate.AddDate(0, 0, 3)
+	items, err := RescheduleBill(ctx, bill.BillId, newCloseDate, models.ProrateByDays)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, int64(300), items[0].Amount)
+	require.NotEmpty(t, items[0].Id)
+
+	// Retries find the bill already rescheduled.
+	items, err = RescheduleBill(ctx, bill.BillId, newCloseDate, models.ProrateByDays)
+	require.NoError(t, err)
+	require.Empty(t, items)
+
+	stored, err := GetBill(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.True(t, stored.CloseDate.Equal(newCloseDate))
+}
@@ -0,0 +1,253 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+	"go.temporal.io/sdk/temporal"
+)
+
+// ScheduleWorkflowId returns the workflow ID shared by every bill of a schedule.
+// Each period continues-as-new into the next, so the ID stays stable.
+func ScheduleWorkflowId(customerId string, scheduleId string) string {
+	return fmt.Sprintf("customer/%s/schedule/%s", customerId, scheduleId)
+}
+
+func validateSchedule(period string, intervalDays int) error {
+	switch period {
+	case "weekly", "monthly":
+		return nil
+	case "custom":
+		if intervalDays <= 0 {
+			return temporal.NewNonRetryableApplicationError("Custom schedules need a positive interval", "INVALID-DATA", nil)
+		}
+		return nil
+	}
+	return temporal.NewNonRetryableApplicationError("Invalid schedule period: "+period, "INVALID-DATA", nil)
+}
+
+// closeDateAt returns the n-th close date of a schedule, n = 0 being the anchor.
+func closeDateAt(schedule *models.BillingSchedule, n int) time.Time {
+	anchor := schedule.AnchorDate
+	switch schedule.Period {
+	case "weekly":
+		return anchor.AddDate(0, 0, 7*n)
+	case "custom":
+		return anchor.AddDate(0, 0, schedule.IntervalDays*n)
+	}
+	// Monthly schedules anchored past the 28th fall on the last day of shorter months.
+	firstOfMonth := time.Date(anchor.Year(), anchor.Month()+time.Month(n), 1, anchor.Hour(), anchor.Minute(), anchor.Second(), anchor.Nanosecond(), anchor.Location())
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	day := anchor.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return firstOfMonth.AddDate(0, 0, day-1)
+}
+
+// NextCloseDate returns the first close date of the schedule strictly after the given time.
+func NextCloseDate(schedule *models.BillingSchedule, after time.Time) time.Time {
+	n := 0
+	if after.After(schedule.AnchorDate) {
+		// Jump close to the answer before stepping, so long-running schedules stay cheap.
+		switch schedule.Period {
+		case "weekly":
+			n = int(after.Sub(schedule.AnchorDate).Hours() / 24 / 7)
+		case "custom":
+			n = int(after.Sub(schedule.AnchorDate).Hours() / 24 / float64(schedule.IntervalDays))
+		default:
+			n = (after.Year()-schedule.AnchorDate.Year())*12 + int(after.Month()) - int(schedule.AnchorDate.Month()) - 1
+		}
+		if n < 0 {
+			n = 0
+		}
+	}
+	for !closeDateAt(schedule, n).After(after) {
+		n++
+	}
+	return closeDateAt(schedule, n)
+}
+
+func CreateBillingSchedule(ctx context.Context, customerId string, period string, intervalDays int, anchorDate time.Time, settlementCurrency string, gracePeriodSeconds int) (*models.BillingSchedule, error) {
+	err := validateSchedule(period, intervalDays)
+	if err != nil {
+		return nil, err
+	}
+	if gracePeriodSeconds < 0 {
+		return nil, temporal.NewNonRetryableApplicationError("Grace period cannot be negative", "INVALID-DATA", nil)
+	}
+	if settlementCurrency == "" {
+		settlementCurrency = DefaultSettlementCurrency
+	}
+	err = validateCurrency(ctx, settlementCurrency)
+	if err != nil {
+		return nil, err
+	}
+	_, err = GetCustomer(ctx, customerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedule models.BillingSchedule
+	err = db.BillDb.QueryRow(ctx, `
+	INSERT INTO billing_schedule
+	(customer_id, period, interval_days, anchor_date, settlement_currency, grace_period_seconds)
+	VALUES ($1,$2,NULLIF($3, 0),$4,$5,$6)
+	RETURNING id, customer_id, period, COALESCE(interval_days, 0), anchor_date, settlement_currency, grace_period_seconds, active
+	`, customerId, period, intervalDays, anchorDate, settlementCurrency, gracePeriodSeconds).Scan(&schedule.Id, &schedule.CustomerId, &schedule.Period, &schedule.IntervalDays, &schedule.AnchorDate, &schedule.SettlementCurrency, &schedule.GracePeriodSeconds, &schedule.Active)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	return &schedule, nil
+}
+
+func GetBillingSchedule(ctx context.Context, scheduleId string) (*models.BillingSchedule, error) {
+	var schedule models.BillingSchedule
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT id, customer_id, period, COALESCE(interval_days, 0), anchor_date, settlement_currency, grace_period_seconds, active
+	FROM billing_schedule
+	WHERE id = $1
+	`, scheduleId).Scan(&schedule.Id, &schedule.CustomerId, &schedule.Period, &schedule.IntervalDays, &schedule.AnchorDate, &schedule.SettlementCurrency, &schedule.GracePeriodSeconds, &schedule.Active)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Billing schedule not found", "NOT_FOUND", nil)
+	}
+	return &schedule, nil
+}
+
+func ListBillingSchedules(ctx context.Context, customerId string) ([]models.BillingSchedule, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT id, customer_id, period, COALESCE(interval_days, 0), anchor_date, settlement_currency, grace_period_seconds, active
+	FROM billing_schedule
+	WHERE customer_id = $1
+	ORDER BY created_at
+	`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []models.BillingSchedule
+	for rows.Next() {
+		var schedule models.BillingSchedule
+		err := rows.Scan(&schedule.Id, &schedule.CustomerId, &schedule.Period, &schedule.IntervalDays, &schedule.AnchorDate, &schedule.SettlementCurrency, &schedule.GracePeriodSeconds, &schedule.Active)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, nil
+}
+
+// DeactivateBillingSchedule stops a schedule from rolling over. Its current
+// open bill still closes normally.
+func DeactivateBillingSchedule(ctx context.Context, customerId string, scheduleId string) error {
+	result, err := db.BillDb.Exec(ctx, `
+	UPDATE billing_schedule
+	SET active = FALSE
+	WHERE id = $1 AND customer_id = $2
+	`, scheduleId, customerId)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return temporal.NewNonRetryableApplicationError("Billing schedule not found", "NOT_FOUND", nil)
+	}
+	return nil
+}
+
+// CreateScheduledBill opens the bill for the period following the given time.
+// It returns nil if the schedule has been deactivated. If the schedule
+// already has an open bill, that bill is returned instead, which makes the
+// activity safe to retry. Like CreateBill, it opens no bills for customers
+// that are deleted or suspended.
+func CreateScheduledBill(ctx context.Context, scheduleId string, after time.Time) (*models.Bill, error) {
+	schedule, err := GetBillingSchedule(ctx, scheduleId)
+	if err != nil {
+		return nil, err
+	}
+	if !schedule.Active {
+		return nil, nil
+	}
+	// A period whose close date has already passed, e.g. after downtime, is skipped.
+	if now := time.Now(); now.After(after) {
+		after = now
+	}
+
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Deleting a customer locks it, so this waits for a delete in progress and then sees it.
+	var suspendedAt *time.Time
+	err = tx.QueryRow(ctx, `
+	SELECT suspended_at
+	FROM customer
+	WHERE id = $1 AND deleted_at IS NULL
+	FOR SHARE
+	`, schedule.CustomerId).Scan(&suspendedAt)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Customer not found", "NOT_FOUND", nil)
+	}
+	// The delete deactivates the customer's schedules, and so may any change
+	// made while the schedule was read.
+	err = tx.QueryRow(ctx, `
+	SELECT active
+	FROM billing_schedule
+	WHERE id = $1
+	`, schedule.Id).Scan(&schedule.Active)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	if !schedule.Active {
+		return nil, nil
+	}
+	if suspendedAt != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Customer is suspended until its overdue bills are paid", "FAILED-PRECONDITION", nil)
+	}
+
+	billId := uuid.NewString()
+	var bill models.Bill
+	err = tx.QueryRow(ctx, `
+	INSERT INTO bill
+	(id, customer_id, schedule_id, close_date, workflow_id, settlement_currency, grace_period_seconds)
+	VALUES ($1,$2,$3,$4,$5,$6,$7)
+	ON CONFLICT (schedule_id) WHERE status = 'open' DO NOTHING
+	RETURNING id, customer_id, schedule_id, status, close_date, grace_period_seconds, settlement_currency, created_at
+	`, billId, schedule.CustomerId, schedule.Id, NextCloseDate(schedule, after), ScheduleWorkflowId(schedule.CustomerId, schedule.Id), schedule.SettlementCurrency, schedule.GracePeriodSeconds).Scan(&bill.BillId, &bill.CustomerId, &bill.ScheduleId, &bill.Status, &bill.CloseDate, &bill.GracePeriodSeconds, &bill.SettlementCurrency, &bill.CreatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		err = tx.QueryRow(ctx, `
+		SELECT id, customer_id, schedule_id, status, close_date, grace_period_seconds, settlement_currency, created_at
+		FROM bill
+		WHERE schedule_id = $1 AND status = 'open'
+		`, schedule.Id).Scan(&bill.BillId, &bill.CustomerId, &bill.ScheduleId, &bill.Status, &bill.CloseDate, &bill.GracePeriodSeconds, &bill.SettlementCurrency, &bill.CreatedAt)
+		if err != nil {
+			return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+		}
+		return &bill, nil
+	}
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	err = recordBillStatus(ctx, tx, bill.BillId, "", models.BillStatusOpen, "Scheduled bill created")
+	if err != nil {
+		return nil, err
+	}
+	eventId, err := enqueueEvent(ctx, tx, models.EventBillCreated, bill, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	flushEvent(ctx, eventId)
+	return &bill, nil
+}
@@ -0,0 +1,89 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextCloseDate_Monthly(t *testing.T) {
+	schedule := &models.BillingSchedule{Period: "monthly", AnchorDate: time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)}
+
+	require.Equal(t, time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC), NextCloseDate(schedule, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)))
+	require.Equal(t, time.Date(2025, 2, 28, 0, 0, 0, 0, time.UTC), NextCloseDate(schedule, time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)))
+	require.Equal(t, time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC), NextCloseDate(schedule, time.Date(2025, 2, 28, 0, 0, 0, 0, time.UTC)))
+	require.Equal(t, time.Date(2026, 4, 30, 0, 0, 0, 0, time.UTC), NextCloseDate(schedule, time.Date(2026, 4, 2, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestNextCloseDate_WeeklyAndCustom(t *testing.T) {
+	anchor := time.Date(2025, 1, 6, 12, 0, 0, 0, time.UTC)
+	weekly := &models.BillingSchedule{Period: "weekly", AnchorDate: anchor}
+	custom := &models.BillingSchedule{Period: "custom", IntervalDays: 10, AnchorDate: anchor}
+
+	require.Equal(t, time.Date(2025, 1, 13, 12, 0, 0, 0, time.UTC), NextCloseDate(weekly, anchor))
+	require.Equal(t, time.Date(2025, 3, 3, 12, 0, 0, 0, time.UTC), NextCloseDate(weekly, time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)))
+	require.Equal(t, time.Date(2025, 1, 26, 12, 0, 0, 0, time.UTC), NextCloseDate(custom, time.Date(2025, 1, 20, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestCreateBillingSchedule_InvalidPeriod(t *testing.T) {
+	_, err := CreateBillingSchedule(context.Background(), createTestCustomer(t), "custom", 0, time.Now(), "USD", 0)
+	require.Error(t, err)
+	_, err = CreateBillingSchedule(context.Background(), createTestCustomer(t), "daily", 0, time.Now(), "USD", 0)
+	require.Error(t, err)
+}
+
+func TestCreateScheduledBill_OneOpenBillPerSchedule(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	schedule, err := CreateBillingSchedule(ctx, customerId, "weekly", 0, time.Now().Add(time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	first, err := CreateScheduledBill(ctx, schedule.Id, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, ScheduleWorkflowId(customerId, schedule.Id), mustBillWorkflowId(t, first.BillId))
+
+	again, err := CreateScheduledBill(ctx, schedule.Id, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, first.BillId, again.BillId)
+
+	require.NoError(t, CloseBill(ctx, first.BillId))
+	next, err := CreateScheduledBill(ctx, schedule.Id, first.CloseDate)
+	require.NoError(t, err)
+	require.NotEqual(t, first.BillId, next.BillId)
+	require.True(t, next.CloseDate.After(first.CloseDate))
+}
+
+func TestCreateScheduledBill_Deactivated(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	schedule, err := CreateBillingSchedule(ctx, customerId, "monthly", 0, time.Now().Add(time.Hour), "USD", 0)
+	require.NoError(t, err)
+	require.NoError(t, DeactivateBillingSchedule(ctx, customerId, schedule.Id))
+
+	bill, err := CreateScheduledBill(ctx, schedule.Id, time.Now())
+	require.NoError(t, err)
+	require.Nil(t, bill)
+}
+
+func TestCreateScheduledBill_SuspendedCustomer(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	schedule, err := CreateBillingSchedule(ctx, customerId, "monthly", 0, time.Now().Add(time.Hour), "USD", 0)
+	require.NoError(t, err)
+	billId := createInvoicedBill(t, customerId, models.BillItem{Amount: 1000, Currency: "USD"})
+	_, err = RecordDunningStep(ctx, billId, 0, DunningSuspend)
+	require.NoError(t, err)
+
+	_, err = CreateScheduledBill(ctx, schedule.Id, time.Now())
+	require.Error(t, err)
+	require.Equal(t, "FAILED-PRECONDITION", applicationErrorType(err))
+}
+
+func mustBillWorkflowId(t *testing.T, billId string) string {
+	workflowId, err := GetBillWorkflowId(context.Background(), billId)
+	require.NoError(t, err)
+	return workflowId
+}
@@ -0,0 +1,149 @@
+package workflows
+
+import (
+	"context"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"go.temporal.io/sdk/temporal"
+)
+
+// billTransitions lists the statuses each bill status may move to.
+var billTransitions = map[string][]string{
+	models.BillStatusOpen: {models.BillStatusClosing, models.BillStatusInvoiced, models.BillStatusVoid},
+	models.BillStatusClosing: {models.BillStatusInvoiced, models.BillStatusVoid},
+	models.BillStatusInvoiced: {models.BillStatusPartiallyPaid, models.BillStatusPaid, models.BillStatusVoid, models.BillStatusWrittenOff},
+	models.BillStatusPartiallyPaid: {models.BillStatusPaid, models.BillStatusWrittenOff},
+	models.BillStatusPaid: {},
+	models.BillStatusVoid: {},
+	models.BillStatusWrittenOff: {},
+}
+
+// CanTransitionBill reports whether a bill may move from one status to another.
+func CanTransitionBill(from string, to string) bool {
+	for _, allowed := range billTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+func checkBillTransition(from string, to string) error {
+	if _, ok := billTransitions[to]; !ok {
+		return temporal.NewNonRetryableApplicationError("Unknown bill status: "+to, "INVALID-DATA", nil)
+	}
+	if !CanTransitionBill(from, to) {
+		return temporal.NewNonRetryableApplicationError("A bill cannot go from "+from+" to "+to, "FAILED-PRECONDITION", nil)
+	}
+	return nil
+}
+
+// recordBillStatus appends an entry to the status history of a bill. from is
+// empty for a bill being opened.
+func recordBillStatus(ctx context.Context, q querier, billId string, from string, to string, reason string) error {
+	_, err := q.Exec(ctx, `
+	INSERT INTO bill_status_history
+	(bill_id, from_status, to_status, reason)
+	VALUES ($1,NULLIF($2, '')::bill_status,$3,$4)
+	`, billId, from, to, reason)
+	return err
+}
+
+// transitionBill moves a bill to a new status within q, which should be a
+// transaction, and records the change. It returns the previous status. A bill
+// already in the target status is left untouched, which keeps retries safe.
+// A bill that is settled for good no longer keeps its customer suspended.
+func transitionBill(ctx context.Context, q querier, billId string, to string, reason string) (string, error) {
+	var from, customerId string
+	err := q.QueryRow(ctx, `
+	SELECT status, COALESCE(customer_id::text, '')
+	FROM bill
+	WHERE id = $1
+	FOR UPDATE
+	`, billId).Scan(&from, &customerId)
+	if err != nil {
+		return "", temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+	if from == to {
+		return from, nil
+	}
+	err = checkBillTransition(from, to)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = q.Exec(ctx, `
+	UPDATE bill
+	SET status = $2
+	WHERE id = $1
+	`, billId, to)
+	if err != nil {
+		return "", err
+	}
+	err = recordBillStatus(ctx, q, billId, from, to, reason)
+	if err != nil {
+		return "", err
+	}
+	if len(billTransitions[to]) == 0 && customerId != "" {
+		err = liftSuspension(ctx, q, customerId)
+		if err != nil {
+			return "", err
+		}
+	}
+	return from, nil
+}
+
+// TransitionBill moves a bill to a new status, rejecting transitions the
+// bill's current status does not allow.
+func TransitionBill(ctx context.Context, billId string, to string, reason string) error {
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = transitionBill(ctx, tx, billId, to, reason)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetBillStatus returns the current status of a bill.
+func GetBillStatus(ctx context.Context, billId string) (string, error) {
+	var status string
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT status
+	FROM bill
+	WHERE id = $1
+	`, billId).Scan(&status)
+	if err != nil {
+		return "", temporal.NewNonRetryableApplicationError("Bill not found", "NOT_FOUND", nil)
+	}
+	return status, nil
+}
+
+func ListBillStatusHistory(ctx context.Context, billId string) ([]models.BillStatusChange, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT COALESCE(from_status::text, ''), to_status, reason, created_at
+	FROM bill_status_history
+	WHERE bill_id = $1
+	ORDER BY created_at, id
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []models.BillStatusChange
+	for rows.Next() {
+		var change models.BillStatusChange
+		err := rows.Scan(&change.FromStatus, &change.ToStatus, &change.Reason, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	return history, nil
+}
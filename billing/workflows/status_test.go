@@ -0,0 +1,59 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanTransitionBill(t *testing.T) {
+	require.True(t, CanTransitionBill(models.BillStatusOpen, models.BillStatusInvoiced))
+	require.True(t, CanTransitionBill(models.BillStatusInvoiced, models.BillStatusPartiallyPaid))
+	require.True(t, CanTransitionBill(models.BillStatusPartiallyPaid, models.BillStatusPaid))
+	require.False(t, CanTransitionBill(models.BillStatusOpen, models.BillStatusPaid))
+	require.False(t, CanTransitionBill(models.BillStatusPaid, models.BillStatusVoid))
+	require.False(t, CanTransitionBill(models.BillStatusVoid, models.BillStatusOpen))
+	require.False(t, CanTransitionBill(models.BillStatusOpen, models.BillStatusWrittenOff))
+}
+
+func TestTransitionBill_RecordsHistory(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	// Closing again is a no-op rather than a second transition.
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	require.NoError(t, TransitionBill(ctx, bill.BillId, models.BillStatusWrittenOff, "Customer went out of business"))
+
+	status, err := GetBillStatus(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Equal(t, models.BillStatusWrittenOff, status)
+
+	history, err := ListBillStatusHistory(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, "", history[0].FromStatus)
+	require.Equal(t, models.BillStatusOpen, history[0].ToStatus)
+	require.Equal(t, models.BillStatusInvoiced, history[1].ToStatus)
+	require.Equal(t, models.BillStatusInvoiced, history[2].FromStatus)
+	require.Equal(t, models.BillStatusWrittenOff, history[2].ToStatus)
+	require.Equal(t, "Customer went out of business", history[2].Reason)
+}
+
+func TestTransitionBill_RejectsIllegalTransitions(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	require.Error(t, TransitionBill(ctx, bill.BillId, models.BillStatusPaid, ""))
+	require.Error(t, TransitionBill(ctx, bill.BillId, "refunded", ""))
+
+	require.NoError(t, TransitionBill(ctx, bill.BillId, models.BillStatusVoid, "Created by mistake"))
+	require.Error(t, CloseBill(ctx, bill.BillId))
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.Error(t, err)
+}
@@ -0,0 +1,449 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"regexp"
+	"sort"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/sdk/temporal"
+)
+
+var taxCategoryPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// jurisdictionPattern matches ISO 3166 country codes, optionally followed by a subdivision, e.g. "US-CA".
+var jurisdictionPattern = regexp.MustCompile(`^[A-Z]{2}(-[A-Z0-9]{1,3})?$`)
+
+// taxRatePattern matches fractions below 1 with the six decimals tax_rate stores.
+var taxRatePattern = regexp.MustCompile(`^0(\.[0-9]{1,6})?$`)
+
+// TaxEngine computes the tax on the items of a bill.
+type TaxEngine interface {
+	// Calculate returns the tax lines for items billed to a customer with the
+	// given tax profile, using the rules in effect at the given time.
+	Calculate(ctx context.Context, profile models.CustomerTaxProfile, items []models.BillItem, at time.Time) ([]models.TaxLine, error)
+}
+
+// Taxes is the tax engine used when bills close.
+var Taxes TaxEngine = RuleTableTaxEngine{}
+
+var errTaxRateNotFound = temporal.NewNonRetryableApplicationError("Tax rate not found", "NOT_FOUND", nil)
+
+// RuleTableTaxEngine taxes items with the rules of the tax_rate table. Items
+// are taxed per currency and tax category; categories without a rule in the
+// customer's jurisdiction are not taxed.
+type RuleTableTaxEngine struct{}
+
+func (RuleTableTaxEngine) Calculate(ctx context.Context, profile models.CustomerTaxProfile, items []models.BillItem, at time.Time) ([]models.TaxLine, error) {
+	if profile.Jurisdiction == "" {
+		return nil, nil
+	}
+	exempt := make(map[string]bool)
+	for _, exemption := range profile.Exemptions {
+		if exemption.TaxCategory == "" {
+			return nil, nil
+		}
+		exempt[exemption.TaxCategory] = true
+	}
+
+	type taxGroup struct {
+		currency string
+		category string
+	}
+	gross := make(map[taxGroup]int64)
+	var groups []taxGroup
+	for _, item := range items {
+		if item.VoidedAt != nil || exempt[item.TaxCategory] {
+			continue
+		}
+		group := taxGroup{currency: item.Currency, category: item.TaxCategory}
+		if _, ok := gross[group]; !ok {
+			groups = append(groups, group)
+		}
+		total, err := models.AddAmounts(gross[group], item.Amount)
+		if err != nil {
+			return nil, temporal.NewNonRetryableApplicationError("Bill total overflows", "INVALID-DATA", nil)
+		}
+		gross[group] = total
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].currency != groups[j].currency {
+			return groups[i].currency < groups[j].currency
+		}
+		return groups[i].category < groups[j].category
+	})
+
+	var lines []models.TaxLine
+	for _, group := range groups {
+		if gross[group] <= 0 {
+			continue
+		}
+		rule, err := taxRateAt(ctx, profile.Jurisdiction, group.category, at)
+		if errors.Is(err, errTaxRateNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rounding, err := Currencies.RoundingMode(ctx, group.currency)
+		if err != nil {
+			return nil, err
+		}
+		line, err := computeTaxLine(group.currency, gross[group], *rule, rounding)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// computeTaxLine taxes the gross amount of one currency and tax category.
+// For inclusive rates the tax is the part of the gross amount that is tax.
+func computeTaxLine(currency string, gross int64, rule models.TaxRate, rounding string) (models.TaxLine, error) {
+	rate, ok := new(big.Rat).SetString(rule.Rate)
+	if !ok {
+		return models.TaxLine{}, temporal.NewNonRetryableApplicationError("Invalid tax rate: "+rule.Rate, "INVALID-DATA", nil)
+	}
+	tax := new(big.Rat).Mul(big.NewRat(gross, 1), rate)
+	if rule.Inclusive {
+		tax.Quo(tax, new(big.Rat).Add(big.NewRat(1, 1), rate))
+	}
+	taxAmount, err := models.Round(tax, rounding)
+	if err != nil {
+		return models.TaxLine{}, temporal.NewNonRetryableApplicationError("Tax amount overflows", "INVALID-DATA", nil)
+	}
+	taxable := gross
+	if rule.Inclusive {
+		taxable = gross - taxAmount
+	}
+	return models.TaxLine{
+		Currency: currency,
+		Jurisdiction: rule.Jurisdiction,
+		TaxCategory: rule.TaxCategory,
+		Rate: rule.Rate,
+		Inclusive: rule.Inclusive,
+		TaxableAmount: taxable,
+		TaxAmount: taxAmount,
+	}, nil
+}
+
+// taxRateAt returns the rule for a tax category of a jurisdiction in effect at the given time.
+func taxRateAt(ctx context.Context, jurisdiction string, category string, at time.Time) (*models.TaxRate, error) {
+	rate := models.TaxRate{Jurisdiction: jurisdiction, TaxCategory: category}
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT rate::text, inclusive, effective_at
+	FROM tax_rate
+	WHERE jurisdiction = $1 AND tax_category = $2 AND effective_at <= $3
+	ORDER BY effective_at DESC
+	LIMIT 1
+	`, jurisdiction, category, at).Scan(&rate.Rate, &rate.Inclusive, &rate.EffectiveAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errTaxRateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
+// SaveTaxRate records a rule in the tax_rate table.
+func SaveTaxRate(ctx context.Context, rate models.TaxRate) (*models.TaxRate, error) {
+	if !jurisdictionPattern.MatchString(rate.Jurisdiction) {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid jurisdiction: "+rate.Jurisdiction, "INVALID-DATA", nil)
+	}
+	if !taxCategoryPattern.MatchString(rate.TaxCategory) {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid tax category: "+rate.TaxCategory, "INVALID-DATA", nil)
+	}
+	if !taxRatePattern.MatchString(rate.Rate) {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid tax rate: "+rate.Rate, "INVALID-DATA", nil)
+	}
+
+	var saved models.TaxRate
+	err := db.BillDb.QueryRow(ctx, `
+	INSERT INTO tax_rate
+	(jurisdiction, tax_category, rate, inclusive, effective_at)
+	VALUES ($1,$2,$3::numeric,$4,$5)
+	ON CONFLICT (jurisdiction, tax_category, effective_at) DO UPDATE
+	SET
+    rate = EXCLUDED.rate,
+    inclusive = EXCLUDED.inclusive
+	RETURNING jurisdiction, tax_category, rate::text, inclusive, effective_at
+	`, rate.Jurisdiction, rate.TaxCategory, rate.Rate, rate.Inclusive, rate.EffectiveAt).Scan(&saved.Jurisdiction, &saved.TaxCategory, &saved.Rate, &saved.Inclusive, &saved.EffectiveAt)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	return &saved, nil
+}
+
+// GetCustomerTaxProfile returns the tax profile of a customer. Customers
+// without one are not taxed.
+func GetCustomerTaxProfile(ctx context.Context, customerId string) (*models.CustomerTaxProfile, error) {
+	profile := models.CustomerTaxProfile{CustomerId: customerId, Exemptions: []models.TaxExemption{}}
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT jurisdiction
+	FROM customer_tax_profile
+	WHERE customer_id = $1
+	`, customerId).Scan(&profile.Jurisdiction)
+	if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, err
+	}
+
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT tax_category, reason
+	FROM customer_tax_exemption
+	WHERE customer_id = $1
+	ORDER BY tax_category
+	`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var exemption models.TaxExemption
+		err := rows.Scan(&exemption.TaxCategory, &exemption.Reason)
+		if err != nil {
+			return nil, err
+		}
+		profile.Exemptions = append(profile.Exemptions, exemption)
+	}
+	return &profile, nil
+}
+
+// SaveCustomerTaxProfile replaces the jurisdiction and exemptions of a
+// customer. Bills that already closed keep the tax computed for them.
+func SaveCustomerTaxProfile(ctx context.Context, profile models.CustomerTaxProfile) (*models.CustomerTaxProfile, error) {
+	if profile.Jurisdiction != "" && !jurisdictionPattern.MatchString(profile.Jurisdiction) {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid jurisdiction: "+profile.Jurisdiction, "INVALID-DATA", nil)
+	}
+	seen := make(map[string]bool)
+	for _, exemption := range profile.Exemptions {
+		if exemption.TaxCategory != "" && !taxCategoryPattern.MatchString(exemption.TaxCategory) {
+			return nil, temporal.NewNonRetryableApplicationError("Invalid tax category: "+exemption.TaxCategory, "INVALID-DATA", nil)
+		}
+		if seen[exemption.TaxCategory] {
+			return nil, temporal.NewNonRetryableApplicationError("Duplicate exemption for tax category "+exemption.TaxCategory, "INVALID-DATA", nil)
+		}
+		seen[exemption.TaxCategory] = true
+	}
+
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var customerId string
+	err = tx.QueryRow(ctx, `
+	SELECT id
+	FROM customer
+	WHERE id = $1 AND deleted_at IS NULL
+	FOR UPDATE
+	`, profile.CustomerId).Scan(&customerId)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Customer not found", "NOT_FOUND", nil)
+	}
+
+	_, err = tx.Exec(ctx, `
+	INSERT INTO customer_tax_profile
+	(customer_id, jurisdiction)
+	VALUES ($1,$2)
+	ON CONFLICT (customer_id) DO UPDATE
+	SET
+    jurisdiction = EXCLUDED.jurisdiction,
+    updated_at = NOW()
+	`, customerId, profile.Jurisdiction)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	_, err = tx.Exec(ctx, `
+	DELETE FROM customer_tax_exemption
+	WHERE customer_id = $1
+	`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	for _, exemption := range profile.Exemptions {
+		_, err = tx.Exec(ctx, `
+		INSERT INTO customer_tax_exemption
+		(customer_id, tax_category, reason)
+		VALUES ($1,$2,$3)
+		`, customerId, exemption.TaxCategory, exemption.Reason)
+		if err != nil {
+			return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return GetCustomerTaxProfile(ctx, customerId)
+}
+
+// calculateBillTax stores the tax lines of a bill that is being closed, taxing
+// its items net of the given discounts.
+func calculateBillTax(ctx context.Context, q querier, billId string, customerId string, closedAt time.Time, discounts []models.DiscountLine) error {
+	if customerId == "" {
+		return nil
+	}
+	profile, err := GetCustomerTaxProfile(ctx, customerId)
+	if err != nil {
+		return err
+	}
+	items, err := getBillItems(ctx, q, billId)
+	if err != nil {
+		return err
+	}
+	items = append(items, discountItems(items, discounts)...)
+	lines, err := Taxes.Calculate(ctx, *profile, items, closedAt)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		_, err = q.Exec(ctx, `
+		INSERT INTO bill_tax_line
+		(bill_id, currency, jurisdiction, tax_category, rate, inclusive, taxable_amount, tax_amount)
+		VALUES ($1,$2,$3,$4,$5::numeric,$6,$7,$8)
+		`, billId, line.Currency, line.Jurisdiction, line.TaxCategory, line.Rate, line.Inclusive, line.TaxableAmount, line.TaxAmount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getBillTaxLines(ctx context.Context, q querier, billId string) ([]models.TaxLine, error) {
+	rows, err := q.Query(ctx, `
+	SELECT id, currency, jurisdiction, tax_category, rate::text, inclusive, taxable_amount, tax_amount, COALESCE(credit_note_id::text, ''), created_at
+	FROM bill_tax_line
+	WHERE bill_id = $1
+	ORDER BY currency, tax_category, created_at
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []models.TaxLine{}
+	for rows.Next() {
+		var line models.TaxLine
+		err := rows.Scan(&line.Id, &line.Currency, &line.Jurisdiction, &line.TaxCategory, &line.Rate, &line.Inclusive, &line.TaxableAmount, &line.TaxAmount, &line.CreditNoteId, &line.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		line.FormattedTaxAmount = Currencies.Format(ctx, line.TaxAmount, line.Currency)
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// creditBillTax stores the tax lines of a credit note. They take back the tax
+// on its items at the rates the bill was taxed at when it closed, by taxing
+// what is left of each currency and tax category once the items are credited.
+func creditBillTax(ctx context.Context, q querier, billId string, creditNoteId string, items []models.BillItem) error {
+	lines, err := getBillTaxLines(ctx, q, billId)
+	if err != nil {
+		return err
+	}
+	type taxGroup struct {
+		currency string
+		category string
+	}
+	rules := make(map[taxGroup]models.TaxRate)
+	// gross, taxable and tax hold what each group comes to with the tax lines
+	// stored so far, which include those of earlier credit notes.
+	gross := make(map[taxGroup]int64)
+	taxable := make(map[taxGroup]int64)
+	tax := make(map[taxGroup]int64)
+	for _, line := range lines {
+		group := taxGroup{currency: line.Currency, category: line.TaxCategory}
+		if line.CreditNoteId == "" {
+			rules[group] = models.TaxRate{Jurisdiction: line.Jurisdiction, TaxCategory: line.TaxCategory, Rate: line.Rate, Inclusive: line.Inclusive}
+		}
+		gross[group] += line.TaxableAmount
+		if line.Inclusive {
+			gross[group] += line.TaxAmount
+		}
+		taxable[group] += line.TaxableAmount
+		tax[group] += line.TaxAmount
+	}
+
+	credited := make(map[taxGroup]int64)
+	var groups []taxGroup
+	for _, item := range items {
+		group := taxGroup{currency: item.Currency, category: item.TaxCategory}
+		// Categories the bill was not taxed on have nothing to take back.
+		if _, ok := rules[group]; !ok {
+			continue
+		}
+		if _, ok := credited[group]; !ok {
+			groups = append(groups, group)
+		}
+		credited[group] += item.Amount
+	}
+
+	for _, group := range groups {
+		remaining := gross[group] + credited[group]
+		if remaining < 0 {
+			remaining = 0
+		}
+		rounding, err := Currencies.RoundingMode(ctx, group.currency)
+		if err != nil {
+			return err
+		}
+		line, err := computeTaxLine(group.currency, remaining, rules[group], rounding)
+		if err != nil {
+			return err
+		}
+		line.TaxableAmount -= taxable[group]
+		line.TaxAmount -= tax[group]
+		if line.TaxableAmount == 0 && line.TaxAmount == 0 {
+			continue
+		}
+		_, err = q.Exec(ctx, `
+		INSERT INTO bill_tax_line
+		(bill_id, currency, jurisdiction, tax_category, rate, inclusive, taxable_amount, tax_amount, credit_note_id)
+		VALUES ($1,$2,$3,$4,$5::numeric,$6,$7,$8,$9)
+		`, billId, line.Currency, line.Jurisdiction, line.TaxCategory, line.Rate, line.Inclusive, line.TaxableAmount, line.TaxAmount, creditNoteId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTaxLines splits the per-currency totals of a bill summary into
+// subtotal and tax. Exclusive tax is added to the total, inclusive tax is
+// already part of it.
+func applyTaxLines(ctx context.Context, summary *models.BillSummary) error {
+	for i := range summary.BillItemSummary {
+		item := &summary.BillItemSummary[i]
+		item.Subtotal = item.TotalAmount
+		for _, line := range summary.TaxLines {
+			if line.Currency != item.Currency {
+				continue
+			}
+			var err error
+			item.TaxAmount, err = models.AddAmounts(item.TaxAmount, line.TaxAmount)
+			if err == nil && line.Inclusive {
+				item.Subtotal, err = models.AddAmounts(item.Subtotal, -line.TaxAmount)
+			} else if err == nil {
+				item.TotalAmount, err = models.AddAmounts(item.TotalAmount, line.TaxAmount)
+			}
+			if err != nil {
+				return temporal.NewNonRetryableApplicationError("Bill total overflows", "INVALID-DATA", nil)
+			}
+		}
+		item.FormattedTotal = Currencies.Format(ctx, item.TotalAmount, item.Currency)
+		item.FormattedSubtotal = Currencies.Format(ctx, item.Subtotal, item.Currency)
+		item.FormattedTaxAmount = Currencies.Format(ctx, item.TaxAmount, item.Currency)
+	}
+	return nil
+}
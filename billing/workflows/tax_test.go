@@ -0,0 +1,99 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeTaxLine(t *testing.T) {
+	exclusive := models.TaxRate{Jurisdiction: "GE", TaxCategory: "standard", Rate: "0.18"}
+	line, err := computeTaxLine("USD", 1000, exclusive, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), line.TaxableAmount)
+	require.Equal(t, int64(180), line.TaxAmount)
+
+	// 1180 includes 180 of tax at 18%.
+	inclusive := models.TaxRate{Jurisdiction: "GE", TaxCategory: "standard", Rate: "0.18", Inclusive: true}
+	line, err = computeTaxLine("USD", 1180, inclusive, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), line.TaxableAmount)
+	require.Equal(t, int64(180), line.TaxAmount)
+
+	// 25 at 10% is 2.5 of tax, rounded per currency.
+	tenth := models.TaxRate{Jurisdiction: "GE", TaxCategory: "standard", Rate: "0.1"}
+	line, err = computeTaxLine("USD", 25, tenth, models.RoundHalfEven)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), line.TaxAmount)
+	line, err = computeTaxLine("USD", 25, tenth, models.RoundHalfUp)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), line.TaxAmount)
+}
+
+func TestSaveTaxRate_Invalid(t *testing.T) {
+	ctx := context.Background()
+	_, err := SaveTaxRate(ctx, models.TaxRate{Jurisdiction: "Georgia", TaxCategory: "standard", Rate: "0.18"})
+	require.Error(t, err)
+	_, err = SaveTaxRate(ctx, models.TaxRate{Jurisdiction: "GE", TaxCategory: "Standard", Rate: "0.18"})
+	require.Error(t, err)
+	_, err = SaveTaxRate(ctx, models.TaxRate{Jurisdiction: "GE", TaxCategory: "standard", Rate: "18"})
+	require.Error(t, err)
+}
+
+func TestCloseBill_CalculatesTax(t *testing.T) {
+	ctx := context.Background()
+	effectiveAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := SaveTaxRate(ctx, models.TaxRate{Jurisdiction: "GE", TaxCategory: "test_exclusive", Rate: "0.18", EffectiveAt: effectiveAt})
+	require.NoError(t, err)
+	_, err = SaveTaxRate(ctx, models.TaxRate{Jurisdiction: "GE", TaxCategory: "test_inclusive", Rate: "0.18", Inclusive: true, EffectiveAt: effectiveAt})
+	require.NoError(t, err)
+	_, err = SaveTaxRate(ctx, models.TaxRate{Jurisdiction: "GE", TaxCategory: "test_exempt", Rate: "0.18", EffectiveAt: effectiveAt})
+	require.NoError(t, err)
+
+	customerId := createTestCustomer(t)
+	profile, err := SaveCustomerTaxProfile(ctx, models.CustomerTaxProfile{
+		CustomerId: customerId,
+		Jurisdiction: "GE",
+		Exemptions: []models.TaxExemption{{TaxCategory: "test_exempt", Reason: "Certificate 42"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, profile.Exemptions, 1)
+
+	billId := createInvoicedBill(t, customerId,
+		models.BillItem{Amount: 1000, Currency: "USD", TaxCategory: "test_exclusive"},
+		models.BillItem{Amount: 1180, Currency: "USD", TaxCategory: "test_inclusive"},
+		models.BillItem{Amount: 500, Currency: "USD", TaxCategory: "test_exempt"},
+		models.BillItem{Amount: 300, Currency: "USD"},
+	)
+
+	summary, err := GetBillSummary(ctx, billId)
+	require.NoError(t, err)
+	require.Len(t, summary.TaxLines, 2)
+	require.Equal(t, "test_exclusive", summary.TaxLines[0].TaxCategory)
+	require.Equal(t, int64(180), summary.TaxLines[0].TaxAmount)
+	require.Equal(t, "test_inclusive", summary.TaxLines[1].TaxCategory)
+	require.Equal(t, int64(1000), summary.TaxLines[1].TaxableAmount)
+	require.Equal(t, int64(180), summary.TaxLines[1].TaxAmount)
+
+	require.Len(t, summary.BillItemSummary, 1)
+	totals := summary.BillItemSummary[0]
+	require.Equal(t, int64(2800), totals.Subtotal)
+	require.Equal(t, int64(360), totals.TaxAmount)
+	require.Equal(t, int64(3160), totals.TotalAmount)
+	require.Equal(t, int64(3160), summary.Balances[0].Outstanding)
+}
+
+func TestCloseBill_UntaxedCustomer(t *testing.T) {
+	ctx := context.Background()
+	billId := createInvoicedBill(t, createTestCustomer(t), models.BillItem{Amount: 1000, Currency: "USD"})
+
+	summary, err := GetBillSummary(ctx, billId)
+	require.NoError(t, err)
+	require.Empty(t, summary.TaxLines)
+	require.Equal(t, int64(1000), summary.BillItemSummary[0].Subtotal)
+	require.Equal(t, int64(0), summary.BillItemSummary[0].TaxAmount)
+	require.Equal(t, int64(1000), summary.BillItemSummary[0].TotalAmount)
+}
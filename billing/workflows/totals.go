@@ -0,0 +1,64 @@
+package workflows
+
+import (
+	"context"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/rlog"
+)
+
+// addToBillTotal adjusts the running total of a bill in one currency. It is
+// called in the transaction that inserts or voids the items, with a negative
+// amount and count for voided items.
+func addToBillTotal(ctx context.Context, q querier, billId string, currency string, amount int64, count int) error {
+	_, err := q.Exec(ctx, `
+	INSERT INTO bill_total
+	(bill_id, currency, total_amount, item_count)
+	VALUES ($1,$2,$3,$4)
+	ON CONFLICT (bill_id, currency) DO UPDATE
+	SET total_amount = bill_total.total_amount + EXCLUDED.total_amount,
+		item_count = bill_total.item_count + EXCLUDED.item_count,
+		updated_at = NOW()
+	`, billId, currency, amount, count)
+	return err
+}
+
+// ReconcileBillTotals recomputes every bill total from the bill's items and
+// returns those that have drifted from the running totals. Drift is logged
+// but left in place for investigation.
+func ReconcileBillTotals(ctx context.Context) ([]models.BillTotalDrift, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT COALESCE(recorded.bill_id, actual.bill_id), COALESCE(recorded.currency, actual.currency),
+		COALESCE(recorded.total_amount, 0), COALESCE(actual.total_amount, 0),
+		COALESCE(recorded.item_count, 0), COALESCE(actual.item_count, 0)
+	FROM bill_total recorded
+	FULL OUTER JOIN (
+		SELECT bill_id, currency, SUM(amount)::bigint AS total_amount, COUNT(*) AS item_count
+		FROM bill_item
+		WHERE voided_at IS NULL
+		GROUP BY bill_id, currency
+	) actual ON actual.bill_id = recorded.bill_id AND actual.currency = recorded.currency
+	WHERE COALESCE(recorded.total_amount, 0) <> COALESCE(actual.total_amount, 0)
+		OR COALESCE(recorded.item_count, 0) <> COALESCE(actual.item_count, 0)
+	ORDER BY 1, 2
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drifts := []models.BillTotalDrift{}
+	for rows.Next() {
+		var drift models.BillTotalDrift
+		err := rows.Scan(&drift.BillId, &drift.Currency, &drift.RecordedTotal, &drift.ActualTotal, &drift.RecordedItemCount, &drift.ActualItemCount)
+		if err != nil {
+			return nil, err
+		}
+		rlog.Error("bill total drifted from its items", "billId", drift.BillId, "currency", drift.Currency,
+			"recordedTotal", drift.RecordedTotal, "actualTotal", drift.ActualTotal,
+			"recordedItemCount", drift.RecordedItemCount, "actualItemCount", drift.ActualItemCount)
+		drifts = append(drifts, drift)
+	}
+	return drifts, nil
+}
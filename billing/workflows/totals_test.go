@@ -0,0 +1,88 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"github.com/stretchr/testify/require"
+)
+
+func billTotals(t *testing.T, billId string) map[string]int64 {
+	rows, err := db.BillDb.Query(context.Background(), `
+	SELECT currency, total_amount
+	FROM bill_summary
+	WHERE bill_id = $1
+	`, billId)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	totals := map[string]int64{}
+	for rows.Next() {
+		var currency string
+		var total int64
+		require.NoError(t, rows.Scan(&currency, &total))
+		totals[currency] = total
+	}
+	return totals
+}
+
+func TestBillTotals_FollowItems(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	chargeId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Kind: "adjustment", Amount: -30, Currency: "USD", AdjustsItemId: chargeId})
+	require.NoError(t, err)
+	_, err = AddBillItemBatch(ctx, bill.BillId, []models.BillItem{{Amount: 200, Currency: "USD"}, {Amount: 50, Currency: "GEL"}})
+	require.NoError(t, err)
+	gelId, err := AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 25, Currency: "GEL"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"USD": 270, "GEL": 75}, billTotals(t, bill.BillId))
+
+	_, err = VoidBillItem(ctx, bill.BillId, gelId)
+	require.NoError(t, err)
+	// Voiding twice must not count the item out twice.
+	_, err = VoidBillItem(ctx, bill.BillId, gelId)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"USD": 270, "GEL": 50}, billTotals(t, bill.BillId))
+}
+
+func TestReconcileBillTotals_ReportsDrift(t *testing.T) {
+	ctx := context.Background()
+	bill, err := CreateBill(ctx, createTestCustomer(t), time.Now().Add(24 * time.Hour), "USD", 0)
+	require.NoError(t, err)
+	_, err = AddBillItem(ctx, bill.BillId, models.BillItem{Amount: 100, Currency: "USD"})
+	require.NoError(t, err)
+
+	driftsOf := func() []models.BillTotalDrift {
+		drifts, err := ReconcileBillTotals(ctx)
+		require.NoError(t, err)
+		var found []models.BillTotalDrift
+		for _, drift := range drifts {
+			if drift.BillId == bill.BillId {
+				found = append(found, drift)
+			}
+		}
+		return found
+	}
+	require.Empty(t, driftsOf())
+
+	_, err = db.BillDb.Exec(ctx, `UPDATE bill_total SET total_amount = 90 WHERE bill_id = $1`, bill.BillId)
+	require.NoError(t, err)
+	require.Equal(t, []models.BillTotalDrift{{
+		BillId: bill.BillId,
+		Currency: "USD",
+		RecordedTotal: 90,
+		ActualTotal: 100,
+		RecordedItemCount: 1,
+		ActualItemCount: 1,
+	}}, driftsOf())
+
+	_, err = db.BillDb.Exec(ctx, `UPDATE bill_total SET total_amount = 100 WHERE bill_id = $1`, bill.BillId)
+	require.NoError(t, err)
+}
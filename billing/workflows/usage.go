@@ -0,0 +1,549 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"go.temporal.io/sdk/temporal"
+)
+
+var meterPattern = regexp.MustCompile(`^[a-z][a-z0-9_.-]{0,63}$`)
+
+// MaxUsageEventsPerBatch caps how many usage events are recorded at once.
+const MaxUsageEventsPerBatch = 1000
+
+const (
+	defaultListUsageEventsLimit = 100
+	maxListUsageEventsLimit = 1000
+)
+
+const meterPriceColumns = `meter, description, currency, model, COALESCE(unit_price::text, ''), COALESCE(package_size, 0), tiers,
+	COALESCE(sku, ''), tax_category, updated_at`
+
+func scanMeterPrice(row interface{ Scan(...interface{}) error }, price *models.MeterPrice) error {
+	err := row.Scan(&price.Meter, &price.Description, &price.Currency, &price.Model, &price.UnitPrice, &price.PackageSize, &price.Tiers,
+		&price.Sku, &price.TaxCategory, &price.UpdatedAt)
+	// NUMERIC pads the unit price to its full scale.
+	if unitPrice, ok := models.ParseDecimal(price.UnitPrice); ok {
+		price.UnitPrice = models.FormatDecimal(unitPrice)
+	}
+	return err
+}
+
+// validPrice reports whether a decimal unit price is valid, which it is if not negative.
+func validPrice(price string) bool {
+	unitPrice, ok := models.ParseDecimal(price)
+	return ok && unitPrice.Sign() >= 0
+}
+
+func validateTiers(tiers []models.PriceTier) error {
+	if len(tiers) == 0 {
+		return temporal.NewNonRetryableApplicationError("Tiered and volume prices need at least one tier", "INVALID-DATA", nil)
+	}
+	var below int64
+	for i, tier := range tiers {
+		if !validPrice(tier.UnitPrice) {
+			return temporal.NewNonRetryableApplicationError(fmt.Sprintf("Tier %d: invalid unit price %s", i+1, tier.UnitPrice), "INVALID-DATA", nil)
+		}
+		last := i == len(tiers)-1
+		switch {
+		case last && tier.UpTo != 0:
+			return temporal.NewNonRetryableApplicationError("The last tier cannot have an upper bound", "INVALID-DATA", nil)
+		case !last && tier.UpTo <= below:
+			return temporal.NewNonRetryableApplicationError(fmt.Sprintf("Tier %d: upper bounds must increase", i+1), "INVALID-DATA", nil)
+		}
+		below = tier.UpTo
+	}
+	return nil
+}
+
+// SaveMeterPrice adds the price of a meter to the price book or replaces it.
+// Usage is rated with the price in effect when its bill closes.
+func SaveMeterPrice(ctx context.Context, price models.MeterPrice) (*models.MeterPrice, error) {
+	if !meterPattern.MatchString(price.Meter) {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid meter: "+price.Meter, "INVALID-DATA", nil)
+	}
+	err := validateCurrency(ctx, price.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if price.TaxCategory == "" {
+		price.TaxCategory = models.TaxCategoryStandard
+	}
+	if !taxCategoryPattern.MatchString(price.TaxCategory) {
+		return nil, temporal.NewNonRetryableApplicationError("Invalid tax category: "+price.TaxCategory, "INVALID-DATA", nil)
+	}
+	switch price.Model {
+	case models.PricingFlat, models.PricingPackage:
+		if !validPrice(price.UnitPrice) {
+			return nil, temporal.NewNonRetryableApplicationError("Invalid unit price: "+price.UnitPrice, "INVALID-DATA", nil)
+		}
+		if len(price.Tiers) > 0 {
+			return nil, temporal.NewNonRetryableApplicationError("Only tiered and volume prices have tiers", "INVALID-DATA", nil)
+		}
+		if price.Model == models.PricingPackage && price.PackageSize <= 0 {
+			return nil, temporal.NewNonRetryableApplicationError("Package prices need a positive package size", "INVALID-DATA", nil)
+		}
+		if price.Model == models.PricingFlat && price.PackageSize != 0 {
+			return nil, temporal.NewNonRetryableApplicationError("Only package prices have a package size", "INVALID-DATA", nil)
+		}
+	case models.PricingTiered, models.PricingVolume:
+		if price.UnitPrice != "" || price.PackageSize != 0 {
+			return nil, temporal.NewNonRetryableApplicationError("Tiered and volume prices are given by their tiers", "INVALID-DATA", nil)
+		}
+		err = validateTiers(price.Tiers)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, temporal.NewNonRetryableApplicationError("Invalid pricing model: "+price.Model, "INVALID-DATA", nil)
+	}
+	if price.Tiers == nil {
+		price.Tiers = []models.PriceTier{}
+	}
+
+	var saved models.MeterPrice
+	err = scanMeterPrice(db.BillDb.QueryRow(ctx, `
+	INSERT INTO meter_price
+	(meter, description, currency, model, unit_price, package_size, tiers, sku, tax_category)
+	VALUES ($1,$2,$3,$4,NULLIF($5, '')::numeric,NULLIF($6, 0),$7,NULLIF($8, ''),$9)
+	ON CONFLICT (meter) DO UPDATE
+	SET
+    description = EXCLUDED.description,
+    currency = EXCLUDED.currency,
+    model = EXCLUDED.model,
+    unit_price = EXCLUDED.unit_price,
+    package_size = EXCLUDED.package_size,
+    tiers = EXCLUDED.tiers,
+    sku = EXCLUDED.sku,
+    tax_category = EXCLUDED.tax_category,
+    updated_at = now()
+	RETURNING `+meterPriceColumns+`
+	`, price.Meter, price.Description, price.Currency, price.Model, price.UnitPrice, price.PackageSize, price.Tiers, price.Sku, price.TaxCategory), &saved)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	return &saved, nil
+}
+
+func getMeterPrice(ctx context.Context, q querier, meter string) (*models.MeterPrice, error) {
+	var price models.MeterPrice
+	err := scanMeterPrice(q.QueryRow(ctx, `
+	SELECT `+meterPriceColumns+`
+	FROM meter_price
+	WHERE meter = $1
+	`, meter), &price)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, temporal.NewNonRetryableApplicationError("Meter not found: "+meter, "NOT_FOUND", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &price, nil
+}
+
+// ListMeterPrices returns the price book ordered by meter.
+func ListMeterPrices(ctx context.Context) ([]models.MeterPrice, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT `+meterPriceColumns+`
+	FROM meter_price
+	ORDER BY meter
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := []models.MeterPrice{}
+	for rows.Next() {
+		var price models.MeterPrice
+		err := scanMeterPrice(rows, &price)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, price)
+	}
+	return prices, nil
+}
+
+// usageEventError points an error at the event of a batch that caused it, keeping its type.
+func usageEventError(i int, err error) error {
+	return temporal.NewNonRetryableApplicationError(fmt.Sprintf("Usage event %d: %s", i, errorReason(err)), applicationErrorType(err), nil)
+}
+
+// RecordUsageEvents stores raw usage until it is rated and returns how many
+// events were new. Events already recorded for the customer under the same
+// ID are ignored, so reporters can safely resend them. If any event is
+// invalid, none are recorded.
+func RecordUsageEvents(ctx context.Context, events []models.UsageEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, temporal.NewNonRetryableApplicationError("No usage events given", "INVALID-DATA", nil)
+	}
+	if len(events) > MaxUsageEventsPerBatch {
+		return 0, temporal.NewNonRetryableApplicationError(fmt.Sprintf("At most %d usage events can be recorded at once", MaxUsageEventsPerBatch), "INVALID-DATA", nil)
+	}
+	meters := make(map[string]error)
+	customers := make(map[string]error)
+	for i, event := range events {
+		switch {
+		case event.Id == "" || len(event.Id) > 255:
+			return 0, usageEventError(i, temporal.NewNonRetryableApplicationError("Event IDs must have 1 to 255 characters", "INVALID-DATA", nil))
+		case event.Quantity < 0:
+			return 0, usageEventError(i, temporal.NewNonRetryableApplicationError("Quantity cannot be negative", "INVALID-DATA", nil))
+		case event.OccurredAt.IsZero():
+			return 0, usageEventError(i, temporal.NewNonRetryableApplicationError("Events must say when they occurred", "INVALID-DATA", nil))
+		}
+		err, checked := meters[event.Meter]
+		if !checked {
+			_, err = getMeterPrice(ctx, db.BillDb, event.Meter)
+			meters[event.Meter] = err
+		}
+		if err != nil {
+			return 0, usageEventError(i, err)
+		}
+		err, checked = customers[event.CustomerId]
+		if !checked {
+			_, err = GetCustomer(ctx, event.CustomerId)
+			customers[event.CustomerId] = err
+		}
+		if err != nil {
+			return 0, usageEventError(i, err)
+		}
+	}
+
+	const columns = 6
+	values := make([]string, 0, len(events))
+	args := make([]interface{}, 0, len(events)*columns)
+	for _, event := range events {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d)", n+1, n+2, n+3, n+4, n+5, n+6))
+		properties := event.Properties
+		if properties == nil {
+			properties = map[string]string{}
+		}
+		args = append(args, event.CustomerId, event.Id, event.Meter, event.Quantity, event.OccurredAt, properties)
+	}
+	result, err := db.BillDb.Exec(ctx, `
+	INSERT INTO usage_event
+	(customer_id, event_id, meter, quantity, occurred_at, properties)
+	VALUES `+strings.Join(values, ",\n\t")+`
+	ON CONFLICT (customer_id, event_id) DO NOTHING
+	`, args...)
+	if err != nil {
+		return 0, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	return int(result.RowsAffected()), nil
+}
+
+// priceUsage prices a quantity of a meter as the items it is charged as. The
+// items give a quantity and decimal unit price, and are one per tier used for
+// tiered prices.
+func priceUsage(price models.MeterPrice, quantity int64) []models.BillItem {
+	if quantity == 0 {
+		return nil
+	}
+	description := price.Description
+	if description == "" {
+		description = price.Meter
+	}
+	tierItem := func(i int, quantity int64) models.BillItem {
+		return models.BillItem{
+			Description: fmt.Sprintf("%s (tier %d)", description, i+1),
+			Quantity: quantity,
+			UnitPriceDecimal: price.Tiers[i].UnitPrice,
+			Metadata: map[string]string{"tier": strconv.Itoa(i + 1)},
+		}
+	}
+
+	switch price.Model {
+	case models.PricingFlat:
+		return []models.BillItem{{Description: description, Quantity: quantity, UnitPriceDecimal: price.UnitPrice}}
+	case models.PricingPackage:
+		packages := quantity / price.PackageSize
+		if quantity%price.PackageSize != 0 {
+			packages++
+		}
+		return []models.BillItem{{
+			Description: fmt.Sprintf("%s (packages of %d)", description, price.PackageSize),
+			Quantity: packages,
+			UnitPriceDecimal: price.UnitPrice,
+			Metadata: map[string]string{"packageSize": strconv.FormatInt(price.PackageSize, 10)},
+		}}
+	case models.PricingVolume:
+		for i, tier := range price.Tiers {
+			if tier.UpTo == 0 || quantity <= tier.UpTo {
+				return []models.BillItem{tierItem(i, quantity)}
+			}
+		}
+	case models.PricingTiered:
+		var items []models.BillItem
+		var below int64
+		for i, tier := range price.Tiers {
+			upTo := tier.UpTo
+			if upTo == 0 || upTo > quantity {
+				upTo = quantity
+			}
+			items = append(items, tierItem(i, upTo-below))
+			below = upTo
+			if below == quantity {
+				break
+			}
+		}
+		return items
+	}
+	return nil
+}
+
+// RateUsage rates the usage a bill's customer reported to have occurred
+// before the bill's close date into items of the bill, and returns them.
+// Rated events are linked to the items through a usage rating. Usage that
+// arrives after a bill closed is rated into the customer's next bill.
+func RateUsage(ctx context.Context, billId string) ([]models.BillItem, error) {
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bill, err := lockBillForItems(ctx, tx, billId)
+	if err != nil {
+		return nil, err
+	}
+	if bill.CustomerId == "" || (bill.Status != models.BillStatusOpen && bill.Status != models.BillStatusClosing) {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(ctx, `
+	SELECT DISTINCT meter
+	FROM usage_event
+	WHERE customer_id = $1 AND rating_id IS NULL AND occurred_at < $2
+	ORDER BY meter
+	`, bill.CustomerId, bill.CloseDate)
+	if err != nil {
+		return nil, err
+	}
+	var meters []string
+	for rows.Next() {
+		var meter string
+		err := rows.Scan(&meter)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		meters = append(meters, meter)
+	}
+	rows.Close()
+
+	var rated []models.BillItem
+	for _, meter := range meters {
+		price, err := getMeterPrice(ctx, tx, meter)
+		if err != nil {
+			return nil, err
+		}
+		rounding, err := Currencies.RoundingMode(ctx, price.Currency)
+		if err != nil {
+			return nil, err
+		}
+
+		var ratingId string
+		err = tx.QueryRow(ctx, `
+		INSERT INTO usage_rating
+		(bill_id, meter)
+		VALUES ($1,$2)
+		RETURNING id
+		`, billId, meter).Scan(&ratingId)
+		if err != nil {
+			return nil, err
+		}
+		var quantity int64
+		var count int
+		var first, last *time.Time
+		err = tx.QueryRow(ctx, `
+		WITH rated AS (
+			UPDATE usage_event
+			SET rating_id = $1
+			WHERE customer_id = $2 AND meter = $3 AND rating_id IS NULL AND occurred_at < $4
+			RETURNING quantity, occurred_at
+		)
+		SELECT COALESCE(SUM(quantity), 0)::bigint, COUNT(*), MIN(occurred_at), MAX(occurred_at)
+		FROM rated
+		`, ratingId, bill.CustomerId, meter, bill.CloseDate).Scan(&quantity, &count, &first, &last)
+		if err != nil {
+			return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+		}
+		if count == 0 {
+			// A concurrent rating took the events first.
+			_, err = tx.Exec(ctx, `
+			DELETE FROM usage_rating
+			WHERE id = $1
+			`, ratingId)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		_, err = tx.Exec(ctx, `
+		UPDATE usage_rating
+		SET quantity = $2, event_count = $3
+		WHERE id = $1
+		`, ratingId, quantity, count)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range priceUsage(*price, quantity) {
+			item.Currency = price.Currency
+			item.Sku = price.Sku
+			item.TaxCategory = price.TaxCategory
+			item.ServicePeriodStart = first
+			item.ServicePeriodEnd = last
+			item.OccurredAt = last
+			if item.Metadata == nil {
+				item.Metadata = map[string]string{}
+			}
+			item.Metadata["meter"] = meter
+			item.Metadata["usageRatingId"] = ratingId
+			item, err = normalizeBillItem(item, rounding)
+			if err != nil {
+				return nil, err
+			}
+			if item.Amount == 0 {
+				// Free tiers are not charged. The rating still accounts for their usage.
+				continue
+			}
+			err = validateBillItem(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			item.Id, err = insertBillItem(ctx, tx, billId, item)
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec(ctx, `
+			INSERT INTO usage_rating_item
+			(rating_id, bill_item_id)
+			VALUES ($1,$2)
+			`, ratingId, item.Id)
+			if err != nil {
+				return nil, err
+			}
+			_, err = enqueueEvent(ctx, tx, models.EventBillItemAdded, bill, &item)
+			if err != nil {
+				return nil, err
+			}
+			rated = append(rated, item)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	if len(rated) > 0 {
+		_, err = PublishOutboxEvents(ctx)
+		if err != nil {
+			rlog.Warn("failed to publish events, leaving them in the outbox", "billId", billId, "error", err)
+		}
+	}
+	return rated, nil
+}
+
+// ListUsageRatings returns the usage rated into a bill with the items it was charged as.
+func ListUsageRatings(ctx context.Context, billId string) ([]models.UsageRating, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT id, bill_id, meter, quantity, event_count, created_at
+	FROM usage_rating
+	WHERE bill_id = $1
+	ORDER BY created_at, meter
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := []models.UsageRating{}
+	index := make(map[string]int)
+	for rows.Next() {
+		rating := models.UsageRating{ItemIds: []string{}}
+		err := rows.Scan(&rating.Id, &rating.BillId, &rating.Meter, &rating.Quantity, &rating.EventCount, &rating.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		index[rating.Id] = len(ratings)
+		ratings = append(ratings, rating)
+	}
+	rows.Close()
+
+	itemRows, err := db.BillDb.Query(ctx, `
+	SELECT usage_rating_item.rating_id, usage_rating_item.bill_item_id
+	FROM usage_rating_item
+	JOIN usage_rating ON usage_rating.id = usage_rating_item.rating_id
+	JOIN bill_item ON bill_item.id = usage_rating_item.bill_item_id
+	WHERE usage_rating.bill_id = $1
+	ORDER BY bill_item.created_at, bill_item.id
+	`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+	for itemRows.Next() {
+		var ratingId, itemId string
+		err := itemRows.Scan(&ratingId, &itemId)
+		if err != nil {
+			return nil, err
+		}
+		i := index[ratingId]
+		ratings[i].ItemIds = append(ratings[i].ItemIds, itemId)
+	}
+	return ratings, nil
+}
+
+// ListUsageEvents returns a page of the raw events behind a usage rating,
+// ordered by ID. Pages continue after the last ID of the previous page.
+func ListUsageEvents(ctx context.Context, ratingId string, after string, limit int) ([]models.UsageEvent, error) {
+	if limit <= 0 {
+		limit = defaultListUsageEventsLimit
+	}
+	if limit > maxListUsageEventsLimit {
+		limit = maxListUsageEventsLimit
+	}
+	var exists bool
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT EXISTS (SELECT 1 FROM usage_rating WHERE id = $1)
+	`, ratingId).Scan(&exists)
+	if err != nil || !exists {
+		return nil, temporal.NewNonRetryableApplicationError("Usage rating not found", "NOT_FOUND", nil)
+	}
+
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT event_id, customer_id, meter, quantity, occurred_at, properties, received_at, rating_id
+	FROM usage_event
+	WHERE rating_id = $1 AND event_id > $2
+	ORDER BY event_id
+	LIMIT $3
+	`, ratingId, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.UsageEvent{}
+	for rows.Next() {
+		var event models.UsageEvent
+		err := rows.Scan(&event.Id, &event.CustomerId, &event.Meter, &event.Quantity, &event.OccurredAt, &event.Properties, &event.ReceivedAt, &event.RatingId)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
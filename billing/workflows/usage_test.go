@@ -0,0 +1,138 @@
+package workflows
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func testMeter() string {
+	return "test." + uuid.NewString()[:8]
+}
+
+func TestPriceUsage(t *testing.T) {
+	tiers := []models.PriceTier{{UpTo: 100, UnitPrice: "0"}, {UpTo: 1000, UnitPrice: "2"}, {UnitPrice: "1"}}
+
+	items := priceUsage(models.MeterPrice{Meter: "api.calls", Model: models.PricingFlat, UnitPrice: "0.5"}, 300)
+	require.Len(t, items, 1)
+	require.Equal(t, int64(300), items[0].Quantity)
+	require.Equal(t, "0.5", items[0].UnitPriceDecimal)
+
+	// Every started package is charged.
+	items = priceUsage(models.MeterPrice{Meter: "gb", Model: models.PricingPackage, UnitPrice: "500", PackageSize: 10}, 21)
+	require.Len(t, items, 1)
+	require.Equal(t, int64(3), items[0].Quantity)
+
+	// Graduated tiers charge the units within each tier at its price.
+	items = priceUsage(models.MeterPrice{Meter: "api.calls", Model: models.PricingTiered, Tiers: tiers}, 1500)
+	require.Len(t, items, 3)
+	require.Equal(t, []int64{100, 900, 500}, []int64{items[0].Quantity, items[1].Quantity, items[2].Quantity})
+	require.Equal(t, "2", items[1].UnitPriceDecimal)
+	items = priceUsage(models.MeterPrice{Meter: "api.calls", Model: models.PricingTiered, Tiers: tiers}, 100)
+	require.Len(t, items, 1)
+
+	// Volume tiers charge all units at the price of the tier reached.
+	items = priceUsage(models.MeterPrice{Meter: "api.calls", Model: models.PricingVolume, Tiers: tiers}, 1500)
+	require.Len(t, items, 1)
+	require.Equal(t, int64(1500), items[0].Quantity)
+	require.Equal(t, "1", items[0].UnitPriceDecimal)
+	items = priceUsage(models.MeterPrice{Meter: "api.calls", Model: models.PricingVolume, Tiers: tiers}, 1000)
+	require.Equal(t, "2", items[0].UnitPriceDecimal)
+
+	require.Empty(t, priceUsage(models.MeterPrice{Meter: "api.calls", Model: models.PricingFlat, UnitPrice: "1"}, 0))
+}
+
+func TestSaveMeterPrice_Invalid(t *testing.T) {
+	ctx := context.Background()
+	_, err := SaveMeterPrice(ctx, models.MeterPrice{Meter: "API Calls", Currency: "USD", Model: models.PricingFlat, UnitPrice: "1"})
+	require.Error(t, err)
+	_, err = SaveMeterPrice(ctx, models.MeterPrice{Meter: testMeter(), Currency: "USD", Model: models.PricingPackage, UnitPrice: "1"})
+	require.Error(t, err)
+	_, err = SaveMeterPrice(ctx, models.MeterPrice{Meter: testMeter(), Currency: "USD", Model: models.PricingTiered,
+		Tiers: []models.PriceTier{{UpTo: 100, UnitPrice: "1"}, {UpTo: 50, UnitPrice: "1"}, {UnitPrice: "1"}}})
+	require.Error(t, err)
+	_, err = SaveMeterPrice(ctx, models.MeterPrice{Meter: testMeter(), Currency: "USD", Model: models.PricingVolume,
+		Tiers: []models.PriceTier{{UpTo: 100, UnitPrice: "1"}}})
+	require.Error(t, err)
+}
+
+func TestRecordUsageEvents(t *testing.T) {
+	ctx := context.Background()
+	meter := testMeter()
+	_, err := SaveMeterPrice(ctx, models.MeterPrice{Meter: meter, Currency: "USD", Model: models.PricingFlat, UnitPrice: "1"})
+	require.NoError(t, err)
+	customerId := createTestCustomer(t)
+	event := models.UsageEvent{Id: "evt-1", CustomerId: customerId, Meter: meter, Quantity: 5, OccurredAt: time.Now()}
+
+	recorded, err := RecordUsageEvents(ctx, []models.UsageEvent{event})
+	require.NoError(t, err)
+	require.Equal(t, 1, recorded)
+	// Resent events are not recorded again.
+	recorded, err = RecordUsageEvents(ctx, []models.UsageEvent{event})
+	require.NoError(t, err)
+	require.Equal(t, 0, recorded)
+
+	// Events of meters missing from the price book are rejected.
+	_, err = RecordUsageEvents(ctx, []models.UsageEvent{{Id: "evt-2", CustomerId: customerId, Meter: testMeter(), Quantity: 5, OccurredAt: time.Now()}})
+	require.Error(t, err)
+}
+
+func TestRateUsage(t *testing.T) {
+	ctx := context.Background()
+	meter := testMeter()
+	_, err := SaveMeterPrice(ctx, models.MeterPrice{Meter: meter, Description: "API calls", Currency: "USD", Model: models.PricingTiered,
+		Tiers: []models.PriceTier{{UpTo: 10, UnitPrice: "0"}, {UnitPrice: "0.5"}}})
+	require.NoError(t, err)
+	customerId := createTestCustomer(t)
+	bill, err := CreateBill(ctx, customerId, time.Now().Add(24*time.Hour), "USD", 0)
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = RecordUsageEvents(ctx, []models.UsageEvent{
+		{Id: "evt-1", CustomerId: customerId, Meter: meter, Quantity: 8, OccurredAt: now.Add(-2 * time.Hour)},
+		{Id: "evt-2", CustomerId: customerId, Meter: meter, Quantity: 15, OccurredAt: now.Add(-time.Hour)},
+		// Usage after the close date belongs to the next bill.
+		{Id: "evt-3", CustomerId: customerId, Meter: meter, Quantity: 100, OccurredAt: now.Add(48 * time.Hour)},
+	})
+	require.NoError(t, err)
+
+	// The free tier is not charged; 13 calls at 0.5 round half even to 6.
+	items, err := RateUsage(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, int64(13), items[0].Quantity)
+	require.Equal(t, int64(6), items[0].Amount)
+	require.Equal(t, "API calls (tier 2)", items[0].Description)
+	require.Equal(t, meter, items[0].Metadata["meter"])
+
+	ratings, err := ListUsageRatings(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Len(t, ratings, 1)
+	require.Equal(t, int64(23), ratings[0].Quantity)
+	require.Equal(t, 2, ratings[0].EventCount)
+	require.Equal(t, []string{items[0].Id}, ratings[0].ItemIds)
+	require.Equal(t, ratings[0].Id, items[0].Metadata["usageRatingId"])
+
+	events, err := ListUsageEvents(ctx, ratings[0].Id, "", 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "evt-1", events[0].Id)
+	events, err = ListUsageEvents(ctx, ratings[0].Id, events[0].Id, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "evt-2", events[0].Id)
+
+	// Rated events are only rated once.
+	items, err = RateUsage(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Empty(t, items)
+
+	require.NoError(t, CloseBill(ctx, bill.BillId))
+	summary, err := GetBillSummary(ctx, bill.BillId)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), summary.BillItemSummary[0].TotalAmount)
+}
@@ -0,0 +1,512 @@
+package workflows
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/models"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// WebhookSignatureHeader carries the signature of a webhook delivery, formatted as
+// "t=<unix timestamp>,v1=<hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the endpoint secret>".
+const WebhookSignatureHeader = "Pave-Signature"
+
+var webhookEventTypes = []string{
+	models.EventBillCreated,
+	models.EventBillItemAdded,
+	models.EventBillItemFailed,
+	models.EventBillClosed,
+	models.EventBillReminder,
+	models.EventBillOverdue,
+	models.EventBillSuspended,
+	models.EventBillCapApproaching,
+	models.EventBillCapExceeded,
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookDeliveryWorkflowId returns the ID of the workflow delivering a webhook.
+func WebhookDeliveryWorkflowId(deliveryId string) string {
+	return "webhook-delivery/" + deliveryId
+}
+
+// SignWebhookPayload returns the signature header value for a delivery body.
+func SignWebhookPayload(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks a signature header produced by SignWebhookPayload.
+// Receivers should also reject timestamps that are too old to prevent replays.
+func VerifyWebhookSignature(secret string, header string, body []byte) bool {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	expected := SignWebhookPayload(secret, time.Unix(unix, 0), body)
+	return hmac.Equal([]byte(expected), []byte("t="+timestamp+",v1="+signature))
+}
+
+func validateWebhookEndpoint(endpointUrl string, eventTypes []string) error {
+	parsed, err := url.Parse(endpointUrl)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return temporal.NewNonRetryableApplicationError("Invalid webhook URL: "+endpointUrl, "INVALID-DATA", nil)
+	}
+	for _, eventType := range eventTypes {
+		known := false
+		for _, webhookEventType := range webhookEventTypes {
+			known = known || eventType == webhookEventType
+		}
+		if !known {
+			return temporal.NewNonRetryableApplicationError("Unknown event type: "+eventType, "INVALID-DATA", nil)
+		}
+	}
+	return nil
+}
+
+func CreateWebhookEndpoint(ctx context.Context, customerId string, endpointUrl string, eventTypes []string) (*models.WebhookEndpoint, error) {
+	err := validateWebhookEndpoint(endpointUrl, eventTypes)
+	if err != nil {
+		return nil, err
+	}
+	_, err = GetCustomer(ctx, customerId)
+	if err != nil {
+		return nil, err
+	}
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoint models.WebhookEndpoint
+	err = db.BillDb.QueryRow(ctx, `
+	INSERT INTO webhook_endpoint
+	(customer_id, url, secret, event_types)
+	VALUES ($1,$2,$3,$4)
+	RETURNING id, customer_id, url, secret, event_types, active, created_at
+	`, customerId, endpointUrl, "whsec_"+hex.EncodeToString(secret), eventTypes).Scan(&endpoint.Id, &endpoint.CustomerId, &endpoint.Url, &endpoint.Secret, &endpoint.EventTypes, &endpoint.Active, &endpoint.CreatedAt)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), "DB-ERROR", nil)
+	}
+	return &endpoint, nil
+}
+
+// ListWebhookEndpoints returns the endpoints of a customer, without their secrets.
+func ListWebhookEndpoints(ctx context.Context, customerId string) ([]models.WebhookEndpoint, error) {
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT id, customer_id, url, event_types, active, created_at
+	FROM webhook_endpoint
+	WHERE customer_id = $1
+	ORDER BY created_at
+	`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []models.WebhookEndpoint
+	for rows.Next() {
+		var endpoint models.WebhookEndpoint
+		err := rows.Scan(&endpoint.Id, &endpoint.CustomerId, &endpoint.Url, &endpoint.EventTypes, &endpoint.Active, &endpoint.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// DeactivateWebhookEndpoint stops new events from being delivered to an endpoint.
+func DeactivateWebhookEndpoint(ctx context.Context, customerId string, endpointId string) error {
+	result, err := db.BillDb.Exec(ctx, `
+	UPDATE webhook_endpoint
+	SET active = FALSE
+	WHERE id = $1 AND customer_id = $2
+	`, endpointId, customerId)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return temporal.NewNonRetryableApplicationError("Webhook endpoint not found", "NOT_FOUND", nil)
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `id, endpoint_id, event_id, event_type, status, attempts, response_status, COALESCE(last_error, ''), created_at, last_attempt_at, delivered_at`
+
+// ListWebhookDeliveries lists the deliveries of an endpoint of the customer, newest first.
+func ListWebhookDeliveries(ctx context.Context, customerId string, endpointId string) ([]models.WebhookDelivery, error) {
+	var id string
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT id
+	FROM webhook_endpoint
+	WHERE id = $1 AND customer_id = $2
+	`, endpointId, customerId).Scan(&id)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, temporal.NewNonRetryableApplicationError("Webhook endpoint not found", "NOT_FOUND", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.BillDb.Query(ctx, `
+	SELECT `+webhookDeliveryColumns+`
+	FROM webhook_delivery
+	WHERE endpoint_id = $1
+	ORDER BY created_at DESC
+	`, endpointId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.WebhookDelivery
+	for rows.Next() {
+		var delivery models.WebhookDelivery
+		err := rows.Scan(&delivery.Id, &delivery.EndpointId, &delivery.EventId, &delivery.EventType, &delivery.Status, &delivery.Attempts, &delivery.ResponseStatus, &delivery.LastError, &delivery.CreatedAt, &delivery.LastAttemptAt, &delivery.DeliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func GetWebhookDelivery(ctx context.Context, deliveryId string) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT `+webhookDeliveryColumns+`
+	FROM webhook_delivery
+	WHERE id = $1
+	`, deliveryId).Scan(&delivery.Id, &delivery.EndpointId, &delivery.EventId, &delivery.EventType, &delivery.Status, &delivery.Attempts, &delivery.ResponseStatus, &delivery.LastError, &delivery.CreatedAt, &delivery.LastAttemptAt, &delivery.DeliveredAt)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("Webhook delivery not found", "NOT_FOUND", nil)
+	}
+	return &delivery, nil
+}
+
+// RecordWebhookEvent queues an event for every active endpoint of the bill's
+// customer that subscribes to it, and returns the IDs of the deliveries.
+// Deliveries are keyed by event ID, so retries do not queue an event twice.
+func RecordWebhookEvent(ctx context.Context, event models.BillEvent) ([]string, error) {
+	return recordWebhookEvent(ctx, db.BillDb, event)
+}
+
+// RecordWebhookEvents records several events at once, e.g. one per item of a
+// batch, and returns the deliveries of all of them.
+func RecordWebhookEvents(ctx context.Context, events []models.BillEvent) ([]string, error) {
+	tx, err := db.BillDb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deliveryIds := []string{}
+	for _, event := range events {
+		ids, err := recordWebhookEvent(ctx, tx, event)
+		if err != nil {
+			return nil, err
+		}
+		deliveryIds = append(deliveryIds, ids...)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return deliveryIds, nil
+}
+
+func recordWebhookEvent(ctx context.Context, q querier, event models.BillEvent) ([]string, error) {
+	rows, err := q.Query(ctx, `
+	INSERT INTO webhook_delivery
+	(endpoint_id, event_id, event_type, payload)
+	SELECT id, $2, $3, $4
+	FROM webhook_endpoint
+	WHERE customer_id::text = $1 AND active AND (event_types = '{}' OR $3 = ANY(event_types))
+	ON CONFLICT (endpoint_id, event_id) DO UPDATE
+	SET event_type = EXCLUDED.event_type
+	RETURNING id
+	`, event.CustomerId, event.Id, event.Type, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveryIds := []string{}
+	for rows.Next() {
+		var deliveryId string
+		err := rows.Scan(&deliveryId)
+		if err != nil {
+			return nil, err
+		}
+		deliveryIds = append(deliveryIds, deliveryId)
+	}
+	return deliveryIds, nil
+}
+
+// DeliverWebhookAttempt posts a delivery to its endpoint once. Any response
+// other than 2xx fails the attempt so that Temporal retries it with backoff.
+// Deliveries to an endpoint that has been deactivated since are not retried.
+func DeliverWebhookAttempt(ctx context.Context, deliveryId string) error {
+	var endpointUrl, secret, status string
+	var active bool
+	var payload []byte
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT webhook_endpoint.url, webhook_endpoint.secret, webhook_endpoint.active, webhook_delivery.payload, webhook_delivery.status
+	FROM webhook_delivery
+	JOIN webhook_endpoint ON webhook_endpoint.id = webhook_delivery.endpoint_id
+	WHERE webhook_delivery.id = $1
+	`, deliveryId).Scan(&endpointUrl, &secret, &active, &payload, &status)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError("Webhook delivery not found", "NOT_FOUND", nil)
+	}
+	if status == "delivered" {
+		return nil
+	}
+	if !active {
+		return temporal.NewNonRetryableApplicationError("Webhook endpoint is inactive", "FAILED-PRECONDITION", nil)
+	}
+
+	responseStatus, err := postWebhook(ctx, endpointUrl, secret, deliveryId, payload)
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+	}
+	_, dbErr := db.BillDb.Exec(ctx, `
+	UPDATE webhook_delivery
+	SET
+    attempts = attempts + 1,
+    last_attempt_at = NOW(),
+    response_status = NULLIF($2, 0),
+    last_error = NULLIF($3, ''),
+    status = CASE WHEN $3 = '' THEN 'delivered'::webhook_delivery_status ELSE status END,
+    delivered_at = CASE WHEN $3 = '' THEN NOW() ELSE delivered_at END
+	WHERE id = $1
+	`, deliveryId, responseStatus, lastError)
+	if dbErr != nil {
+		return dbErr
+	}
+	return err
+}
+
+func postWebhook(ctx context.Context, endpointUrl string, secret string, deliveryId string, payload []byte) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointUrl, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Pave-Delivery-Id", deliveryId)
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(secret, time.Now(), payload))
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("endpoint responded with status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// MarkWebhookDeliveryFailed records that a delivery gave up after exhausting its retries.
+func MarkWebhookDeliveryFailed(ctx context.Context, deliveryId string) error {
+	_, err := db.BillDb.Exec(ctx, `
+	UPDATE webhook_delivery
+	SET status = 'failed'
+	WHERE id = $1 AND status = 'pending'
+	`, deliveryId)
+	return err
+}
+
+// ResetWebhookDelivery puts a delivery back into the pending state ahead of a
+// manual redelivery. Deliveries to inactive endpoints cannot be redelivered.
+func ResetWebhookDelivery(ctx context.Context, customerId string, endpointId string, deliveryId string) error {
+	var active bool
+	err := db.BillDb.QueryRow(ctx, `
+	SELECT webhook_endpoint.active
+	FROM webhook_delivery
+	JOIN webhook_endpoint ON webhook_endpoint.id = webhook_delivery.endpoint_id
+	WHERE webhook_delivery.id = $1 AND webhook_endpoint.id = $2 AND webhook_endpoint.customer_id = $3
+	`, deliveryId, endpointId, customerId).Scan(&active)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return temporal.NewNonRetryableApplicationError("Webhook delivery not found", "NOT_FOUND", nil)
+	}
+	if err != nil {
+		return err
+	}
+	if !active {
+		return temporal.NewNonRetryableApplicationError("Webhook endpoint is inactive", "FAILED-PRECONDITION", nil)
+	}
+
+	_, err = db.BillDb.Exec(ctx, `
+	UPDATE webhook_delivery
+	SET status = 'pending', delivered_at = NULL
+	WHERE id = $1
+	`, deliveryId)
+	return err
+}
+
+// DeliverWebhook delivers one webhook, retrying with exponential backoff for
+// roughly a day before marking the delivery as failed.
+func DeliverWebhook(ctx workflow.Context, deliveryId string) error {
+	logger := workflow.GetLogger(ctx)
+	options := workflow.ActivityOptions{
+		StartToCloseTimeout: time.Second * 30,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval: time.Second * 10,
+			BackoffCoefficient: 2,
+			MaximumInterval: time.Hour,
+			MaximumAttempts: 30,
+		},
+	}
+	ctx = workflow.WithActivityOptions(ctx, options)
+
+	err := workflow.ExecuteActivity(ctx, DeliverWebhookAttempt, deliveryId).Get(ctx, nil)
+	if err == nil {
+		return nil
+	}
+	logger.Error("Webhook delivery failed.", "deliveryId", deliveryId, "error", err)
+
+	return workflow.ExecuteActivity(ctx, MarkWebhookDeliveryFailed, deliveryId).Get(ctx, nil)
+}
+
+// emitBillEvent records a bill event and starts the delivery of its webhooks.
+// Failures are logged rather than failing the bill workflow.
+func emitBillEvent(ctx workflow.Context, eventType string, bill *models.Bill, item *models.BillItem, itemErr error) {
+	event := models.BillEvent{
+		Type: eventType,
+		Item: item,
+	}
+	if itemErr != nil {
+		event.Error = itemErr.Error()
+	}
+	deliverBillEvent(ctx, bill, event)
+}
+
+// emitDunningEvent records the event of a dunning step and starts the delivery of its webhooks.
+func emitDunningEvent(ctx workflow.Context, bill *models.Bill, dunning *models.DunningEvent) {
+	deliverBillEvent(ctx, bill, models.BillEvent{
+		Type: dunningEventTypes[dunning.Action],
+		Dunning: dunning,
+	})
+}
+
+// emitBillEvents records an event for each item of a batch with a single
+// activity and starts the delivery of their webhooks.
+func emitBillEvents(ctx workflow.Context, eventType string, bill *models.Bill, items []models.BillItem, itemErr error) {
+	logger := workflow.GetLogger(ctx)
+
+	var eventIds []string
+	err := workflow.SideEffect(ctx, func(workflow.Context) interface{} {
+		ids := make([]string, len(items))
+		for i := range ids {
+			ids[i] = uuid.NewString()
+		}
+		return ids
+	}).Get(&eventIds)
+	if err != nil {
+		logger.Error("failed to generate event IDs", "error", err)
+		return
+	}
+	events := make([]models.BillEvent, len(items))
+	for i := range items {
+		events[i] = models.BillEvent{
+			Id: eventIds[i],
+			Type: eventType,
+			BillId: bill.BillId,
+			CustomerId: bill.CustomerId,
+			CreatedAt: workflow.Now(ctx),
+			Item: &items[i],
+		}
+		if itemErr != nil {
+			events[i].Error = itemErr.Error()
+		}
+	}
+
+	var deliveryIds []string
+	err = workflow.ExecuteActivity(ctx, RecordWebhookEvents, events).Get(ctx, &deliveryIds)
+	if err != nil {
+		logger.Error("failed to record bill events", "type", eventType, "error", err)
+		return
+	}
+	startWebhookDeliveries(ctx, deliveryIds)
+}
+
+func deliverBillEvent(ctx workflow.Context, bill *models.Bill, event models.BillEvent) {
+	logger := workflow.GetLogger(ctx)
+
+	var eventId string
+	err := workflow.SideEffect(ctx, func(workflow.Context) interface{} {
+		return uuid.NewString()
+	}).Get(&eventId)
+	if err != nil {
+		logger.Error("failed to generate event ID", "error", err)
+		return
+	}
+	event.Id = eventId
+	event.BillId = bill.BillId
+	event.CustomerId = bill.CustomerId
+	event.CreatedAt = workflow.Now(ctx)
+
+	var deliveryIds []string
+	err = workflow.ExecuteActivity(ctx, RecordWebhookEvent, event).Get(ctx, &deliveryIds)
+	if err != nil {
+		logger.Error("failed to record bill event", "type", event.Type, "error", err)
+		return
+	}
+	startWebhookDeliveries(ctx, deliveryIds)
+}
+
+func startWebhookDeliveries(ctx workflow.Context, deliveryIds []string) {
+	logger := workflow.GetLogger(ctx)
+	for _, deliveryId := range deliveryIds {
+		childCtx := workflow.WithChildOptions(ctx, workflow.ChildWorkflowOptions{
+			WorkflowID: WebhookDeliveryWorkflowId(deliveryId),
+			// Deliveries keep retrying after the bill workflow completes or continues as new.
+			ParentClosePolicy: enums.PARENT_CLOSE_POLICY_ABANDON,
+		})
+		err := workflow.ExecuteChildWorkflow(childCtx, DeliverWebhook, deliveryId).GetChildWorkflowExecution().Get(ctx, nil)
+		if err != nil {
+			logger.Error("failed to start webhook delivery", "deliveryId", deliveryId, "error", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package workflows
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"encore.app/billing/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"type":"bill.closed"}`)
+	header := SignWebhookPayload("whsec_test", time.Unix(1700000000, 0), body)
+
+	require.Regexp(t, `^t=1700000000,v1=[0-9a-f]{64}$`, header)
+	require.True(t, VerifyWebhookSignature("whsec_test", header, body))
+	require.False(t, VerifyWebhookSignature("whsec_other", header, body))
+	require.False(t, VerifyWebhookSignature("whsec_test", header, []byte(`{"type":"bill.created"}`)))
+}
+
+func TestCreateWebhookEndpoint_Invalid(t *testing.T) {
+	customerId := createTestCustomer(t)
+
+	_, err := CreateWebhookEndpoint(context.Background(), customerId, "not a url", nil)
+	require.Error(t, err)
+	_, err = CreateWebhookEndpoint(context.Background(), customerId, "https://example.com/hook", []string{"bill.unknown"})
+	require.Error(t, err)
+}
+
+func TestListWebhookEndpoints(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+
+	created, err := CreateWebhookEndpoint(ctx, customerId, "https://example.com/hook", []string{models.EventBillCapApproaching, models.EventBillCapExceeded})
+	require.NoError(t, err)
+	require.NotEmpty(t, created.Secret)
+
+	// The secret is only shown once, when the endpoint is created.
+	endpoints, err := ListWebhookEndpoints(ctx, customerId)
+	require.NoError(t, err)
+	require.Len(t, endpoints, 1)
+	require.Equal(t, created.Id, endpoints[0].Id)
+	require.Empty(t, endpoints[0].Secret)
+}
+
+func TestDeliverWebhookAttempt(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+
+	var received []byte
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(WebhookSignatureHeader)
+	}))
+	defer server.Close()
+
+	endpoint, err := CreateWebhookEndpoint(ctx, customerId, server.URL, []string{models.EventBillClosed})
+	require.NoError(t, err)
+
+	// Events the endpoint does not subscribe to are not queued.
+	deliveryIds, err := RecordWebhookEvent(ctx, models.BillEvent{Id: uuid.NewString(), Type: models.EventBillCreated, BillId: uuid.NewString(), CustomerId: customerId})
+	require.NoError(t, err)
+	require.Empty(t, deliveryIds)
+
+	event := models.BillEvent{Id: uuid.NewString(), Type: models.EventBillClosed, BillId: uuid.NewString(), CustomerId: customerId}
+	deliveryIds, err = RecordWebhookEvent(ctx, event)
+	require.NoError(t, err)
+	require.Len(t, deliveryIds, 1)
+
+	// Recording the same event again returns the existing delivery.
+	retriedIds, err := RecordWebhookEvent(ctx, event)
+	require.NoError(t, err)
+	require.Equal(t, deliveryIds, retriedIds)
+
+	require.NoError(t, DeliverWebhookAttempt(ctx, deliveryIds[0]))
+	require.True(t, VerifyWebhookSignature(endpoint.Secret, signature, received))
+	require.Contains(t, string(received), event.Id)
+
+	delivery, err := GetWebhookDelivery(ctx, deliveryIds[0])
+	require.NoError(t, err)
+	require.Equal(t, "delivered", delivery.Status)
+	require.Equal(t, 1, delivery.Attempts)
+	require.Equal(t, 200, *delivery.ResponseStatus)
+}
+
+func TestDeliverWebhookAttempt_Failure(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, err := CreateWebhookEndpoint(ctx, customerId, server.URL, nil)
+	require.NoError(t, err)
+
+	deliveryIds, err := RecordWebhookEvent(ctx, models.BillEvent{Id: uuid.NewString(), Type: models.EventBillCreated, BillId: uuid.NewString(), CustomerId: customerId})
+	require.NoError(t, err)
+	require.Len(t, deliveryIds, 1)
+
+	require.Error(t, DeliverWebhookAttempt(ctx, deliveryIds[0]))
+	require.NoError(t, MarkWebhookDeliveryFailed(ctx, deliveryIds[0]))
+
+	delivery, err := GetWebhookDelivery(ctx, deliveryIds[0])
+	require.NoError(t, err)
+	require.Equal(t, "failed", delivery.Status)
+	require.Equal(t, 1, delivery.Attempts)
+	require.Equal(t, 500, *delivery.ResponseStatus)
+	require.NotEmpty(t, delivery.LastError)
+}
+
+func TestDeliverWebhookAttempt_InactiveEndpoint(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+
+	endpoint, err := CreateWebhookEndpoint(ctx, customerId, "https://example.com/hook", nil)
+	require.NoError(t, err)
+	deliveryIds, err := RecordWebhookEvent(ctx, models.BillEvent{Id: uuid.NewString(), Type: models.EventBillCreated, BillId: uuid.NewString(), CustomerId: customerId})
+	require.NoError(t, err)
+	require.Len(t, deliveryIds, 1)
+	require.NoError(t, DeactivateWebhookEndpoint(ctx, customerId, endpoint.Id))
+
+	err = DeliverWebhookAttempt(ctx, deliveryIds[0])
+	require.Equal(t, "FAILED-PRECONDITION", applicationErrorType(err))
+	delivery, err := GetWebhookDelivery(ctx, deliveryIds[0])
+	require.NoError(t, err)
+	require.Equal(t, 0, delivery.Attempts)
+
+	err = ResetWebhookDelivery(ctx, customerId, endpoint.Id, deliveryIds[0])
+	require.Equal(t, "FAILED-PRECONDITION", applicationErrorType(err))
+}
+
+func TestWebhookDeliveries_ScopedByCustomer(t *testing.T) {
+	ctx := context.Background()
+	customerId := createTestCustomer(t)
+	otherCustomerId := createTestCustomer(t)
+
+	endpoint, err := CreateWebhookEndpoint(ctx, customerId, "https://example.com/hook", nil)
+	require.NoError(t, err)
+	deliveryIds, err := RecordWebhookEvent(ctx, models.BillEvent{Id: uuid.NewString(), Type: models.EventBillCreated, BillId: uuid.NewString(), CustomerId: customerId})
+	require.NoError(t, err)
+	require.Len(t, deliveryIds, 1)
+
+	deliveries, err := ListWebhookDeliveries(ctx, customerId, endpoint.Id)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+
+	_, err = ListWebhookDeliveries(ctx, otherCustomerId, endpoint.Id)
+	require.Equal(t, "NOT_FOUND", applicationErrorType(err))
+	err = ResetWebhookDelivery(ctx, otherCustomerId, endpoint.Id, deliveryIds[0])
+	require.Equal(t, "NOT_FOUND", applicationErrorType(err))
+	require.NoError(t, ResetWebhookDelivery(ctx, customerId, endpoint.Id, deliveryIds[0]))
+}
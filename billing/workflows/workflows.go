@@ -1,6 +1,8 @@
 package workflows
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
 	"time"
 
@@ -11,11 +13,24 @@ import (
 
 const UpdateBillItems = "update_bill_items"
 
+// MaxBillItemsPerUpdate caps the batch size of an UpdateBillItems update, so
+// that one update cannot hold up the bill workflow for long.
+const MaxBillItemsPerUpdate = 100
+
+const UpdateVoidBillItem = "void_bill_item"
+
+const UpdateVoidBill = "void_bill"
+
+const UpdateRescheduleBill = "reschedule_bill"
+
 const QueryBill = "query_bill"
 
 func ComposeBill(ctx workflow.Context, initial_bill *models.Bill) error {
     logger := workflow.GetLogger(ctx)
     bill := initial_bill
+    if bill.Status == "" {
+        bill.Status = models.BillStatusOpen
+    }
     options := workflow.ActivityOptions{
         StartToCloseTimeout: time.Second * 5,
         RetryPolicy: &temporal.RetryPolicy{
@@ -29,48 +44,506 @@ func ComposeBill(ctx workflow.Context, initial_bill *models.Bill) error {
     workflow.SetQueryHandler(ctx, QueryBill, func () (*models.Bill,error) {
         return bill, nil
     })
-    // Create update handler for updating bill with additional items
-    err := workflow.SetUpdateHandler(ctx,UpdateBillItems, func(ctx workflow.Context, billItems []models.BillItem) error {
-		logger.Info("Received update to add bill items.")
+
+    // nextBill is the following bill of a schedule. It is opened as soon as
+    // this bill starts closing, so that late items can be routed to it.
+    var nextBill *models.Bill
+
+    // findBill returns the bill of this workflow with the given ID. While this
+    // bill is closing, the workflow also holds the open bill of the next period.
+    findBill := func(billId string) (*models.Bill, error) {
+        if nextBill != nil && billId == nextBill.BillId {
+            return nextBill, nil
+        }
+        if billId != bill.BillId {
+            return nil, temporal.NewNonRetryableApplicationError("Bill "+billId+" is not open in this workflow", "FAILED-PRECONDITION", nil)
+        }
+        return bill, nil
+    }
+
+    // targetBill returns the bill an item sent to billId ends up on. While
+    // this bill is closing, items that occurred after its close date belong
+    // to the next period.
+    targetBill := func(billId string, billItem models.BillItem) (*models.Bill, error) {
+        target, err := findBill(billId)
+        if err != nil || target == nextBill {
+            return target, err
+        }
+        switch bill.Status {
+        case models.BillStatusOpen:
+            return bill, nil
+        case models.BillStatusClosing:
+            if occurredBefore(billItem, bill.CloseDate) {
+                return bill, nil
+            }
+            if nextBill != nil {
+                return nextBill, nil
+            }
+            return nil, temporal.NewNonRetryableApplicationError("Bill is closing and only accepts items that occurred before its close date "+bill.CloseDate.Format(time.RFC3339), "FAILED-PRECONDITION", nil)
+        }
+        return nil, temporal.NewNonRetryableApplicationError("Items can only be added while the bill is open", "FAILED-PRECONDITION", nil)
+    }
+
+    // Create update handler for updating bill with additional items. Items
+    // are added one by one, or all or none of them if atomic is set, and the
+    // result of each is returned in order.
+    err := workflow.SetUpdateHandlerWithOptions(ctx,UpdateBillItems, func(ctx workflow.Context, billId string, billItems []models.BillItem, atomic bool) ([]models.BillItemResult, error) {
+		logger.Info("Received update to add bill items.", "count", len(billItems), "atomic", atomic)
         ctx = workflow.WithActivityOptions(ctx, options)
-        for _, billItem := range billItems {
-            err := workflow.ExecuteActivity(ctx,AddBillItem, bill.BillId, billItem.Amount, billItem.Currency).Get(ctx,nil)
+        results := make([]models.BillItemResult, len(billItems))
+        if atomic {
+            // The validator made sure that all items go to the same bill.
+            target, err := targetBill(billId, billItems[0])
             if err != nil {
-                logger.Error("failed to process a bill item: ", strconv.Itoa(billItem.Amount) + billItem.Currency)
-                // probably send some notification or alert
+                return nil, err
+            }
+            var itemIds []string
+            batchCtx := workflow.WithStartToCloseTimeout(ctx, time.Minute)
+            err = workflow.ExecuteActivity(batchCtx, AddBillItemBatch, target.BillId, billItems).Get(ctx, &itemIds)
+            if err != nil {
+                logger.Error("failed to add batch of bill items", "error", err)
+                for i := range billItems {
+                    results[i] = models.BillItemResult{BillId: target.BillId, Status: models.BillItemRejected, Error: errorReason(err)}
+                }
+                emitBillEvents(ctx, models.EventBillItemFailed, target, billItems, err)
+                return results, nil
+            }
+            added := make([]models.BillItem, len(billItems))
+            for i, billItem := range billItems {
+                added[i] = acceptedBillItem(ctx, billItem)
+                added[i].Id = itemIds[i]
+                results[i] = models.BillItemResult{ItemId: itemIds[i], BillId: target.BillId, Status: models.BillItemAccepted}
+            }
+            target.BillItems = append(target.BillItems, added...)
+            emitBillEvents(ctx, models.EventBillItemAdded, target, added, nil)
+            return results, nil
+        }
+        for i, billItem := range billItems {
+            target, err := targetBill(billId, billItem)
+            if err != nil {
+                // The bill closed while earlier items of the update were being added.
+                emitBillEvent(ctx, models.EventBillItemFailed, bill, &billItem, err)
+                results[i] = models.BillItemResult{BillId: billId, Status: models.BillItemRejected, Error: errorReason(err)}
+                continue
+            }
+            var itemId string
+            err = workflow.ExecuteActivity(ctx,AddBillItem, target.BillId, billItem).Get(ctx,&itemId)
+            if err != nil {
+                logger.Error("failed to process a bill item: ", strconv.FormatInt(billItem.Amount, 10) + billItem.Currency)
+                emitBillEvent(ctx, models.EventBillItemFailed, target, &billItem, err)
+                results[i] = models.BillItemResult{BillId: target.BillId, Status: models.BillItemRejected, Error: errorReason(err)}
             } else {
-                bill.BillItems = append(bill.BillItems, billItem)
+                billItem = acceptedBillItem(ctx, billItem)
+                billItem.Id = itemId
+                target.BillItems = append(target.BillItems, billItem)
+                emitBillEvent(ctx, models.EventBillItemAdded, target, &billItem, nil)
+                results[i] = models.BillItemResult{ItemId: itemId, BillId: target.BillId, Status: models.BillItemAccepted}
             }
         }
         
+        return results, nil
+    }, workflow.UpdateHandlerOptions{
+        // Batches that cannot succeed are rejected before they are written to the workflow history.
+        Validator: func(billId string, billItems []models.BillItem, atomic bool) error {
+            if len(billItems) == 0 {
+                return temporal.NewNonRetryableApplicationError("No bill items given", "INVALID-DATA", nil)
+            }
+            if atomic && len(billItems) > MaxBillItemsPerBatch {
+                return temporal.NewNonRetryableApplicationError(fmt.Sprintf("At most %d bill items can be added in one batch", MaxBillItemsPerBatch), "INVALID-DATA", nil)
+            }
+            if !atomic && len(billItems) > MaxBillItemsPerUpdate {
+                return temporal.NewNonRetryableApplicationError(fmt.Sprintf("At most %d bill items can be added at once, use an atomic batch for more", MaxBillItemsPerUpdate), "INVALID-DATA", nil)
+            }
+            var first *models.Bill
+            for i, billItem := range billItems {
+                // The rounding mode only changes amounts, not whether an item is valid.
+                normalized, err := normalizeBillItem(billItem, models.RoundHalfEven)
+                if err == nil {
+                    err = checkBillItem(normalized)
+                }
+                var target *models.Bill
+                if err == nil {
+                    target, err = targetBill(billId, billItem)
+                }
+                if err == nil && atomic && first != nil && target != first {
+                    err = temporal.NewNonRetryableApplicationError("Atomic batches cannot mix items for this period and the next", "INVALID-DATA", nil)
+                }
+                if err != nil {
+                    return batchItemError(i, err)
+                }
+                first = target
+            }
+            return nil
+        },
+    })
+
+    if err != nil {
+        return temporal.NewNonRetryableApplicationError(err.Error(),"WORKFLOW_ERROR",nil)
+    }
+
+    // findBillItem returns the bill holding an item that can still be voided.
+    findBillItem := func(itemId string) *models.Bill {
+        for _, candidate := range []*models.Bill{bill, nextBill} {
+            if candidate == nil {
+                continue
+            }
+            for _, billItem := range candidate.BillItems {
+                if billItem.Id == itemId && billItem.VoidedAt == nil {
+                    return candidate
+                }
+            }
+        }
         return nil
-    },
-)
+    }
+
+    // Create update handler for voiding an item while the bill is open
+    err = workflow.SetUpdateHandlerWithOptions(ctx, UpdateVoidBillItem, func(ctx workflow.Context, itemId string) error {
+        logger.Info("Received update to void a bill item.", "itemId", itemId)
+        ctx = workflow.WithActivityOptions(ctx, options)
+        target := findBillItem(itemId)
+        if target == nil {
+            return temporal.NewNonRetryableApplicationError("Bill item not found or already voided", "NOT_FOUND", nil)
+        }
+        var voidedAt time.Time
+        err := workflow.ExecuteActivity(ctx, VoidBillItem, target.BillId, itemId).Get(ctx, &voidedAt)
+        if err != nil {
+            return err
+        }
+        for i := range target.BillItems {
+            if target.BillItems[i].Id == itemId {
+                target.BillItems[i].VoidedAt = &voidedAt
+            }
+        }
+        return nil
+    }, workflow.UpdateHandlerOptions{
+        Validator: func(itemId string) error {
+            if findBillItem(itemId) == nil {
+                return temporal.NewNonRetryableApplicationError("Bill item not found or already voided", "NOT_FOUND", nil)
+            }
+            return nil
+        },
+    })
 
     if err != nil {
         return temporal.NewNonRetryableApplicationError(err.Error(),"WORKFLOW_ERROR",nil)
     }
 
-	selector := workflow.NewSelector(ctx)
-    timerCtx, cancelHandler := workflow.WithCancel(ctx)
+    // Create update handler for voiding a whole bill while it is open. During
+    // a grace period this is the closing bill or the open bill of the next period.
+    voided, setVoided := workflow.NewFuture(ctx)
+    err = workflow.SetUpdateHandlerWithOptions(ctx, UpdateVoidBill, func(ctx workflow.Context, billId string, reason string) error {
+        logger.Info("Received update to void a bill.", "billId", billId)
+        ctx = workflow.WithActivityOptions(ctx, options)
+        target, err := findBill(billId)
+        if err != nil {
+            return err
+        }
+        err = workflow.ExecuteActivity(ctx, TransitionBill, target.BillId, models.BillStatusVoid, reason).Get(ctx, nil)
+        if err != nil {
+            return err
+        }
+        target.Status = models.BillStatusVoid
+        if target == bill {
+            setVoided.Set(nil, nil)
+        }
+        return nil
+    }, workflow.UpdateHandlerOptions{
+        Validator: func(billId string, reason string) error {
+            target, err := findBill(billId)
+            if err != nil {
+                return err
+            }
+            return checkBillTransition(target.Status, models.BillStatusVoid)
+        },
+    })
 
-    // create timer future to close bill at close date.
-    closeBillFuture := workflow.NewTimer(timerCtx, time.Until(bill.CloseDate))
+    if err != nil {
+        return temporal.NewNonRetryableApplicationError(err.Error(),"WORKFLOW_ERROR",nil)
+    }
 
-    selector.AddFuture(closeBillFuture, func (f workflow.Future) {
-        workflow.ExecuteActivity(ctx, CloseBill, bill.BillId).Get(ctx,nil)
+    // Create update handler for moving the close date of an open bill. Its
+    // recurring fees are prorated to the new period. For the bill of this run,
+    // the wait for the close date starts over with a timer for the new one.
+    rescheduling := false
+    rescheduled := workflow.NewBufferedChannel(ctx, 1)
+    err = workflow.SetUpdateHandlerWithOptions(ctx, UpdateRescheduleBill, func(ctx workflow.Context, billId string, closeDate time.Time, method string) ([]models.BillItem, error) {
+        logger.Info("Received update to reschedule a bill.", "billId", billId, "closeDate", closeDate)
+        ctx = workflow.WithActivityOptions(ctx, options)
+        target, err := findBill(billId)
+        if err != nil {
+            return nil, err
+        }
+        rescheduling = true
+        defer func() { rescheduling = false }()
+        var prorations []models.BillItem
+        err = workflow.ExecuteActivity(ctx, RescheduleBill, target.BillId, closeDate, method).Get(ctx, &prorations)
+        if err != nil {
+            return nil, err
+        }
+        target.CloseDate = closeDate
+        if target == bill {
+            rescheduled.SendAsync(nil)
+        }
+        if len(prorations) > 0 {
+            target.BillItems = append(target.BillItems, prorations...)
+            emitBillEvents(ctx, models.EventBillItemAdded, target, prorations, nil)
+        }
+        return prorations, nil
+    }, workflow.UpdateHandlerOptions{
+        Validator: func(billId string, closeDate time.Time, method string) error {
+            target, err := findBill(billId)
+            if err != nil {
+                return err
+            }
+            switch {
+            case target.Status != models.BillStatusOpen:
+                return temporal.NewNonRetryableApplicationError("Only open bills can be rescheduled", "FAILED-PRECONDITION", nil)
+            case rescheduling:
+                return temporal.NewNonRetryableApplicationError("The bill is already being rescheduled", "FAILED-PRECONDITION", nil)
+            case !closeDate.After(workflow.Now(ctx)):
+                return temporal.NewNonRetryableApplicationError("Bills can only be rescheduled to close in the future", "INVALID-DATA", nil)
+            }
+            return validateProrationMethod(method)
+        },
     })
 
-    // Listen for external signals (manual bill closure)
+    if err != nil {
+        return temporal.NewNonRetryableApplicationError(err.Error(),"WORKFLOW_ERROR",nil)
+    }
+
+    // Every run of the workflow, including each period of a schedule, opens a new bill.
+    // Handlers are registered first so that the bill can be queried and updated meanwhile.
+    emitBillEvent(ctx, models.EventBillCreated, bill, nil, nil)
+
+    // Closing is retried until it succeeds, as nothing else would close the
+    // bill. Only errors that retrying cannot fix fail the workflow.
+    closeCtx := workflow.WithRetryPolicy(ctx, temporal.RetryPolicy{
+        InitialInterval: time.Second,
+        BackoffCoefficient: 2,
+        MaximumInterval: time.Minute,
+    })
+
+    // closeBill invoices a bill of this workflow. During a grace period the
+    // open bill of the next period can be closed early as well.
+    closeBill := func(target *models.Bill) error {
+        if !CanTransitionBill(target.Status, models.BillStatusInvoiced) {
+            logger.Info("Bill can no longer be closed.", "status", target.Status)
+            return nil
+        }
+        // Reported usage becomes items of the bill before it stops accepting them.
+        var rated []models.BillItem
+        err := workflow.ExecuteActivity(closeCtx, RateUsage, target.BillId).Get(ctx, &rated)
+        if err != nil {
+            logger.Error("failed to rate usage", "error", err)
+            return err
+        }
+        if len(rated) > 0 {
+            target.BillItems = append(target.BillItems, rated...)
+            emitBillEvents(ctx, models.EventBillItemAdded, target, rated, nil)
+        }
+        err = workflow.ExecuteActivity(closeCtx, CloseBill, target.BillId).Get(ctx,nil)
+        if err != nil {
+            logger.Error("failed to close bill", "error", err)
+            return err
+        }
+        target.Status = models.BillStatusInvoiced
+        emitBillEvent(ctx, models.EventBillClosed, target, nil, nil)
+        return nil
+    }
+
+    // startClosing begins the grace period of a bill that has reached its close date.
+    startClosing := func() error {
+        err := workflow.ExecuteActivity(ctx, TransitionBill, bill.BillId, models.BillStatusClosing, "Grace period started").Get(ctx, nil)
+        if err != nil {
+            logger.Error("failed to start grace period, closing now", "error", err)
+            return closeBill(bill)
+        }
+        bill.Status = models.BillStatusClosing
+        if bill.ScheduleId != "" {
+            err = workflow.ExecuteActivity(ctx, CreateScheduledBill, bill.ScheduleId, bill.CloseDate).Get(ctx, &nextBill)
+            if err != nil {
+                logger.Error("failed to open next bill, late items will be rejected", "error", err)
+            }
+        }
+        return nil
+    }
+
 	signalChan := workflow.GetSignalChannel(ctx, "CLOSE_BILL")
-	selector.AddReceive(signalChan, func(_ workflow.ReceiveChannel, _ bool) {
-		logger.Info("Received signal to close bill early.")
-        workflow.ExecuteActivity(ctx, CloseBill, bill.BillId).Get(ctx,nil)
+
+    // receiveClose returns the bill a CLOSE_BILL signal asks to close, or nil
+    // for bills that are not in this workflow. Signals without a bill ID are
+    // for the bill of this run.
+    receiveClose := func(c workflow.ReceiveChannel) *models.Bill {
+        var billId string
+        c.Receive(ctx, &billId)
+        if billId == "" {
+            return bill
+        }
+        target, err := findBill(billId)
+        if err != nil {
+            logger.Warn("Ignoring signal to close a bill that is not in this workflow.", "billId", billId)
+        }
+        return target
+    }
+
+    // closeErr is the error a bill of this workflow failed to close with.
+    var closeErr error
+
+    // Wait for the close date. Every reschedule starts the wait over with a
+    // timer for the new date. A bill that was closed or voided while the
+    // previous period was in its grace period has nothing to wait for.
+    for waiting := bill.Status == models.BillStatusOpen; waiting; {
+        waiting = false
+        selector := workflow.NewSelector(ctx)
+        timerCtx, cancelHandler := workflow.WithCancel(ctx)
+
+        // create timer future to close bill at close date.
+        closeBillFuture := workflow.NewTimer(timerCtx, bill.CloseDate.Sub(workflow.Now(ctx)))
+
+        selector.AddFuture(closeBillFuture, func (f workflow.Future) {
+            // A reschedule in progress may move the close date further out.
+            err := workflow.Await(ctx, func() bool { return !rescheduling })
+            if err == nil && workflow.Now(ctx).Before(bill.CloseDate) {
+                waiting = true
+                return
+            }
+            if bill.GracePeriodSeconds > 0 {
+                closeErr = startClosing()
+            } else {
+                closeErr = closeBill(bill)
+            }
+        })
+
+        // Listen for external signals (manual bill closure)
+        selector.AddReceive(signalChan, func(c workflow.ReceiveChannel, _ bool) {
+            if receiveClose(c) != bill {
+                waiting = true
+                return
+            }
+            logger.Info("Received signal to close bill early.")
+            closeErr = closeBill(bill)
+        })
+
+        selector.AddFuture(voided, func(f workflow.Future) {
+            logger.Info("Bill voided.")
+        })
+
+        selector.AddReceive(rescheduled, func(c workflow.ReceiveChannel, _ bool) {
+            c.Receive(ctx, nil)
+            waiting = true
+        })
+
+        selector.Select(ctx)
         cancelHandler()
-	})
+        if closeErr != nil {
+            return closeErr
+        }
+    }
+
+    if bill.Status == models.BillStatusClosing {
+        graceCtx, cancelGrace := workflow.WithCancel(ctx)
+        graceEnd := bill.CloseDate.Add(time.Duration(bill.GracePeriodSeconds) * time.Second)
+        graceTimer := workflow.NewTimer(graceCtx, graceEnd.Sub(workflow.Now(ctx)))
+        // Closing the next bill early leaves this one in its grace period.
+        for graceWaiting := true; graceWaiting; {
+            graceWaiting = false
+            graceSelector := workflow.NewSelector(ctx)
+            graceSelector.AddFuture(graceTimer, func(f workflow.Future) {
+                closeErr = closeBill(bill)
+            })
+            graceSelector.AddReceive(signalChan, func(c workflow.ReceiveChannel, _ bool) {
+                target := receiveClose(c)
+                if target != bill {
+                    if target != nil {
+                        logger.Info("Received signal to close the next bill early.")
+                        closeErr = closeBill(target)
+                    }
+                    graceWaiting = true
+                    return
+                }
+                logger.Info("Received signal to end grace period early.")
+                closeErr = closeBill(bill)
+            })
+            graceSelector.AddFuture(voided, func(f workflow.Future) {
+                logger.Info("Bill voided.")
+            })
+            graceSelector.Select(ctx)
+            if closeErr != nil {
+                cancelGrace()
+                return closeErr
+            }
+        }
+        cancelGrace()
+    }
+
+    if isUnsettled(bill.Status) {
+        if bill.ScheduleId == "" {
+            err := awaitSettlement(ctx, bill)
+            if err != nil {
+                return err
+            }
+        } else {
+            // The schedule moves on to its next bill, so this one is settled by its own workflow.
+            err := startSettlement(ctx, bill)
+            if err != nil {
+                logger.Error("failed to start bill settlement", "error", err)
+            }
+        }
+    }
 
-	selector.Select(ctx)
+    if bill.ScheduleId != "" {
+        // Open the next period of the schedule, unless the grace period already
+        // did, and carry on with it in a fresh run.
+        if nextBill == nil {
+            err := workflow.ExecuteActivity(ctx, CreateScheduledBill, bill.ScheduleId, bill.CloseDate).Get(ctx, &nextBill)
+            if err != nil {
+                return err
+            }
+        }
+        if nextBill != nil {
+            err := workflow.Await(ctx, func() bool { return workflow.AllHandlersFinished(ctx) })
+            if err != nil {
+                return err
+            }
+            logger.Info("Rolling over to next bill.", "billId", nextBill.BillId)
+            return workflow.NewContinueAsNewError(ctx, ComposeBill, nextBill)
+        }
+    }
 
     logger.Info("Bill workflow completed.")
     return nil 
-}
\ No newline at end of file
+}
+
+// acceptedBillItem normalizes an item an activity accepted the way the
+// activity did, so normalizing it cannot fail. Items with a decimal unit
+// price need the rounding mode of their currency for that.
+func acceptedBillItem(ctx workflow.Context, billItem models.BillItem) models.BillItem {
+    rounding := models.RoundHalfEven
+    if billItem.UnitPriceDecimal != "" {
+        lctx := workflow.WithLocalActivityOptions(ctx, workflow.LocalActivityOptions{StartToCloseTimeout: time.Second * 5})
+        err := workflow.ExecuteLocalActivity(lctx, CurrencyRoundingMode, billItem.Currency).Get(ctx, &rounding)
+        if err != nil {
+            workflow.GetLogger(ctx).Warn("failed to look up rounding mode, rounding half to even", "currency", billItem.Currency, "error", err)
+        }
+    }
+    normalized, _ := normalizeBillItem(billItem, rounding)
+    return normalized
+}
+
+// errorReason returns the message of the application error behind err, without
+// the activity details wrapped around it.
+func errorReason(err error) string {
+    var appErr *temporal.ApplicationError
+    if errors.As(err, &appErr) {
+        return appErr.Message()
+    }
+    return err.Error()
+}
+
+func applicationErrorType(err error) string {
+    var appErr *temporal.ApplicationError
+    if errors.As(err, &appErr) {
+        return appErr.Type()
+    }
+    return "INVALID-DATA"
+}
@@ -1,6 +1,8 @@
 package workflows
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -9,7 +11,9 @@ import (
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
 )
 
 func TestWorkflow_CloseBill(t *testing.T) {
@@ -17,26 +21,66 @@ func TestWorkflow_CloseBill(t *testing.T) {
 	env := testSuite.NewTestWorkflowEnvironment()
 
 	// Mock CloseBill activity
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
 	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
 
 	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
 
-	env.SignalWorkflow("CLOSE_BILL", nil)
+	env.SignalWorkflow("CLOSE_BILL", "TEST_BILL")
 
 	require.True(t, env.IsWorkflowCompleted())
 	require.NoError(t, env.GetWorkflowError())
 	env.AssertActivityCalled(t,"CloseBill",mock.Anything, "TEST_BILL")
 }
+func TestWorkflow_CloseBillRetriedUntilItSucceeds(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	// More failures than the usual three attempts, which would leave the bill open.
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(errors.New("connection refused")).Times(4)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil).Once()
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertNumberOfCalls(t, "CloseBill", 5)
+}
+
+func TestWorkflow_CloseBillFailureFailsWorkflow(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(temporal.NewNonRetryableApplicationError("Invalid tax rate", "INVALID-DATA", nil))
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", ScheduleId: "TEST_SCHEDULE", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	// The bill is left open for the workflow to be retried, rather than the schedule moving on.
+	require.True(t, env.IsWorkflowCompleted())
+	require.Error(t, env.GetWorkflowError())
+	env.AssertActivityNotCalled(t, "CreateScheduledBill", mock.Anything, mock.Anything, mock.Anything)
+}
+
 func TestWorkflow_CloseBill_Signal(t *testing.T) {
 	testSuite := &testsuite.WorkflowTestSuite{}
 	env := testSuite.NewTestWorkflowEnvironment()
 
 	// Mock CloseBill activity
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
 	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
 
 	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
 
-	env.SignalWorkflow("CLOSE_BILL", nil)
+	env.SignalWorkflow("CLOSE_BILL", "TEST_BILL")
 
 	require.True(t, env.IsWorkflowCompleted())
 	require.NoError(t, env.GetWorkflowError())
@@ -48,13 +92,16 @@ func TestWorkflow_AddBillItems(t *testing.T) {
 	env := testSuite.NewTestWorkflowEnvironment()
 
 	// Mock CloseBill activity
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
 	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
 	// Mock AddBillItem activity
-	env.OnActivity(AddBillItem, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(AddBillItem, mock.Anything, mock.Anything, mock.Anything).Return("TEST_ITEM", nil)
 
 	var items [2]models.BillItem
-	items[0] = models.BillItem{}
-	items[1] = models.BillItem{}
+	items[0] = models.BillItem{Amount: 100, Currency: "USD"}
+	items[1] = models.BillItem{Amount: 250, Currency: "GEL"}
 	env.RegisterDelayedCallback(func() {
 		env.UpdateWorkflow("update_bill_items","",&testsuite.TestUpdateCallback{
 				OnAccept: func() {},
@@ -63,8 +110,14 @@ func TestWorkflow_AddBillItems(t *testing.T) {
 				},
 				OnComplete: func(i interface{}, err error) {
 					require.NoError(t, err)
+					results := i.([]models.BillItemResult)
+					require.Len(t, results, len(items))
+					for _, result := range results {
+						require.Equal(t, models.BillItemAccepted, result.Status)
+						require.Equal(t, "TEST_ITEM", result.ItemId)
+					}
 				},
-			},items)
+			},"TEST_BILL",items)
 	},0)
 
 	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
@@ -83,13 +136,16 @@ func TestWorkflow_AddBillItemsError(t *testing.T) {
 	env := testSuite.NewTestWorkflowEnvironment()
 
 	// Mock CloseBill activity
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
 	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
 	// Mock AddBillItem activity
-	env.OnActivity(AddBillItem, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(fmt.Errorf("crash"))
+	env.OnActivity(AddBillItem, mock.Anything, mock.Anything, mock.Anything).Return("", fmt.Errorf("crash"))
 
 	var items [2]models.BillItem
-	items[0] = models.BillItem{}
-	items[1] = models.BillItem{}
+	items[0] = models.BillItem{Amount: 100, Currency: "USD"}
+	items[1] = models.BillItem{Amount: 250, Currency: "GEL"}
 	env.RegisterDelayedCallback(func() {
 		env.UpdateWorkflow("update_bill_items","",&testsuite.TestUpdateCallback{
 				OnAccept: func() {},
@@ -98,8 +154,14 @@ func TestWorkflow_AddBillItemsError(t *testing.T) {
 				},
 				OnComplete: func(i interface{}, err error) {
 					require.NoError(t, err)
+					results := i.([]models.BillItemResult)
+					require.Len(t, results, len(items))
+					for _, result := range results {
+						require.Equal(t, models.BillItemRejected, result.Status)
+						require.Equal(t, "crash", result.Error)
+					}
 				},
-			},items)
+			},"TEST_BILL",items)
 	},0)
 
 	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
@@ -111,3 +173,586 @@ func TestWorkflow_AddBillItemsError(t *testing.T) {
 	
 	env.AssertActivityNumberOfCalls(t,"AddBillItem", len(items) * RETRY_COUNT)
 }
+
+func TestWorkflow_AddBillItemsRejectsInvalidBatch(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+
+	batches := [][]models.BillItem{
+		{},
+		{{Amount: 100, Currency: "USD"}, {Amount: -5, Currency: "USD"}},
+		{{Amount: 100}},
+		{{Amount: 100, Currency: "USD", Quantity: 3}},
+		make([]models.BillItem, MaxBillItemsPerUpdate+1),
+	}
+	env.RegisterDelayedCallback(func() {
+		for _, batch := range batches {
+			env.UpdateWorkflow(UpdateBillItems, "", &testsuite.TestUpdateCallback{
+				OnAccept: func() {
+					require.Fail(t, "invalid batch accepted")
+				},
+				OnReject: func(err error) {
+					require.Error(t, err)
+				},
+				OnComplete: func(i interface{}, err error) {},
+			}, "TEST_BILL", batch)
+		}
+		env.UpdateWorkflow(UpdateBillItems, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {
+				require.Fail(t, "items for another bill accepted")
+			},
+			OnReject: func(err error) {
+				require.ErrorContains(t, err, "not open in this workflow")
+			},
+			OnComplete: func(i interface{}, err error) {},
+		}, "OTHER_BILL", []models.BillItem{{Amount: 100, Currency: "USD"}})
+	}, 0)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertActivityNotCalled(t, "AddBillItem", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestWorkflow_ScheduledBillRollsOver(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	closeDate := time.Now().Add(24 * time.Hour)
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(SetBillWorkflowId, mock.Anything, "TEST_BILL", mock.Anything).Return(nil)
+	env.RegisterWorkflow(SettleBill)
+	env.OnWorkflow(SettleBill, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(CreateScheduledBill, mock.Anything, "TEST_SCHEDULE", mock.Anything).Return(&models.Bill{BillId: "NEXT_BILL", ScheduleId: "TEST_SCHEDULE", CloseDate: closeDate.Add(7 * 24 * time.Hour)}, nil)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", ScheduleId: "TEST_SCHEDULE", CloseDate: closeDate})
+
+	require.True(t, env.IsWorkflowCompleted())
+	var continueAsNew *workflow.ContinueAsNewError
+	require.True(t, errors.As(env.GetWorkflowError(), &continueAsNew))
+	env.AssertActivityCalled(t, "CreateScheduledBill", mock.Anything, "TEST_SCHEDULE", mock.Anything)
+}
+
+func TestWorkflow_DeactivatedScheduleCompletes(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(SetBillWorkflowId, mock.Anything, "TEST_BILL", mock.Anything).Return(nil)
+	env.RegisterWorkflow(SettleBill)
+	env.OnWorkflow(SettleBill, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(CreateScheduledBill, mock.Anything, "TEST_SCHEDULE", mock.Anything).Return((*models.Bill)(nil), nil)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", ScheduleId: "TEST_SCHEDULE", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+}
+
+func TestWorkflow_VoidBillItem(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(VoidBillItem, mock.Anything, "TEST_BILL", "TEST_ITEM").Return(time.Now(), nil)
+
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(UpdateVoidBillItem, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {
+				require.Fail(t, "unexpected acceptance")
+			},
+			OnReject: func(err error) {},
+			OnComplete: func(interface{}, error) {},
+		}, "UNKNOWN_ITEM")
+		env.UpdateWorkflow(UpdateVoidBillItem, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) {
+				require.Fail(t, "unexpected rejection")
+			},
+			OnComplete: func(i interface{}, err error) {
+				require.NoError(t, err)
+			},
+		}, "TEST_ITEM")
+	}, 0)
+	env.RegisterDelayedCallback(func() {
+		result, err := env.QueryWorkflow(QueryBill)
+		require.NoError(t, err)
+		var bill models.Bill
+		require.NoError(t, result.Get(&bill))
+		require.Len(t, bill.BillItems, 1)
+		require.NotNil(t, bill.BillItems[0].VoidedAt)
+	}, time.Hour)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{
+		BillId: "TEST_BILL",
+		CloseDate: time.Now().Add(24 * time.Hour),
+		BillItems: []models.BillItem{{Id: "TEST_ITEM", Amount: 100, Currency: "USD"}},
+	})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertActivityNumberOfCalls(t, "VoidBillItem", 1)
+}
+
+func TestWorkflow_EmitsBillEvents(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+	env.RegisterWorkflow(DeliverWebhook)
+
+	var eventTypes []string
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(AddBillItem, mock.Anything, "TEST_BILL", mock.Anything).Return("TEST_ITEM", nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return(func(_ context.Context, event models.BillEvent) ([]string, error) {
+		require.Equal(t, "TEST_BILL", event.BillId)
+		require.NotEmpty(t, event.Id)
+		eventTypes = append(eventTypes, event.Type)
+		return []string{"DELIVERY_" + event.Type}, nil
+	})
+	env.OnWorkflow(DeliverWebhook, mock.Anything, mock.Anything).Return(nil)
+
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(UpdateBillItems, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) {
+				require.Fail(t, "unexpected rejection")
+			},
+			OnComplete: func(i interface{}, err error) {
+				require.NoError(t, err)
+			},
+		}, "TEST_BILL", []models.BillItem{{Amount: 100, Currency: "USD"}})
+	}, time.Hour)
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow("CLOSE_BILL", "TEST_BILL")
+	}, 2*time.Hour)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CustomerId: "TEST_CUSTOMER", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Equal(t, []string{models.EventBillCreated, models.EventBillItemAdded, models.EventBillClosed}, eventTypes)
+	env.AssertWorkflowNumberOfCalls(t, "DeliverWebhook", 3)
+}
+
+func TestWorkflow_DeliverWebhookMarksFailed(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(DeliverWebhookAttempt, mock.Anything, "TEST_DELIVERY").Return(errors.New("endpoint responded with status 500"))
+	env.OnActivity(MarkWebhookDeliveryFailed, mock.Anything, "TEST_DELIVERY").Return(nil)
+
+	env.ExecuteWorkflow(DeliverWebhook, "TEST_DELIVERY")
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertActivityNumberOfCalls(t, "DeliverWebhookAttempt", 30)
+	env.AssertActivityCalled(t, "MarkWebhookDeliveryFailed", mock.Anything, "TEST_DELIVERY")
+}
+
+func TestWorkflow_VoidBill(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(TransitionBill, mock.Anything, "TEST_BILL", models.BillStatusVoid, "Duplicate").Return(nil)
+
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(UpdateVoidBill, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) {
+				require.Fail(t, "unexpected rejection")
+			},
+			OnComplete: func(i interface{}, err error) {
+				require.NoError(t, err)
+			},
+		}, "TEST_BILL", "Duplicate")
+	}, time.Hour)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertActivityNotCalled(t, "CloseBill", mock.Anything, mock.Anything)
+	env.AssertActivityNumberOfCalls(t, "TransitionBill", 1)
+}
+
+func TestWorkflow_RescheduleBill(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	start := env.Now()
+	closeDate := start.Add(48 * time.Hour)
+	var closedAt time.Time
+	// The close date comes back from the workflow history in UTC.
+	sameTime := mock.MatchedBy(func(t time.Time) bool { return t.Equal(closeDate) })
+	env.OnActivity(RescheduleBill, mock.Anything, "TEST_BILL", sameTime, models.ProrateByDays).Return(nil, nil)
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil).Run(func(args mock.Arguments) {
+		closedAt = env.Now()
+	})
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(UpdateRescheduleBill, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) {
+				require.Fail(t, "unexpected rejection")
+			},
+			OnComplete: func(i interface{}, err error) {
+				require.NoError(t, err)
+			},
+		}, "TEST_BILL", closeDate, models.ProrateByDays)
+	}, time.Hour)
+
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(UpdateRescheduleBill, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {
+				require.Fail(t, "unexpected accept")
+			},
+			OnReject: func(err error) {
+				require.Equal(t, "INVALID-DATA", applicationErrorType(err))
+			},
+			OnComplete: func(i interface{}, err error) {},
+		}, "TEST_BILL", start, models.ProrateByDays)
+	}, 2*time.Hour)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: start.Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertActivityNumberOfCalls(t, "RescheduleBill", 1)
+	// The bill closes at the new close date, not the original one.
+	require.False(t, closedAt.Before(closeDate))
+}
+
+func TestWorkflow_AwaitsPayment(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusInvoiced, nil).Once()
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil).Once()
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow("CLOSE_BILL", "TEST_BILL")
+	}, time.Hour)
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(SignalPaymentReceived, models.Payment{Id: "TEST_PAYMENT"})
+	}, 48*time.Hour)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertActivityNumberOfCalls(t, "GetBillStatus", 2)
+}
+
+func TestWorkflow_Dunning(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	var closedAt time.Time
+	var steps []time.Duration
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(func(ctx context.Context, billId string) error {
+		closedAt = env.Now()
+		return nil
+	})
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusInvoiced, nil)
+	env.OnActivity(RecordDunningStep, mock.Anything, "TEST_BILL", mock.Anything, mock.Anything).Return(func(ctx context.Context, billId string, step int, action string) (*models.DunningEvent, error) {
+		require.Equal(t, len(steps), step)
+		require.Equal(t, DunningSchedule[step].Action, action)
+		steps = append(steps, env.Now().Sub(closedAt))
+		return &models.DunningEvent{Step: step, Action: action}, nil
+	})
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Len(t, steps, len(DunningSchedule))
+	for i, step := range DunningSchedule {
+		require.InDelta(t, step.After.Seconds(), steps[i].Seconds(), 1)
+	}
+}
+
+func TestWorkflow_DunningStopsOnPayment(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusInvoiced, nil).Once()
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil).Once()
+	env.OnActivity(RecordDunningStep, mock.Anything, "TEST_BILL", 0, DunningRemind).Return(&models.DunningEvent{Step: 0, Action: DunningRemind}, nil)
+
+	// The bill closes on day one, gets its first reminder on day four and is paid on day six.
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(SignalPaymentReceived, models.Payment{Id: "TEST_PAYMENT"})
+	}, 6*24*time.Hour)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertActivityNumberOfCalls(t, "RecordDunningStep", 1)
+	env.AssertActivityNumberOfCalls(t, "GetBillStatus", 2)
+}
+
+func TestWorkflow_GracePeriodAcceptsLateItems(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	closeDate := time.Now().Add(24 * time.Hour)
+	env.OnActivity(TransitionBill, mock.Anything, "TEST_BILL", models.BillStatusClosing, mock.Anything).Return(nil)
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(AddBillItem, mock.Anything, "TEST_BILL", mock.Anything).Return("TEST_ITEM", nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+
+	occurredBeforeClose := closeDate.Add(-time.Minute)
+	occurredAfterClose := closeDate.Add(time.Minute)
+	env.RegisterDelayedCallback(func() {
+		var bill *models.Bill
+		result, err := env.QueryWorkflow(QueryBill)
+		require.NoError(t, err)
+		require.NoError(t, result.Get(&bill))
+		require.Equal(t, models.BillStatusClosing, bill.Status)
+
+		env.UpdateWorkflow(UpdateBillItems, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) {
+				require.Fail(t, "unexpected rejection")
+			},
+			OnComplete: func(i interface{}, err error) {
+				require.NoError(t, err)
+			},
+		}, "TEST_BILL", []models.BillItem{{Amount: 100, Currency: "USD", OccurredAt: &occurredBeforeClose}})
+		env.UpdateWorkflow(UpdateBillItems, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {
+				require.Fail(t, "late item accepted without a next period")
+			},
+			OnReject: func(err error) {
+				require.ErrorContains(t, err, "only accepts items that occurred before its close date")
+			},
+			OnComplete: func(i interface{}, err error) {},
+		}, "TEST_BILL", []models.BillItem{{Amount: 100, Currency: "USD", OccurredAt: &occurredAfterClose}})
+	}, 24*time.Hour+10*time.Minute)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: closeDate, GracePeriodSeconds: 3600})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertActivityNumberOfCalls(t, "AddBillItem", 1)
+	env.AssertActivityCalled(t, "CloseBill", mock.Anything, "TEST_BILL")
+}
+
+func TestWorkflow_GracePeriodRoutesLateItems(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	closeDate := time.Now().Add(24 * time.Hour)
+	env.OnActivity(TransitionBill, mock.Anything, "TEST_BILL", models.BillStatusClosing, mock.Anything).Return(nil)
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(SetBillWorkflowId, mock.Anything, "TEST_BILL", mock.Anything).Return(nil)
+	env.RegisterWorkflow(SettleBill)
+	env.OnWorkflow(SettleBill, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(CreateScheduledBill, mock.Anything, "TEST_SCHEDULE", mock.Anything).Return(&models.Bill{BillId: "NEXT_BILL", ScheduleId: "TEST_SCHEDULE", Status: models.BillStatusOpen, CloseDate: closeDate.Add(7 * 24 * time.Hour)}, nil).Once()
+	env.OnActivity(AddBillItem, mock.Anything, "NEXT_BILL", mock.Anything).Return("LATE_ITEM", nil)
+
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(UpdateBillItems, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) {
+				require.Fail(t, "unexpected rejection")
+			},
+			OnComplete: func(i interface{}, err error) {
+				require.NoError(t, err)
+			},
+		}, "TEST_BILL", []models.BillItem{{Amount: 100, Currency: "USD"}})
+	}, 24*time.Hour+10*time.Minute)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", ScheduleId: "TEST_SCHEDULE", CloseDate: closeDate, GracePeriodSeconds: 3600})
+
+	require.True(t, env.IsWorkflowCompleted())
+	var continueAsNew *workflow.ContinueAsNewError
+	require.True(t, errors.As(env.GetWorkflowError(), &continueAsNew))
+	env.AssertActivityCalled(t, "AddBillItem", mock.Anything, "NEXT_BILL", mock.Anything)
+	env.AssertActivityNumberOfCalls(t, "CreateScheduledBill", 1)
+}
+
+func TestWorkflow_GracePeriodTargetsNextBill(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	closeDate := time.Now().Add(24 * time.Hour)
+	nextCloseDate := closeDate.Add(7 * 24 * time.Hour)
+	var closedAt time.Time
+	env.OnActivity(TransitionBill, mock.Anything, "TEST_BILL", models.BillStatusClosing, mock.Anything).Return(nil)
+	env.OnActivity(RateUsage, mock.Anything, mock.Anything).Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil).Run(func(args mock.Arguments) {
+		closedAt = env.Now()
+	})
+	env.OnActivity(CloseBill, mock.Anything, "NEXT_BILL").Return(nil)
+	env.OnActivity(SetBillWorkflowId, mock.Anything, "TEST_BILL", mock.Anything).Return(nil)
+	env.RegisterWorkflow(SettleBill)
+	env.OnWorkflow(SettleBill, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(CreateScheduledBill, mock.Anything, "TEST_SCHEDULE", mock.Anything).Return(&models.Bill{BillId: "NEXT_BILL", ScheduleId: "TEST_SCHEDULE", Status: models.BillStatusOpen, CloseDate: closeDate.Add(7 * 24 * time.Hour)}, nil).Once()
+	sameTime := mock.MatchedBy(func(t time.Time) bool { return t.Equal(nextCloseDate.Add(time.Hour)) })
+	env.OnActivity(RescheduleBill, mock.Anything, "NEXT_BILL", sameTime, models.ProrateByDays).Return(nil, nil)
+
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(UpdateRescheduleBill, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) {
+				require.Fail(t, "unexpected rejection")
+			},
+			OnComplete: func(i interface{}, err error) {
+				require.NoError(t, err)
+			},
+		}, "NEXT_BILL", nextCloseDate.Add(time.Hour), models.ProrateByDays)
+		env.UpdateWorkflow(UpdateVoidBill, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {
+				require.Fail(t, "unexpected accept")
+			},
+			OnReject: func(err error) {
+				require.Equal(t, "FAILED-PRECONDITION", applicationErrorType(err))
+			},
+			OnComplete: func(i interface{}, err error) {},
+		}, "OTHER_BILL", "Duplicate")
+	}, 24*time.Hour+10*time.Minute)
+	env.RegisterDelayedCallback(func() {
+		// Closing the next bill early does not end the grace period of this one.
+		env.SignalWorkflow("CLOSE_BILL", "NEXT_BILL")
+	}, 24*time.Hour+20*time.Minute)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", ScheduleId: "TEST_SCHEDULE", CloseDate: closeDate, GracePeriodSeconds: 3600})
+
+	require.True(t, env.IsWorkflowCompleted())
+	var continueAsNew *workflow.ContinueAsNewError
+	require.True(t, errors.As(env.GetWorkflowError(), &continueAsNew))
+	env.AssertActivityNumberOfCalls(t, "RescheduleBill", 1)
+	env.AssertActivityCalled(t, "CloseBill", mock.Anything, "NEXT_BILL")
+	require.False(t, closedAt.Before(closeDate.Add(time.Hour)))
+}
+
+func TestWorkflow_GracePeriodVoidsNextBill(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	closeDate := time.Now().Add(24 * time.Hour)
+	env.OnActivity(TransitionBill, mock.Anything, "TEST_BILL", models.BillStatusClosing, mock.Anything).Return(nil)
+	env.OnActivity(TransitionBill, mock.Anything, "NEXT_BILL", models.BillStatusVoid, "Duplicate").Return(nil)
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(SetBillWorkflowId, mock.Anything, "TEST_BILL", mock.Anything).Return(nil)
+	env.RegisterWorkflow(SettleBill)
+	env.OnWorkflow(SettleBill, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(CreateScheduledBill, mock.Anything, "TEST_SCHEDULE", mock.Anything).Return(&models.Bill{BillId: "NEXT_BILL", ScheduleId: "TEST_SCHEDULE", Status: models.BillStatusOpen, CloseDate: closeDate.Add(7 * 24 * time.Hour)}, nil).Once()
+
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(UpdateVoidBill, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) {
+				require.Fail(t, "unexpected rejection")
+			},
+			OnComplete: func(i interface{}, err error) {
+				require.NoError(t, err)
+			},
+		}, "NEXT_BILL", "Duplicate")
+	}, 24*time.Hour+10*time.Minute)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", ScheduleId: "TEST_SCHEDULE", CloseDate: closeDate, GracePeriodSeconds: 3600})
+
+	require.True(t, env.IsWorkflowCompleted())
+	var continueAsNew *workflow.ContinueAsNewError
+	require.True(t, errors.As(env.GetWorkflowError(), &continueAsNew))
+	// The closing bill is still invoiced at the end of its grace period.
+	env.AssertActivityCalled(t, "TransitionBill", mock.Anything, "NEXT_BILL", models.BillStatusVoid, "Duplicate")
+	env.AssertActivityCalled(t, "CloseBill", mock.Anything, "TEST_BILL")
+}
+
+func TestWorkflow_NextBillClosedDuringGracePeriod(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(SetBillWorkflowId, mock.Anything, "TEST_BILL", mock.Anything).Return(nil)
+	env.RegisterWorkflow(SettleBill)
+	env.OnWorkflow(SettleBill, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(CreateScheduledBill, mock.Anything, "TEST_SCHEDULE", mock.Anything).Return((*models.Bill)(nil), nil)
+
+	// The run of a bill that was closed early goes straight to its settlement.
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", ScheduleId: "TEST_SCHEDULE", Status: models.BillStatusInvoiced, CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Less(t, env.Now().Sub(time.Now()), time.Hour)
+	env.AssertActivityNotCalled(t, "CloseBill", mock.Anything, mock.Anything)
+	env.AssertWorkflowCalled(t, "SettleBill", mock.Anything, mock.Anything)
+}
+
+func TestWorkflow_AddBillItemsAtomic(t *testing.T) {
+	testSuite := &testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestWorkflowEnvironment()
+
+	env.OnActivity(RateUsage, mock.Anything, "TEST_BILL").Return(nil, nil)
+	env.OnActivity(CloseBill, mock.Anything, "TEST_BILL").Return(nil)
+	env.OnActivity(GetBillStatus, mock.Anything, "TEST_BILL").Return(models.BillStatusPaid, nil)
+	env.OnActivity(RecordWebhookEvent, mock.Anything, mock.Anything).Return([]string{}, nil)
+	env.OnActivity(RecordWebhookEvents, mock.Anything, mock.Anything).Return(func(_ context.Context, events []models.BillEvent) ([]string, error) {
+		require.Len(t, events, 2)
+		require.Equal(t, models.EventBillItemAdded, events[0].Type)
+		require.NotEqual(t, events[0].Id, events[1].Id)
+		return []string{}, nil
+	})
+	env.OnActivity(AddBillItemBatch, mock.Anything, "TEST_BILL", mock.Anything).Return([]string{"ITEM_1", "ITEM_2"}, nil)
+
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(UpdateBillItems, "", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) {
+				require.Fail(t, "unexpected rejection")
+			},
+			OnComplete: func(i interface{}, err error) {
+				require.NoError(t, err)
+				results := i.([]models.BillItemResult)
+				require.Equal(t, []models.BillItemResult{
+					{ItemId: "ITEM_1", BillId: "TEST_BILL", Status: models.BillItemAccepted},
+					{ItemId: "ITEM_2", BillId: "TEST_BILL", Status: models.BillItemAccepted},
+				}, results)
+			},
+		}, "TEST_BILL", []models.BillItem{{Amount: 100, Currency: "USD"}, {Amount: 200, Currency: "USD"}}, true)
+	}, 0)
+
+	env.ExecuteWorkflow(ComposeBill, &models.Bill{BillId: "TEST_BILL", CloseDate: time.Now().Add(24 * time.Hour)})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	env.AssertActivityNumberOfCalls(t, "AddBillItemBatch", 1)
+	env.AssertActivityNotCalled(t, "AddBillItem", mock.Anything, mock.Anything, mock.Anything)
+}